@@ -1,7 +1,9 @@
 package api
 
 import (
+	"fmt"
 	"log"
+	"time"
 
 	"github.com/hashicorp/memberlist"
 	"github.com/nstehr/bobcaygeon/cluster"
@@ -10,27 +12,56 @@ import (
 	"golang.org/x/net/context"
 )
 
+// Receiver is an airplay receiver hosted by this node, along with the player it streams to
+type Receiver struct {
+	ID               string
+	AirplayServer    *raop.AirplayServer
+	ForwardingPlayer *forwarding.Player
+}
+
 // Server represents the gRPC server
 type Server struct {
-	airplayServer    *raop.AirplayServer
-	forwardingPlayer *forwarding.Player
-	nodes            *memberlist.Memberlist
+	// the first receiver is the node's primary receiver
+	receivers []*Receiver
+	nodes     *memberlist.Memberlist
+}
+
+// NewServer instantiates a new RPC server for the receivers hosted by this node, the first
+// being the node's primary receiver
+func NewServer(receivers []*Receiver, nodes *memberlist.Memberlist) *Server {
+	return &Server{receivers: receivers, nodes: nodes}
 }
 
-// NewServer instantiates a new RPC server
-func NewServer(airplayServer *raop.AirplayServer, forwardingPlayer *forwarding.Player, nodes *memberlist.Memberlist) *Server {
-	return &Server{airplayServer: airplayServer, forwardingPlayer: forwardingPlayer, nodes: nodes}
+// getReceiver finds the receiver with the given id, an empty id is the primary receiver
+func (s *Server) getReceiver(id string) (*Receiver, error) {
+	if id == "" && len(s.receivers) > 0 {
+		return s.receivers[0], nil
+	}
+	for _, r := range s.receivers {
+		if r.ID == id {
+			return r, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown receiver: %s", id)
 }
 
 // ToggleBroadcast tells node to broadcast that it is an airplay service
 func (s *Server) ToggleBroadcast(ctx context.Context, in *BroadcastRequest) (*ManagementResponse, error) {
-	s.airplayServer.ToggleAdvertise(in.ShouldBroadcast)
+	r, err := s.getReceiver(in.Receiver)
+	if err != nil {
+		return &ManagementResponse{ReturnCode: 404, Message: err.Error()}, nil
+	}
+	r.AirplayServer.ToggleAdvertise(in.ShouldBroadcast)
 	return &ManagementResponse{ReturnCode: 200}, nil
 }
 
 // ChangeServiceName will change the name of that is broadcast for the airplay service
 func (s *Server) ChangeServiceName(ctx context.Context, in *NameChangeRequest) (*ManagementResponse, error) {
-	err := s.airplayServer.ChangeName(in.NewName)
+	r, err := s.getReceiver(in.Receiver)
+	if err != nil {
+		return &ManagementResponse{ReturnCode: 404, Message: err.Error()}, nil
+	}
+	err = r.AirplayServer.ChangeName(in.NewName)
 	returnCode := 200
 	if err != nil {
 		log.Println("Problem changing name: ", err)
@@ -41,6 +72,10 @@ func (s *Server) ChangeServiceName(ctx context.Context, in *NameChangeRequest) (
 
 // ForwardToNodes adds nodes to forward music to
 func (s *Server) ForwardToNodes(ctx context.Context, in *AddRemoveNodesRequest) (*ManagementResponse, error) {
+	r, err := s.getReceiver(in.Receiver)
+	if err != nil {
+		return &ManagementResponse{ReturnCode: 404, Message: err.Error()}, nil
+	}
 	self := s.nodes.LocalNode().Name
 
 	filter := func(node *memberlist.Node) bool {
@@ -57,13 +92,17 @@ func (s *Server) ForwardToNodes(ctx context.Context, in *AddRemoveNodesRequest)
 
 	nodesToAdd := cluster.FilterMembersByFn(filter, s.nodes)
 	for _, nodeToAdd := range nodesToAdd {
-		s.forwardingPlayer.AddSessionForNode(nodeToAdd)
+		r.ForwardingPlayer.AddSessionForNode(nodeToAdd)
 	}
 	return &ManagementResponse{ReturnCode: int32(200)}, nil
 }
 
 // RemoveForwardToNodes removes nodes we were forwarding music to
 func (s *Server) RemoveForwardToNodes(ctx context.Context, in *AddRemoveNodesRequest) (*ManagementResponse, error) {
+	r, err := s.getReceiver(in.Receiver)
+	if err != nil {
+		return &ManagementResponse{ReturnCode: 404, Message: err.Error()}, nil
+	}
 	self := s.nodes.LocalNode().Name
 	filter := func(node *memberlist.Node) bool {
 		if node.Name == self {
@@ -80,10 +119,10 @@ func (s *Server) RemoveForwardToNodes(ctx context.Context, in *AddRemoveNodesReq
 	if !in.GetRemoveAll() {
 		nodesToRemove := cluster.FilterMembersByFn(filter, s.nodes)
 		for _, nodeToRemove := range nodesToRemove {
-			s.forwardingPlayer.RemoveSessionForNode(nodeToRemove)
+			r.ForwardingPlayer.RemoveSessionForNode(nodeToRemove)
 		}
 	} else {
-		s.forwardingPlayer.RemoveAllSessions()
+		r.ForwardingPlayer.RemoveAllSessions()
 	}
 
 	return &ManagementResponse{ReturnCode: int32(200)}, nil
@@ -91,12 +130,54 @@ func (s *Server) RemoveForwardToNodes(ctx context.Context, in *AddRemoveNodesReq
 
 // GetCurrentTrack returns the current playing track on this node
 func (s *Server) GetCurrentTrack(ctx context.Context, in *GetTrackRequest) (*Track, error) {
-	track := s.forwardingPlayer.GetTrack()
-	return &Track{Artist: track.Artist, Album: track.Album, Title: track.Title, Artwork: track.Artwork}, nil
+	r, err := s.getReceiver(in.Receiver)
+	if err != nil {
+		return nil, err
+	}
+	track := r.ForwardingPlayer.GetTrack()
+	artwork, artworkType := track.Artwork, track.ArtworkType
+	if in.WithoutArtwork {
+		artwork, artworkType = nil, ""
+	} else if in.ThumbnailSize > 0 {
+		artwork, artworkType, err = r.ForwardingPlayer.GetThumbnail(int(in.ThumbnailSize))
+		if err != nil {
+			log.Println("Error making thumbnail: ", err)
+		}
+	}
+	return &Track{Artist: track.Artist, Album: track.Album, Title: track.Title, Artwork: artwork, ArtworkType: artworkType,
+		Position: int64(track.Position / time.Millisecond), Duration: int64(track.Duration / time.Millisecond), Playing: r.AirplayServer.IsPlaying()}, nil
 }
 
 // GetMuted returns if the speaker is hard muted
 func (s *Server) GetMuted(ctx context.Context, in *GetMutedRequest) (*SpeakerMuteResponse, error) {
-	muted := s.forwardingPlayer.GetIsMuted()
+	r, err := s.getReceiver(in.Receiver)
+	if err != nil {
+		return nil, err
+	}
+	muted := r.ForwardingPlayer.GetIsMuted()
 	return &SpeakerMuteResponse{IsMuted: muted}, nil
 }
+
+// SetPassword sets the password airplay senders need to stream to this node, an empty password
+// turns off password protection
+func (s *Server) SetPassword(ctx context.Context, in *PasswordRequest) (*ManagementResponse, error) {
+	r, err := s.getReceiver(in.Receiver)
+	if err != nil {
+		return &ManagementResponse{ReturnCode: 404, Message: err.Error()}, nil
+	}
+	r.AirplayServer.SetPassword(in.Password)
+	return &ManagementResponse{ReturnCode: 200}, nil
+}
+
+// GetReceivers returns the receivers hosted by this node, the primary receiver first
+func (s *Server) GetReceivers(ctx context.Context, in *GetReceiversRequest) (*GetReceiversResponse, error) {
+	var receivers []*ReceiverInfo
+	for _, r := range s.receivers {
+		info := &ReceiverInfo{Id: r.ID, Name: r.AirplayServer.Name(), Port: int32(r.AirplayServer.Port()), Broadcasting: r.AirplayServer.IsAdvertising()}
+		if id := r.AirplayServer.DeviceID(); id != nil {
+			info.DeviceId = id.String()
+		}
+		receivers = append(receivers, info)
+	}
+	return &GetReceiversResponse{ReturnCode: 200, Receivers: receivers}, nil
+}
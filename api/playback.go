@@ -0,0 +1,94 @@
+package api
+
+import (
+	"log"
+	"time"
+
+	"github.com/nstehr/bobcaygeon/raop"
+	"golang.org/x/net/context"
+)
+
+// control runs the command against the sender that is playing on the receiver
+func (s *Server) control(receiver string, command func(remote *raop.DacpClient) error) (*ManagementResponse, error) {
+	r, err := s.getReceiver(receiver)
+	if err != nil {
+		return &ManagementResponse{ReturnCode: 404, Message: err.Error()}, nil
+	}
+	remote, err := r.AirplayServer.Remote()
+	if err != nil {
+		return &ManagementResponse{ReturnCode: 404, Message: err.Error()}, nil
+	}
+	if err := command(remote); err != nil {
+		log.Println("Problem controlling playback: ", err)
+		return &ManagementResponse{ReturnCode: 500, Message: err.Error()}, nil
+	}
+	return &ManagementResponse{ReturnCode: 200}, nil
+}
+
+// Play starts playback on the sender
+func (s *Server) Play(ctx context.Context, in *PlaybackRequest) (*ManagementResponse, error) {
+	return s.control(in.Receiver, (*raop.DacpClient).Play)
+}
+
+// Pause pauses playback on the sender
+func (s *Server) Pause(ctx context.Context, in *PlaybackRequest) (*ManagementResponse, error) {
+	return s.control(in.Receiver, (*raop.DacpClient).Pause)
+}
+
+// PlayPause toggles between playing and paused on the sender
+func (s *Server) PlayPause(ctx context.Context, in *PlaybackRequest) (*ManagementResponse, error) {
+	return s.control(in.Receiver, (*raop.DacpClient).PlayPause)
+}
+
+// Stop stops playback on the sender
+func (s *Server) Stop(ctx context.Context, in *PlaybackRequest) (*ManagementResponse, error) {
+	return s.control(in.Receiver, (*raop.DacpClient).Stop)
+}
+
+// NextTrack skips to the next track
+func (s *Server) NextTrack(ctx context.Context, in *PlaybackRequest) (*ManagementResponse, error) {
+	return s.control(in.Receiver, (*raop.DacpClient).Next)
+}
+
+// PreviousTrack goes back to the previous track
+func (s *Server) PreviousTrack(ctx context.Context, in *PlaybackRequest) (*ManagementResponse, error) {
+	return s.control(in.Receiver, (*raop.DacpClient).Previous)
+}
+
+// VolumeUp turns the sender's volume up a step
+func (s *Server) VolumeUp(ctx context.Context, in *PlaybackRequest) (*ManagementResponse, error) {
+	return s.control(in.Receiver, (*raop.DacpClient).VolumeUp)
+}
+
+// VolumeDown turns the sender's volume down a step
+func (s *Server) VolumeDown(ctx context.Context, in *PlaybackRequest) (*ManagementResponse, error) {
+	return s.control(in.Receiver, (*raop.DacpClient).VolumeDown)
+}
+
+// SetSenderVolume sets the sender's volume, from 0 to 100
+func (s *Server) SetSenderVolume(ctx context.Context, in *SenderVolumeRequest) (*ManagementResponse, error) {
+	return s.control(in.Receiver, func(remote *raop.DacpClient) error {
+		return remote.SetVolume(in.Volume)
+	})
+}
+
+// SetShuffle turns shuffle on or off on the sender
+func (s *Server) SetShuffle(ctx context.Context, in *ShuffleRequest) (*ManagementResponse, error) {
+	return s.control(in.Receiver, func(remote *raop.DacpClient) error {
+		return remote.SetShuffle(in.Shuffle)
+	})
+}
+
+// SetRepeat sets how the sender repeats what it is playing
+func (s *Server) SetRepeat(ctx context.Context, in *RepeatRequest) (*ManagementResponse, error) {
+	return s.control(in.Receiver, func(remote *raop.DacpClient) error {
+		return remote.SetRepeat(raop.RepeatMode(in.Mode))
+	})
+}
+
+// Seek moves playback to the position, in milliseconds, in the current track
+func (s *Server) Seek(ctx context.Context, in *SeekRequest) (*ManagementResponse, error) {
+	return s.control(in.Receiver, func(remote *raop.DacpClient) error {
+		return remote.Seek(time.Duration(in.Position) * time.Millisecond)
+	})
+}
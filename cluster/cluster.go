@@ -143,6 +143,16 @@ func FilterMembersByFn(filter MemberFilter, list *memberlist.Memberlist) []*memb
 	return nodes
 }
 
+// IsMember returns if the address belongs to a node in the cluster
+func IsMember(address string, list *memberlist.Memberlist) bool {
+	for _, member := range list.Members() {
+		if member.Addr.String() == address {
+			return true
+		}
+	}
+	return false
+}
+
 // SearchForCluster searches for a cluster to join
 func SearchForCluster() *zeroconf.ServiceEntry {
 	// next we use mdns to try to find a cluster to join.
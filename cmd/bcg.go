@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -8,29 +10,64 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/grandcat/zeroconf"
 	"github.com/hashicorp/memberlist"
 	"github.com/nstehr/bobcaygeon/api"
 	"github.com/nstehr/bobcaygeon/cluster"
+	"github.com/nstehr/bobcaygeon/input"
+	"github.com/nstehr/bobcaygeon/output"
 	"github.com/nstehr/bobcaygeon/player"
 	"github.com/nstehr/bobcaygeon/player/forwarding"
 	"github.com/nstehr/bobcaygeon/raop"
+	"github.com/nstehr/bobcaygeon/raop/pairing"
+	"github.com/nstehr/bobcaygeon/rtsp"
 	"github.com/pelletier/go-toml"
 	"google.golang.org/grpc"
 
 	petname "github.com/dustinkirkland/golang-petname"
 )
 
+const (
+	// how long to wait before restarting the airplay server after it fails
+	airplayRestartDelay = 5 * time.Second
+	// how long to wait for connections and sessions to close when shutting down
+	shutdownTimeout = 5 * time.Second
+	// where generated device ids are kept, next to the config, by receiver id
+	deviceIDsFile = "device-ids.json"
+)
+
 var (
 	verbose    = flag.Bool("verbose", false, "Verbose logging; logs requests and responses")
 	configPath = flag.String("config", "bcg.toml", "Path to the config file for the node")
+	capture    = flag.String("capture", "", "Path to write a capture of the airplay traffic to, for replaying with bcg-replay")
 )
 
 type rtspConfig struct {
-	Name string `toml:"name"`
-	Port int    `toml:"port"`
+	// identifies the receiver in the API, defaults to the name
+	ID           string `toml:"id"`
+	Name         string `toml:"name"`
+	DeviceID     string `toml:"device-id"`
+	Port         int    `toml:"port"`
+	SecondSender string `toml:"second-sender"`
+	Password     string `toml:"password"`
+	// seconds a sender can go quiet before its session is torn down, 0 for the default
+	// or negative to never time out
+	InactivityTimeout int `toml:"inactivity-timeout"`
+	// overrides for the TXT records we advertise, keyed by record name
+	TXT map[string]string `toml:"txt"`
+	// pin senders pair with, 3939 if left out
+	PairingPin string `toml:"pairing-pin"`
+	// file pairings are kept in, if left out one named after the device id next to the config
+	PairingStore string `toml:"pairing-store"`
+	// only forward what we receive to other nodes, don't play it on this node
+	ForwardOnly bool `toml:"forward-only"`
+	// names of the nodes to forward to as they join, every node if empty
+	ForwardTo []string `toml:"forward-to"`
 }
 
 type nodeConfig struct {
@@ -39,9 +76,48 @@ type nodeConfig struct {
 	Name        string `toml:"name"`
 }
 
+type pipeConfig struct {
+	Path           string `toml:"path"`
+	SampleRate     int    `toml:"sample-rate"`
+	Channels       int    `toml:"channels"`
+	BitDepth       int    `toml:"bit-depth"`
+	BigEndian      bool   `toml:"big-endian"`
+	SilenceTimeout int    `toml:"silence-timeout"`
+}
+
+type latencyConfig struct {
+	Buffer     int `toml:"buffer"`
+	Sink       int `toml:"sink"`
+	Forwarding int `toml:"forwarding"`
+}
+
+type audioDeviceConfig struct {
+	IdleTimeout int `toml:"idle-timeout"`
+}
+
+type httpStreamConfig struct {
+	Port int `toml:"port"`
+}
+
+type metadataConfig struct {
+	// named pipe to write metadata to
+	Pipe string `toml:"pipe"`
+	// host:port to send metadata to over UDP, usually a multicast group
+	Address        string `toml:"address"`
+	MaxPacketSize  int    `toml:"max-packet-size"`
+	IncludeArtwork bool   `toml:"include-artwork"`
+}
+
 type conf struct {
 	Node nodeConfig `toml:"node"`
 	Rtsp rtspConfig `toml:"rtsp"`
+	// each receiver is an airplay receiver of its own, if there are none [rtsp] is the only one
+	Receivers   []rtspConfig      `toml:"receiver"`
+	Pipe        pipeConfig        `toml:"pipe"`
+	HTTPStream  httpStreamConfig  `toml:"http-stream"`
+	Latency     latencyConfig     `toml:"latency"`
+	AudioDevice audioDeviceConfig `toml:"audio-device"`
+	Metadata    metadataConfig    `toml:"metadata"`
 }
 
 func main() {
@@ -66,11 +142,28 @@ func main() {
 		if err != nil {
 			log.Fatal("Could not update config")
 		}
-		ioutil.WriteFile(*configPath, updated, 0644)
+		if err := ioutil.WriteFile(*configPath, updated, 0644); err != nil {
+			log.Println("Could not save the generated node name: ", err)
+		}
 	}
+	receiverConfigs := []*rtspConfig{&config.Rtsp}
+	if len(config.Receivers) > 0 {
+		receiverConfigs = nil
+		for i := range config.Receivers {
+			receiverConfigs = append(receiverConfigs, &config.Receivers[i])
+		}
+	}
+	if err := validateReceivers(receiverConfigs); err != nil {
+		log.Fatal("Invalid receiver config: ", err)
+	}
+	if err := loadDeviceIDs(receiverConfigs, filepath.Join(filepath.Dir(*configPath), deviceIDsFile)); err != nil {
+		log.Fatal("Could not load device ids: ", err)
+	}
+	warnOverlappingReceivers(receiverConfigs)
 	nodeName := config.Node.Name
 	log.Printf("Starting node: %s\n", nodeName)
-	metaData := &cluster.NodeMeta{RtspPort: config.Rtsp.Port, NodeType: cluster.Music, APIPort: config.Node.APIPort}
+	// the rest of the cluster talks to our primary receiver
+	metaData := &cluster.NodeMeta{RtspPort: receiverConfigs[0].Port, NodeType: cluster.Music, APIPort: config.Node.APIPort}
 	c := memberlist.DefaultLANConfig()
 	c.Name = nodeName
 	c.BindPort = config.Node.ClusterPort
@@ -83,12 +176,20 @@ func main() {
 	}
 
 	var delegates []memberlist.EventDelegate
-	var streamPlayer player.Player
-	forwardingPlayer, err := forwarding.NewPlayer()
-	if err != nil {
-		panic("Failed to initialize player" + err.Error())
+	var receivers []*api.Receiver
+	for _, receiverConfig := range receiverConfigs {
+		receiver, err := newReceiver(*receiverConfig, config)
+		if err != nil {
+			log.Fatal("Failed to initialize receiver: ", err)
+		}
+		// the rest of the cluster can control us without the password
+		receiver.AirplayServer.SetClusterPeers(func(address string) bool { return cluster.IsMember(address, list) })
+		receivers = append(receivers, receiver)
 	}
-	streamPlayer = forwardingPlayer
+	// the pipe input, http stream and capture go to the primary receiver
+	primary := receivers[0]
+	var streamPlayer player.Player
+	streamPlayer = primary.ForwardingPlayer
 	// we use our airplay server to handle both scenarios
 	// the "leader" and the "follower".  If we are a follower
 	// we don't advertise as an airplay server
@@ -101,7 +202,9 @@ func main() {
 	// if the entry is nil, then we didn't find a cluster to join, so assume leadership
 	if entry == nil {
 		log.Println("starting cluster, I am now initial leader")
-		delegates = append(delegates, forwardingPlayer)
+		for _, receiver := range receivers {
+			delegates = append(delegates, receiver.ForwardingPlayer)
+		}
 
 		nd := cluster.NewEventDelegate(delegates)
 		c.Events = nd
@@ -116,7 +219,9 @@ func main() {
 		musicNodes := cluster.FilterMembers(cluster.Music, list)
 		if len(musicNodes) <= 1 {
 			log.Println("I am only music node, becoming leader")
-			delegates = append(delegates, forwardingPlayer)
+			for _, receiver := range receivers {
+				delegates = append(delegates, receiver.ForwardingPlayer)
+			}
 
 			nd := cluster.NewEventDelegate(delegates)
 			c.Events = nd
@@ -132,12 +237,89 @@ func main() {
 	}
 	defer server.Shutdown()
 
-	airplayServer := raop.NewAirplayServer(config.Rtsp.Port, config.Rtsp.Name, streamPlayer)
-	go airplayServer.Start(*verbose, advertise)
-	defer airplayServer.Stop()
+	if *capture != "" {
+		captureFile, err := os.Create(*capture)
+		if err != nil {
+			log.Fatal("Error creating capture file: ", err)
+		}
+		defer captureFile.Close()
+		recorder, err := rtsp.NewRecorder(captureFile)
+		if err != nil {
+			log.Fatal("Error starting capture: ", err)
+		}
+		log.Printf("Capturing airplay traffic to: %s\n", *capture)
+		primary.AirplayServer.SetRecorder(recorder)
+	}
+	// optionally send metadata about what we are playing, the way shairport-sync does
+	if config.Metadata.Pipe != "" {
+		metadataPipe := output.NewMetadataPipe(config.Metadata.Pipe, config.Metadata.IncludeArtwork)
+		if err := metadataPipe.Start(); err != nil {
+			log.Println("Error starting metadata pipe", err)
+		} else {
+			primary.AirplayServer.AddMetadataSink(metadataPipe)
+			defer metadataPipe.Stop()
+		}
+	}
+	if config.Metadata.Address != "" {
+		metadataMulticast := output.NewMetadataMulticast(config.Metadata.Address, config.Metadata.MaxPacketSize, config.Metadata.IncludeArtwork)
+		if err := metadataMulticast.Start(); err != nil {
+			log.Println("Error starting metadata multicast", err)
+		} else {
+			primary.AirplayServer.AddMetadataSink(metadataMulticast)
+			defer metadataMulticast.Stop()
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// one browser finds the DACP servers of the senders streaming to any of the receivers
+	dacpBrowser := raop.NewDacpBrowser()
+	if err := dacpBrowser.Start(ctx); err != nil {
+		log.Println("Error browsing for DACP servers, senders will not be able to be controlled: ", err)
+	} else {
+		for _, receiver := range receivers {
+			receiver.AirplayServer.SetDacpBrowser(dacpBrowser)
+		}
+	}
+	for _, receiver := range receivers {
+		go runAirplayServer(ctx, receiver.AirplayServer, advertise)
+	}
+	defer func() {
+		stopCtx, stopCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer stopCancel()
+		for _, receiver := range receivers {
+			if err := receiver.AirplayServer.Stop(stopCtx); err != nil {
+				log.Println("Error stopping airplay server: ", err)
+			}
+		}
+	}()
+
+	// optionally take audio written to a named pipe as well
+	if config.Pipe.Path != "" {
+		pipeSource := newPipeSource(config.Pipe, streamPlayer)
+		// the pipe plays through the same player as airplay senders, so it waits its turn
+		pipeSource.SetBusy(primary.AirplayServer.IsPlaying)
+		err = pipeSource.Start()
+		if err != nil {
+			log.Println("Error starting pipe input", err)
+		} else {
+			defer pipeSource.Stop()
+		}
+	}
+
+	// optionally serve what we are playing over http
+	if config.HTTPStream.Port != 0 {
+		streamer := output.NewHTTPStreamer(config.HTTPStream.Port, primary.ForwardingPlayer)
+		primary.ForwardingPlayer.AddOutput(streamer)
+		go func() {
+			if err := streamer.Start(); err != nil {
+				log.Println("Error starting HTTP stream", err)
+			}
+		}()
+		defer streamer.Stop()
+	}
 
 	// start the API server
-	go startAPIServer(config.Node.APIPort, airplayServer, forwardingPlayer, list)
+	go startAPIServer(config.Node.APIPort, receivers, list)
 
 	// Clean exit.
 	sig := make(chan os.Signal, 1)
@@ -152,14 +334,188 @@ func main() {
 	log.Println("Goodbye.")
 }
 
-func startAPIServer(apiServerPort int, airplayServer *raop.AirplayServer, forwardingPlayer *forwarding.Player, nodes *memberlist.Memberlist) {
+// runAirplayServer runs the airplay server until ctx is done, restarting it if it fails
+func runAirplayServer(ctx context.Context, airplayServer *raop.AirplayServer, advertise bool) {
+	for {
+		err := airplayServer.Start(ctx, *verbose, advertise)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		log.Printf("Airplay server failed, restarting in %s: %s\n", airplayRestartDelay, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(airplayRestartDelay):
+		}
+	}
+}
+
+// newReceiver sets up an airplay receiver, and the player it streams to, from its config
+func newReceiver(receiverConfig rtspConfig, config conf) (*api.Receiver, error) {
+	forwardingPlayer, err := forwarding.NewPlayer(newLatency(config.Latency), time.Duration(config.AudioDevice.IdleTimeout)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	forwardingPlayer.SetLocalPlayback(!receiverConfig.ForwardOnly)
+	if len(receiverConfig.ForwardTo) > 0 {
+		forwardingPlayer.SetForwardTo(receiverConfig.ForwardTo)
+	}
+
+	airplayServer := raop.NewAirplayServer(receiverConfig.Port, receiverConfig.Name, forwardingPlayer)
+	deviceID, err := raop.ParseDeviceID(receiverConfig.DeviceID)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid device-id: %s", err)
+	}
+	airplayServer.SetDeviceID(deviceID)
+	pairingStore := receiverConfig.PairingStore
+	if pairingStore == "" {
+		pairingStore = filepath.Join(filepath.Dir(*configPath), fmt.Sprintf("pairings-%s.json", strings.Replace(deviceID.String(), ":", "", -1)))
+	}
+	store, err := pairing.OpenStore(pairingStore)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open pairing store: %s", err)
+	}
+	airplayServer.SetPairing(pairing.NewAccessory(deviceID.String(), receiverConfig.PairingPin, store))
+	senderPolicy, err := raop.ParseSenderPolicy(receiverConfig.SecondSender)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid second-sender policy: %s", err)
+	}
+	airplayServer.SetSenderPolicy(senderPolicy)
+	airplayServer.SetPassword(receiverConfig.Password)
+	airplayServer.SetTextOverrides(receiverConfig.TXT)
+	if receiverConfig.InactivityTimeout != 0 {
+		inactivityTimeout := time.Duration(receiverConfig.InactivityTimeout) * time.Second
+		if inactivityTimeout < 0 {
+			inactivityTimeout = 0
+		}
+		airplayServer.SetInactivityTimeout(inactivityTimeout)
+	}
+	return &api.Receiver{ID: receiverConfig.ID, AirplayServer: airplayServer, ForwardingPlayer: forwardingPlayer}, nil
+}
+
+// validateReceivers makes sure the receivers can be told apart, defaulting their ids to their names
+func validateReceivers(receiverConfigs []*rtspConfig) error {
+	ids := make(map[string]bool)
+	ports := make(map[int]bool)
+	for _, receiverConfig := range receiverConfigs {
+		if receiverConfig.ID == "" {
+			receiverConfig.ID = receiverConfig.Name
+		}
+		if ids[receiverConfig.ID] {
+			return fmt.Errorf("Duplicate receiver id: %s", receiverConfig.ID)
+		}
+		if ports[receiverConfig.Port] {
+			return fmt.Errorf("Duplicate receiver port: %d", receiverConfig.Port)
+		}
+		ids[receiverConfig.ID] = true
+		ports[receiverConfig.Port] = true
+	}
+	return nil
+}
+
+// loadDeviceIDs fills in the device ids of the receivers that don't have one in the config, from the
+// file at path.  The device id has to stay the same, so senders recognize us between restarts, so
+// any that are missing are generated and saved there, rather than rewriting the config
+func loadDeviceIDs(receiverConfigs []*rtspConfig, path string) error {
+	deviceIDs := make(map[string]string)
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, &deviceIDs); err != nil {
+			return fmt.Errorf("Could not read %s: %s", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	generated := false
+	for _, receiverConfig := range receiverConfigs {
+		if receiverConfig.DeviceID != "" {
+			continue
+		}
+		if deviceID, ok := deviceIDs[receiverConfig.ID]; ok {
+			receiverConfig.DeviceID = deviceID
+			continue
+		}
+		log.Printf("Generating device id for receiver: %s\n", receiverConfig.ID)
+		deviceID, err := raop.GenerateDeviceID()
+		if err != nil {
+			return err
+		}
+		receiverConfig.DeviceID = deviceID.String()
+		deviceIDs[receiverConfig.ID] = receiverConfig.DeviceID
+		generated = true
+	}
+	if !generated {
+		return nil
+	}
+	data, err = json.MarshalIndent(deviceIDs, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		// we can still run, but senders will see a new speaker next time
+		log.Println("Could not save the generated device ids: ", err)
+	}
+	return nil
+}
+
+// warnOverlappingReceivers warns about receivers that would play over each other if two senders
+// streamed at once, either on this node's speaker or on the nodes they forward to
+func warnOverlappingReceivers(receiverConfigs []*rtspConfig) {
+	var local, everywhere []string
+	for _, receiverConfig := range receiverConfigs {
+		if !receiverConfig.ForwardOnly {
+			local = append(local, receiverConfig.ID)
+		}
+		if len(receiverConfig.ForwardTo) == 0 {
+			everywhere = append(everywhere, receiverConfig.ID)
+		}
+	}
+	if len(local) > 1 {
+		log.Printf("Receivers %s all play on this node, set forward-only on all but one of them\n", strings.Join(local, ", "))
+	}
+	if len(everywhere) > 1 {
+		log.Printf("Receivers %s all forward to every node, set forward-to on all but one of them\n", strings.Join(everywhere, ", "))
+	}
+}
+
+func newLatency(config latencyConfig) player.Latency {
+	// a sink latency of 0 tells the player to work it out itself
+	latency := player.Latency{Buffer: 100 * time.Millisecond, Sink: time.Duration(config.Sink) * time.Millisecond, Forwarding: 50 * time.Millisecond}
+	if config.Buffer != 0 {
+		latency.Buffer = time.Duration(config.Buffer) * time.Millisecond
+	}
+	if config.Forwarding != 0 {
+		latency.Forwarding = time.Duration(config.Forwarding) * time.Millisecond
+	}
+	return latency
+}
+
+func newPipeSource(config pipeConfig, streamPlayer player.Player) *input.PipeSource {
+	format := input.PcmFormat{SampleRate: 44100, Channels: 2, BitDepth: 16, BigEndian: config.BigEndian}
+	if config.SampleRate != 0 {
+		format.SampleRate = config.SampleRate
+	}
+	if config.Channels != 0 {
+		format.Channels = config.Channels
+	}
+	if config.BitDepth != 0 {
+		format.BitDepth = config.BitDepth
+	}
+	silenceTimeout := 5 * time.Second
+	if config.SilenceTimeout != 0 {
+		silenceTimeout = time.Duration(config.SilenceTimeout) * time.Second
+	}
+	return input.NewPipeSource(config.Path, format, silenceTimeout, streamPlayer)
+}
+
+func startAPIServer(apiServerPort int, receivers []*api.Receiver, nodes *memberlist.Memberlist) {
 	// create a listener
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", apiServerPort))
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
 	// create a server instance
-	s := api.NewServer(airplayServer, forwardingPlayer, nodes)
+	s := api.NewServer(receivers, nodes)
 	// create a gRPC server object
 	grpcServer := grpc.NewServer()
 	// attach the Ping service to the server
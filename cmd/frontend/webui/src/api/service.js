@@ -20,6 +20,8 @@ export const getZones = () => {
 export const getCurrentTrackForSpeaker = async (speakerId) => {
     const request = new GetTrackRequest();
     request.setSpeakerid(speakerId);
+    // the album art is shown at 200px, no need for the full size artwork
+    request.setThumbnailsize(200);
     const trackResp = await mgmtService.getCurrentTrack(request);
     return trackResp;
 }
@@ -8,10 +8,12 @@ function NowPlaying(props) {
     useEffect(() => {
         if (props.speakerId) {
             getCurrentTrackForSpeaker(props.speakerId).then(currentTrack => {
-                const blob = new Blob([currentTrack.getArtwork()], { type: "image/jpeg" });
-                const urlCreator = window.URL || window.webkitURL;
-                const imageUrl = urlCreator.createObjectURL(blob);
-                currentTrack.artworkUrl = imageUrl;
+                if (currentTrack.getArtwork().length > 0) {
+                    const blob = new Blob([currentTrack.getArtwork()], { type: currentTrack.getArtworktype() || "image/jpeg" });
+                    const urlCreator = window.URL || window.webkitURL;
+                    const imageUrl = urlCreator.createObjectURL(blob);
+                    currentTrack.artworkUrl = imageUrl;
+                }
                 setTrack(currentTrack);
             });
         }
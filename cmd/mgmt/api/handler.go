@@ -1,6 +1,8 @@
 package api
 
 import (
+	"time"
+
 	"github.com/nstehr/bobcaygeon/cmd/mgmt/service"
 
 	context "golang.org/x/net/context"
@@ -112,17 +114,19 @@ func (s *Server) GetCurrentTrack(ctx context.Context, in *GetTrackRequest) (*Tra
 		return &Track{}, nil
 	}
 	if in.ZoneId != "" {
-		t, err := s.service.GetTrackForZone(in.ZoneId)
+		t, err := s.service.GetTrackForZone(in.ZoneId, int(in.ThumbnailSize))
 		if err != nil {
 			return &Track{}, nil
 		}
-		return &Track{Artist: t.Artist, Album: t.Album, Title: t.Title, Artwork: t.Artwork}, nil
+		return &Track{Artist: t.Artist, Album: t.Album, Title: t.Title, Artwork: t.Artwork, ArtworkType: t.ArtworkType,
+			Position: int64(t.Position / time.Millisecond), Duration: int64(t.Duration / time.Millisecond), Playing: t.Playing}, nil
 	} else {
-		t, err := s.service.GetTrackForSpeaker(in.SpeakerId)
+		t, err := s.service.GetTrackForSpeaker(in.SpeakerId, int(in.ThumbnailSize))
 		if err != nil {
 			return &Track{}, nil
 		}
-		return &Track{Artist: t.Artist, Album: t.Album, Title: t.Title, Artwork: t.Artwork}, nil
+		return &Track{Artist: t.Artist, Album: t.Album, Title: t.Title, Artwork: t.Artwork, ArtworkType: t.ArtworkType,
+			Position: int64(t.Position / time.Millisecond), Duration: int64(t.Duration / time.Millisecond), Playing: t.Playing}, nil
 	}
 }
 
@@ -138,8 +142,104 @@ func (s *Server) SetMuteForSpeaker(ctx context.Context, in *SetMuteRequest) (*Up
 	return &UpdateResponse{ResponseCode: 200}, nil
 }
 
+// GetVolumeForSpeaker returns the speaker volume, between 0 and 1
+func (s *Server) GetVolumeForSpeaker(ctx context.Context, in *GetVolumeRequest) (*SpeakerVolumeResponse, error) {
+	if in.SpeakerId == "" {
+		return &SpeakerVolumeResponse{ResponseCode: 400, Message: "No speaker id specified"}, nil
+	}
+	volume, err := s.service.GetVolumeForSpeaker(in.SpeakerId)
+	if err != nil {
+		return &SpeakerVolumeResponse{ResponseCode: 500, Message: err.Error()}, nil
+	}
+	return &SpeakerVolumeResponse{Volume: volume, ResponseCode: 200}, nil
+}
+
 // GetMuteForSpeaker returns speaker mute state
 func (s *Server) GetMuteForSpeaker(ctx context.Context, in *GetMuteRequest) (*SpeakerMuteResponse, error) {
 	muted, _ := s.service.GetIsMutedForSpeaker(in.SpeakerId)
 	return &SpeakerMuteResponse{IsMuted: muted}, nil
 }
+
+// SetZonePassword sets or clears (with an empty password) the password needed to stream to a zone
+func (s *Server) SetZonePassword(ctx context.Context, in *ZonePasswordRequest) (*UpdateResponse, error) {
+	if in.ZoneId == "" {
+		return &UpdateResponse{ResponseCode: 400, Message: "No zone id specified"}, nil
+	}
+	err := s.service.SetZonePassword(in.ZoneId, in.Password)
+	if err != nil {
+		return &UpdateResponse{ResponseCode: 500, Message: err.Error()}, nil
+	}
+	return &UpdateResponse{ResponseCode: 200}, nil
+}
+
+// controlZone runs the playback command against the sender playing to the zone
+func (s *Server) controlZone(zoneID string, command service.PlaybackCommand) (*UpdateResponse, error) {
+	if zoneID == "" {
+		return &UpdateResponse{ResponseCode: 400, Message: "No zone id specified"}, nil
+	}
+	err := s.service.ControlZonePlayback(zoneID, command)
+	if err != nil {
+		return &UpdateResponse{ResponseCode: 500, Message: err.Error()}, nil
+	}
+	return &UpdateResponse{ResponseCode: 200}, nil
+}
+
+// ZonePlay starts playback in the zone
+func (s *Server) ZonePlay(ctx context.Context, in *ZonePlaybackRequest) (*UpdateResponse, error) {
+	return s.controlZone(in.ZoneId, service.PlaybackCommand{Action: service.Play})
+}
+
+// ZonePause pauses playback in the zone
+func (s *Server) ZonePause(ctx context.Context, in *ZonePlaybackRequest) (*UpdateResponse, error) {
+	return s.controlZone(in.ZoneId, service.PlaybackCommand{Action: service.Pause})
+}
+
+// ZonePlayPause toggles between playing and paused in the zone
+func (s *Server) ZonePlayPause(ctx context.Context, in *ZonePlaybackRequest) (*UpdateResponse, error) {
+	return s.controlZone(in.ZoneId, service.PlaybackCommand{Action: service.PlayPause})
+}
+
+// ZoneStop stops playback in the zone
+func (s *Server) ZoneStop(ctx context.Context, in *ZonePlaybackRequest) (*UpdateResponse, error) {
+	return s.controlZone(in.ZoneId, service.PlaybackCommand{Action: service.Stop})
+}
+
+// ZoneNextTrack skips to the next track in the zone
+func (s *Server) ZoneNextTrack(ctx context.Context, in *ZonePlaybackRequest) (*UpdateResponse, error) {
+	return s.controlZone(in.ZoneId, service.PlaybackCommand{Action: service.NextTrack})
+}
+
+// ZonePreviousTrack goes back to the previous track in the zone
+func (s *Server) ZonePreviousTrack(ctx context.Context, in *ZonePlaybackRequest) (*UpdateResponse, error) {
+	return s.controlZone(in.ZoneId, service.PlaybackCommand{Action: service.PreviousTrack})
+}
+
+// ZoneVolumeUp turns the volume of the sender playing to the zone up a step
+func (s *Server) ZoneVolumeUp(ctx context.Context, in *ZonePlaybackRequest) (*UpdateResponse, error) {
+	return s.controlZone(in.ZoneId, service.PlaybackCommand{Action: service.VolumeUp})
+}
+
+// ZoneVolumeDown turns the volume of the sender playing to the zone down a step
+func (s *Server) ZoneVolumeDown(ctx context.Context, in *ZonePlaybackRequest) (*UpdateResponse, error) {
+	return s.controlZone(in.ZoneId, service.PlaybackCommand{Action: service.VolumeDown})
+}
+
+// ZoneSetVolume sets the volume of the sender playing to the zone, from 0 to 100
+func (s *Server) ZoneSetVolume(ctx context.Context, in *ZoneVolumeRequest) (*UpdateResponse, error) {
+	return s.controlZone(in.ZoneId, service.PlaybackCommand{Action: service.SetVolume, Volume: in.Volume})
+}
+
+// ZoneSetShuffle turns shuffle on or off in the zone
+func (s *Server) ZoneSetShuffle(ctx context.Context, in *ZoneShuffleRequest) (*UpdateResponse, error) {
+	return s.controlZone(in.ZoneId, service.PlaybackCommand{Action: service.SetShuffle, Shuffle: in.Shuffle})
+}
+
+// ZoneSetRepeat sets how the sender playing to the zone repeats what it is playing
+func (s *Server) ZoneSetRepeat(ctx context.Context, in *ZoneRepeatRequest) (*UpdateResponse, error) {
+	return s.controlZone(in.ZoneId, service.PlaybackCommand{Action: service.SetRepeat, Repeat: int(in.Mode)})
+}
+
+// ZoneSeek moves playback in the zone to the position, in milliseconds, in the current track
+func (s *Server) ZoneSeek(ctx context.Context, in *ZoneSeekRequest) (*UpdateResponse, error) {
+	return s.controlZone(in.ZoneId, service.PlaybackCommand{Action: service.Seek, Position: time.Duration(in.Position) * time.Millisecond})
+}
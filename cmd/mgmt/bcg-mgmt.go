@@ -9,6 +9,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/grandcat/zeroconf"
 	"github.com/nstehr/bobcaygeon/cmd/mgmt/raft"
@@ -17,6 +18,8 @@ import (
 	"github.com/hashicorp/memberlist"
 	"github.com/nstehr/bobcaygeon/cluster"
 	"github.com/nstehr/bobcaygeon/cmd/mgmt/api"
+	"github.com/nstehr/bobcaygeon/cmd/mgmt/mqtt"
+	"github.com/nstehr/bobcaygeon/cmd/mgmt/webhook"
 	toml "github.com/pelletier/go-toml"
 	"google.golang.org/grpc"
 )
@@ -36,18 +39,54 @@ type mgmtConfig struct {
 	StorageDir string `toml:"storage-dir"`
 }
 
+type mqttConfig struct {
+	// e.g: tcp://localhost:1883, the bridge is off if empty
+	Broker   string `toml:"broker"`
+	ClientID string `toml:"client-id"`
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+	// topics are published under this, bobcaygeon if left out
+	TopicPrefix string `toml:"topic-prefix"`
+	// where Home Assistant looks for discovery payloads, empty to not publish them
+	DiscoveryPrefix string `toml:"discovery-prefix"`
+	// seconds between checking the speakers and zones for changes, 5 if left out
+	PollInterval int `toml:"poll-interval"`
+}
+
+type webhookEndpointConfig struct {
+	URL string `toml:"url"`
+	// signs the requests with an HMAC of the body, if set
+	Secret string `toml:"secret"`
+	// the events to send, e.g: zone.playing or zone.*, all of them if left out
+	Events []string `toml:"events"`
+}
+
+type webhookConfig struct {
+	// seconds between checking the zones for changes, 5 if left out
+	PollInterval int `toml:"poll-interval"`
+	// how many times a failed request is retried, 5 if left out
+	MaxRetries int `toml:"max-retries"`
+	// seconds to wait before the first retry, doubling after each one, 1 if left out
+	RetryBackoff int                     `toml:"retry-backoff"`
+	Endpoints    []webhookEndpointConfig `toml:"endpoint"`
+}
+
 type conf struct {
-	Node nodeConfig `toml:"node"`
-	Mgmt mgmtConfig `toml:"mgmt"`
+	Node     nodeConfig    `toml:"node"`
+	Mgmt     mgmtConfig    `toml:"mgmt"`
+	MQTT     mqttConfig    `toml:"mqtt"`
+	Webhooks webhookConfig `toml:"webhooks"`
 }
 
 type memberHandler struct {
 	store   *raft.DistributedStore
 	service *raft.DistributedMgmtService
+	// nil if there are no webhooks
+	webhooks *webhook.Notifier
 }
 
-func newMemberHandler(ds *raft.DistributedStore, service *raft.DistributedMgmtService) *memberHandler {
-	return &memberHandler{store: ds, service: service}
+func newMemberHandler(ds *raft.DistributedStore, service *raft.DistributedMgmtService, webhooks *webhook.Notifier) *memberHandler {
+	return &memberHandler{store: ds, service: service, webhooks: webhooks}
 }
 
 // NotifyJoin is invoked when a node is detected to have joined.
@@ -65,6 +104,9 @@ func (m *memberHandler) NotifyJoin(node *memberlist.Node) {
 	}
 	if meta.NodeType == cluster.Music {
 		go m.service.HandleMusicNodeJoin(node)
+		if m.webhooks != nil {
+			go m.webhooks.SpeakerJoined(node.Name)
+		}
 	}
 
 }
@@ -79,6 +121,9 @@ func (m *memberHandler) NotifyLeave(node *memberlist.Node) {
 	}
 	if meta.NodeType == cluster.Music {
 		go m.service.HandleMusicNodeLeave(node)
+		if m.webhooks != nil {
+			go m.webhooks.SpeakerLeft(node.Name)
+		}
 	}
 
 }
@@ -146,9 +191,29 @@ func main() {
 
 	store := initDistributedStore(list, config.Node.Name, config.Mgmt.RaftPort, config.Mgmt.StorageDir)
 	service := raft.NewDistributedMgmtService(list, store)
+	// optionally send cluster events to webhooks
+	var webhooks *webhook.Notifier
+	if len(config.Webhooks.Endpoints) > 0 {
+		webhooks = webhook.NewNotifier(newWebhookConfig(config.Webhooks), service, store)
+		if err := webhooks.Start(); err != nil {
+			log.Println("Error starting webhooks: ", err)
+			webhooks = nil
+		} else {
+			defer webhooks.Stop()
+		}
+	}
 	// sets up the delegate to handle when members join or leave
-	c.Events = cluster.NewEventDelegate([]memberlist.EventDelegate{newMemberHandler(store, service)})
+	c.Events = cluster.NewEventDelegate([]memberlist.EventDelegate{newMemberHandler(store, service, webhooks)})
 	go startAPIServer(config.Node.APIPort, list, service)
+	// optionally bridge the speakers and zones to MQTT
+	if config.MQTT.Broker != "" {
+		bridge := mqtt.NewBridge(newMQTTConfig(config.MQTT, nodeName), service, store)
+		if err := bridge.Start(); err != nil {
+			log.Println("Error starting MQTT bridge: ", err)
+		} else {
+			defer bridge.Stop()
+		}
+	}
 	// Clean exit.
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
@@ -163,6 +228,38 @@ func main() {
 
 }
 
+func newMQTTConfig(config mqttConfig, nodeName string) mqtt.Config {
+	bridgeConfig := mqtt.Config{Broker: config.Broker, ClientID: config.ClientID, Username: config.Username, Password: config.Password,
+		TopicPrefix: config.TopicPrefix, DiscoveryPrefix: config.DiscoveryPrefix, PollInterval: 5 * time.Second}
+	if bridgeConfig.ClientID == "" {
+		bridgeConfig.ClientID = "bcg-mgmt-" + nodeName
+	}
+	if bridgeConfig.TopicPrefix == "" {
+		bridgeConfig.TopicPrefix = "bobcaygeon"
+	}
+	if config.PollInterval != 0 {
+		bridgeConfig.PollInterval = time.Duration(config.PollInterval) * time.Second
+	}
+	return bridgeConfig
+}
+
+func newWebhookConfig(config webhookConfig) webhook.Config {
+	notifierConfig := webhook.Config{PollInterval: 5 * time.Second, MaxRetries: 5, RetryBackoff: time.Second}
+	for _, endpoint := range config.Endpoints {
+		notifierConfig.Endpoints = append(notifierConfig.Endpoints, webhook.Endpoint{URL: endpoint.URL, Secret: endpoint.Secret, Events: endpoint.Events})
+	}
+	if config.PollInterval != 0 {
+		notifierConfig.PollInterval = time.Duration(config.PollInterval) * time.Second
+	}
+	if config.MaxRetries != 0 {
+		notifierConfig.MaxRetries = config.MaxRetries
+	}
+	if config.RetryBackoff != 0 {
+		notifierConfig.RetryBackoff = time.Duration(config.RetryBackoff) * time.Second
+	}
+	return notifierConfig
+}
+
 func startAPIServer(apiServerPort int, list *memberlist.Memberlist, service *raft.DistributedMgmtService) {
 	// create a listener
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", apiServerPort))
@@ -0,0 +1,448 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/nstehr/bobcaygeon/cmd/mgmt/service"
+)
+
+const (
+	speakerKind = "speaker"
+	zoneKind    = "zone"
+	// payloads for the online topics, and the bridge's own status, the defaults Home Assistant expects
+	online  = "online"
+	offline = "offline"
+	// payloads for the mute topics
+	on  = "ON"
+	off = "OFF"
+	// how long to wait on the broker before giving up on a publish
+	publishTimeout = 5 * time.Second
+	// how long to give the broker to take our last messages when stopping
+	disconnectQuiesce = 250
+)
+
+// what Home Assistant discovery ids can be made of
+var invalidIDChars = regexp.MustCompile("[^a-zA-Z0-9_-]")
+
+// the playback commands taken on a zone's playback topic
+var playbackActions = map[string]service.PlaybackAction{
+	"play":        service.Play,
+	"pause":       service.Pause,
+	"play_pause":  service.PlayPause,
+	"stop":        service.Stop,
+	"next":        service.NextTrack,
+	"previous":    service.PreviousTrack,
+	"volume_up":   service.VolumeUp,
+	"volume_down": service.VolumeDown,
+}
+
+// Config configures the bridge
+type Config struct {
+	// e.g: tcp://localhost:1883
+	Broker   string
+	ClientID string
+	Username string
+	Password string
+	// the topics are published under this, e.g: bobcaygeon/speaker/<id>/volume
+	TopicPrefix string
+	// the prefix Home Assistant watches for discovery payloads, no discovery payloads are published if empty
+	DiscoveryPrefix string
+	// how often the speakers and zones are checked for changes
+	PollInterval time.Duration
+}
+
+// Leadership tells whether this node leads the management cluster, e.g: the distributed store
+type Leadership interface {
+	AmLeader() bool
+}
+
+// Bridge publishes the speakers and zones to MQTT, as retained topics, and takes commands for them.
+// Every management node runs a bridge, but only the leader's publishes and takes commands
+type Bridge struct {
+	config     Config
+	service    service.MgmtService
+	leadership Leadership
+	client     paho.Client
+	// the last payload published to each topic, so only changes are published
+	publishedLock sync.Mutex
+	published     map[string]string
+	// the speakers and zones last published, so we know when they have gone
+	speakers map[string]bool
+	zones    map[string]bool
+	refresh  chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// nowPlaying is retained, so it leaves out the position which changes every poll
+type nowPlaying struct {
+	Title  string `json:"title"`
+	Artist string `json:"artist"`
+	Album  string `json:"album"`
+	// in milliseconds
+	Duration int64 `json:"duration"`
+}
+
+// NewBridge instantiates a new Bridge
+func NewBridge(config Config, service service.MgmtService, leadership Leadership) *Bridge {
+	return &Bridge{config: config, service: service, leadership: leadership, published: make(map[string]string),
+		speakers: make(map[string]bool), zones: make(map[string]bool),
+		refresh: make(chan struct{}, 1), done: make(chan struct{})}
+}
+
+// Start connects to the broker and starts publishing
+func (b *Bridge) Start() error {
+	if b.config.PollInterval <= 0 {
+		return fmt.Errorf("Poll interval must be positive, got: %s", b.config.PollInterval)
+	}
+	opts := paho.NewClientOptions()
+	opts.AddBroker(b.config.Broker)
+	opts.SetClientID(b.config.ClientID)
+	opts.SetUsername(b.config.Username)
+	opts.SetPassword(b.config.Password)
+	opts.SetAutoReconnect(true)
+	// lets everyone know the bridge has gone, if it goes without saying goodbye
+	opts.SetWill(b.statusTopic(), offline, 1, true)
+	opts.SetOnConnectHandler(b.onConnect)
+	b.client = paho.NewClient(opts)
+	token := b.client.Connect()
+	token.Wait()
+	if token.Error() != nil {
+		return token.Error()
+	}
+	log.Printf("Connected to MQTT broker: %s\n", b.config.Broker)
+	go b.run()
+	return nil
+}
+
+// Stop stops publishing and disconnects from the broker
+func (b *Bridge) Stop() {
+	b.stopOnce.Do(func() {
+		close(b.done)
+		if b.leadership.AmLeader() {
+			b.client.Publish(b.statusTopic(), 1, true, offline).WaitTimeout(publishTimeout)
+		}
+		b.client.Disconnect(disconnectQuiesce)
+	})
+}
+
+// onConnect subscribes to the command topics, on every (re)connect
+func (b *Bridge) onConnect(client paho.Client) {
+	// the broker may have lost what we published, so publish it all again
+	b.forgetPublished()
+	filters := map[string]byte{
+		b.config.TopicPrefix + "/+/+/+/set":         1,
+		b.config.TopicPrefix + "/zone/+/speakers/+": 1,
+	}
+	token := client.SubscribeMultiple(filters, b.handleCommand)
+	token.Wait()
+	if token.Error() != nil {
+		log.Println("Error subscribing to MQTT commands: ", token.Error())
+	}
+	token = client.Subscribe(b.statusTopic(), 1, b.handleStatus)
+	token.Wait()
+	if token.Error() != nil {
+		log.Println("Error subscribing to MQTT status: ", token.Error())
+	}
+	b.triggerRefresh()
+}
+
+// handleStatus puts the status back to online when the broker publishes the will of another
+// node's bridge that has gone away, while we are the one publishing
+func (b *Bridge) handleStatus(client paho.Client, msg paho.Message) {
+	if string(msg.Payload()) != offline || !b.leadership.AmLeader() {
+		return
+	}
+	select {
+	case <-b.done:
+		return
+	default:
+	}
+	b.publishedLock.Lock()
+	delete(b.published, b.statusTopic())
+	b.publishedLock.Unlock()
+	b.triggerRefresh()
+}
+
+// forgetPublished forgets what has been published, so it is all published again
+func (b *Bridge) forgetPublished() {
+	b.publishedLock.Lock()
+	defer b.publishedLock.Unlock()
+	b.published = make(map[string]string)
+}
+
+func (b *Bridge) run() {
+	ticker := time.NewTicker(b.config.PollInterval)
+	defer ticker.Stop()
+	for {
+		b.update()
+		select {
+		case <-ticker.C:
+		case <-b.refresh:
+		case <-b.done:
+			return
+		}
+	}
+}
+
+func (b *Bridge) triggerRefresh() {
+	select {
+	case b.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// update publishes anything about the speakers and zones that has changed
+func (b *Bridge) update() {
+	if !b.leadership.AmLeader() {
+		// the leader is publishing, if we take over we publish it all again
+		b.forgetPublished()
+		return
+	}
+	b.publish(b.statusTopic(), online)
+	speakers := make(map[string]bool)
+	for _, speaker := range b.service.GetSpeakers() {
+		speakers[speaker.ID] = true
+		b.updateSpeaker(speaker)
+	}
+	for id := range b.speakers {
+		if !speakers[id] {
+			b.publish(b.topic(speakerKind, id, "online"), offline)
+		}
+	}
+	b.speakers = speakers
+
+	zones := make(map[string]bool)
+	for _, zone := range b.service.GetZones() {
+		zones[zone.ID] = true
+		b.updateZone(zone)
+	}
+	for id := range b.zones {
+		if !zones[id] {
+			// the zone has been deleted, so take it out of Home Assistant too
+			b.publish(b.topic(zoneKind, id, "online"), offline)
+			b.removeDiscovery(zoneKind, id)
+		}
+	}
+	b.zones = zones
+}
+
+func (b *Bridge) updateSpeaker(speaker *service.Speaker) {
+	b.publishDiscovery(speakerKind, speaker.ID, speaker.DisplayName)
+	if volume, err := b.service.GetVolumeForSpeaker(speaker.ID); err == nil {
+		b.publish(b.topic(speakerKind, speaker.ID, "volume"), formatVolume(volume))
+	}
+	if muted, err := b.service.GetIsMutedForSpeaker(speaker.ID); err == nil {
+		b.publish(b.topic(speakerKind, speaker.ID, "mute"), formatMute(muted))
+	}
+	if track, err := b.service.GetTrackForSpeaker(speaker.ID, service.NoArtwork); err == nil {
+		b.publishTrack(speakerKind, speaker.ID, track)
+	}
+	b.publish(b.topic(speakerKind, speaker.ID, "online"), online)
+}
+
+// updateZone publishes the zone, its volume is the average of its speakers' volumes and it is
+// muted if all of its speakers are
+func (b *Bridge) updateZone(zone *service.Zone) {
+	b.publishDiscovery(zoneKind, zone.ID, zone.DisplayName)
+	// an empty zone is published as [] rather than null
+	speakerIDs := []string{}
+	for _, speaker := range zone.Speakers {
+		speakerIDs = append(speakerIDs, speaker.ID)
+	}
+	members, err := json.Marshal(speakerIDs)
+	if err == nil {
+		b.publish(b.topic(zoneKind, zone.ID, "speakers"), string(members))
+	}
+	if len(speakerIDs) == 0 {
+		b.publish(b.topic(zoneKind, zone.ID, "online"), offline)
+		return
+	}
+	var total float64
+	muted := true
+	for _, speakerID := range speakerIDs {
+		volume, err := b.service.GetVolumeForSpeaker(speakerID)
+		if err != nil {
+			return
+		}
+		total += volume
+		isMuted, err := b.service.GetIsMutedForSpeaker(speakerID)
+		if err != nil {
+			return
+		}
+		muted = muted && isMuted
+	}
+	b.publish(b.topic(zoneKind, zone.ID, "volume"), formatVolume(total/float64(len(speakerIDs))))
+	b.publish(b.topic(zoneKind, zone.ID, "mute"), formatMute(muted))
+	if track, err := b.service.GetTrackForZone(zone.ID, service.NoArtwork); err == nil {
+		b.publishTrack(zoneKind, zone.ID, track)
+	}
+	b.publish(b.topic(zoneKind, zone.ID, "online"), online)
+}
+
+// publishTrack publishes what is playing, and while it plays, how far into the track it is
+func (b *Bridge) publishTrack(kind string, id string, track *service.Track) {
+	payload, err := json.Marshal(nowPlaying{Title: track.Title, Artist: track.Artist, Album: track.Album,
+		Duration: int64(track.Duration / time.Millisecond)})
+	if err != nil {
+		log.Println("Error encoding now playing: ", err)
+		return
+	}
+	b.publish(b.topic(kind, id, "now_playing"), string(payload))
+	if track.Playing && track.Duration > 0 {
+		b.publishUpdate(b.topic(kind, id, "position"), strconv.FormatInt(int64(track.Position/time.Millisecond), 10))
+	}
+}
+
+// publishUpdate publishes the payload without retaining it, for values that change every poll
+func (b *Bridge) publishUpdate(topic string, payload string) {
+	token := b.client.Publish(topic, 0, false, payload)
+	if !token.WaitTimeout(publishTimeout) {
+		log.Printf("Timed out publishing to: %s\n", topic)
+		return
+	}
+	if token.Error() != nil {
+		log.Printf("Error publishing to %s: %s\n", topic, token.Error())
+	}
+}
+
+// publish publishes the payload as retained, if it has changed since it was last published
+func (b *Bridge) publish(topic string, payload string) {
+	b.publishedLock.Lock()
+	last, ok := b.published[topic]
+	b.publishedLock.Unlock()
+	if ok && last == payload {
+		return
+	}
+	token := b.client.Publish(topic, 1, true, payload)
+	if !token.WaitTimeout(publishTimeout) {
+		log.Printf("Timed out publishing to: %s\n", topic)
+		return
+	}
+	if token.Error() != nil {
+		log.Printf("Error publishing to %s: %s\n", topic, token.Error())
+		return
+	}
+	b.publishedLock.Lock()
+	b.published[topic] = payload
+	b.publishedLock.Unlock()
+}
+
+// handleCommand handles a message on one of the command topics
+func (b *Bridge) handleCommand(client paho.Client, msg paho.Message) {
+	// every node gets the command, only the leader carries it out
+	if !b.leadership.AmLeader() {
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(msg.Topic(), b.config.TopicPrefix+"/"), "/")
+	if len(parts) != 4 {
+		return
+	}
+	kind, id, attribute, action := parts[0], parts[1], parts[2], parts[3]
+	payload := strings.TrimSpace(string(msg.Payload()))
+	if err := b.command(kind, id, attribute, action, payload); err != nil {
+		log.Printf("Error handling MQTT command on %s: %s\n", msg.Topic(), err)
+	}
+	b.triggerRefresh()
+}
+
+func (b *Bridge) command(kind string, id string, attribute string, action string, payload string) error {
+	var speakerIDs []string
+	switch kind {
+	case speakerKind:
+		speakerIDs = []string{id}
+	case zoneKind:
+		zone := b.findZone(id)
+		if zone == nil {
+			return fmt.Errorf("Zone: %s not found", id)
+		}
+		for _, speaker := range zone.Speakers {
+			speakerIDs = append(speakerIDs, speaker.ID)
+		}
+	default:
+		return fmt.Errorf("Unknown topic: %s", kind)
+	}
+	switch {
+	case attribute == "volume" && action == "set":
+		volume, err := strconv.ParseFloat(payload, 64)
+		if err != nil || volume < 0 || volume > 100 {
+			return fmt.Errorf("Invalid volume: %s", payload)
+		}
+		for _, speakerID := range speakerIDs {
+			if err := b.service.SetVolumeForSpeaker(speakerID, volume/100); err != nil {
+				return err
+			}
+		}
+		return nil
+	case attribute == "mute" && action == "set":
+		if payload != on && payload != off {
+			return fmt.Errorf("Invalid mute: %s", payload)
+		}
+		for _, speakerID := range speakerIDs {
+			if err := b.service.SetMuteForSpeaker(speakerID, payload == on); err != nil {
+				return err
+			}
+		}
+		return nil
+	case kind == zoneKind && attribute == "playback" && action == "set":
+		playbackAction, ok := playbackActions[payload]
+		if !ok {
+			return fmt.Errorf("Unknown playback command: %s", payload)
+		}
+		return b.service.ControlZonePlayback(id, service.PlaybackCommand{Action: playbackAction})
+	case kind == zoneKind && attribute == "speakers" && action == "add":
+		return b.service.AddSpeakersToZone(id, splitIDs(payload))
+	case kind == zoneKind && attribute == "speakers" && action == "remove":
+		return b.service.RemoveSpeakersFromZone(id, splitIDs(payload))
+	}
+	return fmt.Errorf("Unknown command: %s/%s", attribute, action)
+}
+
+func (b *Bridge) findZone(zoneID string) *service.Zone {
+	for _, zone := range b.service.GetZones() {
+		if zone.ID == zoneID {
+			return zone
+		}
+	}
+	return nil
+}
+
+func (b *Bridge) topic(kind string, id string, attribute string) string {
+	return fmt.Sprintf("%s/%s/%s/%s", b.config.TopicPrefix, kind, id, attribute)
+}
+
+func (b *Bridge) statusTopic() string {
+	return b.config.TopicPrefix + "/status"
+}
+
+// splitIDs splits a comma separated list of ids
+func splitIDs(payload string) []string {
+	var ids []string
+	for _, id := range strings.Split(payload, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// formatVolume formats a volume between 0 and 1 as a percentage
+func formatVolume(volume float64) string {
+	return strconv.Itoa(int(math.Round(volume * 100)))
+}
+
+func formatMute(muted bool) string {
+	if muted {
+		return on
+	}
+	return off
+}
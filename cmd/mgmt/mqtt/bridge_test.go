@@ -0,0 +1,448 @@
+package mqtt
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/nstehr/bobcaygeon/cmd/mgmt/service"
+)
+
+// testBroker is just enough of an MQTT broker to test against: it keeps retained
+// messages and passes publishes on to subscribers
+type testBroker struct {
+	listener net.Listener
+	lock     sync.Mutex
+	retained map[string]string
+	subs     map[net.Conn][]string
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb := &testBroker{listener: listener, retained: make(map[string]string), subs: make(map[net.Conn][]string)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go tb.serve(conn)
+		}
+	}()
+	return tb
+}
+
+func (tb *testBroker) address() string {
+	return "tcp://" + tb.listener.Addr().String()
+}
+
+func (tb *testBroker) close() {
+	tb.listener.Close()
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+	for conn := range tb.subs {
+		conn.Close()
+	}
+}
+
+func (tb *testBroker) serve(conn net.Conn) {
+	tb.lock.Lock()
+	tb.subs[conn] = nil
+	tb.lock.Unlock()
+	defer func() {
+		tb.lock.Lock()
+		delete(tb.subs, conn)
+		tb.lock.Unlock()
+		conn.Close()
+	}()
+	for {
+		cp, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		tb.lock.Lock()
+		switch p := cp.(type) {
+		case *packets.ConnectPacket:
+			packets.NewControlPacket(packets.Connack).Write(conn)
+		case *packets.SubscribePacket:
+			tb.subs[conn] = append(tb.subs[conn], p.Topics...)
+			ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			ack.MessageID = p.MessageID
+			ack.ReturnCodes = p.Qoss
+			ack.Write(conn)
+			for topic, payload := range tb.retained {
+				for _, filter := range p.Topics {
+					if topicMatches(filter, topic) {
+						writePublish(conn, topic, payload)
+					}
+				}
+			}
+		case *packets.PublishPacket:
+			if p.Qos == 1 {
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				ack.Write(conn)
+			}
+			if p.Retain {
+				if len(p.Payload) == 0 {
+					delete(tb.retained, p.TopicName)
+				} else {
+					tb.retained[p.TopicName] = string(p.Payload)
+				}
+			}
+			for sub, filters := range tb.subs {
+				for _, filter := range filters {
+					if topicMatches(filter, p.TopicName) {
+						writePublish(sub, p.TopicName, string(p.Payload))
+						break
+					}
+				}
+			}
+		case *packets.PingreqPacket:
+			packets.NewControlPacket(packets.Pingresp).Write(conn)
+		case *packets.DisconnectPacket:
+			tb.lock.Unlock()
+			return
+		}
+		tb.lock.Unlock()
+	}
+}
+
+func (tb *testBroker) getRetained(topic string) (string, bool) {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+	payload, ok := tb.retained[topic]
+	return payload, ok
+}
+
+func writePublish(conn net.Conn, topic string, payload string) {
+	publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	publish.TopicName = topic
+	publish.Payload = []byte(payload)
+	publish.Write(conn)
+}
+
+func topicMatches(filter string, topic string) bool {
+	filterParts := strings.Split(filter, "/")
+	topicParts := strings.Split(topic, "/")
+	for i, part := range filterParts {
+		if part == "#" {
+			return true
+		}
+		if i >= len(topicParts) || (part != "+" && part != topicParts[i]) {
+			return false
+		}
+	}
+	return len(filterParts) == len(topicParts)
+}
+
+type fakeService struct {
+	sync.Mutex
+	speakers []*service.Speaker
+	zones    []*service.Zone
+	volumes  map[string]float64
+	muted    map[string]bool
+	track    *service.Track
+	playback []service.PlaybackAction
+	added    []string
+}
+
+func newFakeService() *fakeService {
+	kitchen := &service.Speaker{ID: "kitchen", DisplayName: "Kitchen"}
+	den := &service.Speaker{ID: "den", DisplayName: "Den"}
+	return &fakeService{
+		speakers: []*service.Speaker{kitchen, den},
+		zones:    []*service.Zone{{ID: "1234", DisplayName: "Downstairs", Speakers: []*service.Speaker{kitchen, den}}},
+		volumes:  map[string]float64{"kitchen": 0.5, "den": 1},
+		muted:    map[string]bool{"kitchen": true, "den": false},
+		track:    &service.Track{Title: "Bobcaygeon", Artist: "The Tragically Hip", Album: "Phantom Power", Duration: 3 * time.Minute},
+	}
+}
+
+func (fs *fakeService) GetSpeakers() []*service.Speaker {
+	fs.Lock()
+	defer fs.Unlock()
+	return fs.speakers
+}
+func (fs *fakeService) GetZones() []*service.Zone {
+	fs.Lock()
+	defer fs.Unlock()
+	return fs.zones
+}
+func (fs *fakeService) GetVolumeForSpeaker(speakerID string) (float64, error) {
+	fs.Lock()
+	defer fs.Unlock()
+	return fs.volumes[speakerID], nil
+}
+func (fs *fakeService) SetVolumeForSpeaker(speakerID string, volume float64) error {
+	fs.Lock()
+	defer fs.Unlock()
+	fs.volumes[speakerID] = volume
+	return nil
+}
+func (fs *fakeService) GetIsMutedForSpeaker(speakerID string) (bool, error) {
+	fs.Lock()
+	defer fs.Unlock()
+	return fs.muted[speakerID], nil
+}
+func (fs *fakeService) SetMuteForSpeaker(speakerID string, isMuted bool) error {
+	fs.Lock()
+	defer fs.Unlock()
+	fs.muted[speakerID] = isMuted
+	return nil
+}
+func (fs *fakeService) GetTrackForZone(zoneID string, thumbnailSize int) (*service.Track, error) {
+	return fs.track, nil
+}
+func (fs *fakeService) GetTrackForSpeaker(speakerID string, thumbnailSize int) (*service.Track, error) {
+	return fs.track, nil
+}
+func (fs *fakeService) ControlZonePlayback(zoneID string, command service.PlaybackCommand) error {
+	fs.Lock()
+	defer fs.Unlock()
+	fs.playback = append(fs.playback, command.Action)
+	return nil
+}
+func (fs *fakeService) AddSpeakersToZone(zoneID string, speakerIDs []string) error {
+	fs.Lock()
+	defer fs.Unlock()
+	fs.added = append(fs.added, speakerIDs...)
+	return nil
+}
+func (*fakeService) SetDisplayName(ID string, displayName string, updateBroadcast bool) error {
+	return nil
+}
+func (*fakeService) CreateZone(displayName string, speakerIDs []string) (string, error) {
+	return "", nil
+}
+func (*fakeService) RemoveSpeakersFromZone(zoneID string, speakerIDs []string) error { return nil }
+func (*fakeService) DeleteZone(zoneID string) error                                  { return nil }
+func (*fakeService) ChangeZoneName(zoneID string, newName string) error              { return nil }
+func (*fakeService) SetZonePassword(zoneID string, password string) error            { return nil }
+
+// fakeLeadership is whether the node leads the management cluster
+type fakeLeadership struct {
+	leader int32
+}
+
+func newFakeLeadership(leader bool) *fakeLeadership {
+	fl := &fakeLeadership{}
+	fl.set(leader)
+	return fl
+}
+
+func (fl *fakeLeadership) AmLeader() bool {
+	return atomic.LoadInt32(&fl.leader) == 1
+}
+
+func (fl *fakeLeadership) set(leader bool) {
+	if leader {
+		atomic.StoreInt32(&fl.leader, 1)
+	} else {
+		atomic.StoreInt32(&fl.leader, 0)
+	}
+}
+
+func startTestBridge(t *testing.T, fs *fakeService) (*testBroker, *Bridge) {
+	tb := newTestBroker(t)
+	bridge := startBridge(t, tb, fs, "test-bridge", newFakeLeadership(true))
+	return tb, bridge
+}
+
+func startBridge(t *testing.T, tb *testBroker, fs *fakeService, clientID string, leadership Leadership) *Bridge {
+	bridge := NewBridge(Config{Broker: tb.address(), ClientID: clientID, TopicPrefix: "bobcaygeon",
+		DiscoveryPrefix: "homeassistant", PollInterval: 50 * time.Millisecond}, fs, leadership)
+	if err := bridge.Start(); err != nil {
+		tb.close()
+		t.Fatal(err)
+	}
+	return bridge
+}
+
+func waitFor(condition func() bool) bool {
+	for i := 0; i < 200; i++ {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func waitForRetained(t *testing.T, tb *testBroker, topic string, expected string) {
+	var payload string
+	if !waitFor(func() bool {
+		payload, _ = tb.getRetained(topic)
+		return payload == expected
+	}) {
+		t.Error(fmt.Sprintf("Expected: %s on %s\r\n Got: %s", expected, topic, payload))
+	}
+}
+
+func TestBridgePublishesState(t *testing.T) {
+	fs := newFakeService()
+	tb, bridge := startTestBridge(t, fs)
+	defer tb.close()
+	defer bridge.Stop()
+
+	waitForRetained(t, tb, "bobcaygeon/status", "online")
+	waitForRetained(t, tb, "bobcaygeon/speaker/kitchen/volume", "50")
+	waitForRetained(t, tb, "bobcaygeon/speaker/kitchen/mute", "ON")
+	waitForRetained(t, tb, "bobcaygeon/speaker/kitchen/online", "online")
+	waitForRetained(t, tb, "bobcaygeon/speaker/kitchen/now_playing",
+		`{"title":"Bobcaygeon","artist":"The Tragically Hip","album":"Phantom Power","duration":180000}`)
+	// the zone is muted only if all its speakers are
+	waitForRetained(t, tb, "bobcaygeon/zone/1234/volume", "75")
+	waitForRetained(t, tb, "bobcaygeon/zone/1234/mute", "OFF")
+	waitForRetained(t, tb, "bobcaygeon/zone/1234/speakers", `["kitchen","den"]`)
+
+	discovery, ok := tb.getRetained("homeassistant/number/bobcaygeon_speaker_kitchen/volume/config")
+	if !ok || !strings.Contains(discovery, `"command_topic":"bobcaygeon/speaker/kitchen/volume/set"`) {
+		t.Error(fmt.Sprintf("Expected: volume discovery payload\r\n Got: %s", discovery))
+	}
+	if _, ok := tb.getRetained("homeassistant/button/bobcaygeon_zone_1234/next/config"); !ok {
+		t.Error("Expected a discovery payload for the zone's next button")
+	}
+
+	bridge.Stop()
+	waitForRetained(t, tb, "bobcaygeon/status", "offline")
+}
+
+func TestBridgePublishesPosition(t *testing.T) {
+	fs := newFakeService()
+	fs.track.Playing = true
+	fs.track.Position = 42 * time.Second
+	tb, bridge := startTestBridge(t, fs)
+	defer tb.close()
+	defer bridge.Stop()
+
+	opts := paho.NewClientOptions().AddBroker(tb.address()).SetClientID("test-position")
+	client := paho.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer client.Disconnect(0)
+	positions := make(chan string, 10)
+	client.Subscribe("bobcaygeon/zone/1234/position", 0, func(c paho.Client, msg paho.Message) {
+		positions <- string(msg.Payload())
+	}).Wait()
+	select {
+	case position := <-positions:
+		if position != "42000" {
+			t.Error(fmt.Sprintf("Expected: 42000\r\n Got: %s", position))
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Expected the position to be published")
+	}
+	// it changes all the time, so isn't retained
+	if position, ok := tb.getRetained("bobcaygeon/zone/1234/position"); ok {
+		t.Error(fmt.Sprintf("Expected the position not to be retained\r\n Got: %s", position))
+	}
+}
+
+func TestBridgeCommands(t *testing.T) {
+	fs := newFakeService()
+	tb, bridge := startTestBridge(t, fs)
+	defer tb.close()
+	defer bridge.Stop()
+	waitForRetained(t, tb, "bobcaygeon/status", "online")
+
+	opts := paho.NewClientOptions().AddBroker(tb.address()).SetClientID("test-commands")
+	client := paho.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer client.Disconnect(0)
+	commands := map[string]string{
+		"bobcaygeon/speaker/den/volume/set": "30",
+		"bobcaygeon/speaker/den/mute/set":   "ON",
+		"bobcaygeon/zone/1234/playback/set": "next",
+		"bobcaygeon/zone/1234/speakers/add": "patio, garage",
+	}
+	for topic, payload := range commands {
+		client.Publish(topic, 0, false, payload).Wait()
+	}
+	if !waitFor(func() bool {
+		fs.Lock()
+		defer fs.Unlock()
+		return fs.volumes["den"] == 0.3 && fs.muted["den"] && len(fs.playback) == 1 && len(fs.added) == 2
+	}) {
+		fs.Lock()
+		t.Error(fmt.Sprintf("Expected: volume 0.3, muted, next and two speakers added\r\n Got: %f, %t, %v, %v",
+			fs.volumes["den"], fs.muted["den"], fs.playback, fs.added))
+		fs.Unlock()
+	}
+	waitForRetained(t, tb, "bobcaygeon/speaker/den/volume", "30")
+	// and the zone is now fully muted
+	waitForRetained(t, tb, "bobcaygeon/zone/1234/mute", "ON")
+}
+
+func TestBridgeRemovesZones(t *testing.T) {
+	fs := newFakeService()
+	tb, bridge := startTestBridge(t, fs)
+	defer tb.close()
+	defer bridge.Stop()
+	waitForRetained(t, tb, "bobcaygeon/zone/1234/online", "online")
+
+	fs.Lock()
+	fs.zones = nil
+	fs.speakers = fs.speakers[:1]
+	fs.Unlock()
+	waitForRetained(t, tb, "bobcaygeon/zone/1234/online", "offline")
+	waitForRetained(t, tb, "bobcaygeon/speaker/den/online", "offline")
+	if !waitFor(func() bool {
+		_, ok := tb.getRetained("homeassistant/switch/bobcaygeon_zone_1234/mute/config")
+		return !ok
+	}) {
+		t.Error("Expected the zone's discovery payloads to be cleared")
+	}
+}
+
+func TestOnlyLeaderBridges(t *testing.T) {
+	fs := newFakeService()
+	tb := newTestBroker(t)
+	defer tb.close()
+	follower := newFakeLeadership(false)
+	followerBridge := startBridge(t, tb, fs, "test-follower", follower)
+	defer followerBridge.Stop()
+	leaderBridge := startBridge(t, tb, fs, "test-leader", newFakeLeadership(true))
+	waitForRetained(t, tb, "bobcaygeon/status", "online")
+	waitForRetained(t, tb, "bobcaygeon/speaker/den/volume", "100")
+
+	opts := paho.NewClientOptions().AddBroker(tb.address()).SetClientID("test-commands")
+	client := paho.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer client.Disconnect(0)
+	// both bridges get the command, it is only carried out once
+	client.Publish("bobcaygeon/zone/1234/playback/set", 0, false, "next").Wait()
+	waitFor(func() bool {
+		fs.Lock()
+		defer fs.Unlock()
+		return len(fs.playback) > 0
+	})
+	time.Sleep(100 * time.Millisecond)
+	fs.Lock()
+	if len(fs.playback) != 1 {
+		t.Error(fmt.Sprintf("Expected: %d\r\n Got: %d", 1, len(fs.playback)))
+	}
+	fs.Unlock()
+
+	// the leader goes, and the follower takes over
+	leaderBridge.Stop()
+	waitForRetained(t, tb, "bobcaygeon/status", "offline")
+	follower.set(true)
+	waitForRetained(t, tb, "bobcaygeon/status", "online")
+	client.Publish("bobcaygeon/speaker/den/volume/set", 0, false, "30").Wait()
+	waitForRetained(t, tb, "bobcaygeon/speaker/den/volume", "30")
+}
@@ -0,0 +1,130 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// device groups a speaker's or zone's entities together in Home Assistant
+type device struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+}
+
+type availability struct {
+	Topic string `json:"topic"`
+}
+
+// entityConfig is a Home Assistant MQTT discovery payload, only the fields for
+// the entities we publish are set
+type entityConfig struct {
+	Name                string         `json:"name"`
+	UniqueID            string         `json:"unique_id"`
+	StateTopic          string         `json:"state_topic,omitempty"`
+	CommandTopic        string         `json:"command_topic,omitempty"`
+	ValueTemplate       string         `json:"value_template,omitempty"`
+	JSONAttributesTopic string         `json:"json_attributes_topic,omitempty"`
+	PayloadOn           string         `json:"payload_on,omitempty"`
+	PayloadOff          string         `json:"payload_off,omitempty"`
+	PayloadPress        string         `json:"payload_press,omitempty"`
+	Min                 *int           `json:"min,omitempty"`
+	Max                 *int           `json:"max,omitempty"`
+	Icon                string         `json:"icon,omitempty"`
+	Availability        []availability `json:"availability"`
+	AvailabilityMode    string         `json:"availability_mode"`
+	Device              device         `json:"device"`
+}
+
+// entity is an entity to publish a discovery payload for, under its component
+type entity struct {
+	component string
+	name      string
+	config    entityConfig
+}
+
+// entities returns the Home Assistant entities for a speaker or zone: its volume, mute and
+// what is playing, and for zones buttons to control playback
+func (b *Bridge) entities(kind string, id string, displayName string) []entity {
+	minVolume, maxVolume := 0, 100
+	entities := []entity{
+		{component: "number", name: "volume", config: entityConfig{
+			Name: displayName + " Volume", StateTopic: b.topic(kind, id, "volume"),
+			CommandTopic: b.topic(kind, id, "volume") + "/set", Min: &minVolume, Max: &maxVolume, Icon: "mdi:volume-high"}},
+		{component: "switch", name: "mute", config: entityConfig{
+			Name: displayName + " Mute", StateTopic: b.topic(kind, id, "mute"),
+			CommandTopic: b.topic(kind, id, "mute") + "/set", PayloadOn: on, PayloadOff: off, Icon: "mdi:volume-off"}},
+		{component: "sensor", name: "now_playing", config: entityConfig{
+			Name: displayName + " Now Playing", StateTopic: b.topic(kind, id, "now_playing"),
+			ValueTemplate: "{{ value_json.title }}", JSONAttributesTopic: b.topic(kind, id, "now_playing"), Icon: "mdi:music"}},
+	}
+	if kind == zoneKind {
+		buttons := []struct {
+			name    string
+			payload string
+			icon    string
+		}{
+			{"Play/Pause", "play_pause", "mdi:play-pause"},
+			{"Next", "next", "mdi:skip-next"},
+			{"Previous", "previous", "mdi:skip-previous"},
+		}
+		for _, button := range buttons {
+			entities = append(entities, entity{component: "button", name: button.payload, config: entityConfig{
+				Name: displayName + " " + button.name, CommandTopic: b.topic(kind, id, "playback") + "/set",
+				PayloadPress: button.payload, Icon: button.icon}})
+		}
+	}
+	nodeID := discoveryID(kind, id)
+	model := "Speaker"
+	if kind == zoneKind {
+		model = "Zone"
+	}
+	for i := range entities {
+		config := &entities[i].config
+		config.UniqueID = nodeID + "_" + entities[i].name
+		// entities are only available while both the bridge and the speaker or zone are
+		config.Availability = []availability{{Topic: b.statusTopic()}, {Topic: b.topic(kind, id, "online")}}
+		config.AvailabilityMode = "all"
+		config.Device = device{Identifiers: []string{nodeID}, Name: displayName, Manufacturer: "Bobcaygeon", Model: model}
+	}
+	return entities
+}
+
+// publishDiscovery publishes the discovery payloads for a speaker or zone, so Home Assistant picks it up
+func (b *Bridge) publishDiscovery(kind string, id string, displayName string) {
+	if b.config.DiscoveryPrefix == "" {
+		return
+	}
+	if displayName == "" {
+		displayName = id
+	}
+	for _, e := range b.entities(kind, id, displayName) {
+		payload, err := json.Marshal(e.config)
+		if err != nil {
+			log.Println("Error encoding discovery payload: ", err)
+			continue
+		}
+		b.publish(b.discoveryTopic(e.component, kind, id, e.name), string(payload))
+	}
+}
+
+// removeDiscovery removes a speaker or zone from Home Assistant, by clearing its discovery payloads
+func (b *Bridge) removeDiscovery(kind string, id string) {
+	if b.config.DiscoveryPrefix == "" {
+		return
+	}
+	for _, e := range b.entities(kind, id, id) {
+		b.publish(b.discoveryTopic(e.component, kind, id, e.name), "")
+	}
+}
+
+func (b *Bridge) discoveryTopic(component string, kind string, id string, name string) string {
+	return fmt.Sprintf("%s/%s/%s/%s/config", b.config.DiscoveryPrefix, component, discoveryID(kind, id), name)
+}
+
+// discoveryID makes an id Home Assistant will accept for a speaker or zone
+func discoveryID(kind string, id string) string {
+	return invalidIDChars.ReplaceAllString(fmt.Sprintf("bobcaygeon_%s_%s", kind, id), "_")
+}
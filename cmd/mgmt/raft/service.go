@@ -14,14 +14,20 @@ import (
 	"github.com/nstehr/bobcaygeon/cluster"
 	"github.com/nstehr/bobcaygeon/cmd/mgmt/api"
 	"github.com/nstehr/bobcaygeon/cmd/mgmt/service"
+	"github.com/nstehr/bobcaygeon/raop"
 	"github.com/nstehr/bobcaygeon/rtsp"
 	"google.golang.org/grpc"
 )
 
+// how long to wait on a speaker to answer an RTSP request
+const rtspTimeout = 5 * time.Second
+
 // DistributedMgmtService implements MgmtService with a distributed backing store
 type DistributedMgmtService struct {
 	nodes *memberlist.Memberlist
 	store *DistributedStore
+	// connections for sending RTSP control requests to the speakers
+	rtspClients *rtsp.ClientPool
 }
 
 type closableClient struct {
@@ -31,7 +37,7 @@ type closableClient struct {
 
 // NewDistributedMgmtService instantiates the DistributedMgmtService
 func NewDistributedMgmtService(nodes *memberlist.Memberlist, store *DistributedStore) *DistributedMgmtService {
-	return &DistributedMgmtService{nodes: nodes, store: store}
+	return &DistributedMgmtService{nodes: nodes, store: store, rtspClients: rtsp.NewClientPool()}
 }
 
 // GetSpeakers returns information about the speaker (bcg apps) under our management
@@ -399,6 +405,13 @@ func (dms *DistributedMgmtService) DeleteZone(zoneID string) error {
 		if err != nil {
 			return err
 		}
+		if zone.Password != "" {
+			log.Printf("Clearing password of: %s \n", zone.Leader)
+			_, err = client.SetPassword(context.Background(), &speakerAPI.PasswordRequest{})
+			if err != nil {
+				return err
+			}
+		}
 	}
 	dms.store.DeleteZoneConfig(zone.ID)
 	return nil
@@ -448,6 +461,112 @@ func (dms *DistributedMgmtService) ChangeZoneName(zoneID string, newName string)
 	return nil
 }
 
+// SetZonePassword sets the password senders need to stream to the zone, an empty password clears it
+func (dms *DistributedMgmtService) SetZonePassword(zoneID string, password string) error {
+	if !dms.store.AmLeader() {
+		client, err := dms.getLeaderClient(dms.store.GetLeader())
+		if err != nil {
+			return err
+		}
+		resp, err := client.SetZonePassword(context.Background(), &api.ZonePasswordRequest{ZoneId: zoneID, Password: password})
+		if err != nil {
+			return err
+		}
+		if resp.ResponseCode != 200 {
+			return fmt.Errorf(resp.Message)
+		}
+		return nil
+	}
+
+	zc := dms.store.GetZoneConfigs()
+	var zone ZoneConfig
+	for _, zoneConfig := range zc {
+		if zoneConfig.ID == zoneID {
+			zone = zoneConfig
+			break
+		}
+	}
+	if zone.ID == "" {
+		return fmt.Errorf("Zone: %s not found", zoneID)
+	}
+
+	client, err := dms.getSpeakerClient(zone.Leader)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	log.Printf("Changing password of zone: %s (leader: %s)", zone.DisplayName, zone.Leader)
+	resp, err := client.SetPassword(context.Background(), &speakerAPI.PasswordRequest{Password: password})
+	if err != nil {
+		return err
+	}
+	if resp.ReturnCode != 200 {
+		return fmt.Errorf("Could not set password, got: %d", resp.ReturnCode)
+	}
+	zone.Password = password
+	dms.store.SaveZoneConfig(zone)
+	return nil
+}
+
+// ControlZonePlayback controls playback on the sender playing to the zone, through the zone leader
+func (dms *DistributedMgmtService) ControlZonePlayback(zoneID string, command service.PlaybackCommand) error {
+	zc := dms.store.GetZoneConfigs()
+	var zone ZoneConfig
+	for _, zoneConfig := range zc {
+		if zoneConfig.ID == zoneID {
+			zone = zoneConfig
+			break
+		}
+	}
+	if zone.ID == "" {
+		return fmt.Errorf("Zone: %s not found", zoneID)
+	}
+
+	client, err := dms.getSpeakerClient(zone.Leader)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	ctx := context.Background()
+	playback := &speakerAPI.PlaybackRequest{}
+	var resp *speakerAPI.ManagementResponse
+	switch command.Action {
+	case service.Play:
+		resp, err = client.Play(ctx, playback)
+	case service.Pause:
+		resp, err = client.Pause(ctx, playback)
+	case service.PlayPause:
+		resp, err = client.PlayPause(ctx, playback)
+	case service.Stop:
+		resp, err = client.Stop(ctx, playback)
+	case service.NextTrack:
+		resp, err = client.NextTrack(ctx, playback)
+	case service.PreviousTrack:
+		resp, err = client.PreviousTrack(ctx, playback)
+	case service.VolumeUp:
+		resp, err = client.VolumeUp(ctx, playback)
+	case service.VolumeDown:
+		resp, err = client.VolumeDown(ctx, playback)
+	case service.SetVolume:
+		resp, err = client.SetSenderVolume(ctx, &speakerAPI.SenderVolumeRequest{Volume: command.Volume})
+	case service.SetShuffle:
+		resp, err = client.SetShuffle(ctx, &speakerAPI.ShuffleRequest{Shuffle: command.Shuffle})
+	case service.SetRepeat:
+		resp, err = client.SetRepeat(ctx, &speakerAPI.RepeatRequest{Mode: speakerAPI.RepeatMode(command.Repeat)})
+	case service.Seek:
+		resp, err = client.Seek(ctx, &speakerAPI.SeekRequest{Position: int64(command.Position / time.Millisecond)})
+	default:
+		return fmt.Errorf("Unknown playback action: %d", command.Action)
+	}
+	if err != nil {
+		return err
+	}
+	if resp.ReturnCode != 200 {
+		return fmt.Errorf("Could not control playback: %s", resp.Message)
+	}
+	return nil
+}
+
 // GetZones returns information about the zones under our management
 func (dms *DistributedMgmtService) GetZones() []*service.Zone {
 	var zones []*service.Zone
@@ -468,8 +587,9 @@ func (dms *DistributedMgmtService) GetZones() []*service.Zone {
 	return zones
 }
 
-// GetTrackForZone returns the track that is playing on all speakers in the zone
-func (dms *DistributedMgmtService) GetTrackForZone(zoneID string) (*service.Track, error) {
+// GetTrackForZone returns the track that is playing on all speakers in the zone, with the artwork
+// scaled down to the thumbnail size if it is set, or left out if it is service.NoArtwork
+func (dms *DistributedMgmtService) GetTrackForZone(zoneID string, thumbnailSize int) (*service.Track, error) {
 	zc := dms.store.GetZoneConfigs()
 	var zone ZoneConfig
 	for _, zoneConfig := range zc {
@@ -487,25 +607,36 @@ func (dms *DistributedMgmtService) GetTrackForZone(zoneID string) (*service.Trac
 		return nil, err
 	}
 	defer client.Close()
-	track, err := client.GetCurrentTrack(context.Background(), &speakerAPI.GetTrackRequest{})
+	track, err := client.GetCurrentTrack(context.Background(), newTrackRequest(thumbnailSize))
 	if err != nil {
 		return nil, err
 	}
-	return &service.Track{Artist: track.Artist, Album: track.Album, Title: track.Title, Artwork: track.Artwork}, nil
+	return &service.Track{Artist: track.Artist, Album: track.Album, Title: track.Title, Artwork: track.Artwork, ArtworkType: track.ArtworkType,
+		Position: time.Duration(track.Position) * time.Millisecond, Duration: time.Duration(track.Duration) * time.Millisecond, Playing: track.Playing}, nil
 }
 
-// GetTrackForSpeaker returns the track that is playing for the given speaker
-func (dms *DistributedMgmtService) GetTrackForSpeaker(speakerID string) (*service.Track, error) {
+// GetTrackForSpeaker returns the track that is playing for the given speaker, with the artwork
+// scaled down to the thumbnail size if it is set, or left out if it is service.NoArtwork
+func (dms *DistributedMgmtService) GetTrackForSpeaker(speakerID string, thumbnailSize int) (*service.Track, error) {
 	client, err := dms.getSpeakerClient(speakerID)
 	if err != nil {
 		return nil, err
 	}
 	defer client.Close()
-	track, err := client.GetCurrentTrack(context.Background(), &speakerAPI.GetTrackRequest{})
+	track, err := client.GetCurrentTrack(context.Background(), newTrackRequest(thumbnailSize))
 	if err != nil {
 		return nil, err
 	}
-	return &service.Track{Artist: track.Artist, Album: track.Album, Title: track.Title, Artwork: track.Artwork}, nil
+	return &service.Track{Artist: track.Artist, Album: track.Album, Title: track.Title, Artwork: track.Artwork, ArtworkType: track.ArtworkType,
+		Position: time.Duration(track.Position) * time.Millisecond, Duration: time.Duration(track.Duration) * time.Millisecond, Playing: track.Playing}, nil
+}
+
+// newTrackRequest builds the request for a speaker's track, for the given thumbnail size
+func newTrackRequest(thumbnailSize int) *speakerAPI.GetTrackRequest {
+	if thumbnailSize == service.NoArtwork {
+		return &speakerAPI.GetTrackRequest{WithoutArtwork: true}
+	}
+	return &speakerAPI.GetTrackRequest{ThumbnailSize: int32(thumbnailSize)}
 }
 
 func (dms *DistributedMgmtService) getLeaderAPIAddress(leader *net.TCPAddr) string {
@@ -666,6 +797,14 @@ func (dms *DistributedMgmtService) HandleMusicNodeJoin(node *memberlist.Node) {
 			log.Println("Error changing service name", err)
 			return
 		}
+		// only a zone with a password changes it, otherwise the node keeps its own
+		if updateZone.Password != "" {
+			_, err = client.SetPassword(context.Background(), &speakerAPI.PasswordRequest{Password: updateZone.Password})
+			if err != nil {
+				log.Println("Error setting password", err)
+				return
+			}
+		}
 
 		return
 	}
@@ -697,6 +836,8 @@ func (dms *DistributedMgmtService) HandleMusicNodeJoin(node *memberlist.Node) {
 // HandleMusicNodeLeave will try to preserve any zone by promoting a new leader,
 // if it is the leader who has left
 func (dms *DistributedMgmtService) HandleMusicNodeLeave(node *memberlist.Node) {
+	meta := cluster.DecodeNodeMeta(node.Meta)
+	dms.rtspClients.Remove(node.Addr.String(), meta.RtspPort)
 	if !dms.store.AmLeader() {
 		return
 	}
@@ -753,6 +894,14 @@ func (dms *DistributedMgmtService) HandleMusicNodeLeave(node *memberlist.Node) {
 		log.Println("Error changing service name", err)
 		return
 	}
+	// only a zone with a password changes it, otherwise the node keeps its own
+	if updateZone.Password != "" {
+		_, err = client.SetPassword(context.Background(), &speakerAPI.PasswordRequest{Password: updateZone.Password})
+		if err != nil {
+			log.Println("Error setting password", err)
+			return
+		}
+	}
 	_, err = client.ToggleBroadcast(context.Background(), &speakerAPI.BroadcastRequest{ShouldBroadcast: true})
 	if err != nil {
 		log.Println("Error toggling broadcast", err)
@@ -778,6 +927,24 @@ func (dms *DistributedMgmtService) SetMuteForSpeaker(speakerID string, isMuted b
 		}
 		return nil
 	}
+	if isMuted {
+		//airplay servers understands mute as -144
+		return dms.sendSpeakerVolume(speakerID, -144.0, "muted")
+	}
+	return dms.sendSpeakerVolume(speakerID, 0.0, "unmuted")
+}
+
+// SetVolumeForSpeaker sets the volume of the given speaker, between 0 and 1
+func (dms *DistributedMgmtService) SetVolumeForSpeaker(speakerID string, volume float64) error {
+	if volume < 0 || volume > 1 {
+		return fmt.Errorf("Volume must be between 0 and 1, got: %f", volume)
+	}
+	return dms.sendSpeakerVolume(speakerID, raop.AirplayVolume(volume), "")
+}
+
+// sendSpeakerVolume sends the airplay volume straight to the speaker, along with whether it
+// should be muted or unmuted if muted isn't empty
+func (dms *DistributedMgmtService) sendSpeakerVolume(speakerID string, volume float64, muted string) error {
 	filter := func(node *memberlist.Node) bool {
 		meta := cluster.DecodeNodeMeta(node.Meta)
 		return meta.NodeType == cluster.Music && speakerID == node.Name
@@ -791,7 +958,7 @@ func (dms *DistributedMgmtService) SetMuteForSpeaker(speakerID string, isMuted b
 	meta := cluster.DecodeNodeMeta(speaker.Meta)
 
 	// volume is a 'pure' RTSP/RAOP function, so we will use the RTSP client to play with mute
-	client, err := rtsp.NewClient(speaker.Addr.String(), meta.RtspPort)
+	client, err := dms.rtspClients.Get(speaker.Addr.String(), meta.RtspPort)
 	if err != nil {
 		return err
 	}
@@ -800,19 +967,21 @@ func (dms *DistributedMgmtService) SetMuteForSpeaker(speakerID string, isMuted b
 	sessionID := strconv.FormatInt(time.Now().Unix(), 10)
 	localAddress := client.LocalAddress()
 	req.RequestURI = fmt.Sprintf("rtsp://%s/%s", localAddress, sessionID)
-	req.Headers["Content-Type"] = "text/parameters"
-	var body = ""
-	if isMuted {
-		req.Headers["X-BCG-Muted"] = "muted"
-		//airplay servers understands mute as -144
-		body = fmt.Sprintf("volume: %f", -144.0)
-	} else {
-		req.Headers["X-BCG-Muted"] = "unmuted"
-		body = fmt.Sprintf("volume: %f", 0.0)
+	req.Headers.Set("Content-Type", "text/parameters")
+	if muted != "" {
+		req.Headers.Set("X-BCG-Muted", muted)
+	}
+	req.Body = []byte(fmt.Sprintf("volume: %f", volume))
+	ctx, cancel := context.WithTimeout(context.Background(), rtspTimeout)
+	defer cancel()
+	resp, err := client.SendContext(ctx, req)
+	if err != nil {
+		return err
+	}
+	if resp.Status != rtsp.Ok {
+		return fmt.Errorf("Non-ok status returned: %s", resp.Status.String())
 	}
-	req.Body = []byte(body)
-	_, err = client.Send(req)
-	return err
+	return nil
 }
 
 // GetIsMutedForSpeaker returns if the given speaker is hard muted
@@ -829,3 +998,20 @@ func (dms *DistributedMgmtService) GetIsMutedForSpeaker(speakerID string) (bool,
 	return mutedResp.GetIsMuted(), nil
 
 }
+
+// GetVolumeForSpeaker returns the volume of the given speaker, between 0 and 1
+func (dms *DistributedMgmtService) GetVolumeForSpeaker(speakerID string) (float64, error) {
+	filter := func(node *memberlist.Node) bool {
+		meta := cluster.DecodeNodeMeta(node.Meta)
+		return meta.NodeType == cluster.Music && speakerID == node.Name
+	}
+
+	speakers := cluster.FilterMembersByFn(filter, dms.nodes)
+	if len(speakers) != 1 {
+		return 0, fmt.Errorf("Could not find speaker with id: %s", speakerID)
+	}
+	speaker := speakers[0]
+	meta := cluster.DecodeNodeMeta(speaker.Meta)
+	// like setting it, the volume is read straight from the speaker over RTSP
+	return raop.GetVolume(dms.rtspClients, speaker.Addr.String(), meta.RtspPort)
+}
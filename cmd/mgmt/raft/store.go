@@ -32,6 +32,8 @@ type ZoneConfig struct {
 	DisplayName string
 	Leader      string
 	Speakers    []string
+	// password senders need to stream to the zone, empty if there isn't one
+	Password string
 }
 
 type entry struct {
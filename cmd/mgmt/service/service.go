@@ -1,5 +1,10 @@
 package service
 
+import "time"
+
+// NoArtwork can be given as the thumbnail size when getting a track to leave the artwork out
+const NoArtwork = -1
+
 // MgmtService interface for handling management capabilities
 type MgmtService interface {
 	GetSpeakers() []*Speaker
@@ -10,10 +15,14 @@ type MgmtService interface {
 	DeleteZone(zoneID string) error
 	ChangeZoneName(zoneID string, newName string) error
 	GetZones() []*Zone
-	GetTrackForZone(zoneID string) (*Track, error)
-	GetTrackForSpeaker(speakerID string) (*Track, error)
+	GetTrackForZone(zoneID string, thumbnailSize int) (*Track, error)
+	GetTrackForSpeaker(speakerID string, thumbnailSize int) (*Track, error)
 	SetMuteForSpeaker(speakerID string, isMuted bool) error
 	GetIsMutedForSpeaker(speakerID string) (bool, error)
+	GetVolumeForSpeaker(speakerID string) (float64, error)
+	SetVolumeForSpeaker(speakerID string, volume float64) error
+	SetZonePassword(zoneID string, password string) error
+	ControlZonePlayback(zoneID string, command PlaybackCommand) error
 }
 
 // Speaker speaker instance
@@ -35,4 +44,42 @@ type Track struct {
 	Album   string
 	Title   string
 	Artwork []byte
+	// the MIME type of the artwork
+	ArtworkType string
+	Position    time.Duration
+	Duration    time.Duration
+	// if a sender is streaming to the speaker or zone
+	Playing bool
+}
+
+// PlaybackAction is something to do to the playback on the sender playing to a zone
+type PlaybackAction int
+
+// the playback actions
+const (
+	Play PlaybackAction = iota
+	Pause
+	PlayPause
+	Stop
+	NextTrack
+	PreviousTrack
+	VolumeUp
+	VolumeDown
+	SetVolume
+	SetShuffle
+	SetRepeat
+	Seek
+)
+
+// PlaybackCommand is a playback action, along with what the action needs
+type PlaybackCommand struct {
+	Action PlaybackAction
+	// from 0 to 100, to SetVolume
+	Volume float64
+	// to SetShuffle
+	Shuffle bool
+	// 0 off, 1 repeat one and 2 repeat all, to SetRepeat
+	Repeat int
+	// to Seek
+	Position time.Duration
 }
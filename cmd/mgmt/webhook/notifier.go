@@ -0,0 +1,299 @@
+package webhook
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/nstehr/bobcaygeon/cmd/mgmt/raft"
+	"github.com/nstehr/bobcaygeon/cmd/mgmt/service"
+)
+
+// Config configures the notifier
+type Config struct {
+	Endpoints []Endpoint
+	// how often the zones are checked for changes to their config and what they are playing
+	PollInterval time.Duration
+	// how many times a failed event is sent again, waiting RetryBackoff before the first
+	// retry and doubling the wait after each one
+	MaxRetries   int
+	RetryBackoff time.Duration
+}
+
+// Store is where the zone configs are read from, and tells whether this node leads the
+// management cluster, e.g: the distributed store
+type Store interface {
+	GetZoneConfigs() []raft.ZoneConfig
+	AmLeader() bool
+}
+
+// Notifier POSTs events about the cluster to webhooks: speakers coming and going,
+// zones being changed and what the zones are playing.  Every management node can run a notifier,
+// but only the leader's sends events
+type Notifier struct {
+	config  Config
+	service service.MgmtService
+	store   Store
+	client  *http.Client
+	queues  []*endpointQueue
+	// display names of the speakers we have seen, so speakers that have left can be named,
+	// and the speakers we know are online, nil until the first poll
+	namesLock      sync.Mutex
+	speakerNames   map[string]string
+	onlineSpeakers map[string]bool
+	// the zones as of the last poll, nil until the first poll
+	zoneStates map[string]*zoneState
+	done       chan struct{}
+	stopOnce   sync.Once
+}
+
+type speakerData struct {
+	ID          string `json:"id"`
+	DisplayName string `json:"display_name"`
+}
+
+type zoneData struct {
+	ID          string   `json:"id"`
+	DisplayName string   `json:"display_name"`
+	Speakers    []string `json:"speakers"`
+}
+
+type trackData struct {
+	Title  string `json:"title"`
+	Artist string `json:"artist"`
+	Album  string `json:"album"`
+	// in milliseconds
+	Duration int64 `json:"duration"`
+}
+
+type speakerEvent struct {
+	Speaker speakerData `json:"speaker"`
+}
+
+type zoneEvent struct {
+	Zone zoneData `json:"zone"`
+	// what the zone was before it was updated
+	Previous *zoneData `json:"previous,omitempty"`
+}
+
+type trackEvent struct {
+	Zone  zoneData   `json:"zone"`
+	Track *trackData `json:"track"`
+	// the track that was playing before, on track.changed
+	Previous *trackData `json:"previous,omitempty"`
+}
+
+// zoneState is what we last knew about a zone
+type zoneState struct {
+	zone zoneData
+	// nil until the zone has had a track
+	track   *trackData
+	playing bool
+}
+
+// NewNotifier instantiates a new Notifier
+func NewNotifier(config Config, service service.MgmtService, store Store) *Notifier {
+	n := &Notifier{config: config, service: service, store: store, client: &http.Client{Timeout: deliveryTimeout},
+		speakerNames: make(map[string]string), done: make(chan struct{})}
+	for _, endpoint := range config.Endpoints {
+		n.queues = append(n.queues, newEndpointQueue(endpoint))
+	}
+	return n
+}
+
+// Start starts watching the zones and sending events
+func (n *Notifier) Start() error {
+	if n.config.PollInterval <= 0 {
+		return fmt.Errorf("Poll interval must be positive, got: %s", n.config.PollInterval)
+	}
+	if n.config.MaxRetries > 0 && n.config.RetryBackoff <= 0 {
+		return fmt.Errorf("Retry backoff must be positive, got: %s", n.config.RetryBackoff)
+	}
+	for _, q := range n.queues {
+		u, err := url.Parse(q.endpoint.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("Invalid webhook URL: %s", q.endpoint.URL)
+		}
+	}
+	for _, q := range n.queues {
+		log.Printf("Sending events to webhook: %s\n", q.endpoint.URL)
+		go n.deliverQueued(q)
+	}
+	go n.run()
+	return nil
+}
+
+// Stop stops sending events, events still waiting to be sent are dropped
+func (n *Notifier) Stop() {
+	n.stopOnce.Do(func() { close(n.done) })
+}
+
+// SpeakerJoined sends speaker.online for a speaker that has joined the cluster.  Like the zones,
+// speakers that were already there when we started aren't announced, the cluster tells us about
+// each of them as if they had just joined
+func (n *Notifier) SpeakerJoined(speakerID string) {
+	n.refreshSpeakerNames()
+	if n.setOnline(speakerID, true) {
+		n.notify(EventSpeakerOnline, speakerEvent{Speaker: n.speaker(speakerID)})
+	}
+}
+
+// SpeakerLeft sends speaker.offline for a speaker that has left the cluster
+func (n *Notifier) SpeakerLeft(speakerID string) {
+	if n.setOnline(speakerID, false) {
+		n.notify(EventSpeakerOffline, speakerEvent{Speaker: n.speaker(speakerID)})
+	}
+}
+
+// setOnline records if the speaker is online, returning if that is news worth sending
+func (n *Notifier) setOnline(speakerID string, online bool) bool {
+	n.namesLock.Lock()
+	defer n.namesLock.Unlock()
+	if n.onlineSpeakers == nil || n.onlineSpeakers[speakerID] == online {
+		return false
+	}
+	if online {
+		n.onlineSpeakers[speakerID] = true
+	} else {
+		delete(n.onlineSpeakers, speakerID)
+	}
+	return true
+}
+
+func (n *Notifier) speaker(speakerID string) speakerData {
+	n.namesLock.Lock()
+	defer n.namesLock.Unlock()
+	displayName, ok := n.speakerNames[speakerID]
+	if !ok {
+		displayName = speakerID
+	}
+	return speakerData{ID: speakerID, DisplayName: displayName}
+}
+
+// refreshSpeakerNames remembers the names of the speakers in the cluster, names of speakers
+// that have left are kept
+func (n *Notifier) refreshSpeakerNames() {
+	speakers := n.service.GetSpeakers()
+	n.namesLock.Lock()
+	defer n.namesLock.Unlock()
+	for _, speaker := range speakers {
+		n.speakerNames[speaker.ID] = speaker.DisplayName
+	}
+}
+
+// primeOnlineSpeakers learns which speakers are online, on the first poll
+func (n *Notifier) primeOnlineSpeakers() {
+	speakers := n.service.GetSpeakers()
+	n.namesLock.Lock()
+	defer n.namesLock.Unlock()
+	n.onlineSpeakers = make(map[string]bool)
+	for _, speaker := range speakers {
+		n.onlineSpeakers[speaker.ID] = true
+	}
+}
+
+// forget forgets what the zones and speakers were, so the next poll learns them again
+func (n *Notifier) forget() {
+	n.namesLock.Lock()
+	n.onlineSpeakers = nil
+	n.namesLock.Unlock()
+	n.zoneStates = nil
+}
+
+func (n *Notifier) run() {
+	ticker := time.NewTicker(n.config.PollInterval)
+	defer ticker.Stop()
+	for {
+		n.update()
+		select {
+		case <-ticker.C:
+		case <-n.done:
+			return
+		}
+	}
+}
+
+// update sends events for anything about the zones that has changed since the last poll.  The
+// first poll only learns what the zones are, so we don't announce everything on start up
+func (n *Notifier) update() {
+	if !n.store.AmLeader() {
+		// the leader is sending the events, if we take over we start again from what is there then
+		n.forget()
+		return
+	}
+	n.refreshSpeakerNames()
+	primed := n.zoneStates != nil
+	if !primed {
+		n.primeOnlineSpeakers()
+	}
+	states := make(map[string]*zoneState)
+	for _, config := range n.store.GetZoneConfigs() {
+		zone := zoneData{ID: config.ID, DisplayName: config.DisplayName, Speakers: append([]string{}, config.Speakers...)}
+		state := &zoneState{zone: zone}
+		previous, known := n.zoneStates[config.ID]
+		if known {
+			state.track, state.playing = previous.track, previous.playing
+			if !sameZone(previous.zone, zone) {
+				n.notify(EventZoneUpdated, zoneEvent{Zone: zone, Previous: &previous.zone})
+			}
+		} else if primed {
+			n.notify(EventZoneCreated, zoneEvent{Zone: zone})
+		}
+		states[config.ID] = state
+		n.updateTrack(state, primed)
+	}
+	for id, previous := range n.zoneStates {
+		if _, ok := states[id]; !ok {
+			n.notify(EventZoneDeleted, zoneEvent{Zone: previous.zone})
+		}
+	}
+	n.zoneStates = states
+}
+
+// updateTrack sends events for the zone starting or stopping playing, or its track changing
+func (n *Notifier) updateTrack(state *zoneState, primed bool) {
+	track, err := n.service.GetTrackForZone(state.zone.ID, service.NoArtwork)
+	if err != nil {
+		// the zone's leader may be on its way out, we'll find out what is happening next poll
+		return
+	}
+	var current *trackData
+	if track.Title != "" || track.Artist != "" || track.Album != "" {
+		current = &trackData{Title: track.Title, Artist: track.Artist, Album: track.Album,
+			Duration: int64(track.Duration / time.Millisecond)}
+	}
+	if primed && current != nil && (state.track == nil || !sameTrack(*state.track, *current)) {
+		n.notify(EventTrackChanged, trackEvent{Zone: state.zone, Track: current, Previous: state.track})
+	}
+	if primed && track.Playing && !state.playing {
+		n.notify(EventZonePlaying, trackEvent{Zone: state.zone, Track: current})
+	}
+	if primed && !track.Playing && state.playing {
+		n.notify(EventZoneStopped, trackEvent{Zone: state.zone, Track: current})
+	}
+	state.track, state.playing = current, track.Playing
+}
+
+func sameZone(a zoneData, b zoneData) bool {
+	if a.DisplayName != b.DisplayName || len(a.Speakers) != len(b.Speakers) {
+		return false
+	}
+	speakers := make(map[string]bool)
+	for _, id := range a.Speakers {
+		speakers[id] = true
+	}
+	for _, id := range b.Speakers {
+		if !speakers[id] {
+			return false
+		}
+	}
+	return true
+}
+
+// sameTrack compares what is playing, the duration is left out as it can come in after the title
+func sameTrack(a trackData, b trackData) bool {
+	return a.Title == b.Title && a.Artist == b.Artist && a.Album == b.Album
+}
@@ -0,0 +1,242 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/nstehr/bobcaygeon/cmd/mgmt/raft"
+	"github.com/nstehr/bobcaygeon/cmd/mgmt/service"
+)
+
+// fakeService only has what the notifier uses, anything else panics
+type fakeService struct {
+	service.MgmtService
+	sync.Mutex
+	speakers []*service.Speaker
+	tracks   map[string]*service.Track
+}
+
+func (fs *fakeService) GetSpeakers() []*service.Speaker {
+	fs.Lock()
+	defer fs.Unlock()
+	return fs.speakers
+}
+
+func (fs *fakeService) GetTrackForZone(zoneID string, thumbnailSize int) (*service.Track, error) {
+	fs.Lock()
+	defer fs.Unlock()
+	track, ok := fs.tracks[zoneID]
+	if !ok {
+		return nil, fmt.Errorf("Zone: %s not found", zoneID)
+	}
+	return track, nil
+}
+
+func (fs *fakeService) setTrack(zoneID string, track *service.Track) {
+	fs.Lock()
+	defer fs.Unlock()
+	if fs.tracks == nil {
+		fs.tracks = make(map[string]*service.Track)
+	}
+	fs.tracks[zoneID] = track
+}
+
+type fakeStore struct {
+	sync.Mutex
+	zones []raft.ZoneConfig
+	// another management node is the leader
+	follower bool
+}
+
+func (fz *fakeStore) AmLeader() bool {
+	fz.Lock()
+	defer fz.Unlock()
+	return !fz.follower
+}
+
+func (fz *fakeStore) setFollower(follower bool) {
+	fz.Lock()
+	defer fz.Unlock()
+	fz.follower = follower
+}
+
+func (fz *fakeStore) GetZoneConfigs() []raft.ZoneConfig {
+	fz.Lock()
+	defer fz.Unlock()
+	return fz.zones
+}
+
+func (fz *fakeStore) set(zones ...raft.ZoneConfig) {
+	fz.Lock()
+	defer fz.Unlock()
+	fz.zones = zones
+}
+
+type testEvent struct {
+	Type string
+	Data struct {
+		Speaker  speakerData
+		Zone     zoneData
+		Previous json.RawMessage
+		Track    *trackData
+	}
+}
+
+func expectEvent(t *testing.T, te *testEndpoint, eventType string) testEvent {
+	r := te.next(t)
+	var event testEvent
+	if err := json.Unmarshal(r.body, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != eventType {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", eventType, r.body))
+	}
+	return event
+}
+
+func newNotifierTest(fs *fakeService, fz *fakeStore) (*Notifier, *testEndpoint, func()) {
+	te, server := newTestEndpoint()
+	n := NewNotifier(Config{Endpoints: []Endpoint{{URL: server.URL}}}, fs, fz)
+	for _, q := range n.queues {
+		go n.deliverQueued(q)
+	}
+	return n, te, func() {
+		n.Stop()
+		server.Close()
+	}
+}
+
+func TestNotifierSpeakers(t *testing.T) {
+	fs := &fakeService{}
+	n, te, stop := newNotifierTest(fs, &fakeStore{})
+	defer stop()
+	n.update()
+	fs.Lock()
+	fs.speakers = []*service.Speaker{{ID: "abc", DisplayName: "Kitchen"}}
+	fs.Unlock()
+	n.SpeakerJoined("abc")
+	if event := expectEvent(t, te, EventSpeakerOnline); event.Data.Speaker.DisplayName != "Kitchen" {
+		t.Error(fmt.Sprintf("Expected: Kitchen\r\n Got: %s", event.Data.Speaker.DisplayName))
+	}
+	// the speaker has gone from the cluster, but we still know its name
+	fs.Lock()
+	fs.speakers = nil
+	fs.Unlock()
+	n.SpeakerLeft("abc")
+	if event := expectEvent(t, te, EventSpeakerOffline); event.Data.Speaker.DisplayName != "Kitchen" {
+		t.Error(fmt.Sprintf("Expected: Kitchen\r\n Got: %s", event.Data.Speaker.DisplayName))
+	}
+}
+
+func TestNotifierSpeakersOnStartup(t *testing.T) {
+	fs := &fakeService{speakers: []*service.Speaker{{ID: "abc", DisplayName: "Kitchen"}}}
+	n, te, stop := newNotifierTest(fs, &fakeStore{})
+	defer stop()
+	// the cluster tells us about the speakers that are already there, before and after the first poll
+	n.SpeakerJoined("abc")
+	n.update()
+	n.SpeakerJoined("abc")
+	te.expectNone(t)
+	// but it has really left
+	n.SpeakerLeft("abc")
+	expectEvent(t, te, EventSpeakerOffline)
+}
+
+func TestNotifierOnlyOnLeader(t *testing.T) {
+	fs := &fakeService{speakers: []*service.Speaker{{ID: "abc", DisplayName: "Kitchen"}}}
+	fz := &fakeStore{follower: true}
+	fz.set(raft.ZoneConfig{ID: "z1", DisplayName: "Kitchen", Leader: "abc", Speakers: []string{"abc"}})
+	fs.setTrack("z1", &service.Track{})
+	n, te, stop := newNotifierTest(fs, fz)
+	defer stop()
+	// another node is sending the events
+	n.update()
+	n.SpeakerLeft("abc")
+	fs.setTrack("z1", &service.Track{Title: "Bobcaygeon", Playing: true})
+	n.update()
+	te.expectNone(t)
+
+	// we take over, and only send what changes from then on
+	fz.setFollower(false)
+	n.update()
+	te.expectNone(t)
+	fs.setTrack("z1", &service.Track{Title: "Bobcaygeon"})
+	n.update()
+	expectEvent(t, te, EventZoneStopped)
+}
+
+func TestNotifierZones(t *testing.T) {
+	fs := &fakeService{}
+	fz := &fakeStore{}
+	kitchen := raft.ZoneConfig{ID: "z1", DisplayName: "Kitchen", Leader: "abc", Speakers: []string{"abc"}}
+	fz.set(kitchen)
+	fs.setTrack("z1", &service.Track{})
+	n, te, stop := newNotifierTest(fs, fz)
+	defer stop()
+	// the first poll learns what there is, without sending anything
+	n.update()
+	te.expectNone(t)
+
+	kitchen.DisplayName = "Downstairs"
+	kitchen.Speakers = []string{"abc", "def"}
+	patio := raft.ZoneConfig{ID: "z2", DisplayName: "Patio", Leader: "ghi", Speakers: []string{"ghi"}}
+	fz.set(kitchen, patio)
+	n.update()
+	event := expectEvent(t, te, EventZoneUpdated)
+	if event.Data.Zone.DisplayName != "Downstairs" || len(event.Data.Zone.Speakers) != 2 {
+		t.Error(fmt.Sprintf("Expected: Downstairs with 2 speakers\r\n Got: %v", event.Data.Zone))
+	}
+	var previous zoneData
+	json.Unmarshal(event.Data.Previous, &previous)
+	if previous.DisplayName != "Kitchen" {
+		t.Error(fmt.Sprintf("Expected: Kitchen\r\n Got: %s", previous.DisplayName))
+	}
+	if event := expectEvent(t, te, EventZoneCreated); event.Data.Zone.ID != "z2" {
+		t.Error(fmt.Sprintf("Expected: z2\r\n Got: %s", event.Data.Zone.ID))
+	}
+
+	// nothing has changed
+	n.update()
+	te.expectNone(t)
+
+	fz.set(patio)
+	n.update()
+	if event := expectEvent(t, te, EventZoneDeleted); event.Data.Zone.ID != "z1" {
+		t.Error(fmt.Sprintf("Expected: z1\r\n Got: %s", event.Data.Zone.ID))
+	}
+}
+
+func TestNotifierTracks(t *testing.T) {
+	fs := &fakeService{}
+	fz := &fakeStore{}
+	fz.set(raft.ZoneConfig{ID: "z1", DisplayName: "Kitchen", Leader: "abc", Speakers: []string{"abc"}})
+	fs.setTrack("z1", &service.Track{})
+	n, te, stop := newNotifierTest(fs, fz)
+	defer stop()
+	n.update()
+
+	fs.setTrack("z1", &service.Track{Title: "Bobcaygeon", Artist: "The Tragically Hip", Playing: true})
+	n.update()
+	if event := expectEvent(t, te, EventTrackChanged); event.Data.Track == nil || event.Data.Track.Title != "Bobcaygeon" {
+		t.Error(fmt.Sprintf("Expected: Bobcaygeon\r\n Got: %v", event.Data.Track))
+	}
+	if event := expectEvent(t, te, EventZonePlaying); event.Data.Zone.ID != "z1" {
+		t.Error(fmt.Sprintf("Expected: z1\r\n Got: %s", event.Data.Zone.ID))
+	}
+
+	fs.setTrack("z1", &service.Track{Title: "Ahead by a Century", Artist: "The Tragically Hip", Playing: true})
+	n.update()
+	event := expectEvent(t, te, EventTrackChanged)
+	var previous trackData
+	json.Unmarshal(event.Data.Previous, &previous)
+	if previous.Title != "Bobcaygeon" {
+		t.Error(fmt.Sprintf("Expected: Bobcaygeon\r\n Got: %s", previous.Title))
+	}
+
+	fs.setTrack("z1", &service.Track{Title: "Ahead by a Century", Artist: "The Tragically Hip"})
+	n.update()
+	expectEvent(t, te, EventZoneStopped)
+	te.expectNone(t)
+}
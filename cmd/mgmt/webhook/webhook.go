@@ -0,0 +1,191 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// the events sent to webhooks
+const (
+	EventSpeakerOnline  = "speaker.online"
+	EventSpeakerOffline = "speaker.offline"
+	EventZoneCreated    = "zone.created"
+	EventZoneUpdated    = "zone.updated"
+	EventZoneDeleted    = "zone.deleted"
+	EventZonePlaying    = "zone.playing"
+	EventZoneStopped    = "zone.stopped"
+	EventTrackChanged   = "track.changed"
+)
+
+const (
+	// how many events an endpoint can fall behind by before we start dropping them
+	queueSize = 64
+	// how long an endpoint has to answer
+	deliveryTimeout = 10 * time.Second
+	// the longest we wait between retries
+	maxRetryBackoff = time.Minute
+	// headers sent with each event
+	eventHeader     = "X-Bobcaygeon-Event"
+	deliveryHeader  = "X-Bobcaygeon-Delivery"
+	signatureHeader = "X-Bobcaygeon-Signature"
+)
+
+// Event is POSTed to the endpoints as JSON
+type Event struct {
+	// unique to the event, and the same when the event is retried
+	ID   string      `json:"id"`
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+// Endpoint is somewhere events are POSTed to
+type Endpoint struct {
+	URL string
+	// if set, requests are signed with an HMAC-SHA256 of the body, in the X-Bobcaygeon-Signature header
+	Secret string
+	// the events to send, e.g: zone.playing, or zone.* for all of the zone events.  All events
+	// are sent if empty
+	Events []string
+}
+
+// wants returns if the endpoint's filter lets the event through
+func (e Endpoint) wants(eventType string) bool {
+	if len(e.Events) == 0 {
+		return true
+	}
+	for _, filter := range e.Events {
+		if filter == eventType || filter == "*" {
+			return true
+		}
+		if strings.HasSuffix(filter, "*") && strings.HasPrefix(eventType, strings.TrimSuffix(filter, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// endpointQueue holds the events waiting to be sent to an endpoint, so a slow endpoint
+// doesn't hold up the others
+type endpointQueue struct {
+	endpoint Endpoint
+	events   chan Event
+}
+
+func newEndpointQueue(endpoint Endpoint) *endpointQueue {
+	return &endpointQueue{endpoint: endpoint, events: make(chan Event, queueSize)}
+}
+
+// notify queues the event for each endpoint that wants it
+func (n *Notifier) notify(eventType string, data interface{}) {
+	if !n.store.AmLeader() {
+		return
+	}
+	event := Event{ID: newEventID(), Type: eventType, Time: time.Now().UTC(), Data: data}
+	for _, q := range n.queues {
+		if !q.endpoint.wants(eventType) {
+			continue
+		}
+		select {
+		case q.events <- event:
+		default:
+			log.Printf("Webhook %s is falling behind, dropping: %s\n", q.endpoint.URL, eventType)
+		}
+	}
+}
+
+// deliverQueued sends the endpoint's events, one at a time, until stopped
+func (n *Notifier) deliverQueued(q *endpointQueue) {
+	for {
+		select {
+		case event := <-q.events:
+			n.deliverWithRetry(q.endpoint, event)
+		case <-n.done:
+			return
+		}
+	}
+}
+
+// deliverWithRetry sends the event, backing off exponentially between retries
+func (n *Notifier) deliverWithRetry(endpoint Endpoint, event Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Println("Error encoding webhook event: ", err)
+		return
+	}
+	backoff := n.config.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := n.deliver(endpoint, event, body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= n.config.MaxRetries {
+			log.Printf("Giving up sending %s to %s: %s\n", event.Type, endpoint.URL, err)
+			return
+		}
+		log.Printf("Error sending %s to %s, retrying in %s: %s\n", event.Type, endpoint.URL, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-n.done:
+			return
+		}
+		backoff *= 2
+		if backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// deliver POSTs the event to the endpoint, returning if it is worth trying again when it fails
+func (n *Notifier) deliver(endpoint Endpoint, event Event, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "bobcaygeon")
+	req.Header.Set(eventHeader, event.Type)
+	req.Header.Set(deliveryHeader, event.ID)
+	if endpoint.Secret != "" {
+		req.Header.Set(signatureHeader, sign(endpoint.Secret, body))
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	// other client errors mean the endpoint doesn't want the event, sending it again won't change that
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("Endpoint responded with: %s", resp.Status)
+}
+
+// sign returns the signature header for the body, in the same form GitHub uses: sha256=<hex HMAC>
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newEventID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// very unlikely, but fallback to something that is still unique to us
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,174 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// received is a request an endpoint got
+type received struct {
+	header http.Header
+	body   []byte
+}
+
+// testEndpoint answers with the statuses in turn, then with 200, passing on what it gets
+type testEndpoint struct {
+	sync.Mutex
+	statuses []int
+	requests chan received
+}
+
+func newTestEndpoint(statuses ...int) (*testEndpoint, *httptest.Server) {
+	te := &testEndpoint{statuses: statuses, requests: make(chan received, queueSize)}
+	return te, httptest.NewServer(te)
+}
+
+func (te *testEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	te.requests <- received{header: r.Header, body: body}
+	te.Lock()
+	defer te.Unlock()
+	if len(te.statuses) > 0 {
+		w.WriteHeader(te.statuses[0])
+		te.statuses = te.statuses[1:]
+	}
+}
+
+func (te *testEndpoint) next(t *testing.T) received {
+	select {
+	case r := <-te.requests:
+		return r
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a request, got none")
+	}
+	return received{}
+}
+
+func (te *testEndpoint) expectNone(t *testing.T) {
+	select {
+	case r := <-te.requests:
+		t.Error(fmt.Sprintf("Expected no request\r\n Got: %s", r.body))
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func startTestNotifier(config Config) *Notifier {
+	n := NewNotifier(config, &fakeService{}, &fakeStore{})
+	for _, q := range n.queues {
+		go n.deliverQueued(q)
+	}
+	return n
+}
+
+func TestEndpointFilter(t *testing.T) {
+	all := Endpoint{}
+	if !all.wants(EventZonePlaying) {
+		t.Error("Expected an endpoint without a filter to want every event")
+	}
+	filtered := Endpoint{Events: []string{"zone.*", EventSpeakerOffline}}
+	for _, eventType := range []string{EventZonePlaying, EventZoneDeleted, EventSpeakerOffline} {
+		if !filtered.wants(eventType) {
+			t.Error(fmt.Sprintf("Expected the filter to let through: %s", eventType))
+		}
+	}
+	for _, eventType := range []string{EventSpeakerOnline, EventTrackChanged} {
+		if filtered.wants(eventType) {
+			t.Error(fmt.Sprintf("Expected the filter to leave out: %s", eventType))
+		}
+	}
+}
+
+func TestSign(t *testing.T) {
+	// from GitHub's webhook docs
+	expected := "sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17"
+	if got := sign("It's a Secret to Everybody", []byte("Hello, World!")); got != expected {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", expected, got))
+	}
+}
+
+func TestDeliverSigned(t *testing.T) {
+	te, server := newTestEndpoint()
+	defer server.Close()
+	n := startTestNotifier(Config{Endpoints: []Endpoint{{URL: server.URL, Secret: "secret"}}})
+	defer n.Stop()
+	n.notify(EventSpeakerOnline, speakerEvent{Speaker: speakerData{ID: "abc", DisplayName: "Kitchen"}})
+
+	r := te.next(t)
+	if r.header.Get(signatureHeader) != sign("secret", r.body) {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", sign("secret", r.body), r.header.Get(signatureHeader)))
+	}
+	if r.header.Get(eventHeader) != EventSpeakerOnline {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", EventSpeakerOnline, r.header.Get(eventHeader)))
+	}
+	var event struct {
+		ID   string
+		Type string
+		Data speakerEvent
+	}
+	if err := json.Unmarshal(r.body, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != EventSpeakerOnline || event.Data.Speaker.DisplayName != "Kitchen" {
+		t.Error(fmt.Sprintf("Expected: %s from Kitchen\r\n Got: %s", EventSpeakerOnline, r.body))
+	}
+	if event.ID == "" || r.header.Get(deliveryHeader) != event.ID {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", event.ID, r.header.Get(deliveryHeader)))
+	}
+}
+
+func TestDeliverFiltered(t *testing.T) {
+	te, server := newTestEndpoint()
+	defer server.Close()
+	n := startTestNotifier(Config{Endpoints: []Endpoint{{URL: server.URL, Events: []string{EventSpeakerOffline}}}})
+	defer n.Stop()
+	n.notify(EventSpeakerOnline, speakerEvent{Speaker: speakerData{ID: "abc"}})
+	n.notify(EventSpeakerOffline, speakerEvent{Speaker: speakerData{ID: "abc"}})
+	if r := te.next(t); r.header.Get(eventHeader) != EventSpeakerOffline {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", EventSpeakerOffline, r.header.Get(eventHeader)))
+	}
+	te.expectNone(t)
+}
+
+func TestDeliverRetries(t *testing.T) {
+	te, server := newTestEndpoint(http.StatusInternalServerError, http.StatusTooManyRequests)
+	defer server.Close()
+	n := startTestNotifier(Config{Endpoints: []Endpoint{{URL: server.URL}}, MaxRetries: 3, RetryBackoff: 10 * time.Millisecond})
+	defer n.Stop()
+	n.notify(EventZoneDeleted, zoneEvent{Zone: zoneData{ID: "z1"}})
+	first := te.next(t)
+	for i := 0; i < 2; i++ {
+		r := te.next(t)
+		if r.header.Get(deliveryHeader) != first.header.Get(deliveryHeader) {
+			t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", first.header.Get(deliveryHeader), r.header.Get(deliveryHeader)))
+		}
+	}
+	// delivered on the third try, so there is nothing more
+	te.expectNone(t)
+}
+
+func TestDeliverGivesUp(t *testing.T) {
+	te, server := newTestEndpoint(http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError)
+	defer server.Close()
+	n := startTestNotifier(Config{Endpoints: []Endpoint{{URL: server.URL}}, MaxRetries: 1, RetryBackoff: 10 * time.Millisecond})
+	defer n.Stop()
+	n.notify(EventZoneDeleted, zoneEvent{Zone: zoneData{ID: "z1"}})
+	te.next(t)
+	te.next(t)
+	te.expectNone(t)
+}
+
+func TestDeliverClientErrorNotRetried(t *testing.T) {
+	te, server := newTestEndpoint(http.StatusBadRequest)
+	defer server.Close()
+	n := startTestNotifier(Config{Endpoints: []Endpoint{{URL: server.URL}}, MaxRetries: 3, RetryBackoff: 10 * time.Millisecond})
+	defer n.Stop()
+	n.notify(EventZoneDeleted, zoneEvent{Zone: zoneData{ID: "z1"}})
+	te.next(t)
+	te.expectNone(t)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/nstehr/bobcaygeon/rtsp"
+)
+
+var (
+	capturePath = flag.String("capture", "", "Path to a capture written by bcg -capture")
+	address     = flag.String("address", "127.0.0.1", "Address of the bcg instance to replay the capture against")
+	port        = flag.Int("port", 5000, "RTSP port of the bcg instance to replay the capture against")
+	fast        = flag.Bool("fast", false, "Replay as fast as possible, instead of with the captured timing")
+	list        = flag.Bool("list", false, "Print the records in the capture instead of replaying it")
+)
+
+func main() {
+	flag.Parse()
+	if *capturePath == "" {
+		log.Fatal("A capture is required, see -capture")
+	}
+	captureFile, err := os.Open(*capturePath)
+	if err != nil {
+		log.Fatal("Could not open capture: ", err)
+	}
+	records, err := rtsp.ReadCapture(captureFile)
+	captureFile.Close()
+	if err != nil {
+		log.Fatal("Could not read capture: ", err)
+	}
+	if *list {
+		printRecords(records)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		cancel()
+	}()
+
+	log.Printf("Replaying %d records against %s:%d\n", len(records), *address, *port)
+	if err := rtsp.Replay(ctx, records, *address, *port, !*fast); err != nil {
+		log.Fatal("Replay failed: ", err)
+	}
+	log.Println("Replay complete")
+}
+
+func printRecords(records []*rtsp.CaptureRecord) {
+	for _, record := range records {
+		switch record.Kind {
+		case rtsp.CaptureRequest:
+			req, err := record.Request()
+			if err != nil {
+				fmt.Printf("%s conn %d: unparseable request: %s\n", record.Offset, record.ConnID, err)
+				continue
+			}
+			fmt.Printf("%s conn %d: %s %s\n", record.Offset, record.ConnID, req.Method, req.RequestURI)
+		case rtsp.CaptureResponse:
+			resp, err := record.Response()
+			if err != nil {
+				fmt.Printf("%s conn %d: unparseable response: %s\n", record.Offset, record.ConnID, err)
+				continue
+			}
+			fmt.Printf("%s conn %d: %d %s\n", record.Offset, record.ConnID, resp.Status, resp.Status)
+		default:
+			fmt.Printf("%s session %s: %s packet, %d bytes\n", record.Offset, record.Session, record.Kind, len(record.Data))
+		}
+	}
+}
@@ -7,6 +7,7 @@ require (
 	github.com/boltdb/bolt v1.3.1 // indirect
 	github.com/cenkalti/backoff v1.1.0 // indirect
 	github.com/dustinkirkland/golang-petname v0.0.0-20170921220637-d3c2ba80e75e
+	github.com/eclipse/paho.mqtt.golang v1.2.0
 	github.com/envoyproxy/go-control-plane v0.6.3
 	github.com/gobuffalo/packr/v2 v2.5.2
 	github.com/gogo/googleapis v1.1.0 // indirect
@@ -30,6 +31,7 @@ require (
 	github.com/pelletier/go-toml v1.2.0
 	github.com/rakyll/statik v0.1.7
 	github.com/sean-/seed v0.0.0-20170313163322-e2103e2c3529 // indirect
+	golang.org/x/crypto v0.0.0-20190621222207-cc06ce4a13d4
 	golang.org/x/net v0.0.0-20190404232315-eb5bcb51f2a3
 	google.golang.org/appengine v1.4.0 // indirect
 	google.golang.org/genproto v0.0.0-20190306222511-6e86cb5d2f12 // indirect
@@ -0,0 +1,143 @@
+package input
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// the player (and the ALAC stream we forward) is fixed at 16 bit, 2 channel, 44.1kHz
+	outputSampleRate = 44100
+	outputChannels   = 2
+)
+
+// PcmFormat describes the layout of the raw PCM being written into the pipe
+type PcmFormat struct {
+	SampleRate int
+	Channels   int
+	BitDepth   int
+	BigEndian  bool
+}
+
+// Validate makes sure we know how to convert the format
+func (f PcmFormat) Validate() error {
+	if f.SampleRate <= 0 {
+		return fmt.Errorf("Invalid sample rate: %d", f.SampleRate)
+	}
+	if f.Channels != 1 && f.Channels != 2 {
+		return fmt.Errorf("Unsupported number of channels: %d", f.Channels)
+	}
+	if f.BitDepth != 16 && f.BitDepth != 24 && f.BitDepth != 32 {
+		return fmt.Errorf("Unsupported bit depth: %d", f.BitDepth)
+	}
+	return nil
+}
+
+func (f PcmFormat) frameSize() int {
+	return f.Channels * f.BitDepth / 8
+}
+
+// converter turns PCM in the configured format into 16 bit little endian stereo
+// at 44.1kHz.  It keeps state between calls so that frames split across reads and
+// the resampler position carry over
+type converter struct {
+	format   PcmFormat
+	leftover []byte
+	// resampler state
+	step   float64
+	pos    float64
+	last   [2]int16
+	primed bool
+}
+
+func newConverter(format PcmFormat) *converter {
+	return &converter{format: format, step: float64(format.SampleRate) / outputSampleRate}
+}
+
+// convert returns the converted PCM along with whether or not the chunk was silent
+func (c *converter) convert(data []byte, threshold int16) ([]byte, bool) {
+	data = append(c.leftover, data...)
+	frameSize := c.format.frameSize()
+	frames := len(data) / frameSize
+	c.leftover = append([]byte(nil), data[frames*frameSize:]...)
+
+	in := make([][2]int16, frames)
+	silent := true
+	for i := 0; i < frames; i++ {
+		frame := data[i*frameSize : (i+1)*frameSize]
+		left := c.sample(frame, 0)
+		right := left
+		if c.format.Channels == 2 {
+			right = c.sample(frame, 1)
+		}
+		if abs(left) > threshold || abs(right) > threshold {
+			silent = false
+		}
+		in[i] = [2]int16{left, right}
+	}
+
+	out := in
+	if c.format.SampleRate != outputSampleRate {
+		out = c.resample(in)
+	}
+	pcm := make([]byte, len(out)*outputChannels*2)
+	for i, frame := range out {
+		binary.LittleEndian.PutUint16(pcm[i*4:], uint16(frame[0]))
+		binary.LittleEndian.PutUint16(pcm[i*4+2:], uint16(frame[1]))
+	}
+	return pcm, silent
+}
+
+// sample reads the given channel out of the frame, reducing it to 16 bits
+func (c *converter) sample(frame []byte, channel int) int16 {
+	width := c.format.BitDepth / 8
+	b := frame[channel*width : (channel+1)*width]
+	// we only keep the most significant 16 bits
+	if c.format.BigEndian {
+		return int16(binary.BigEndian.Uint16(b[:2]))
+	}
+	return int16(binary.LittleEndian.Uint16(b[width-2:]))
+}
+
+// resample does linear interpolation between input frames to get to the output rate
+func (c *converter) resample(in [][2]int16) [][2]int16 {
+	buf := in
+	if c.primed {
+		buf = append([][2]int16{c.last}, in...)
+	}
+	if len(buf) < 2 {
+		if len(buf) == 1 {
+			c.last = buf[0]
+			c.primed = true
+		}
+		return nil
+	}
+	var out [][2]int16
+	end := float64(len(buf) - 1)
+	for c.pos < end {
+		i := int(c.pos)
+		frac := c.pos - float64(i)
+		var frame [2]int16
+		for ch := 0; ch < 2; ch++ {
+			a := float64(buf[i][ch])
+			b := float64(buf[i+1][ch])
+			frame[ch] = int16(a + (b-a)*frac)
+		}
+		out = append(out, frame)
+		c.pos += c.step
+	}
+	c.pos -= end
+	c.last = buf[len(buf)-1]
+	c.primed = true
+	return out
+}
+
+func abs(v int16) int16 {
+	if v == -32768 {
+		return 32767
+	}
+	if v < 0 {
+		return -v
+	}
+	return v
+}
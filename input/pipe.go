@@ -0,0 +1,211 @@
+package input
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nstehr/bobcaygeon/player"
+	"github.com/nstehr/bobcaygeon/rtsp"
+	"github.com/nstehr/bobcaygeon/sdp"
+)
+
+const (
+	// samples with an amplitude at or below this are treated as silence
+	silenceThreshold = 16
+	readChunkSize    = 4096
+)
+
+// PipeSource reads raw PCM from a named pipe (FIFO) and plays it through a player
+// as if it had been sent from an airplay client.  Because the data ends up on a
+// regular session, the forwarding player will send it on to the rest of the zone.
+// A session is started as soon as audio shows up in the pipe and is ended once
+// the pipe has been silent for the configured timeout.  Airplay senders come first,
+// the pipe's audio is dropped while one is playing through the same player
+type PipeSource struct {
+	path           string
+	format         PcmFormat
+	silenceTimeout time.Duration
+	player         player.Player
+	mu             sync.Mutex
+	pipe           *os.File
+	done           chan struct{}
+	// whether an airplay sender is playing through the player, nil if nothing else plays through it
+	busy func() bool
+}
+
+// NewPipeSource instantiates a new PipeSource
+func NewPipeSource(path string, format PcmFormat, silenceTimeout time.Duration, player player.Player) *PipeSource {
+	return &PipeSource{path: path, format: format, silenceTimeout: silenceTimeout, player: player, done: make(chan struct{})}
+}
+
+// SetBusy sets how to tell if an airplay sender is playing through the same player,
+// the pipe stays out of the way while it is.  It must be set before Start
+func (ps *PipeSource) SetBusy(busy func() bool) {
+	ps.busy = busy
+}
+
+// isBusy returns whether something else is playing through the player
+func (ps *PipeSource) isBusy() bool {
+	return ps.busy != nil && ps.busy()
+}
+
+// Start creates the pipe (if it doesn't already exist) and starts waiting for audio
+func (ps *PipeSource) Start() error {
+	if err := ps.format.Validate(); err != nil {
+		return err
+	}
+	if ps.silenceTimeout <= 0 {
+		return fmt.Errorf("Silence timeout must be positive, got: %s", ps.silenceTimeout)
+	}
+	if _, err := os.Stat(ps.path); os.IsNotExist(err) {
+		log.Printf("Creating pipe: %s\n", ps.path)
+		if err := syscall.Mkfifo(ps.path, 0666); err != nil {
+			return err
+		}
+	}
+	// opening read/write means we never see EOF when a producer closes its end,
+	// so producers can come and go without us having to reopen the pipe
+	pipe, err := os.OpenFile(ps.path, os.O_RDWR, os.ModeNamedPipe)
+	if err != nil {
+		return err
+	}
+	ps.mu.Lock()
+	ps.pipe = pipe
+	ps.mu.Unlock()
+	log.Printf("Waiting for audio on pipe: %s\n", ps.path)
+	go ps.stream(pipe)
+	return nil
+}
+
+// Stop stops reading from the pipe, ending any active session
+func (ps *PipeSource) Stop() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	select {
+	case <-ps.done:
+		return
+	default:
+	}
+	close(ps.done)
+	if ps.pipe != nil {
+		ps.pipe.Close()
+	}
+}
+
+// stream reads from r until it is exhausted or the source is stopped, starting
+// and stopping sessions on the player as audio comes and goes
+func (ps *PipeSource) stream(r io.Reader) {
+	chunks := make(chan []byte, 16)
+	go func() {
+		defer close(chunks)
+		for {
+			buf := make([]byte, readChunkSize)
+			n, err := r.Read(buf)
+			if n > 0 {
+				select {
+				case chunks <- buf[:n]:
+				case <-ps.done:
+					return
+				}
+			}
+			if err != nil {
+				if err != io.EOF {
+					log.Println("Error reading from pipe: ", err)
+				}
+				return
+			}
+		}
+	}()
+
+	conv := newConverter(ps.format)
+	var session *rtsp.Session
+	var pending []byte
+	lastSound := time.Now()
+	ticker := time.NewTicker(ps.silenceTimeout / 4)
+	defer ticker.Stop()
+
+	endSession := func() {
+		if session == nil {
+			return
+		}
+		close(session.DataChan)
+		session = nil
+		pending = nil
+	}
+	stopSession := func() {
+		if session == nil {
+			return
+		}
+		log.Println("Pipe has gone silent, ending session")
+		if len(pending) > 0 {
+			session.DataChan <- player.EncodeAlac(pending)
+		}
+		endSession()
+	}
+	// the audio is dropped rather than played over an airplay sender
+	yield := func() {
+		if session != nil {
+			log.Println("Airplay sender is playing, ending pipe session")
+			endSession()
+		}
+	}
+	defer stopSession()
+
+	for {
+		select {
+		case chunk, ok := <-chunks:
+			if !ok {
+				return
+			}
+			pcm, silent := conv.convert(chunk, silenceThreshold)
+			if !silent {
+				lastSound = time.Now()
+			}
+			if ps.isBusy() {
+				yield()
+				continue
+			}
+			if session == nil {
+				if silent {
+					continue
+				}
+				log.Println("Audio detected on pipe, starting session")
+				session = newPipeSession()
+				ps.player.Play(session)
+			}
+			pending = append(pending, pcm...)
+			// chop the audio up into airplay sized packets
+			packetSize := player.AlacFramesPerPacket * outputChannels * 2
+			for len(pending) >= packetSize {
+				session.DataChan <- player.EncodeAlac(pending[:packetSize])
+				pending = pending[packetSize:]
+			}
+			if time.Since(lastSound) > ps.silenceTimeout {
+				stopSession()
+			}
+		case <-ticker.C:
+			if ps.isBusy() {
+				yield()
+				continue
+			}
+			if session != nil && time.Since(lastSound) > ps.silenceTimeout {
+				stopSession()
+			}
+		case <-ps.done:
+			return
+		}
+	}
+}
+
+// newPipeSession builds a session that looks like one an airplay client would
+// have set up, that is, one carrying ALAC packets
+func newPipeSession() *rtsp.Session {
+	description := sdp.NewSessionDescription()
+	description.Attributes["rtpmap"] = "96 AppleLossless"
+	return rtsp.NewSession(description, nil)
+}
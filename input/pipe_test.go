@@ -0,0 +1,181 @@
+package input
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nstehr/bobcaygeon/player"
+	"github.com/nstehr/bobcaygeon/rtsp"
+)
+
+type FakePlayer struct {
+	sessions chan *rtsp.Session
+}
+
+func (fp *FakePlayer) Play(session *rtsp.Session)                              { fp.sessions <- session }
+func (*FakePlayer) SetVolume(volume float64)                                   {}
+func (*FakePlayer) GetVolume() float64                                         { return 1 }
+func (*FakePlayer) SetMute(isMuted bool)                                       {}
+func (*FakePlayer) GetIsMuted() bool                                           { return false }
+func (*FakePlayer) SetTrack(track player.Track)                                {}
+func (*FakePlayer) SetAlbumArt(artwork []byte, mimeType string)                {}
+func (*FakePlayer) SetProgress(position time.Duration, duration time.Duration) {}
+func (*FakePlayer) GetTrack() player.Track                                     { return player.Track{} }
+
+func stereoPCM(frames int, value int16) []byte {
+	pcm := make([]byte, frames*4)
+	for i := 0; i < frames; i++ {
+		binary.LittleEndian.PutUint16(pcm[i*4:], uint16(value))
+		binary.LittleEndian.PutUint16(pcm[i*4+2:], uint16(-value))
+	}
+	return pcm
+}
+
+func TestEncodeAlacRoundTrip(t *testing.T) {
+	pcm := stereoPCM(player.AlacFramesPerPacket, 1234)
+	pcm[0] = 0x7f
+	encoded := player.EncodeAlac(pcm)
+	decoded, err := player.GetCodec(newPipeSession())(encoded)
+	if err != nil {
+		t.Error("Unexpected error decoding", err)
+	}
+	if !bytes.Equal(pcm, decoded) {
+		t.Error(fmt.Sprintf("Expected: %v\r\n Got: %v", pcm[:16], decoded[:16]))
+	}
+}
+
+func TestConvertMonoBigEndian24(t *testing.T) {
+	c := newConverter(PcmFormat{SampleRate: 44100, Channels: 1, BitDepth: 24, BigEndian: true})
+	pcm, silent := c.convert([]byte{0x12, 0x34, 0x56, 0xff, 0xfe, 0x00}, silenceThreshold)
+	if silent {
+		t.Error("Expected audio to not be silent")
+	}
+	expected := []byte{0x34, 0x12, 0x34, 0x12, 0xfe, 0xff, 0xfe, 0xff}
+	if !bytes.Equal(pcm, expected) {
+		t.Error(fmt.Sprintf("Expected: %v\r\n Got: %v", expected, pcm))
+	}
+}
+
+func TestConvertKeepsPartialFrames(t *testing.T) {
+	c := newConverter(PcmFormat{SampleRate: 44100, Channels: 2, BitDepth: 16})
+	pcm, _ := c.convert([]byte{1, 0, 2}, silenceThreshold)
+	if len(pcm) != 0 {
+		t.Error(fmt.Sprintf("Expected no output\r\n Got: %v", pcm))
+	}
+	pcm, _ = c.convert([]byte{0}, silenceThreshold)
+	expected := []byte{1, 0, 2, 0}
+	if !bytes.Equal(pcm, expected) {
+		t.Error(fmt.Sprintf("Expected: %v\r\n Got: %v", expected, pcm))
+	}
+}
+
+func TestConvertSilence(t *testing.T) {
+	c := newConverter(PcmFormat{SampleRate: 44100, Channels: 2, BitDepth: 16})
+	_, silent := c.convert(stereoPCM(100, 3), silenceThreshold)
+	if !silent {
+		t.Error("Expected audio to be silent")
+	}
+}
+
+func TestResample(t *testing.T) {
+	c := newConverter(PcmFormat{SampleRate: 48000, Channels: 2, BitDepth: 16})
+	total := 0
+	// feed a second of audio in uneven chunks
+	for i := 0; i < 48000; i += 1000 {
+		pcm, _ := c.convert(stereoPCM(1000, 1000), silenceThreshold)
+		total += len(pcm) / 4
+	}
+	if total < 44099 || total > 44101 {
+		t.Error(fmt.Sprintf("Expected: ~44100 frames\r\n Got: %d", total))
+	}
+}
+
+func TestFormatValidate(t *testing.T) {
+	if err := (PcmFormat{SampleRate: 44100, Channels: 6, BitDepth: 16}).Validate(); err == nil {
+		t.Error("Expected error for 6 channels")
+	}
+	if err := (PcmFormat{SampleRate: 44100, Channels: 2, BitDepth: 8}).Validate(); err == nil {
+		t.Error("Expected error for 8 bit audio")
+	}
+	if err := (PcmFormat{SampleRate: 48000, Channels: 2, BitDepth: 32}).Validate(); err != nil {
+		t.Error("Unexpected error", err)
+	}
+}
+
+func TestStreamStartsAndStopsOnSilence(t *testing.T) {
+	fp := &FakePlayer{sessions: make(chan *rtsp.Session, 1)}
+	ps := NewPipeSource("", PcmFormat{SampleRate: 44100, Channels: 2, BitDepth: 16}, 50*time.Millisecond, fp)
+	r, w := io.Pipe()
+	go ps.stream(r)
+	defer ps.Stop()
+
+	// silence alone shouldn't start anything
+	w.Write(stereoPCM(player.AlacFramesPerPacket, 0))
+	select {
+	case <-fp.sessions:
+		t.Fatal("Expected no session to be started for silence")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	w.Write(stereoPCM(player.AlacFramesPerPacket*2, 5000))
+	var session *rtsp.Session
+	select {
+	case session = <-fp.sessions:
+	case <-time.After(time.Second):
+		t.Fatal("Expected session to be started")
+	}
+	packets := 0
+	for range session.DataChan {
+		packets++
+	}
+	if packets != 2 {
+		t.Error(fmt.Sprintf("Expected: %d packets\r\n Got: %d", 2, packets))
+	}
+}
+
+func TestStreamYieldsToAirplay(t *testing.T) {
+	fp := &FakePlayer{sessions: make(chan *rtsp.Session, 1)}
+	ps := NewPipeSource("", PcmFormat{SampleRate: 44100, Channels: 2, BitDepth: 16}, time.Second, fp)
+	var airplaying int32
+	ps.SetBusy(func() bool { return atomic.LoadInt32(&airplaying) == 1 })
+	r, w := io.Pipe()
+	go ps.stream(r)
+	defer ps.Stop()
+
+	w.Write(stereoPCM(player.AlacFramesPerPacket, 5000))
+	var session *rtsp.Session
+	select {
+	case session = <-fp.sessions:
+	case <-time.After(time.Second):
+		t.Fatal("Expected session to be started")
+	}
+	// a sender starts playing while the pipe is, so the pipe gets out of the way
+	atomic.StoreInt32(&airplaying, 1)
+	go w.Write(stereoPCM(player.AlacFramesPerPacket*4, 5000))
+	packets := 0
+	for range session.DataChan {
+		packets++
+	}
+	if packets != 1 {
+		t.Error(fmt.Sprintf("Expected: %d packets\r\n Got: %d", 1, packets))
+	}
+	w.Write(stereoPCM(player.AlacFramesPerPacket, 5000))
+	select {
+	case <-fp.sessions:
+		t.Fatal("Expected no session to be started while the sender is playing")
+	case <-time.After(20 * time.Millisecond):
+	}
+	// once the sender is done the pipe plays again
+	atomic.StoreInt32(&airplaying, 0)
+	w.Write(stereoPCM(player.AlacFramesPerPacket, 5000))
+	select {
+	case <-fp.sessions:
+	case <-time.After(time.Second):
+		t.Fatal("Expected session to be started")
+	}
+}
@@ -0,0 +1,186 @@
+package output
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/nstehr/bobcaygeon/player"
+)
+
+// a small FLAC stream encoder.  We don't do any actual compression, every
+// subframe is written verbatim; what we get out of FLAC is a format that
+// browsers and media players understand and that can carry the track metadata.
+// format details: https://xiph.org/flac/format.html
+const (
+	flacBlockSize = 4096
+
+	flacMetadataStreamInfo    = 0
+	flacMetadataVorbisComment = 4
+)
+
+type flacEncoder struct {
+	frameNumber uint64
+	pending     []byte
+}
+
+// header returns the stream marker and metadata blocks that start a FLAC stream
+func (e *flacEncoder) header(track player.Track) []byte {
+	buf := []byte("fLaC")
+
+	streamInfo := make([]byte, 34)
+	binary.BigEndian.PutUint16(streamInfo[0:], flacBlockSize)
+	binary.BigEndian.PutUint16(streamInfo[2:], flacBlockSize)
+	// min and max frame size (bytes 4-9) are left as 0, meaning unknown.
+	// next is 20 bits of sample rate, 3 bits of channels-1, 5 bits of
+	// bits per sample-1 and 36 bits of total samples, which is 0 (unknown)
+	// for a live stream.  The MD5 signature is also left zeroed out
+	packed := uint64(sampleRate)<<44 | uint64(channels-1)<<41 | uint64(bitDepth-1)<<36
+	binary.BigEndian.PutUint64(streamInfo[10:], packed)
+	buf = append(buf, metadataBlockHeader(flacMetadataStreamInfo, len(streamInfo), false)...)
+	buf = append(buf, streamInfo...)
+
+	comments := vorbisComment(track)
+	buf = append(buf, metadataBlockHeader(flacMetadataVorbisComment, len(comments), true)...)
+	buf = append(buf, comments...)
+	return buf
+}
+
+// encode buffers up the pcm and returns any complete frames
+func (e *flacEncoder) encode(pcm []byte) []byte {
+	e.pending = append(e.pending, pcm...)
+	blockBytes := flacBlockSize * channels * 2
+	var out []byte
+	for len(e.pending) >= blockBytes {
+		out = append(out, e.frame(e.pending[:blockBytes])...)
+		e.pending = e.pending[blockBytes:]
+	}
+	return out
+}
+
+// frame writes a single FLAC frame holding the given 16 bit stereo pcm
+func (e *flacEncoder) frame(pcm []byte) []byte {
+	samples := len(pcm) / (channels * 2)
+	// sync code plus a fixed blocking strategy
+	buf := []byte{0xff, 0xf8}
+	// block size and sample rate (0b1001 is 44.1kHz)
+	blockSizeCode := byte(0x7)
+	if samples == flacBlockSize {
+		blockSizeCode = 0xc
+	}
+	buf = append(buf, blockSizeCode<<4|0x9)
+	// left/right channel assignment and 16 bits per sample
+	buf = append(buf, byte(channels-1)<<4|0x4<<1)
+	buf = append(buf, utf8Number(e.frameNumber)...)
+	if blockSizeCode == 0x7 {
+		size := make([]byte, 2)
+		binary.BigEndian.PutUint16(size, uint16(samples-1))
+		buf = append(buf, size...)
+	}
+	buf = append(buf, crc8(buf))
+
+	for channel := 0; channel < channels; channel++ {
+		// subframe header: padding bit, verbatim type, no wasted bits
+		buf = append(buf, 0x1<<1)
+		for i := 0; i < samples; i++ {
+			offset := (i*channels + channel) * 2
+			sample := binary.LittleEndian.Uint16(pcm[offset:])
+			buf = append(buf, byte(sample>>8), byte(sample))
+		}
+	}
+	crc := make([]byte, 2)
+	binary.BigEndian.PutUint16(crc, crc16(buf))
+	buf = append(buf, crc...)
+	e.frameNumber++
+	return buf
+}
+
+func metadataBlockHeader(blockType byte, length int, last bool) []byte {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(length))
+	header[0] = blockType
+	if last {
+		header[0] |= 0x80
+	}
+	return header
+}
+
+// vorbisComment builds the body of a VORBIS_COMMENT block, which unlike
+// the rest of FLAC is little endian
+func vorbisComment(track player.Track) []byte {
+	var comments []string
+	if track.Artist != "" {
+		comments = append(comments, fmt.Sprintf("ARTIST=%s", track.Artist))
+	}
+	if track.Album != "" {
+		comments = append(comments, fmt.Sprintf("ALBUM=%s", track.Album))
+	}
+	if track.Title != "" {
+		comments = append(comments, fmt.Sprintf("TITLE=%s", track.Title))
+	}
+	vendor := "Bobcaygeon"
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, uint32(len(vendor)))
+	buf = append(buf, vendor...)
+	count := make([]byte, 4)
+	binary.LittleEndian.PutUint32(count, uint32(len(comments)))
+	buf = append(buf, count...)
+	for _, c := range comments {
+		length := make([]byte, 4)
+		binary.LittleEndian.PutUint32(length, uint32(len(c)))
+		buf = append(buf, length...)
+		buf = append(buf, c...)
+	}
+	return buf
+}
+
+// utf8Number encodes the frame number the same way UTF-8 encodes a code point,
+// extended out to 36 bits
+func utf8Number(n uint64) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	// figure out how many continuation bytes we need, each holds 6 bits
+	extra := 1
+	for n >= 1<<uint(6*extra+(6-extra)) {
+		extra++
+	}
+	buf := make([]byte, extra+1)
+	for i := extra; i > 0; i-- {
+		buf[i] = 0x80 | byte(n&0x3f)
+		n >>= 6
+	}
+	buf[0] = byte(0xff<<uint(7-extra)) | byte(n)
+	return buf
+}
+
+// crc8 with polynomial x^8 + x^2 + x^1 + x^0, as used by the frame header
+func crc8(data []byte) byte {
+	var crc byte
+	for _, b := range data {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// crc16 with polynomial x^16 + x^15 + x^2 + x^0, as used by the frame footer
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x8005
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
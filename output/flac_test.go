@@ -0,0 +1,86 @@
+package output
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/nstehr/bobcaygeon/player"
+)
+
+func TestCrc8(t *testing.T) {
+	crc := crc8([]byte("123456789"))
+	if crc != 0xf4 {
+		t.Error(fmt.Sprintf("Expected: %x\r\n Got: %x", 0xf4, crc))
+	}
+}
+
+func TestCrc16(t *testing.T) {
+	crc := crc16([]byte("123456789"))
+	if crc != 0xfee8 {
+		t.Error(fmt.Sprintf("Expected: %x\r\n Got: %x", 0xfee8, crc))
+	}
+}
+
+func TestUtf8Number(t *testing.T) {
+	tests := []struct {
+		n        uint64
+		expected []byte
+	}{
+		{0, []byte{0x00}},
+		{0x7f, []byte{0x7f}},
+		{0x80, []byte{0xc2, 0x80}},
+		{0x7ff, []byte{0xdf, 0xbf}},
+		{0x800, []byte{0xe0, 0xa0, 0x80}},
+		{0x10000, []byte{0xf0, 0x90, 0x80, 0x80}},
+	}
+	for _, test := range tests {
+		encoded := utf8Number(test.n)
+		if !bytes.Equal(encoded, test.expected) {
+			t.Error(fmt.Sprintf("Expected: %x\r\n Got: %x", test.expected, encoded))
+		}
+	}
+}
+
+func TestFlacHeader(t *testing.T) {
+	encoder := &flacEncoder{}
+	header := encoder.header(player.Track{Artist: "The Tragically Hip", Title: "Bobcaygeon"})
+	if string(header[:4]) != "fLaC" {
+		t.Error(fmt.Sprintf("Expected: fLaC\r\n Got: %s", header[:4]))
+	}
+	// STREAMINFO is first and isn't the last block
+	if header[4] != flacMetadataStreamInfo {
+		t.Error(fmt.Sprintf("Expected: %d\r\n Got: %d", flacMetadataStreamInfo, header[4]))
+	}
+	comments := header[4+4+34:]
+	if comments[0] != 0x80|flacMetadataVorbisComment {
+		t.Error(fmt.Sprintf("Expected: %x\r\n Got: %x", 0x80|flacMetadataVorbisComment, comments[0]))
+	}
+	if !bytes.Contains(comments, []byte("TITLE=Bobcaygeon")) {
+		t.Error("Expected title to be in the vorbis comments")
+	}
+	if bytes.Contains(comments, []byte("ALBUM=")) {
+		t.Error("Expected empty album to be left out")
+	}
+}
+
+func TestFlacEncodeBuffersFullBlocks(t *testing.T) {
+	encoder := &flacEncoder{}
+	// less than a block shouldn't produce a frame
+	out := encoder.encode(make([]byte, 352*4))
+	if len(out) != 0 {
+		t.Error(fmt.Sprintf("Expected no output\r\n Got: %d bytes", len(out)))
+	}
+	out = encoder.encode(make([]byte, flacBlockSize*4))
+	// frame header (sync, codes, frame number, crc8) + 2 verbatim subframes + crc16
+	expected := 6 + 2*(1+flacBlockSize*2) + 2
+	if len(out) != expected {
+		t.Error(fmt.Sprintf("Expected: %d\r\n Got: %d", expected, len(out)))
+	}
+	if out[0] != 0xff || out[1] != 0xf8 {
+		t.Error(fmt.Sprintf("Expected: fff8\r\n Got: %x", out[:2]))
+	}
+	if encoder.frameNumber != 1 {
+		t.Error(fmt.Sprintf("Expected: %d\r\n Got: %d", 1, encoder.frameNumber))
+	}
+}
@@ -0,0 +1,224 @@
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nstehr/bobcaygeon/player"
+)
+
+const (
+	// the format of the pcm handed to us by the player
+	sampleRate = 44100
+	channels   = 2
+	bitDepth   = 16
+	// how many writes from the player we will hold for a listener before
+	// deciding they can't keep up.  Airplay packets are 352 frames, so this
+	// is roughly 2 seconds of audio
+	listenerBuffer = 256
+)
+
+// TrackProvider returns the track currently being played
+type TrackProvider interface {
+	GetTrack() player.Track
+}
+
+// HTTPStreamer serves the audio being played to any number of HTTP listeners,
+// either as a WAV or a FLAC stream
+type HTTPStreamer struct {
+	port      int
+	tracks    TrackProvider
+	mu        sync.Mutex
+	listeners map[*listener]struct{}
+	server    *http.Server
+}
+
+type listener struct {
+	audio chan []byte
+	// closed when we drop the listener
+	done chan struct{}
+}
+
+// NewHTTPStreamer instantiates a new HTTPStreamer
+func NewHTTPStreamer(port int, tracks TrackProvider) *HTTPStreamer {
+	return &HTTPStreamer{port: port, tracks: tracks, listeners: make(map[*listener]struct{})}
+}
+
+// Start starts serving the streams, blocking until the server is stopped
+func (hs *HTTPStreamer) Start() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stream.wav", hs.handleWav)
+	mux.HandleFunc("/stream.flac", hs.handleFlac)
+	mux.HandleFunc("/track", hs.handleTrack)
+	mux.HandleFunc("/artwork", hs.handleArtwork)
+	hs.mu.Lock()
+	hs.server = &http.Server{Addr: fmt.Sprintf(":%d", hs.port), Handler: mux}
+	server := hs.server
+	hs.mu.Unlock()
+	log.Printf("Starting HTTP audio stream on port: %d\n", hs.port)
+	err := server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Stop stops the server and drops all listeners
+func (hs *HTTPStreamer) Stop() {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	for l := range hs.listeners {
+		hs.dropListener(l)
+	}
+	if hs.server != nil {
+		hs.server.Close()
+	}
+}
+
+// WriteAudio hands the pcm to every listener.  We never block the player; if a
+// listener has fallen too far behind it gets disconnected
+func (hs *HTTPStreamer) WriteAudio(pcm []byte) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	if len(hs.listeners) == 0 {
+		return
+	}
+	data := make([]byte, len(pcm))
+	copy(data, pcm)
+	for l := range hs.listeners {
+		select {
+		case l.audio <- data:
+		default:
+			log.Println("HTTP stream listener can't keep up, dropping")
+			hs.dropListener(l)
+		}
+	}
+}
+
+func (hs *HTTPStreamer) addListener() *listener {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	l := &listener{audio: make(chan []byte, listenerBuffer), done: make(chan struct{})}
+	hs.listeners[l] = struct{}{}
+	return l
+}
+
+func (hs *HTTPStreamer) removeListener(l *listener) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	hs.dropListener(l)
+}
+
+// dropListener needs to be called with the lock held
+func (hs *HTTPStreamer) dropListener(l *listener) {
+	if _, ok := hs.listeners[l]; !ok {
+		return
+	}
+	delete(hs.listeners, l)
+	close(l.done)
+}
+
+func (hs *HTTPStreamer) handleWav(w http.ResponseWriter, r *http.Request) {
+	hs.stream(w, r, "audio/wav", func(player.Track) []byte { return wavHeader() }, func(pcm []byte) []byte { return pcm })
+}
+
+func (hs *HTTPStreamer) handleFlac(w http.ResponseWriter, r *http.Request) {
+	encoder := &flacEncoder{}
+	hs.stream(w, r, "audio/flac", encoder.header, encoder.encode)
+}
+
+// stream writes the header, then the encoded audio, to the listener until
+// they go away or get dropped.  Listeners asking for ICY metadata get the track
+// in the stream as it changes
+func (hs *HTTPStreamer) stream(w http.ResponseWriter, r *http.Request, contentType string, header func(player.Track) []byte, encode func([]byte) []byte) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	track := hs.tracks.GetTrack()
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	setTrackHeaders(w.Header(), track)
+	var out io.Writer = w
+	if r.Header.Get("Icy-MetaData") == "1" {
+		w.Header().Set("icy-metaint", strconv.Itoa(icyMetaInterval))
+		out = newIcyWriter(w, hs.tracks)
+	}
+	w.WriteHeader(http.StatusOK)
+
+	l := hs.addListener()
+	defer hs.removeListener(l)
+	log.Printf("HTTP stream listener connected: %s\n", r.RemoteAddr)
+
+	if _, err := out.Write(header(track)); err != nil {
+		return
+	}
+	flusher.Flush()
+	for {
+		select {
+		case pcm := <-l.audio:
+			data := encode(pcm)
+			if len(data) == 0 {
+				continue
+			}
+			if _, err := out.Write(data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-l.done:
+			return
+		case <-r.Context().Done():
+			log.Printf("HTTP stream listener disconnected: %s\n", r.RemoteAddr)
+			return
+		}
+	}
+}
+
+type trackResponse struct {
+	Artist string `json:"artist"`
+	Album  string `json:"album"`
+	Title  string `json:"title"`
+	// in milliseconds
+	Position int64 `json:"position"`
+	Duration int64 `json:"duration"`
+}
+
+func (hs *HTTPStreamer) handleTrack(w http.ResponseWriter, r *http.Request) {
+	track := hs.tracks.GetTrack()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(trackResponse{Artist: track.Artist, Album: track.Album, Title: track.Title,
+		Position: int64(track.Position / time.Millisecond), Duration: int64(track.Duration / time.Millisecond)})
+}
+
+func (hs *HTTPStreamer) handleArtwork(w http.ResponseWriter, r *http.Request) {
+	track := hs.tracks.GetTrack()
+	if len(track.Artwork) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	mimeType := track.ArtworkType
+	if mimeType == "" {
+		mimeType = http.DetectContentType(track.Artwork)
+	}
+	w.Header().Set("Content-Type", mimeType)
+	w.Write(track.Artwork)
+}
+
+func setTrackHeaders(h http.Header, track player.Track) {
+	if track.Artist != "" {
+		h.Set("X-Track-Artist", track.Artist)
+	}
+	if track.Album != "" {
+		h.Set("X-Track-Album", track.Album)
+	}
+	if track.Title != "" {
+		h.Set("X-Track-Title", track.Title)
+	}
+}
@@ -0,0 +1,182 @@
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nstehr/bobcaygeon/player"
+)
+
+type fakeTracks struct {
+	sync.Mutex
+	track player.Track
+}
+
+func (ft *fakeTracks) GetTrack() player.Track {
+	ft.Lock()
+	defer ft.Unlock()
+	return ft.track
+}
+
+func (ft *fakeTracks) set(track player.Track) {
+	ft.Lock()
+	defer ft.Unlock()
+	ft.track = track
+}
+
+func newTestServer(track player.Track) (*HTTPStreamer, *httptest.Server) {
+	hs := NewHTTPStreamer(0, &fakeTracks{track: track})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stream.wav", hs.handleWav)
+	mux.HandleFunc("/stream.flac", hs.handleFlac)
+	mux.HandleFunc("/track", hs.handleTrack)
+	return hs, httptest.NewServer(mux)
+}
+
+func waitForListeners(hs *HTTPStreamer, count int) bool {
+	for i := 0; i < 100; i++ {
+		hs.mu.Lock()
+		n := len(hs.listeners)
+		hs.mu.Unlock()
+		if n == count {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestWavStream(t *testing.T) {
+	hs, server := newTestServer(player.Track{Artist: "The Tragically Hip"})
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/stream.wav")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "audio/wav" {
+		t.Error(fmt.Sprintf("Expected: audio/wav\r\n Got: %s", resp.Header.Get("Content-Type")))
+	}
+	if resp.Header.Get("X-Track-Artist") != "The Tragically Hip" {
+		t.Error(fmt.Sprintf("Expected: The Tragically Hip\r\n Got: %s", resp.Header.Get("X-Track-Artist")))
+	}
+	header := make([]byte, 44)
+	if _, err := io.ReadFull(resp.Body, header); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if !bytes.Equal(header, wavHeader()) {
+		t.Error(fmt.Sprintf("Expected: %x\r\n Got: %x", wavHeader(), header))
+	}
+
+	if !waitForListeners(hs, 1) {
+		t.Fatal("Expected listener to be registered")
+	}
+	pcm := []byte{1, 2, 3, 4}
+	hs.WriteAudio(pcm)
+	data := make([]byte, len(pcm))
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if !bytes.Equal(data, pcm) {
+		t.Error(fmt.Sprintf("Expected: %v\r\n Got: %v", pcm, data))
+	}
+}
+
+func TestSlowListenerIsDropped(t *testing.T) {
+	hs := NewHTTPStreamer(0, &fakeTracks{})
+	l := hs.addListener()
+	for i := 0; i < listenerBuffer; i++ {
+		hs.WriteAudio([]byte{0})
+	}
+	select {
+	case <-l.done:
+		t.Fatal("Expected listener to still be connected")
+	default:
+	}
+	hs.WriteAudio([]byte{0})
+	select {
+	case <-l.done:
+	default:
+		t.Error("Expected listener to be dropped")
+	}
+	if len(hs.listeners) != 0 {
+		t.Error(fmt.Sprintf("Expected: %d listeners\r\n Got: %d", 0, len(hs.listeners)))
+	}
+}
+
+func TestTrack(t *testing.T) {
+	_, server := newTestServer(player.Track{Artist: "The Tragically Hip", Album: "Phantom Power", Title: "Bobcaygeon",
+		Position: 90 * time.Second, Duration: 205 * time.Second})
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/track")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer resp.Body.Close()
+	var track trackResponse
+	if err := json.NewDecoder(resp.Body).Decode(&track); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if track.Title != "Bobcaygeon" || track.Album != "Phantom Power" {
+		t.Error(fmt.Sprintf("Expected: Bobcaygeon, Phantom Power\r\n Got: %s, %s", track.Title, track.Album))
+	}
+	if track.Position != 90000 || track.Duration != 205000 {
+		t.Error(fmt.Sprintf("Expected: 90000/205000\r\n Got: %d/%d", track.Position, track.Duration))
+	}
+}
+
+// readIcyMetadata reads the audio up to the next metadata block, returning the block
+func readIcyMetadata(t *testing.T, r io.Reader, audio int) string {
+	if _, err := io.ReadFull(r, make([]byte, audio)); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(r, length); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	metadata := make([]byte, int(length[0])*16)
+	if _, err := io.ReadFull(r, metadata); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	return string(bytes.TrimRight(metadata, "\x00"))
+}
+
+func TestIcyMetadata(t *testing.T) {
+	hs, server := newTestServer(player.Track{Artist: "The Tragically Hip", Title: "Bobcaygeon"})
+	defer server.Close()
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/stream.wav", nil)
+	req.Header.Set("Icy-MetaData", "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("icy-metaint") != fmt.Sprint(icyMetaInterval) {
+		t.Error(fmt.Sprintf("Expected: %d\r\n Got: %s", icyMetaInterval, resp.Header.Get("icy-metaint")))
+	}
+	if !waitForListeners(hs, 1) {
+		t.Fatal("Expected listener to be registered")
+	}
+	// the wav header counts towards the first block of audio
+	hs.WriteAudio(make([]byte, icyMetaInterval-len(wavHeader())))
+	if metadata := readIcyMetadata(t, resp.Body, icyMetaInterval); metadata != "StreamTitle='The Tragically Hip - Bobcaygeon';" {
+		t.Error(fmt.Sprintf("Expected: StreamTitle='The Tragically Hip - Bobcaygeon';\r\n Got: %s", metadata))
+	}
+	// nothing is sent while the track stays the same
+	hs.WriteAudio(make([]byte, icyMetaInterval))
+	if metadata := readIcyMetadata(t, resp.Body, icyMetaInterval); metadata != "" {
+		t.Error(fmt.Sprintf("Expected no metadata\r\n Got: %s", metadata))
+	}
+	hs.tracks.(*fakeTracks).set(player.Track{Artist: "The Tragically Hip", Title: "Ahead by a Century"})
+	hs.WriteAudio(make([]byte, icyMetaInterval))
+	if metadata := readIcyMetadata(t, resp.Body, icyMetaInterval); metadata != "StreamTitle='The Tragically Hip - Ahead by a Century';" {
+		t.Error(fmt.Sprintf("Expected: StreamTitle='The Tragically Hip - Ahead by a Century';\r\n Got: %s", metadata))
+	}
+}
@@ -0,0 +1,87 @@
+package output
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/nstehr/bobcaygeon/player"
+)
+
+const (
+	// how many bytes of the stream go between ICY metadata blocks
+	icyMetaInterval = 16000
+	// the length of a metadata block is sent as a count of 16 byte blocks, in a byte
+	icyMaxMetadata = 255 * 16
+)
+
+// icyWriter interleaves ICY (SHOUTcast) metadata with the stream, for listeners that ask for it
+// with Icy-MetaData: 1, so they see the track change without having to reconnect
+type icyWriter struct {
+	w      io.Writer
+	tracks TrackProvider
+	// bytes of the stream written since the last metadata block
+	sinceMetadata int
+	// the title we last sent, it is only sent again when it changes
+	lastTitle string
+}
+
+func newIcyWriter(w io.Writer, tracks TrackProvider) *icyWriter {
+	return &icyWriter{w: w, tracks: tracks}
+}
+
+// Write writes the data, with a metadata block every icyMetaInterval bytes
+func (iw *icyWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		n := icyMetaInterval - iw.sinceMetadata
+		if n > len(data) {
+			n = len(data)
+		}
+		if _, err := iw.w.Write(data[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		iw.sinceMetadata += n
+		data = data[n:]
+		if iw.sinceMetadata == icyMetaInterval {
+			if _, err := iw.w.Write(iw.metadata()); err != nil {
+				return written, err
+			}
+			iw.sinceMetadata = 0
+		}
+	}
+	return written, nil
+}
+
+// metadata returns the next metadata block, which is empty unless the track has changed
+func (iw *icyWriter) metadata() []byte {
+	title := icyTitle(iw.tracks.GetTrack())
+	if title == iw.lastTitle {
+		return []byte{0}
+	}
+	iw.lastTitle = title
+	return icyMetadataBlock(title)
+}
+
+// icyTitle is what players show for the track, e.g: The Tragically Hip - Bobcaygeon
+func icyTitle(track player.Track) string {
+	if track.Artist == "" || track.Title == "" {
+		return track.Artist + track.Title
+	}
+	return track.Artist + " - " + track.Title
+}
+
+// icyMetadataBlock encodes the title as a metadata block: its length in 16 byte blocks, then
+// StreamTitle='<title>'; padded out with zeros
+func icyMetadataBlock(title string) []byte {
+	format := "StreamTitle='%s';"
+	if limit := icyMaxMetadata - len(format) + 2; len(title) > limit {
+		title = title[:limit]
+	}
+	metadata := fmt.Sprintf(format, title)
+	blocks := (len(metadata) + 15) / 16
+	block := make([]byte, 1+blocks*16)
+	block[0] = byte(blocks)
+	copy(block[1:], metadata)
+	return block
+}
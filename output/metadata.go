@@ -0,0 +1,226 @@
+package output
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/nstehr/bobcaygeon/raop"
+)
+
+const (
+	// how many metadata items we hold for a slow reader before dropping them
+	metadataBuffer = 64
+	// shairport-sync's default, and smallest, UDP packet size
+	defaultMetadataPacketSize = 500
+	// type, code, and for chunked items: ssnc chnk, the chunk number and count
+	metadataHeaderSize      = 8
+	metadataChunkHeaderSize = 24
+)
+
+// metadataQueue hands metadata items to a writer without holding up the airplay server,
+// dropping items when the writer can't keep up
+type metadataQueue struct {
+	includeArtwork bool
+	items          chan raop.MetadataItem
+	done           chan struct{}
+	stopOnce       sync.Once
+}
+
+func newMetadataQueue(includeArtwork bool) *metadataQueue {
+	return &metadataQueue{includeArtwork: includeArtwork, items: make(chan raop.MetadataItem, metadataBuffer), done: make(chan struct{})}
+}
+
+// WriteMetadata queues the item to be written
+func (mq *metadataQueue) WriteMetadata(item raop.MetadataItem) {
+	if item.IsArtwork() && !mq.includeArtwork {
+		return
+	}
+	select {
+	case mq.items <- item:
+	case <-mq.done:
+	default:
+		log.Printf("Metadata writer is falling behind, dropping: %s %s\n", item.Type, item.Code)
+	}
+}
+
+// run writes queued items until stopped
+func (mq *metadataQueue) run(write func(item raop.MetadataItem) error) {
+	for {
+		select {
+		case item := <-mq.items:
+			if err := write(item); err != nil {
+				log.Println("Error writing metadata: ", err)
+			}
+		case <-mq.done:
+			return
+		}
+	}
+}
+
+func (mq *metadataQueue) stop() {
+	mq.stopOnce.Do(func() { close(mq.done) })
+}
+
+// MetadataPipe writes metadata to a named pipe, in shairport-sync's XML format.  Items
+// are dropped while nothing is reading the pipe
+type MetadataPipe struct {
+	*metadataQueue
+	path string
+	mu   sync.Mutex
+	pipe *os.File
+}
+
+// NewMetadataPipe instantiates a new MetadataPipe
+func NewMetadataPipe(path string, includeArtwork bool) *MetadataPipe {
+	return &MetadataPipe{metadataQueue: newMetadataQueue(includeArtwork), path: path}
+}
+
+// Start creates the pipe (if it doesn't already exist) and starts writing to it
+func (mp *MetadataPipe) Start() error {
+	if _, err := os.Stat(mp.path); os.IsNotExist(err) {
+		log.Printf("Creating metadata pipe: %s\n", mp.path)
+		if err := syscall.Mkfifo(mp.path, 0666); err != nil {
+			return err
+		}
+	}
+	log.Printf("Writing metadata to pipe: %s\n", mp.path)
+	go mp.run(mp.write)
+	return nil
+}
+
+// Stop stops writing to the pipe
+func (mp *MetadataPipe) Stop() {
+	mp.stop()
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	if mp.pipe != nil {
+		mp.pipe.Close()
+		mp.pipe = nil
+	}
+}
+
+func (mp *MetadataPipe) write(item raop.MetadataItem) error {
+	mp.mu.Lock()
+	pipe := mp.pipe
+	mp.mu.Unlock()
+	if pipe == nil {
+		// opening without blocking fails while nothing is reading, rather than waiting for a reader
+		opened, err := os.OpenFile(mp.path, os.O_WRONLY|syscall.O_NONBLOCK, os.ModeNamedPipe)
+		if err != nil {
+			if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.ENXIO {
+				return nil
+			}
+			return err
+		}
+		mp.mu.Lock()
+		mp.pipe = opened
+		mp.mu.Unlock()
+		pipe = opened
+	}
+	if _, err := pipe.Write(encodeMetadataXML(item)); err != nil {
+		// the reader has gone away, we'll open the pipe again once there is a new one
+		mp.mu.Lock()
+		if mp.pipe == pipe {
+			mp.pipe = nil
+		}
+		mp.mu.Unlock()
+		pipe.Close()
+		if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.EPIPE {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// MetadataMulticast sends metadata over UDP, usually to a multicast group, in the packet
+// format shairport-sync uses
+type MetadataMulticast struct {
+	*metadataQueue
+	address       string
+	maxPacketSize int
+	conn          net.Conn
+}
+
+// NewMetadataMulticast instantiates a new MetadataMulticast, 0 for maxPacketSize uses shairport-sync's default
+func NewMetadataMulticast(address string, maxPacketSize int, includeArtwork bool) *MetadataMulticast {
+	if maxPacketSize == 0 {
+		maxPacketSize = defaultMetadataPacketSize
+	}
+	return &MetadataMulticast{metadataQueue: newMetadataQueue(includeArtwork), address: address, maxPacketSize: maxPacketSize}
+}
+
+// Start starts sending metadata to the address
+func (mm *MetadataMulticast) Start() error {
+	if mm.maxPacketSize <= metadataChunkHeaderSize {
+		return fmt.Errorf("Packet size must be more than %d bytes, got: %d", metadataChunkHeaderSize, mm.maxPacketSize)
+	}
+	conn, err := net.Dial("udp", mm.address)
+	if err != nil {
+		return err
+	}
+	mm.conn = conn
+	log.Printf("Sending metadata to: %s\n", mm.address)
+	go mm.run(mm.write)
+	return nil
+}
+
+// Stop stops sending metadata
+func (mm *MetadataMulticast) Stop() {
+	mm.stop()
+	if mm.conn != nil {
+		mm.conn.Close()
+	}
+}
+
+func (mm *MetadataMulticast) write(item raop.MetadataItem) error {
+	for _, packet := range encodeMetadataPackets(item, mm.maxPacketSize) {
+		if _, err := mm.conn.Write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeMetadataXML encodes the item the way shairport-sync writes it to its metadata pipe
+func encodeMetadataXML(item raop.MetadataItem) []byte {
+	encoded := fmt.Sprintf("<item><type>%s</type><code>%s</code><length>%d</length>",
+		hex.EncodeToString([]byte(item.Type)), hex.EncodeToString([]byte(item.Code)), len(item.Data))
+	if len(item.Data) > 0 {
+		encoded += fmt.Sprintf("\n<data encoding=\"base64\">\n%s</data>", base64.StdEncoding.EncodeToString(item.Data))
+	}
+	return []byte(encoded + "</item>\n")
+}
+
+// encodeMetadataPackets encodes the item the way shairport-sync sends it over UDP, the type
+// and code followed by the data.  Items too big for one packet are split into chunks, each
+// starting with ssnc chnk, the chunk number and the number of chunks, then the type and code
+func encodeMetadataPackets(item raop.MetadataItem, maxPacketSize int) [][]byte {
+	if metadataHeaderSize+len(item.Data) <= maxPacketSize {
+		packet := append([]byte(item.Type+item.Code), item.Data...)
+		return [][]byte{packet}
+	}
+	chunkSize := maxPacketSize - metadataChunkHeaderSize
+	count := (len(item.Data) + chunkSize - 1) / chunkSize
+	var packets [][]byte
+	for i := 0; i < count; i++ {
+		end := (i + 1) * chunkSize
+		if end > len(item.Data) {
+			end = len(item.Data)
+		}
+		packet := make([]byte, metadataChunkHeaderSize, metadataChunkHeaderSize+end-i*chunkSize)
+		copy(packet, "ssncchnk")
+		binary.BigEndian.PutUint32(packet[8:], uint32(i))
+		binary.BigEndian.PutUint32(packet[12:], uint32(count))
+		copy(packet[16:], item.Type+item.Code)
+		packets = append(packets, append(packet, item.Data[i*chunkSize:end]...))
+	}
+	return packets
+}
@@ -0,0 +1,134 @@
+package output
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nstehr/bobcaygeon/raop"
+)
+
+func TestEncodeMetadataXML(t *testing.T) {
+	item := raop.MetadataItem{Type: raop.MetadataCore, Code: "minm", Data: []byte("Bobcaygeon")}
+	expected := "<item><type>636f7265</type><code>6d696e6d</code><length>10</length>\n<data encoding=\"base64\">\nQm9iY2F5Z2Vvbg==</data></item>\n"
+	if got := string(encodeMetadataXML(item)); got != expected {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", expected, got))
+	}
+	item = raop.MetadataItem{Type: raop.MetadataShairport, Code: "pbeg"}
+	expected = "<item><type>73736e63</type><code>70626567</code><length>0</length></item>\n"
+	if got := string(encodeMetadataXML(item)); got != expected {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", expected, got))
+	}
+}
+
+func TestEncodeMetadataPacket(t *testing.T) {
+	item := raop.MetadataItem{Type: raop.MetadataShairport, Code: "pvol", Data: []byte("-15.00")}
+	packets := encodeMetadataPackets(item, defaultMetadataPacketSize)
+	if len(packets) != 1 {
+		t.Fatal(fmt.Sprintf("Expected: 1 packet\r\n Got: %d", len(packets)))
+	}
+	if string(packets[0]) != "ssncpvol-15.00" {
+		t.Error(fmt.Sprintf("Expected: ssncpvol-15.00\r\n Got: %s", packets[0]))
+	}
+}
+
+func TestEncodeMetadataChunks(t *testing.T) {
+	data := bytes.Repeat([]byte{1, 2, 3, 4, 5}, 250)
+	item := raop.MetadataItem{Type: raop.MetadataShairport, Code: "PICT", Data: data}
+	packets := encodeMetadataPackets(item, defaultMetadataPacketSize)
+	if len(packets) != 3 {
+		t.Fatal(fmt.Sprintf("Expected: 3 packets\r\n Got: %d", len(packets)))
+	}
+	var joined []byte
+	for i, packet := range packets {
+		if len(packet) > defaultMetadataPacketSize {
+			t.Error(fmt.Sprintf("Expected: at most %d bytes\r\n Got: %d", defaultMetadataPacketSize, len(packet)))
+		}
+		if string(packet[:8]) != "ssncchnk" || string(packet[16:24]) != "ssncPICT" {
+			t.Error(fmt.Sprintf("Expected: ssncchnk...ssncPICT\r\n Got: %q", packet[:24]))
+		}
+		if n := binary.BigEndian.Uint32(packet[8:12]); n != uint32(i) {
+			t.Error(fmt.Sprintf("Expected: chunk %d\r\n Got: %d", i, n))
+		}
+		if n := binary.BigEndian.Uint32(packet[12:16]); n != 3 {
+			t.Error(fmt.Sprintf("Expected: 3 chunks\r\n Got: %d", n))
+		}
+		joined = append(joined, packet[24:]...)
+	}
+	if !bytes.Equal(joined, data) {
+		t.Error("Expected chunks to join back into the artwork")
+	}
+}
+
+func TestMetadataPipe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metadata")
+	mp := NewMetadataPipe(path, false)
+	if err := mp.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Stop()
+	// nothing is reading yet, so this is dropped
+	mp.WriteMetadata(raop.MetadataItem{Type: raop.MetadataShairport, Code: "pbeg"})
+	time.Sleep(50 * time.Millisecond)
+
+	reader, err := os.OpenFile(path, os.O_RDWR, os.ModeNamedPipe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	mp.WriteMetadata(raop.MetadataItem{Type: raop.MetadataShairport, Code: "PICT", Data: []byte{1}})
+	mp.WriteMetadata(raop.MetadataItem{Type: raop.MetadataShairport, Code: "pend"})
+	reader.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := bufio.NewReader(reader).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the artwork is left out
+	expected := "<item><type>73736e63</type><code>70656e64</code><length>0</length></item>\n"
+	if line != expected {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", expected, line))
+	}
+}
+
+func TestMetadataMulticast(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	mm := NewMetadataMulticast(listener.LocalAddr().String(), 0, true)
+	if err := mm.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mm.Stop()
+	mm.WriteMetadata(raop.MetadataItem{Type: raop.MetadataCore, Code: "minm", Data: []byte("Bobcaygeon")})
+	listener.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1024)
+	n, _, err := listener.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "coreminmBobcaygeon" {
+		t.Error(fmt.Sprintf("Expected: coreminmBobcaygeon\r\n Got: %s", buf[:n]))
+	}
+}
+
+func TestMetadataMulticastPacketSize(t *testing.T) {
+	mm := NewMetadataMulticast("127.0.0.1:5555", 20, true)
+	if err := mm.Start(); err == nil {
+		mm.Stop()
+		t.Error("Expected an error for a packet size too small for the chunk header")
+	}
+}
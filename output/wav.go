@@ -0,0 +1,28 @@
+package output
+
+import "encoding/binary"
+
+// streamed wav files don't know how long they are, so the lengths are set to
+// the max value, which players treat as "keep reading until the end"
+const wavUnknownLength = 0xffffffff
+
+// wavHeader returns a RIFF/WAVE header for 16 bit stereo 44.1kHz PCM
+func wavHeader() []byte {
+	buf := make([]byte, 44)
+	copy(buf[0:], "RIFF")
+	binary.LittleEndian.PutUint32(buf[4:], wavUnknownLength)
+	copy(buf[8:], "WAVE")
+	copy(buf[12:], "fmt ")
+	binary.LittleEndian.PutUint32(buf[16:], 16)
+	// 1 is plain PCM
+	binary.LittleEndian.PutUint16(buf[20:], 1)
+	binary.LittleEndian.PutUint16(buf[22:], channels)
+	binary.LittleEndian.PutUint32(buf[24:], sampleRate)
+	blockAlign := channels * bitDepth / 8
+	binary.LittleEndian.PutUint32(buf[28:], uint32(sampleRate*blockAlign))
+	binary.LittleEndian.PutUint16(buf[32:], uint16(blockAlign))
+	binary.LittleEndian.PutUint16(buf[34:], bitDepth)
+	copy(buf[36:], "data")
+	binary.LittleEndian.PutUint32(buf[40:], wavUnknownLength)
+	return buf
+}
@@ -0,0 +1,80 @@
+package player
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	// gif and png artwork can be decoded too
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+)
+
+// the most pixels artwork can have for us to scale it down, decoding needs a few bytes for each one
+const maxArtworkPixels = 40000000
+
+// Thumbnail scales the artwork down to fit in a square size pixels across, as a jpeg.  Artwork
+// that already fits is returned as is
+func Thumbnail(artwork []byte, mimeType string, size int) ([]byte, string, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(artwork))
+	if err != nil {
+		return nil, "", err
+	}
+	if config.Width <= size && config.Height <= size {
+		return artwork, mimeType, nil
+	}
+	if int64(config.Width)*int64(config.Height) > maxArtworkPixels {
+		return nil, "", fmt.Errorf("Artwork is too big to scale down: %dx%d", config.Width, config.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(artwork))
+	if err != nil {
+		return nil, "", err
+	}
+	// keep the aspect ratio
+	width, height := size, size
+	if config.Width > config.Height {
+		height = config.Height * size / config.Width
+	} else {
+		width = config.Width * size / config.Height
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, scaleDown(img, width, height), &jpeg.Options{Quality: 85}); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), "image/jpeg", nil
+}
+
+// scaleDown scales the image down, each pixel of the result is the average of
+// the pixels it covers in the original
+func scaleDown(img image.Image, width int, height int) image.Image {
+	bounds := img.Bounds()
+	scaled := image.NewRGBA64(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := bounds.Min.Y + (y+1)*bounds.Dy()/height
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := bounds.Min.X + (x+1)*bounds.Dx()/width
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := img.At(sx, sy).RGBA()
+					r += uint64(pr)
+					g += uint64(pg)
+					b += uint64(pb)
+					a += uint64(pa)
+					n++
+				}
+			}
+			scaled.SetRGBA64(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: uint16(a / n)})
+		}
+	}
+	return scaled
+}
@@ -0,0 +1,48 @@
+package player
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"testing"
+)
+
+func encodePNG(t *testing.T, width int, height int) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestThumbnail(t *testing.T) {
+	artwork, mimeType, err := Thumbnail(encodePNG(t, 400, 200), "image/png", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mimeType != "image/jpeg" {
+		t.Error(fmt.Sprintf("Expected: image/jpeg\r\n Got: %s", mimeType))
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(artwork))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Width != 100 || config.Height != 50 {
+		t.Error(fmt.Sprintf("Expected: 100x50\r\n Got: %dx%d", config.Width, config.Height))
+	}
+}
+
+func TestThumbnailTooBig(t *testing.T) {
+	// a small file can claim to be a huge image, rewrite the size in the IHDR chunk
+	artwork := encodePNG(t, 1, 1)
+	ihdr := artwork[8:]
+	binary.BigEndian.PutUint32(ihdr[8:], 30000)
+	binary.BigEndian.PutUint32(ihdr[12:], 30000)
+	binary.BigEndian.PutUint32(ihdr[21:], crc32.ChecksumIEEE(ihdr[4:21]))
+	if _, _, err := Thumbnail(artwork, "image/png", 100); err == nil {
+		t.Error("Expected huge artwork to be rejected")
+	}
+}
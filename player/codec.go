@@ -1,6 +1,7 @@
 package player
 
 import (
+	"encoding/binary"
 	"strings"
 
 	"github.com/maghul/alac"
@@ -13,6 +14,9 @@ type CodecHandler func(data []byte) ([]byte, error)
 var codecMap = map[string]CodecHandler{
 	"AppleLossless": decodeAlac}
 
+// AlacFramesPerPacket is the number of frames airplay senders pack into a single ALAC packet
+const AlacFramesPerPacket = 352
+
 func decodeAlac(data []byte) ([]byte, error) {
 	decoder, err := alac.New()
 	if err != nil {
@@ -32,3 +36,51 @@ func GetCodec(session *rtsp.Session) CodecHandler {
 	}
 	return decoder
 }
+
+// EncodeAlac wraps 16 bit little endian stereo PCM in an uncompressed ALAC frame.
+// This is the same trick airplay senders use when they don't want to spend the
+// CPU compressing; it lets us feed PCM to anything that expects ALAC packets.
+// The pcm passed in should hold at most AlacFramesPerPacket frames
+func EncodeAlac(pcm []byte) []byte {
+	frames := len(pcm) / 4
+	// header is 55 bits, each frame is 32 bits and the end tag is 3 bits
+	w := &bitWriter{buf: make([]byte, 0, 8+frames*4+1)}
+	// channel tag: 1 is a channel pair element (stereo)
+	w.write(1, 3)
+	// unused
+	w.write(0, 4)
+	w.write(0, 12)
+	// has size
+	w.write(1, 1)
+	// uncompressed bytes
+	w.write(0, 2)
+	// is not compressed
+	w.write(1, 1)
+	w.write(uint32(frames), 32)
+	for i := 0; i < frames; i++ {
+		left := binary.LittleEndian.Uint16(pcm[i*4:])
+		right := binary.LittleEndian.Uint16(pcm[i*4+2:])
+		w.write(uint32(left), 16)
+		w.write(uint32(right), 16)
+	}
+	// end tag
+	w.write(7, 3)
+	return w.buf
+}
+
+// bitWriter writes big endian bit fields into a byte slice
+type bitWriter struct {
+	buf  []byte
+	used uint
+}
+
+func (w *bitWriter) write(value uint32, bits uint) {
+	for i := int(bits) - 1; i >= 0; i-- {
+		if w.used == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		bit := byte((value >> uint(i)) & 1)
+		w.buf[len(w.buf)-1] |= bit << (7 - w.used)
+		w.used = (w.used + 1) % 8
+	}
+}
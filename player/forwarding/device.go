@@ -0,0 +1,133 @@
+package forwarding
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/hajimehoshi/oto"
+)
+
+const (
+	// size, in bytes, of the buffer used by the audio device
+	otoBufferSize = 10000
+	// how long to wait before trying to open the device again after it failed to open
+	reopenInterval = 5 * time.Second
+)
+
+// sink is what the audio is played on, an oto player outside of tests
+type sink interface {
+	Write(pcm []byte) (int, error)
+	Close() error
+}
+
+func openOto() (sink, error) {
+	ap, err := oto.NewPlayer(44100, 2, 2, otoBufferSize)
+	if err != nil {
+		return nil, err
+	}
+	return ap, nil
+}
+
+// audioDevice wraps the oto player so that the audio device is only held on to
+// while there is something to play.  It is opened when a stream starts, closed
+// once there have been no streams for the idle timeout, and reopened if writing
+// to it fails (say, a USB DAC being unplugged and plugged back in)
+type audioDevice struct {
+	mu              sync.Mutex
+	ap              sink
+	openSink        func() (sink, error)
+	streams         int
+	idleTimeout     time.Duration
+	idleTimer       *time.Timer
+	lastOpenFailure time.Time
+}
+
+func newAudioDevice(idleTimeout time.Duration) *audioDevice {
+	return &audioDevice{idleTimeout: idleTimeout, openSink: openOto}
+}
+
+// startStream marks a stream as active, opening the device if needed
+func (d *audioDevice) startStream() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.streams++
+	if d.idleTimer != nil {
+		d.idleTimer.Stop()
+		d.idleTimer = nil
+	}
+	d.open()
+}
+
+// endStream marks a stream as finished.  Once there are no streams left, the
+// device is closed after the idle timeout; a timeout of 0 keeps it open
+func (d *audioDevice) endStream() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.streams--
+	if d.streams > 0 || d.idleTimeout <= 0 {
+		return
+	}
+	d.idleTimer = time.AfterFunc(d.idleTimeout, d.closeIfIdle)
+}
+
+func (d *audioDevice) closeIfIdle() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.streams > 0 || d.ap == nil {
+		return
+	}
+	log.Println("Audio device idle, closing")
+	d.close()
+}
+
+// write plays the pcm, dropping it if the device isn't available
+func (d *audioDevice) write(pcm []byte) {
+	d.mu.Lock()
+	if !d.open() {
+		d.mu.Unlock()
+		return
+	}
+	ap := d.ap
+	d.mu.Unlock()
+	// writing blocks until the device has room, so we don't hold the lock for it
+	if _, err := ap.Write(pcm); err != nil {
+		log.Println("Error writing to audio device, will reopen: ", err)
+		d.mu.Lock()
+		if d.ap == ap {
+			d.close()
+		}
+		d.mu.Unlock()
+	}
+}
+
+// open needs to be called with the lock held, it returns whether or not the device is open
+func (d *audioDevice) open() bool {
+	if d.ap != nil {
+		return true
+	}
+	// don't hammer a device that isn't there
+	if time.Since(d.lastOpenFailure) < reopenInterval {
+		return false
+	}
+	ap, err := d.openSink()
+	if err != nil {
+		log.Println("Error opening audio device: ", err)
+		d.lastOpenFailure = time.Now()
+		return false
+	}
+	log.Println("Audio device opened")
+	d.ap = ap
+	return true
+}
+
+// close needs to be called with the lock held
+func (d *audioDevice) close() {
+	if d.ap == nil {
+		return
+	}
+	if err := d.ap.Close(); err != nil {
+		log.Println("Error closing audio device: ", err)
+	}
+	d.ap = nil
+}
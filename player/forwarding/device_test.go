@@ -0,0 +1,145 @@
+package forwarding
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSink stands in for the audio device, failing writes once broken
+type fakeSink struct {
+	sync.Mutex
+	written int
+	closed  bool
+	broken  bool
+}
+
+func (fs *fakeSink) Write(pcm []byte) (int, error) {
+	fs.Lock()
+	defer fs.Unlock()
+	if fs.broken {
+		return 0, errors.New("Device unplugged")
+	}
+	fs.written += len(pcm)
+	return len(pcm), nil
+}
+
+func (fs *fakeSink) Close() error {
+	fs.Lock()
+	defer fs.Unlock()
+	fs.closed = true
+	return nil
+}
+
+func (fs *fakeSink) isClosed() bool {
+	fs.Lock()
+	defer fs.Unlock()
+	return fs.closed
+}
+
+// fakeOpener hands out a new fakeSink each time the device is opened, unless told to fail
+type fakeOpener struct {
+	sync.Mutex
+	sinks []*fakeSink
+	fail  bool
+	opens int
+}
+
+func (fo *fakeOpener) open() (sink, error) {
+	fo.Lock()
+	defer fo.Unlock()
+	fo.opens++
+	if fo.fail {
+		return nil, errors.New("No device")
+	}
+	s := &fakeSink{}
+	fo.sinks = append(fo.sinks, s)
+	return s, nil
+}
+
+func (fo *fakeOpener) opened() (int, *fakeSink) {
+	fo.Lock()
+	defer fo.Unlock()
+	if len(fo.sinks) == 0 {
+		return fo.opens, nil
+	}
+	return fo.opens, fo.sinks[len(fo.sinks)-1]
+}
+
+func newTestDevice(idleTimeout time.Duration) (*audioDevice, *fakeOpener) {
+	fo := &fakeOpener{}
+	d := newAudioDevice(idleTimeout)
+	d.openSink = fo.open
+	return d, fo
+}
+
+func TestDeviceClosesWhenIdle(t *testing.T) {
+	d, fo := newTestDevice(20 * time.Millisecond)
+	d.startStream()
+	_, s := fo.opened()
+	if s == nil {
+		t.Fatal("Expected the device to be opened when a stream starts")
+	}
+	d.endStream()
+	// a stream starting before the timeout keeps it open
+	d.startStream()
+	time.Sleep(50 * time.Millisecond)
+	if s.isClosed() {
+		t.Error("Expected the device to stay open while streaming")
+	}
+	d.endStream()
+	time.Sleep(50 * time.Millisecond)
+	if !s.isClosed() {
+		t.Error("Expected the device to be closed once idle")
+	}
+	// and it is opened again for the next stream
+	d.startStream()
+	defer d.endStream()
+	if opens, _ := fo.opened(); opens != 2 {
+		t.Error(fmt.Sprintf("Expected: 2 opens\r\n Got: %d", opens))
+	}
+}
+
+func TestDeviceReopensAfterWriteError(t *testing.T) {
+	d, fo := newTestDevice(0)
+	d.write([]byte{1, 2, 3, 4})
+	_, first := fo.opened()
+	first.Lock()
+	first.broken = true
+	first.Unlock()
+	d.write([]byte{1, 2, 3, 4})
+	if !first.isClosed() {
+		t.Error("Expected the device to be closed after failing to write")
+	}
+	d.write([]byte{1, 2, 3, 4})
+	opens, second := fo.opened()
+	if opens != 2 || second == first {
+		t.Fatal(fmt.Sprintf("Expected: 2 opens\r\n Got: %d", opens))
+	}
+	if second.written != 4 {
+		t.Error(fmt.Sprintf("Expected: 4 bytes written\r\n Got: %d", second.written))
+	}
+}
+
+func TestDeviceBacksOffOpening(t *testing.T) {
+	d, fo := newTestDevice(0)
+	fo.fail = true
+	d.write([]byte{1, 2, 3, 4})
+	d.write([]byte{1, 2, 3, 4})
+	if opens, _ := fo.opened(); opens != 1 {
+		t.Error(fmt.Sprintf("Expected: 1 open\r\n Got: %d", opens))
+	}
+	// the device shows up, and we have waited long enough to try again
+	fo.Lock()
+	fo.fail = false
+	fo.Unlock()
+	d.mu.Lock()
+	d.lastOpenFailure = time.Now().Add(-reopenInterval)
+	d.mu.Unlock()
+	d.write([]byte{1, 2, 3, 4})
+	if opens, s := fo.opened(); opens != 2 || s == nil {
+		t.Error(fmt.Sprintf("Expected: 2 opens\r\n Got: %d", opens))
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/hajimehoshi/oto"
 	"github.com/hashicorp/memberlist"
 	"github.com/nstehr/bobcaygeon/cluster"
 	"github.com/nstehr/bobcaygeon/player"
@@ -23,8 +22,26 @@ type Player struct {
 	volume       float64
 	isMuted      bool
 	sessions     *sessionMap
-	ap           *oto.Player
+	device       *audioDevice
 	currentTrack player.Track
+	outputLock   sync.RWMutex
+	outputs      []player.Output
+	latency      player.Latency
+	// when the sender last told us the track's progress, or started or stopped playing
+	progressAt time.Time
+	// if the sender is playing, the track's position only moves on while it is
+	playing bool
+	// thumbnails of the artwork, by size
+	thumbnails map[int]thumbnail
+	// bumped each time the artwork changes, so a thumbnail of the old artwork isn't cached
+	artworkVersion int
+	// connections for sending control requests (volume, track info) to the nodes
+	clients *rtsp.ClientPool
+	// whether we play the audio ourselves, or only forward it
+	localPlayback bool
+	forwardLock   sync.RWMutex
+	// the nodes we forward to when they join, nil for every node
+	forwardTo []string
 }
 
 // represents what a client calling an RTSP
@@ -73,6 +90,12 @@ func (sm *sessionMap) sessionExists(name string) bool {
 	return present
 }
 
+func (sm *sessionMap) getSession(name string) *clientSession {
+	sm.RLock()
+	defer sm.RUnlock()
+	return sm.sessions[name]
+}
+
 func (sm *sessionMap) getSessions() []*clientSession {
 	sm.RLock()
 	defer sm.RUnlock()
@@ -84,19 +107,57 @@ func (sm *sessionMap) getSessions() []*clientSession {
 	return sessions
 }
 
-// NewPlayer instantiates a new Player
-func NewPlayer() (*Player, error) {
-	ap, err := oto.NewPlayer(44100, 2, 2, 10000)
-	if err != nil {
-		return nil, err
+// NewPlayer instantiates a new Player.  If the sink latency isn't
+// set, it is worked out from the size of the audio device buffer.  The
+// audio device isn't opened until there is something to play, and is
+// released once nothing has been played for the idle timeout
+func NewPlayer(latency player.Latency, idleTimeout time.Duration) (*Player, error) {
+	if idleTimeout < 0 {
+		return nil, fmt.Errorf("Idle timeout must not be negative, got: %s", idleTimeout)
+	}
+	if latency.Sink == 0 {
+		// 2 channels of 2 bytes each per frame
+		latency.Sink = player.FramesToDuration(otoBufferSize / 4)
+	}
+	return &Player{sessions: newSessionMap(), clients: rtsp.NewClientPool(), volume: 1, device: newAudioDevice(idleTimeout), isMuted: false, latency: latency, localPlayback: true}, nil
+}
+
+// SetLocalPlayback sets whether the player plays the audio on this node's audio device, or only
+// forwards it to other nodes.  It must be set before anything is played
+func (p *Player) SetLocalPlayback(localPlayback bool) {
+	p.localPlayback = localPlayback
+}
+
+// SetForwardTo limits the nodes we start forwarding to when they join the cluster to the ones
+// named, nil forwards to every node that joins.  Nodes can still be added with AddSessionForNode
+func (p *Player) SetForwardTo(names []string) {
+	p.forwardLock.Lock()
+	defer p.forwardLock.Unlock()
+	p.forwardTo = names
+}
+
+// forwardsTo returns whether we forward to the node when it joins
+func (p *Player) forwardsTo(name string) bool {
+	p.forwardLock.RLock()
+	defer p.forwardLock.RUnlock()
+	if p.forwardTo == nil {
+		return true
 	}
-	return &Player{sessions: newSessionMap(), volume: 1, ap: ap, isMuted: false}, nil
+	for _, n := range p.forwardTo {
+		if n == name {
+			return true
+		}
+	}
+	return false
 }
 
 // NotifyJoin is invoked when a node is detected to have joined.
 // The Node argument must not be modified.
 func (p *Player) NotifyJoin(node *memberlist.Node) {
 	log.Println("Node Joined " + node.Name)
+	if !p.forwardsTo(node.Name) {
+		return
+	}
 	p.AddSessionForNode(node)
 
 }
@@ -133,6 +194,9 @@ func (p *Player) RemoveSessionForNode(node *memberlist.Node) {
 	// next connection to node will do that, so it should be ok
 	// for now
 	if meta.NodeType == cluster.Music {
+		if s := p.sessions.getSession(node.Name); s != nil {
+			p.clients.Remove(s.RemotePorts.Address, s.rtspPort)
+		}
 		p.sessions.removeSession(node.Name)
 	}
 }
@@ -141,6 +205,7 @@ func (p *Player) RemoveSessionForNode(node *memberlist.Node) {
 func (p *Player) RemoveAllSessions() {
 	log.Println("Removing all forwarding sessions")
 	p.sessions.removeAll()
+	p.clients.Close()
 }
 
 // SetVolume accepts a float between 0 (mute) and 1 (full volume)
@@ -153,7 +218,7 @@ func (p *Player) SetVolume(volume float64) {
 	// forward the volume settings
 	go func() {
 		for _, s := range p.sessions.getSessions() {
-			client, err := rtsp.NewClient(s.RemotePorts.Address, s.rtspPort)
+			client, err := p.clients.Get(s.RemotePorts.Address, s.rtspPort)
 			if err != nil {
 				log.Println("Error establishing RTSP connection", err)
 				continue
@@ -163,14 +228,39 @@ func (p *Player) SetVolume(volume float64) {
 			sessionID := strconv.FormatInt(time.Now().Unix(), 10)
 			localAddress := client.LocalAddress()
 			req.RequestURI = fmt.Sprintf("rtsp://%s/%s", localAddress, sessionID)
-			req.Headers["Content-Type"] = "text/parameters"
+			req.Headers.Set("Content-Type", "text/parameters")
 			body := fmt.Sprintf("volume: %f", prepareVolume(volume))
 			req.Body = []byte(body)
-			client.Send(req)
+			sendControl(client, req)
 		}
 	}()
 }
 
+// GetVolume returns the volume, between 0 (mute) and 1 (full volume)
+func (p *Player) GetVolume() float64 {
+	p.volLock.RLock()
+	defer p.volLock.RUnlock()
+	return p.volume
+}
+
+// GetVolumeForNode asks the node we are forwarding to for its volume, between 0 (mute) and 1 (full volume)
+func (p *Player) GetVolumeForNode(nodeName string) (float64, error) {
+	s := p.sessions.getSession(nodeName)
+	if s == nil {
+		return 0, fmt.Errorf("Not forwarding to node: %s", nodeName)
+	}
+	return raop.GetVolume(p.clients, s.RemotePorts.Address, s.rtspPort)
+}
+
+// GetProgressForNode asks the node we are forwarding to how far into the track it is, and how long the track is
+func (p *Player) GetProgressForNode(nodeName string) (time.Duration, time.Duration, error) {
+	s := p.sessions.getSession(nodeName)
+	if s == nil {
+		return 0, 0, fmt.Errorf("Not forwarding to node: %s", nodeName)
+	}
+	return raop.GetProgress(p.clients, s.RemotePorts.Address, s.rtspPort)
+}
+
 // SetMute will mute or unmute the player, mute overrides any volume settings
 func (p *Player) SetMute(isMuted bool) {
 	p.volLock.Lock()
@@ -191,50 +281,126 @@ func (p *Player) Play(session *rtsp.Session) {
 	decoder := player.GetCodec(session)
 
 	go func(dc player.CodecHandler) {
+		if p.localPlayback {
+			p.device.startStream()
+			defer p.device.endStream()
+		}
+		// we hold on to the first packets until enough audio is buffered
+		// to cover the latency we are playing with
+		var pending [][]byte
+		primed := false
 		for d := range session.DataChan {
-			p.volLock.RLock()
-			vol := p.volume
-			isMuted := p.isMuted
-			p.volLock.RUnlock()
-			func() {
-				defer func() {
-					if err := recover(); err != nil {
-						fmt.Println(err)
-					}
-				}()
-				// will play the audio, if player isn't muted
-				if !isMuted {
-					decoded, err := dc(d)
-					if err != nil {
-						log.Println("Problem decoding packet")
-					}
-					p.ap.Write(player.AdjustAudio(decoded, vol))
+			// will forward the audio to other clients
+			go func(pkt []byte) {
+				sessions := p.sessions.getSessions()
+				for _, s := range sessions {
+					s.DataChan <- pkt
 				}
-				// will forward the audio to other clients
-				go func(pkt []byte) {
-					sessions := p.sessions.getSessions()
-					for _, s := range sessions {
-						s.DataChan <- pkt
-					}
-				}(d)
-			}()
+			}(d)
+			if primed {
+				p.playPacket(dc, d)
+				continue
+			}
+			pending = append(pending, d)
+			if !p.isPrimed(session, len(pending)) {
+				continue
+			}
+			primed = true
+			for _, pkt := range pending {
+				p.playPacket(dc, pkt)
+			}
+			pending = nil
+		}
+		// the stream may have ended before the buffer filled up
+		for _, pkt := range pending {
+			p.playPacket(dc, pkt)
 		}
 		log.Println("Session data sending closed")
 	}(decoder)
 
 }
 
-// SetTrack sets the track for the player
-func (p *Player) SetTrack(album string, artist string, title string) {
+// isPrimed returns whether or not the given number of buffered packets is
+// enough to start playing the session
+func (p *Player) isPrimed(session *rtsp.Session, buffered int) bool {
+	latency := p.GetLatency()
+	target := latency.Buffer + latency.Forwarding
+	// if the sender wants more latency than we add on our own, buffer
+	// more to make up the difference
+	requested := player.FramesToDuration(session.RequestedLatency())
+	if requested-latency.Sink > target {
+		target = requested - latency.Sink
+	}
+	return player.FramesToDuration(uint32(buffered*player.AlacFramesPerPacket)) >= target
+}
+
+func (p *Player) playPacket(dc player.CodecHandler, d []byte) {
+	p.volLock.RLock()
+	vol := p.volume
+	// if we aren't playing it ourselves, it may as well be muted
+	isMuted := p.isMuted || !p.localPlayback
+	p.volLock.RUnlock()
+	defer func() {
+		if err := recover(); err != nil {
+			fmt.Println(err)
+		}
+	}()
+	outputs := p.getOutputs()
+	// will play the audio, if player isn't muted, and hand it
+	// to any outputs regardless
+	if !isMuted || len(outputs) > 0 {
+		decoded, err := dc(d)
+		if err != nil {
+			log.Println("Problem decoding packet")
+		}
+		if !isMuted {
+			p.device.write(player.AdjustAudio(decoded, vol))
+		}
+		for _, o := range outputs {
+			o.WriteAudio(decoded)
+		}
+	}
+}
+
+// GetLatency returns the latency the player adds.  The forwarding delay
+// only applies when there are other nodes in the zone
+func (p *Player) GetLatency() player.Latency {
+	latency := p.latency
+	if len(p.sessions.getSessions()) == 0 {
+		latency.Forwarding = 0
+	}
+	return latency
+}
+
+// AddOutput registers an output that will receive the decoded audio being played
+func (p *Player) AddOutput(o player.Output) {
+	p.outputLock.Lock()
+	defer p.outputLock.Unlock()
+	p.outputs = append(p.outputs, o)
+}
+
+func (p *Player) getOutputs() []player.Output {
+	p.outputLock.RLock()
+	defer p.outputLock.RUnlock()
+	return p.outputs
+}
+
+// SetTrack sets the track for the player, the artwork and progress are kept as they're
+// set separately
+func (p *Player) SetTrack(track player.Track) {
 	p.trackLock.Lock()
 	defer p.trackLock.Unlock()
-	p.currentTrack.Album = album
-	p.currentTrack.Artist = artist
-	p.currentTrack.Title = title
+	track.Artwork = p.currentTrack.Artwork
+	track.ArtworkType = p.currentTrack.ArtworkType
+	track.Position = p.currentTrack.Position
+	if track.Duration == 0 {
+		track.Duration = p.currentTrack.Duration
+	}
+	p.currentTrack = track
 	// forward the track data downstream
 	go func() {
 		for _, s := range p.sessions.getSessions() {
-			client, err := rtsp.NewClient(s.RemotePorts.Address, s.rtspPort)
+			client, err := p.clients.Get(s.RemotePorts.Address, s.rtspPort)
 			if err != nil {
 				log.Println("Error establishing RTSP connection", err)
 				continue
@@ -244,32 +410,30 @@ func (p *Player) SetTrack(album string, artist string, title string) {
 			sessionID := strconv.FormatInt(time.Now().Unix(), 10)
 			localAddress := client.LocalAddress()
 			req.RequestURI = fmt.Sprintf("rtsp://%s/%s", localAddress, sessionID)
-			req.Headers["Content-Type"] = "application/x-dmap-tagged"
-			input := make(map[string]interface{})
-
-			input["daap.songalbum"] = album
-			input["dmap.itemname"] = title
-			input["daap.songartist"] = artist
-			body, err := raop.EncodeDaap(input)
+			req.Headers.Set("Content-Type", "application/x-dmap-tagged")
+			body, err := raop.EncodeTrack(track)
 			if err != nil {
 				log.Println("Error encoding song information", err)
 				continue
 			}
 			req.Body = body
-			client.Send(req)
+			sendControl(client, req)
 		}
 	}()
 }
 
-// SetAlbumArt sets the album art for the player
-func (p *Player) SetAlbumArt(artwork []byte) {
+// SetAlbumArt sets the album art for the player, no artwork clears it
+func (p *Player) SetAlbumArt(artwork []byte, mimeType string) {
 	p.trackLock.Lock()
 	defer p.trackLock.Unlock()
 	p.currentTrack.Artwork = artwork
+	p.currentTrack.ArtworkType = mimeType
+	p.thumbnails = make(map[int]thumbnail)
+	p.artworkVersion++
 	// forward the album art downstream
 	go func() {
 		for _, s := range p.sessions.getSessions() {
-			client, err := rtsp.NewClient(s.RemotePorts.Address, s.rtspPort)
+			client, err := p.clients.Get(s.RemotePorts.Address, s.rtspPort)
 			if err != nil {
 				log.Println("Error establishing RTSP connection", err)
 				continue
@@ -279,19 +443,114 @@ func (p *Player) SetAlbumArt(artwork []byte) {
 			sessionID := strconv.FormatInt(time.Now().Unix(), 10)
 			localAddress := client.LocalAddress()
 			req.RequestURI = fmt.Sprintf("rtsp://%s/%s", localAddress, sessionID)
-			req.Headers["Content-Type"] = "image/jpeg"
-
+			if len(artwork) == 0 {
+				req.Headers.Set("Content-Type", "image/none")
+			} else {
+				req.Headers.Set("Content-Type", mimeType)
+			}
 			req.Body = artwork
-			client.Send(req)
+			sendControl(client, req)
+		}
+	}()
+}
+
+// SetProgress sets how far into the track we are, and how long it is
+func (p *Player) SetProgress(position time.Duration, duration time.Duration) {
+	p.trackLock.Lock()
+	defer p.trackLock.Unlock()
+	p.currentTrack.Position = position
+	p.currentTrack.Duration = duration
+	p.progressAt = time.Now()
+	// forward the progress downstream
+	go func() {
+		for _, s := range p.sessions.getSessions() {
+			client, err := p.clients.Get(s.RemotePorts.Address, s.rtspPort)
+			if err != nil {
+				log.Println("Error establishing RTSP connection", err)
+				continue
+			}
+			req := rtsp.NewRequest()
+			req.Method = rtsp.Set_Parameter
+			sessionID := strconv.FormatInt(time.Now().Unix(), 10)
+			localAddress := client.LocalAddress()
+			req.RequestURI = fmt.Sprintf("rtsp://%s/%s", localAddress, sessionID)
+			req.Headers.Set("Content-Type", "text/parameters")
+			req.Body = []byte(fmt.Sprintf("progress: %s\r\n", raop.FormatProgress(position, duration)))
+			sendControl(client, req)
 		}
 	}()
 }
 
-// GetTrack returns the track
+// SetPlaying sets if the sender is playing, the position is held where it is while it isn't
+func (p *Player) SetPlaying(playing bool) {
+	p.trackLock.Lock()
+	defer p.trackLock.Unlock()
+	if p.playing == playing {
+		return
+	}
+	p.currentTrack.Position = p.position()
+	p.progressAt = time.Now()
+	p.playing = playing
+}
+
+// GetTrack returns the track, with its position moved on by the time it has been playing
+// since the sender told us it
 func (p *Player) GetTrack() player.Track {
 	p.trackLock.RLock()
 	defer p.trackLock.RUnlock()
-	return p.currentTrack
+	track := p.currentTrack
+	track.Position = p.position()
+	return track
+}
+
+// position works out how far into the track we are, the caller must hold the trackLock
+func (p *Player) position() time.Duration {
+	position := p.currentTrack.Position
+	if p.playing && p.currentTrack.Duration > 0 {
+		position += time.Since(p.progressAt)
+		if position > p.currentTrack.Duration {
+			position = p.currentTrack.Duration
+		}
+	}
+	return position
+}
+
+// thumbnail is the artwork scaled down, for UIs that don't need the full size artwork
+type thumbnail struct {
+	artwork  []byte
+	mimeType string
+}
+
+// the most thumbnail sizes we keep around for the current artwork
+const maxThumbnails = 8
+
+// GetThumbnail returns the artwork scaled down to fit in a square size pixels across, and its MIME type
+func (p *Player) GetThumbnail(size int) ([]byte, string, error) {
+	p.trackLock.Lock()
+	original, originalType, version := p.currentTrack.Artwork, p.currentTrack.ArtworkType, p.artworkVersion
+	t, ok := p.thumbnails[size]
+	p.trackLock.Unlock()
+	if len(original) == 0 {
+		return nil, "", nil
+	}
+	if ok {
+		return t.artwork, t.mimeType, nil
+	}
+	// scaling can take a while for big artwork, so it is done without holding up the track
+	artwork, mimeType, err := player.Thumbnail(original, originalType, size)
+	if err != nil {
+		return nil, "", err
+	}
+	p.trackLock.Lock()
+	defer p.trackLock.Unlock()
+	if version != p.artworkVersion {
+		return artwork, mimeType, nil
+	}
+	if p.thumbnails == nil || len(p.thumbnails) >= maxThumbnails {
+		p.thumbnails = make(map[int]thumbnail)
+	}
+	p.thumbnails[size] = thumbnail{artwork: artwork, mimeType: mimeType}
+	return artwork, mimeType, nil
 }
 
 func (p *Player) initSession(nodeName string, ip net.IP, port int) {
@@ -325,6 +584,19 @@ func (p *Player) initSession(nodeName string, ip net.IP, port int) {
 
 }
 
+// sendControl sends a control request to a node, there is nothing to do
+// with the response, but we want to know if it failed
+func sendControl(client *rtsp.Client, req *rtsp.Request) {
+	resp, err := client.Send(req)
+	if err != nil {
+		log.Println("Error sending control request", err)
+		return
+	}
+	if resp.Status != rtsp.Ok {
+		log.Println("Control request failed: ", resp.Status.String())
+	}
+}
+
 // airplay server will apply a normalization,
 // we have the raw volume on a scale of 0 to 1,
 // so we build the proper format
@@ -0,0 +1,109 @@
+package forwarding
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nstehr/bobcaygeon/player"
+	"github.com/nstehr/bobcaygeon/raop"
+	"github.com/nstehr/bobcaygeon/rtsp"
+	"github.com/nstehr/bobcaygeon/sdp"
+)
+
+func TestPositionOnlyMovesWhilePlaying(t *testing.T) {
+	p, err := NewPlayer(player.Latency{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetProgress(10*time.Second, time.Minute)
+	time.Sleep(20 * time.Millisecond)
+	// nothing is playing yet
+	if position := p.GetTrack().Position; position != 10*time.Second {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", 10*time.Second, position))
+	}
+	p.SetPlaying(true)
+	time.Sleep(20 * time.Millisecond)
+	playing := p.GetTrack().Position
+	if playing <= 10*time.Second {
+		t.Error(fmt.Sprintf("Expected: more than %s\r\n Got: %s", 10*time.Second, playing))
+	}
+	p.SetPlaying(false)
+	paused := p.GetTrack().Position
+	time.Sleep(20 * time.Millisecond)
+	if position := p.GetTrack().Position; position != paused || paused < playing {
+		t.Error(fmt.Sprintf("Expected: held at %s\r\n Got: %s", paused, position))
+	}
+}
+
+func TestReadStateForNode(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer l.Close()
+	// the node we are forwarding to
+	server := rtsp.NewServer(0)
+	server.AddHandler(rtsp.Get_Parameter, func(req *rtsp.Request, resp *rtsp.Response, ctx *rtsp.Context) {
+		params := rtsp.ParseParameters(req.Body)
+		values := make(map[string]string)
+		if _, ok := params["volume"]; ok {
+			values["volume"] = "-15.000000"
+		}
+		if _, ok := params["progress"]; ok {
+			values["progress"] = raop.FormatProgress(30*time.Second, 3*time.Minute)
+		}
+		resp.Body = rtsp.WriteParameters(values)
+		resp.Status = rtsp.Ok
+	})
+	go server.Serve(context.Background(), l)
+
+	p, err := NewPlayer(player.Latency{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.RemoveAllSessions()
+	if _, err := p.GetVolumeForNode("kitchen"); err == nil {
+		t.Error("Expected an error for a node we aren't forwarding to")
+	}
+	session := rtsp.NewSession(sdp.NewSessionDescription(), nil)
+	session.RemotePorts.Address = "127.0.0.1"
+	p.sessions.addSession("kitchen", &clientSession{Session: session, rtspPort: l.Addr().(*net.TCPAddr).Port})
+
+	volume, err := p.GetVolumeForNode("kitchen")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if volume != 0.5 {
+		t.Error(fmt.Sprintf("Expected: %f\r\n Got: %f", 0.5, volume))
+	}
+	position, duration, err := p.GetProgressForNode("kitchen")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if position != 30*time.Second || duration != 3*time.Minute {
+		t.Error(fmt.Sprintf("Expected: %s/%s\r\n Got: %s/%s", 30*time.Second, 3*time.Minute, position, duration))
+	}
+}
+
+func TestSetTrackKeepsArtwork(t *testing.T) {
+	p, err := NewPlayer(player.Latency{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetAlbumArt([]byte{0xff, 0xd8}, "image/jpeg")
+	// the sender sends the track info again after the artwork
+	p.SetTrack(player.Track{Title: "Bobcaygeon", Artist: "The Tragically Hip"})
+	track := p.GetTrack()
+	if len(track.Artwork) != 2 {
+		t.Error(fmt.Sprintf("Expected: %d\r\n Got: %d", 2, len(track.Artwork)))
+	}
+	if track.ArtworkType != "image/jpeg" {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", "image/jpeg", track.ArtworkType))
+	}
+	if track.Title != "Bobcaygeon" {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", "Bobcaygeon", track.Title))
+	}
+}
@@ -0,0 +1,36 @@
+package player
+
+import "time"
+
+// the rate all of our audio is played at
+const sampleRate = 44100
+
+// Latency breaks down the delay between audio being received and it being heard
+type Latency struct {
+	// how much audio is held on to before playback starts, to smooth over network jitter
+	Buffer time.Duration
+	// how long the audio device takes to play what is written to it
+	Sink time.Duration
+	// extra delay so the nodes in the zone we forward to have time to receive the audio
+	Forwarding time.Duration
+}
+
+// Total returns the total latency
+func (l Latency) Total() time.Duration {
+	return l.Buffer + l.Sink + l.Forwarding
+}
+
+// LatencyReporter is implemented by players that know how much latency they add
+type LatencyReporter interface {
+	GetLatency() Latency
+}
+
+// DurationToFrames converts a duration into the number of frames played in that time
+func DurationToFrames(d time.Duration) uint32 {
+	return uint32(d * sampleRate / time.Second)
+}
+
+// FramesToDuration converts a number of frames into the time it takes to play them
+func FramesToDuration(frames uint32) time.Duration {
+	return time.Duration(frames) * time.Second / sampleRate
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"log"
 	"sync"
+	"time"
 
 	"github.com/hajimehoshi/oto"
 	"github.com/nstehr/bobcaygeon/rtsp"
@@ -14,13 +15,27 @@ import (
 type Player interface {
 	Play(session *rtsp.Session)
 	SetVolume(volume float64)
+	GetVolume() float64
 	SetMute(isMuted bool)
 	GetIsMuted() bool
-	SetTrack(album string, artist string, title string)
-	SetAlbumArt(artwork []byte)
+	SetTrack(track Track)
+	SetAlbumArt(artwork []byte, mimeType string)
+	SetProgress(position time.Duration, duration time.Duration)
 	GetTrack() Track
 }
 
+// Output receives a copy of the audio being played, once it has been decoded
+// to 16 bit little endian stereo PCM
+type Output interface {
+	WriteAudio(pcm []byte)
+}
+
+// PlaybackTracker is implemented by players that want to know when the sender starts and
+// stops playing, e.g. to only move the track's position on while it is playing
+type PlaybackTracker interface {
+	SetPlaying(playing bool)
+}
+
 // LocalPlayer is a player that will just play the audio locally
 type LocalPlayer struct {
 	volLock sync.RWMutex
@@ -29,10 +44,26 @@ type LocalPlayer struct {
 
 // Track represents a track playing by the player
 type Track struct {
-	Artist  string
-	Album   string
-	Title   string
-	Artwork []byte
+	Artist      string
+	Album       string
+	Title       string
+	AlbumArtist string
+	Genre       string
+	Composer    string
+	TrackNumber int
+	TrackCount  int
+	DiscNumber  int
+	DiscCount   int
+	Year        int
+	// the ids the sender knows the track, and its album, by
+	PersistentID uint64
+	AlbumID      uint64
+	Artwork      []byte
+	// the MIME type of the artwork, e.g: image/png
+	ArtworkType string
+	// how far into the track we are, and how long it is, zero if the sender hasn't said
+	Position time.Duration
+	Duration time.Duration
 }
 
 // NewLocalPlayer instantiates a new LocalPlayer
@@ -53,13 +84,25 @@ func (lp *LocalPlayer) SetVolume(volume float64) {
 
 }
 
+// GetVolume returns the volume, between 0 (mute) and 1 (full volume)
+func (lp *LocalPlayer) GetVolume() float64 {
+	lp.volLock.RLock()
+	defer lp.volLock.RUnlock()
+	return lp.volume
+}
+
 // SetTrack sets the track for the player
-func (lp *LocalPlayer) SetTrack(album string, artist string, title string) {
+func (lp *LocalPlayer) SetTrack(track Track) {
 	// no op for now
 }
 
 // SetAlbumArt sets the album art for the player
-func (lp *LocalPlayer) SetAlbumArt(artwork []byte) {
+func (lp *LocalPlayer) SetAlbumArt(artwork []byte, mimeType string) {
+	// no op for now
+}
+
+// SetProgress sets how far into the track we are
+func (lp *LocalPlayer) SetProgress(position time.Duration, duration time.Duration) {
 	// no op for now
 }
 
@@ -2,6 +2,7 @@ package raop
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -10,9 +11,11 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/grandcat/zeroconf"
 	"github.com/nstehr/bobcaygeon/player"
+	"github.com/nstehr/bobcaygeon/raop/pairing"
 	"github.com/nstehr/bobcaygeon/rtsp"
 	"github.com/nstehr/bobcaygeon/sdp"
 )
@@ -24,23 +27,14 @@ const (
 	airTunesServiceType = "_raop._tcp"
 	domain              = "local."
 	localTimingPort     = 6002
-	localControlPort    = 6001
+	// the latency (in frames) we report when the player can't tell us its own
+	defaultAudioLatency = 2205
+	// realm used when asking senders for the password
+	digestRealm = "raop"
+	// how long a sender can go quiet before we give up on it
+	defaultInactivityTimeout = 120 * time.Second
 )
 
-var airtunesServiceProperties = []string{"txtvers=1",
-	"tp=UDP",
-	"ch=2",
-	"ss=16",
-	"sr=44100",
-	"pw=false",
-	"sm=false",
-	"sv=false",
-	"ek=1",
-	"et=0,1",
-	"cn=0,1",
-	"md=0,1,2",
-	"vn=3"}
-
 // AirplayServer server for handling the RTSP protocol
 type AirplayServer struct {
 	port          int
@@ -49,87 +43,276 @@ type AirplayServer struct {
 	zerconfServer *zeroconf.Server
 	sessions      *sessionMap
 	player        player.Player
+	senderPolicy  SenderPolicy
+	subscribers   *subscribers
+	// serializes changes to which session is playing
+	lifecycleLock     sync.Mutex
+	inactivityTimeout time.Duration
+	// guards the servers, and what we advertise
+	serverLock   sync.Mutex
+	capabilities Capabilities
+	txtOverrides map[string]string
+	// identifies us to senders, in place of a MAC address
+	deviceID net.HardwareAddr
+	// what senders pair with, nil if pairing is turned off
+	pairing      *pairing.Accessory
+	passwordLock sync.RWMutex
+	password     string
+	// tells if an address is another node in the cluster, nil if we aren't in one
+	isPeer   func(address string) bool
+	recorder *rtsp.Recorder
+	// where metadata about what is playing is sent, in shairport-sync's format
+	metadataSinks []MetadataSink
+	// finds the sender's DACP server, so we can control playback on the sender
+	dacpBrowser  *DacpBrowser
+	discoverDacp func(ctx context.Context, dacpID string) (string, int, error)
 }
 
-type airplaySession struct {
-	session *rtsp.Session
-	client  *DacpClient
+// NewAirplayServer instantiates a new airplayer server
+func NewAirplayServer(port int, name string, player player.Player) *AirplayServer {
+	as := AirplayServer{port: port, name: name, player: player, sessions: newSessionMap(),
+		subscribers: newSubscribers(), inactivityTimeout: defaultInactivityTimeout, capabilities: DefaultCapabilities()}
+	as.discoverDacp = as.lookupDacp
+	return &as
 }
 
-func newAirplaySession(session *rtsp.Session, dacpClient *DacpClient) *airplaySession {
-	return &airplaySession{session, dacpClient}
+// SetDacpBrowser sets the browser used to find the DACP servers of senders, so it can be shared
+// between servers.  Without one the server starts its own
+func (a *AirplayServer) SetDacpBrowser(browser *DacpBrowser) {
+	a.serverLock.Lock()
+	defer a.serverLock.Unlock()
+	a.dacpBrowser = browser
 }
 
-type sessionMap struct {
-	sync.RWMutex
-	sessions map[string]*airplaySession
+func (a *AirplayServer) lookupDacp(ctx context.Context, dacpID string) (string, int, error) {
+	a.serverLock.Lock()
+	browser := a.dacpBrowser
+	a.serverLock.Unlock()
+	if browser == nil {
+		return "", 0, errors.New("Not browsing for DACP servers")
+	}
+	return browser.Lookup(ctx, dacpID)
 }
 
-func newSessionMap() *sessionMap {
-	return &sessionMap{sessions: make(map[string]*airplaySession)}
+// attachRemote finds the sender's DACP server in the background, attaching a DACP client
+// to control playback on the sender to the session once it is found
+func (a *AirplayServer) attachRemote(as *airplaySession, dacpID string, activeRemote string) {
+	ctx, cancel := context.WithTimeout(context.Background(), dacpLookupTimeout)
+	defer cancel()
+	// no point waiting on the sender once its session is over
+	go func() {
+		select {
+		case <-as.session.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	ipAddress, port, err := a.discoverDacp(ctx, dacpID)
+	if err != nil {
+		log.Println("No DACP server found, will not be able to control the sender: ", err)
+		return
+	}
+	if !as.setClient(newDacpClient(ipAddress, port, dacpID, activeRemote)) {
+		return
+	}
+	log.Printf("Found DACP server for: %s at: %s:%d\n", dacpID, ipAddress, port)
 }
 
-func (sm *sessionMap) addSession(address string, session *airplaySession) {
-	sm.Lock()
-	defer sm.Unlock()
-	sm.sessions[address] = session
+// SetSenderPolicy sets what to do when a second sender connects while one is already streaming
+func (a *AirplayServer) SetSenderPolicy(policy SenderPolicy) {
+	a.senderPolicy = policy
 }
 
-func (sm *sessionMap) removeSession(address string) {
-	sm.Lock()
-	defer sm.Unlock()
-	delete(sm.sessions, address)
+// SetInactivityTimeout sets how long a streaming sender can go without sending us anything
+// before its session is torn down, 0 leaves sessions open until the sender tears them down
+func (a *AirplayServer) SetInactivityTimeout(timeout time.Duration) {
+	a.lifecycleLock.Lock()
+	defer a.lifecycleLock.Unlock()
+	a.inactivityTimeout = timeout
 }
 
-func (sm *sessionMap) getSession(address string) *airplaySession {
-	sm.RLock()
-	defer sm.RUnlock()
-	s, ok := sm.sessions[address]
-	if !ok {
-		return nil
-	}
-	return s
+// SetRecorder captures the RTSP exchanges, and the packets of every session, with the given
+// recorder.  It must be set before the server is started
+func (a *AirplayServer) SetRecorder(recorder *rtsp.Recorder) {
+	a.recorder = recorder
+}
+
+// SetClusterPeers sets how to tell if an address belongs to another node in the cluster, so
+// they can control us without the password.  It must be set before the server is started
+func (a *AirplayServer) SetClusterPeers(isPeer func(address string) bool) {
+	a.isPeer = isPeer
 }
 
-func (sm *sessionMap) getSessions() []*airplaySession {
-	sessions := make([]*airplaySession, 0, len(sm.sessions))
+// SetPassword sets the password senders need to stream to us, an empty password turns off
+// password protection
+func (a *AirplayServer) SetPassword(password string) {
+	a.passwordLock.Lock()
+	a.password = password
+	a.passwordLock.Unlock()
+	// let senders know whether to ask for a password
+	a.updateTextRecords()
+}
 
-	for _, value := range sm.sessions {
-		sessions = append(sessions, value)
+// SetDeviceID sets the id we identify ourselves to senders with, in the service name and in
+// the response to their challenge.  A nil id uses the MAC address of the interface a sender
+// connects to
+func (a *AirplayServer) SetDeviceID(id net.HardwareAddr) error {
+	a.serverLock.Lock()
+	a.deviceID = id
+	a.serverLock.Unlock()
+	// the id is part of the service name
+	return a.readvertise()
+}
+
+// DeviceID returns the id we identify ourselves to senders with, nil if there isn't one set
+func (a *AirplayServer) DeviceID() net.HardwareAddr {
+	a.serverLock.Lock()
+	defer a.serverLock.Unlock()
+	return a.deviceID
+}
+
+// challengeID returns the id to answer a challenge made over a connection to the local address
+func (a *AirplayServer) challengeID(localAddress string) net.HardwareAddr {
+	if id := a.DeviceID(); id != nil {
+		return id
 	}
-	return sessions
+	return interfaceMacAddr(localAddress)
 }
 
-// NewAirplayServer instantiates a new airplayer server
-func NewAirplayServer(port int, name string, player player.Player) *AirplayServer {
-	as := AirplayServer{port: port, name: name, player: player, sessions: newSessionMap()}
-	return &as
+// SetCapabilities sets what we tell senders we support
+func (a *AirplayServer) SetCapabilities(capabilities Capabilities) {
+	a.serverLock.Lock()
+	a.capabilities = capabilities
+	a.serverLock.Unlock()
+	a.updateTextRecords()
+}
+
+// SetTextOverrides sets TXT records that replace (or add to) the ones worked out from
+// our capabilities.  An empty value leaves the record out
+func (a *AirplayServer) SetTextOverrides(overrides map[string]string) {
+	a.serverLock.Lock()
+	a.txtOverrides = overrides
+	a.serverLock.Unlock()
+	a.updateTextRecords()
 }
 
-//Start starts the airplay server, broadcasting on bonjour, ready to accept requests
-func (a *AirplayServer) Start(verbose bool, advertise bool) {
+func (a *AirplayServer) getPassword() string {
+	a.passwordLock.RLock()
+	defer a.passwordLock.RUnlock()
+	return a.password
+}
 
-	if advertise {
-		a.initAdvertise()
+// authPassword returns the password a request has to be authenticated with, if any.  Only
+// the node senders can see (i.e. is advertising) asks for the password, and control requests
+// outside of a session from the rest of the cluster (e.g. from the management api) don't need
+// it, so the cluster can still talk to us
+func (a *AirplayServer) authPassword(req *rtsp.Request, ctx *rtsp.Context) string {
+	if !a.IsAdvertising() {
+		return ""
+	}
+	// pairing is protected by the pairing pin instead
+	if req.Method == rtsp.Post {
+		return ""
+	}
+	if (req.Method == rtsp.Get_Parameter || req.Method == rtsp.Set_Parameter) && !req.Headers.Has("Session") &&
+		a.isPeer != nil && a.isPeer(ctx.RemoteAddr) {
+		return ""
 	}
+	return a.getPassword()
+}
 
-	rtspServer := rtsp.NewServer(a.port)
+// textRecords returns the TXT records to advertise the service with, the caller must hold the serverLock
+func (a *AirplayServer) textRecords() []string {
+	return a.capabilities.textRecords(a.getPassword() != "", a.pairingRecords(a.txtOverrides))
+}
 
+// updateTextRecords announces the TXT records again, if we are advertising, so senders
+// pick up changes without us having to re-register
+func (a *AirplayServer) updateTextRecords() {
+	a.serverLock.Lock()
+	defer a.serverLock.Unlock()
+	if a.zerconfServer != nil {
+		a.zerconfServer.SetText(a.textRecords())
+	}
+}
+
+// Start starts the airplay server, broadcasting on bonjour, ready to accept requests.  It blocks
+// until the server is stopped or ctx is done, returning an error if the server couldn't be
+// started or failed.  The server can be started again once it returns
+func (a *AirplayServer) Start(ctx context.Context, verbose bool, advertise bool) error {
+	rtspServer := a.newRTSPServer(verbose)
+	// listen before advertising, so senders never see us while we can't take connections
+	log.Printf("Starting RTSP server on port: %d\n", a.port)
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", a.port))
+	if err != nil {
+		return err
+	}
+
+	a.serverLock.Lock()
 	a.rtspServer = rtspServer
+	var ownBrowser *DacpBrowser
+	browserCtx, stopBrowsing := context.WithCancel(ctx)
+	defer stopBrowsing()
+	if a.dacpBrowser == nil {
+		ownBrowser = NewDacpBrowser()
+		// we can still play without it, we just can't control the sender
+		if err := ownBrowser.Start(browserCtx); err != nil {
+			log.Println("Error browsing for DACP servers: ", err)
+		} else {
+			a.dacpBrowser = ownBrowser
+		}
+	}
+	if advertise && a.zerconfServer == nil {
+		if err := a.startAdvertising(); err != nil {
+			a.serverLock.Unlock()
+			l.Close()
+			return err
+		}
+	}
+	a.serverLock.Unlock()
+
+	err = rtspServer.Serve(ctx, l)
+	// none of the sessions can be controlled anymore
+	a.closeAllSessions(ReasonStopped)
+	if ownBrowser != nil {
+		// it stops browsing once we return, a new one is started if we are started again
+		a.SetDacpBrowser(nil)
+	}
+	if err != nil || ctx.Err() != nil {
+		a.stopAdvertising()
+	}
+	return err
+}
 
-	rtspServer.AddHandler(rtsp.Options, handleOptions)
+// newRTSPServer sets up an RTSP server to handle the airplay protocol
+func (a *AirplayServer) newRTSPServer(verbose bool) *rtsp.Server {
+	rtspServer := rtsp.NewServer(a.port)
+
+	rtspServer.AddHandler(rtsp.Options, a.handleOptions)
 	rtspServer.AddHandler(rtsp.Announce, a.handleAnnounce)
 	rtspServer.AddHandler(rtsp.Setup, a.handleSetup)
 	rtspServer.AddHandler(rtsp.Record, a.handleRecord)
 	rtspServer.AddHandler(rtsp.Set_Parameter, a.handlSetParameter)
-	rtspServer.AddHandler(rtsp.Flush, handlFlush)
+	rtspServer.AddHandler(rtsp.Get_Parameter, a.handleGetParameter)
+	rtspServer.AddHandler(rtsp.Flush, a.handlFlush)
 	rtspServer.AddHandler(rtsp.Teardown, a.handleTeardown)
-	rtspServer.Start(verbose)
-
+	rtspServer.AddHandler(rtsp.Post, a.handlePost)
+	// capture everything, including what is turned away by authentication
+	if a.recorder != nil {
+		rtspServer.Use(rtsp.CaptureMiddleware(a.recorder))
+	}
+	if verbose {
+		rtspServer.Use(rtsp.LoggingMiddleware)
+	}
+	rtspServer.Use(rtsp.DigestAuth(digestRealm, a.authPassword))
+	rtspServer.Use(a.keepAlive)
+	return rtspServer
 }
 
 // ToggleAdvertise will toggle whether or not to advertise as an airplay service
 func (a *AirplayServer) ToggleAdvertise(shouldAdvertise bool) {
+	a.serverLock.Lock()
+	defer a.serverLock.Unlock()
 	if !shouldAdvertise {
 		if a.zerconfServer == nil {
 			log.Println("Currently not advertising, ignoring turn off advertise request")
@@ -146,36 +329,97 @@ func (a *AirplayServer) ToggleAdvertise(shouldAdvertise bool) {
 			log.Println("Currently advertising, ignoring turn on advertise request")
 			return
 		}
-		a.initAdvertise()
+		if err := a.startAdvertising(); err != nil {
+			log.Println("Error starting advertising: ", err)
+		}
 	}
 }
 
+// Name returns the name we advertise as
+func (a *AirplayServer) Name() string {
+	a.serverLock.Lock()
+	defer a.serverLock.Unlock()
+	return a.name
+}
+
+// Port returns the port we listen for RTSP requests on
+func (a *AirplayServer) Port() int {
+	return a.port
+}
+
 //ChangeName will change the name of the broadcast service
 func (a *AirplayServer) ChangeName(newName string) error {
 	if strings.TrimSpace(newName) == "" {
 		return errors.New("New name must be non-empty")
 	}
+	a.serverLock.Lock()
 	a.name = strings.TrimSpace(newName)
+	a.serverLock.Unlock()
 	// if we are advertising, stop the zeroconf server and start it so it
 	// reflects the name change
+	return a.readvertise()
+}
+
+// IsAdvertising returns whether we are advertising as an airplay service
+func (a *AirplayServer) IsAdvertising() bool {
+	a.serverLock.Lock()
+	defer a.serverLock.Unlock()
+	return a.zerconfServer != nil
+}
+
+// IsPlaying returns if a sender is streaming to us
+func (a *AirplayServer) IsPlaying() bool {
+	return a.sessions.getSessionInState(SessionRecording) != nil
+}
+
+// Remote returns the DACP client to control playback on the sender that is playing
+func (a *AirplayServer) Remote() (*DacpClient, error) {
+	as := a.sessions.getSessionInState(SessionRecording)
+	if as == nil {
+		return nil, errors.New("Nothing is playing")
+	}
+	client := as.getClient()
+	if client == nil {
+		return nil, errors.New("The sender that is playing can't be controlled")
+	}
+	return client, nil
+}
+
+// readvertise restarts advertising, if we are advertising, to pick up changes to what is advertised
+func (a *AirplayServer) readvertise() error {
+	a.serverLock.Lock()
+	defer a.serverLock.Unlock()
+	if a.zerconfServer == nil {
+		return nil
+	}
+	a.zerconfServer.Shutdown()
+	a.zerconfServer = nil
+	return a.startAdvertising()
+}
+
+func (a *AirplayServer) stopAdvertising() {
+	a.serverLock.Lock()
+	defer a.serverLock.Unlock()
 	if a.zerconfServer != nil {
 		a.zerconfServer.Shutdown()
 		a.zerconfServer = nil
-		a.initAdvertise()
 	}
-	return nil
 }
 
-func (a *AirplayServer) initAdvertise() {
+// startAdvertising registers us as an airplay service, the caller must hold the serverLock
+func (a *AirplayServer) startAdvertising() error {
 	// as per the protocol, the mac address makes up part of the service name
-	macAddr := getMacAddr().String()
-	macAddr = strings.Replace(macAddr, ":", "", -1)
+	id := a.deviceID
+	if id == nil {
+		id = getMacAddr()
+	}
+	macAddr := strings.Replace(id.String(), ":", "", -1)
 
 	serviceName := fmt.Sprintf("%s@%s", macAddr, a.name)
 
-	server, err := zeroconf.Register(serviceName, airTunesServiceType, domain, a.port, airtunesServiceProperties, nil)
+	server, err := zeroconf.Register(serviceName, airTunesServiceType, domain, a.port, a.textRecords(), nil)
 	if err != nil {
-		log.Fatal("couldn't start zeroconf: ", err)
+		return fmt.Errorf("Couldn't start zeroconf: %s", err)
 	}
 
 	log.Println("Published service:")
@@ -185,34 +429,39 @@ func (a *AirplayServer) initAdvertise() {
 	log.Println("- Port:", a.port)
 
 	a.zerconfServer = server
+	return nil
 }
 
-func handleOptions(req *rtsp.Request, resp *rtsp.Response, localAddress string, remoteAddress string) {
+func (a *AirplayServer) handleOptions(req *rtsp.Request, resp *rtsp.Response, ctx *rtsp.Context) {
 	resp.Status = rtsp.Ok
-	resp.Headers["Public"] = strings.Join(rtsp.GetMethods(), " ")
-	appleChallenge, exists := req.Headers["Apple-Challenge"]
-	if !exists {
+	resp.Headers.Set("Public", strings.Join(rtsp.GetMethods(), " "))
+	if !req.Headers.Has("Apple-Challenge") {
 		return
 	}
+	appleChallenge := req.Headers.Get("Apple-Challenge")
 	log.Printf("Apple Challenge detected: %s\n", appleChallenge)
-	challengResponse, err := generateChallengeResponse(appleChallenge, getMacAddr(), localAddress)
+	challengResponse, err := generateChallengeResponse(appleChallenge, a.challengeID(ctx.LocalAddr), ctx.LocalAddr)
 	if err != nil {
 		log.Println("Error generating challenge response: ", err.Error())
 	}
-	resp.Headers["Apple-Response"] = challengResponse
+	resp.Headers.Set("Apple-Response", challengResponse)
 
 }
 
-func (a *AirplayServer) handleAnnounce(req *rtsp.Request, resp *rtsp.Response, localAddress string, remoteAddress string) {
-	if req.Headers["Content-Type"] == "application/sdp" {
+func (a *AirplayServer) handleAnnounce(req *rtsp.Request, resp *rtsp.Response, ctx *rtsp.Context) {
+	if req.Headers.Get("Content-Type") == "application/sdp" {
 		description, err := sdp.Parse(bytes.NewReader(req.Body))
 		if err != nil {
 			log.Println("error parsing SDP payload: ", err)
 			resp.Status = rtsp.BadRequest
 			return
 		}
-		// right now, we only maintain one audio session, so close any existing one
-		a.closeAllSessions()
+		key := clientKey(req, ctx.RemoteAddr)
+		if !a.admitSender(key) {
+			log.Println("Refusing sender, another sender is already streaming")
+			resp.Status = rtsp.NotEnoughBandwidth
+			return
+		}
 		var decoder rtsp.Decrypter
 
 		if key, ok := description.Attributes["rsaaeskey"]; ok {
@@ -233,26 +482,97 @@ func (a *AirplayServer) handleAnnounce(req *rtsp.Request, resp *rtsp.Response, l
 			}
 			decoder = NewAesDecrypter(aesKey, aesIv)
 		}
-		// create the dacp client for player control and then attach to the stream
-		dacpID := req.Headers["DACP-ID"]
-		activeRemote := req.Headers["Active-Remote"]
-		dacpClient := DiscoverDacpClient(dacpID, activeRemote)
 		s := rtsp.NewSession(description, decoder)
+		s.SetRecorder(a.recorder)
 		err = s.InitReceive()
 		if err != nil {
 			log.Println("error intializing data receiving", err)
 			resp.Status = rtsp.InternalServerError
 			return
 		}
-		session := newAirplaySession(s, dacpClient)
-		a.sessions.addSession(remoteAddress, session)
+		session := newAirplaySession(s, nil)
+		session.clientKey = key
+		session.peer = a.isPeer != nil && a.isPeer(ctx.RemoteAddr)
+		a.sessions.addSession(session)
+		a.emitSender(req, ctx)
+		// the DACP client for player control is attached once the sender's DACP server is found
+		if dacpID := req.Headers.Get("DACP-ID"); dacpID != "" {
+			go a.attachRemote(session, dacpID, req.Headers.Get("Active-Remote"))
+		}
 	}
 	resp.Status = rtsp.Ok
 }
 
-func (a *AirplayServer) handleSetup(req *rtsp.Request, resp *rtsp.Response, localAddress string, remoteAddress string) {
-	transport, hasTransport := req.Headers["Transport"]
-	as := a.sessions.getSession(remoteAddress)
+// admitSender applies the sender policy when a sender announces a stream, returning false if it
+// should be refused.  A sender announcing again replaces the session it already has
+func (a *AirplayServer) admitSender(key string) bool {
+	a.lifecycleLock.Lock()
+	defer a.lifecycleLock.Unlock()
+	if previous := a.sessions.getSessionForClient(key); previous != nil {
+		a.closeSession(previous.id, ReasonReplaced)
+	}
+	if len(a.sessions.getSessions()) == 0 {
+		return true
+	}
+	switch a.senderPolicy {
+	case SenderRefuse:
+		return false
+	case SenderTakeover:
+		a.closeAllSessions(ReasonTakeover)
+	}
+	return true
+}
+
+// lookupSession finds the session a request belongs to, by the Session header if the
+// sender sent one, otherwise by who sent it
+func (a *AirplayServer) lookupSession(req *rtsp.Request, remoteAddress string) *airplaySession {
+	if req.Headers.Has("Session") {
+		return a.sessions.getSession(sessionIDFromHeader(req.Headers.Get("Session")))
+	}
+	return a.sessions.getSessionForClient(clientKey(req, remoteAddress))
+}
+
+// keepAlive is middleware that counts any request for a session as hearing from its sender,
+// senders keep sessions alive over RTSP while no audio is flowing (e.g. when paused)
+func (a *AirplayServer) keepAlive(next rtsp.RequestHandler) rtsp.RequestHandler {
+	return func(req *rtsp.Request, resp *rtsp.Response, ctx *rtsp.Context) {
+		if as := a.lookupSession(req, ctx.RemoteAddr); as != nil {
+			as.session.Touch()
+		}
+		next(req, resp, ctx)
+	}
+}
+
+// controlsPlayer checks whether a request should be applied to the player.  Requests for a
+// queued session are ignored, and requests without a session (e.g. from other nodes) always apply
+func (a *AirplayServer) controlsPlayer(req *rtsp.Request, resp *rtsp.Response) bool {
+	if !req.Headers.Has("Session") {
+		return true
+	}
+	as := a.sessions.getSession(sessionIDFromHeader(req.Headers.Get("Session")))
+	if as == nil {
+		resp.Status = rtsp.SessionNotFound
+		return false
+	}
+	if as.getState() == SessionQueued {
+		resp.Status = rtsp.Ok
+		return false
+	}
+	return true
+}
+
+func (a *AirplayServer) handleSetup(req *rtsp.Request, resp *rtsp.Response, ctx *rtsp.Context) {
+	transport := req.Headers.Get("Transport")
+	hasTransport := req.Headers.Has("Transport")
+	as := a.lookupSession(req, ctx.RemoteAddr)
+	if as == nil {
+		resp.Status = rtsp.SessionNotFound
+		return
+	}
+	if as.getState() != SessionAnnounced {
+		resp.Status = rtsp.MethodNotValidInThisState
+		return
+	}
 	if hasTransport {
 		transportParts := strings.Split(transport, ";")
 		var controlPort int
@@ -265,67 +585,197 @@ func (a *AirplayServer) handleSetup(req *rtsp.Request, resp *rtsp.Response, loca
 				timingPort, _ = strconv.Atoi(strings.Split(part, "=")[1])
 			}
 		}
-		as.session.RemotePorts.Address = remoteAddress
+		as.session.RemotePorts.Address = ctx.RemoteAddr
 		as.session.RemotePorts.Control = controlPort
 		as.session.RemotePorts.Timing = timingPort
 	}
 
-	// hardcode our listening ports for now
-	as.session.LocalPorts.Control = localControlPort
+	// hardcode our timing port for now, the control port is bound by the session
 	as.session.LocalPorts.Timing = localTimingPort
 
-	resp.Headers["Transport"] = fmt.Sprintf("RTP/AVP/UDP;unicast;mode=record;server_port=%d;control_port=%d;timing_port=%d", as.session.LocalPorts.Data, localControlPort, localTimingPort)
-	resp.Headers["Session"] = "1"
-	resp.Headers["Audio-Jack-Status"] = "connected"
+	resp.Headers.Set("Transport", fmt.Sprintf("RTP/AVP/UDP;unicast;mode=record;server_port=%d;control_port=%d;timing_port=%d", as.session.LocalPorts.Data, as.session.LocalPorts.Control, localTimingPort))
+	resp.Headers.Set("Session", as.id)
+	resp.Headers.Set("Audio-Jack-Status", "connected")
+	a.setSessionState(as, SessionSetUp)
 
 	resp.Status = rtsp.Ok
 }
 
-func (a *AirplayServer) handleRecord(req *rtsp.Request, resp *rtsp.Response, localAddress string, remoteAddress string) {
-	as := a.sessions.getSession(remoteAddress)
-	err := as.session.StartReceiving()
+func (a *AirplayServer) handleRecord(req *rtsp.Request, resp *rtsp.Response, ctx *rtsp.Context) {
+	as := a.lookupSession(req, ctx.RemoteAddr)
+	if as == nil {
+		resp.Status = rtsp.SessionNotFound
+		return
+	}
+	if as.getState() != SessionSetUp {
+		resp.Status = rtsp.MethodNotValidInThisState
+		return
+	}
+	// the sender can tell us up front the latency it wants, later on
+	// it will also tell us via the sync packets
+	if val := req.Headers.Get("Audio-Latency"); val != "" {
+		latency, err := strconv.ParseUint(val, 10, 32)
+		if err != nil {
+			log.Println("Error parsing requested latency: ", err)
+		} else {
+			as.session.SetRequestedLatency(uint32(latency))
+		}
+	}
+	a.lifecycleLock.Lock()
+	defer a.lifecycleLock.Unlock()
+	if playing := a.sessions.getSessionInState(SessionRecording); playing != nil && playing != as {
+		if a.senderPolicy == SenderQueue {
+			log.Printf("Another sender is streaming, queueing session %s\n", as.id)
+			a.setSessionState(as, SessionQueued)
+			resp.Status = rtsp.Ok
+			return
+		}
+		a.closeSession(playing.id, ReasonTakeover)
+	}
+	err := a.startSession(as)
 	if err != nil {
 		log.Println("could not start streaming session: ", err)
 		resp.Status = rtsp.InternalServerError
 		return
 	}
-	a.player.Play(as.session)
-	resp.Headers["Audio-Latency"] = "2205"
+	resp.Headers.Set("Audio-Latency", strconv.FormatUint(uint64(a.audioLatency(as.session)), 10))
 	resp.Status = rtsp.Ok
 
 }
 
-func (a *AirplayServer) handlSetParameter(req *rtsp.Request, resp *rtsp.Response, localAddress string, remoteAddress string) {
-	if req.Headers["Content-Type"] == "application/x-dmap-tagged" {
-		daapData := parseDaap(req.Body)
-		album := ""
-		artist := ""
-		title := ""
-		if val, ok := daapData["daap.songalbum"]; ok {
-			album = val.(string)
+// startSession starts receiving audio for the session and hands it to the player
+func (a *AirplayServer) startSession(as *airplaySession) error {
+	// a zone leader sets up its session once and leaves it quiet while nothing is playing,
+	// and wouldn't know to set it up again, so only senders are timed out
+	timeout := a.inactivityTimeout
+	if as.peer {
+		timeout = 0
+	}
+	as.session.SetInactivityTimeout(timeout)
+	err := as.session.StartReceiving()
+	if err != nil {
+		return err
+	}
+	a.player.Play(as.session)
+	a.setPlaying(true)
+	a.setSessionState(as, SessionRecording)
+	a.emitMetadata(MetadataShairport, "pbeg", nil)
+	if timeout > 0 {
+		go a.watchSession(as)
+	}
+	return nil
+}
+
+// watchSession tears down a session if its sender goes quiet, e.g. a phone that has
+// walked out of wifi range, so we aren't left waiting on it
+func (a *AirplayServer) watchSession(as *airplaySession) {
+	select {
+	case <-as.session.Done():
+	case <-as.session.Inactive():
+		log.Printf("Sender has gone quiet, closing session %s\n", as.id)
+		a.lifecycleLock.Lock()
+		a.closeSession(as.id, ReasonInactive)
+		a.lifecycleLock.Unlock()
+		a.promoteQueued()
+	}
+}
+
+// setSessionState moves the session to a new state, and lets subscribers know
+func (a *AirplayServer) setSessionState(as *airplaySession, state SessionState) {
+	as.setState(state)
+	a.publish(SessionEvent{SessionID: as.id, State: state})
+}
+
+// promoteQueued starts playing the longest waiting queued session, if nothing else is playing
+func (a *AirplayServer) promoteQueued() {
+	a.lifecycleLock.Lock()
+	defer a.lifecycleLock.Unlock()
+	if a.sessions.getSessionInState(SessionRecording) != nil {
+		return
+	}
+	next := a.sessions.getSessionInState(SessionQueued)
+	if next == nil {
+		return
+	}
+	log.Printf("Starting queued session %s\n", next.id)
+	err := a.startSession(next)
+	if err != nil {
+		log.Println("could not start queued session: ", err)
+		a.closeSession(next.id, ReasonError)
+	}
+}
+
+// setPlaying tells the player if the sender is playing, if it wants to know
+func (a *AirplayServer) setPlaying(playing bool) {
+	if tracker, ok := a.player.(player.PlaybackTracker); ok {
+		tracker.SetPlaying(playing)
+	}
+}
+
+// audioLatency works out how many frames of latency we add to the stream,
+// which the sender uses to keep things (like video) in sync with what is heard
+func (a *AirplayServer) audioLatency(session *rtsp.Session) uint32 {
+	reporter, ok := a.player.(player.LatencyReporter)
+	if !ok {
+		return defaultAudioLatency
+	}
+	latency := player.DurationToFrames(reporter.GetLatency().Total())
+	// the player will buffer up to whatever the sender asks for
+	if requested := session.RequestedLatency(); requested > latency {
+		return requested
+	}
+	return latency
+}
+
+func (a *AirplayServer) handlSetParameter(req *rtsp.Request, resp *rtsp.Response, ctx *rtsp.Context) {
+	if !a.controlsPlayer(req, resp) {
+		return
+	}
+	if req.Headers.Get("Content-Type") == "application/x-dmap-tagged" {
+		track, err := parseTrack(req.Body)
+		if err != nil {
+			log.Println("Error parsing track information: ", err)
+			resp.Status = rtsp.BadRequest
+			return
 		}
-		if val, ok := daapData["daap.songartist"]; ok {
-			artist = val.(string)
+		a.player.SetTrack(track)
+		if err := a.emitTrack(req); err != nil {
+			log.Println("Error sending track metadata: ", err)
 		}
-		if val, ok := daapData["dmap.itemname"]; ok {
-			title = val.(string)
+	} else if strings.HasPrefix(req.Headers.Get("Content-Type"), "image/") {
+		artwork, mimeType, err := parseArtwork(req.Headers.Get("Content-Type"), req.Body)
+		if err != nil {
+			log.Println("Error parsing artwork: ", err)
+			resp.Status = rtsp.BadRequest
+			return
 		}
-		a.player.SetTrack(album, artist, title)
-	} else if req.Headers["Content-Type"] == "image/jpeg" {
-		a.player.SetAlbumArt(req.Body)
-	} else if req.Headers["Content-Type"] == "text/parameters" {
-		body := string(req.Body)
-		if strings.Contains(body, "volume") {
-			volStr := strings.TrimSpace(strings.Split(body, "volume:")[1])
+		a.player.SetAlbumArt(artwork, mimeType)
+		a.emitArtwork(artwork, req)
+	} else if req.Headers.Get("Content-Type") == "text/parameters" {
+		params := rtsp.ParseParameters(req.Body)
+		if progress, ok := params["progress"]; ok {
+			position, duration, err := parseProgress(progress)
+			if err != nil {
+				log.Println("Error parsing progress: ", err)
+				resp.Status = rtsp.BadRequest
+				return
+			}
+			a.player.SetProgress(position, duration)
+			// senders send the progress when they start playing again after a pause
+			a.setPlaying(true)
+			a.emitMetadata(MetadataShairport, "prgr", []byte(progress))
+		}
+		if volStr, ok := params["volume"]; ok {
 			vol, err := strconv.ParseFloat(volStr, 32)
 			if err != nil {
 				log.Println("Error converting volume to float: ", err)
 				resp.Status = rtsp.BadRequest
 				return
 			}
-			if val, ok := req.Headers["X-BCG-Muted"]; ok {
-				if val == "muted" {
+			if req.Headers.Has("X-BCG-Muted") {
+				if req.Headers.Get("X-BCG-Muted") == "muted" {
 					a.player.SetMute(true)
+					a.emitVolume(-144)
 					// muting is enough, we don't need to bother
 					// going on to set the actual volume
 					resp.Status = rtsp.Ok
@@ -333,6 +783,7 @@ func (a *AirplayServer) handlSetParameter(req *rtsp.Request, resp *rtsp.Response
 				}
 				a.player.SetMute(false)
 			}
+			a.emitVolume(vol)
 			vol = normalizeVolume(vol)
 			a.player.SetVolume(vol)
 
@@ -341,64 +792,114 @@ func (a *AirplayServer) handlSetParameter(req *rtsp.Request, resp *rtsp.Response
 	resp.Status = rtsp.Ok
 }
 
-func handlFlush(req *rtsp.Request, resp *rtsp.Response, localAddress string, remoteAddress string) {
+func (a *AirplayServer) handleGetParameter(req *rtsp.Request, resp *rtsp.Response, ctx *rtsp.Context) {
+	if !a.controlsPlayer(req, resp) {
+		return
+	}
 	resp.Status = rtsp.Ok
+	// senders also send GET_PARAMETER with no body as a keep alive
+	if req.Headers.Get("Content-Type") != "text/parameters" {
+		return
+	}
+	values := make(map[string]string)
+	for name := range rtsp.ParseParameters(req.Body) {
+		switch name {
+		case "volume":
+			volume := denormalizeVolume(a.player.GetVolume())
+			if a.player.GetIsMuted() {
+				volume = -144
+			}
+			values[name] = fmt.Sprintf("%f", volume)
+		case "progress":
+			// left out until the sender has told us how long the track is
+			if track := a.player.GetTrack(); track.Duration > 0 {
+				values[name] = FormatProgress(track.Position, track.Duration)
+			}
+		default:
+			log.Printf("Unknown parameter requested: %s\n", name)
+		}
+	}
+	resp.Headers.Set("Content-Type", "text/parameters")
+	resp.Body = rtsp.WriteParameters(values)
 }
 
-func (a *AirplayServer) handleTeardown(req *rtsp.Request, resp *rtsp.Response, localAddress string, remoteAddress string) {
-	a.closeSession(remoteAddress)
+func (a *AirplayServer) handlFlush(req *rtsp.Request, resp *rtsp.Response, ctx *rtsp.Context) {
+	if !a.controlsPlayer(req, resp) {
+		return
+	}
+	// senders flush when they pause
+	a.setPlaying(false)
+	a.emitMetadata(MetadataShairport, "pfls", nil)
 	resp.Status = rtsp.Ok
 }
 
-// Stop stops thes airplay server
-func (a *AirplayServer) Stop() {
-	a.closeAllSessions()
-	a.rtspServer.Stop()
-	if a.zerconfServer != nil {
-		a.zerconfServer.Shutdown()
+func (a *AirplayServer) handleTeardown(req *rtsp.Request, resp *rtsp.Response, ctx *rtsp.Context) {
+	as := a.lookupSession(req, ctx.RemoteAddr)
+	if as == nil {
+		if req.Headers.Has("Session") {
+			resp.Status = rtsp.SessionNotFound
+			return
+		}
+		resp.Status = rtsp.Ok
+		return
 	}
+	a.lifecycleLock.Lock()
+	a.closeSession(as.id, ReasonTeardown)
+	a.lifecycleLock.Unlock()
+	// if someone was waiting, it is their turn now
+	a.promoteQueued()
+	resp.Status = rtsp.Ok
+}
 
+// Stop stops thes airplay server, closing every session and connection.  It waits
+// for everything to be closed, or until ctx is done
+func (a *AirplayServer) Stop(ctx context.Context) error {
+	a.serverLock.Lock()
+	rtspServer := a.rtspServer
+	a.serverLock.Unlock()
+	var err error
+	if rtspServer != nil {
+		err = rtspServer.Stop(ctx)
+	}
+	a.closeAllSessions(ReasonStopped)
+	a.stopAdvertising()
+	return err
 }
 
-func (a *AirplayServer) closeSession(remoteAddress string) {
+// closeSession closes the session, letting subscribers know why
+func (a *AirplayServer) closeSession(id string, reason string) {
 	doneChan := make(chan struct{})
-	as := a.sessions.getSession(remoteAddress)
+	// taken out of the map first, so racing to close the same session, e.g: on Stop and
+	// TEARDOWN, only closes it once
+	as := a.sessions.removeSession(id)
 	if as != nil {
-		// stops the client from sending data
-		if as.client != nil {
-			as.client.Stop()
+		if client := as.takeClient(); client != nil {
+			// stops the client from sending data, no point if it has already gone away
+			if reason != ReasonInactive {
+				client.Stop()
+			}
+			client.Close()
 		}
 		// closes the actual listening socket
 		as.session.Close(doneChan)
 		<-doneChan
 		log.Println("Session closed")
 		close(doneChan)
-		a.sessions.removeSession(remoteAddress)
+		if as.getState() == SessionRecording {
+			a.setPlaying(false)
+			a.emitMetadata(MetadataShairport, "pend", nil)
+		}
+		as.setState(SessionClosed)
+		a.publish(SessionEvent{SessionID: id, State: SessionClosed, Reason: reason})
 	}
 }
 
-func (a *AirplayServer) closeAllSessions() {
+func (a *AirplayServer) closeAllSessions(reason string) {
 	for _, as := range a.sessions.getSessions() {
-		a.closeSession(as.session.RemotePorts.Address)
+		a.closeSession(as.id, reason)
 	}
 }
 
-// getMacAddr gets the MAC hardware
-// address of the host machine: https://gist.github.com/rucuriousyet/ab2ab3dc1a339de612e162512be39283
-func getMacAddr() (addr net.HardwareAddr) {
-	interfaces, err := net.Interfaces()
-	if err == nil {
-		for _, i := range interfaces {
-			if i.Flags&net.FlagUp != 0 && bytes.Compare(i.HardwareAddr, nil) != 0 {
-				// Don't use random as we have a real address
-				addr = i.HardwareAddr
-				break
-			}
-		}
-	}
-	return
-}
-
 // normalizeVolume maps airplay volume values to a range betweeon 0 and 1
 func normalizeVolume(volume float64) float64 {
 	// according to: https://nto.github.io/AirPlay.html#audio
@@ -416,3 +917,14 @@ func normalizeVolume(volume float64) float64 {
 	adjusted := (volume + 30) / 30
 	return adjusted
 }
+
+// denormalizeVolume maps a volume between 0 and 1 back to an airplay volume
+func denormalizeVolume(volume float64) float64 {
+	if volume == 0 {
+		return -144
+	}
+	if volume == 1 {
+		return 0
+	}
+	return (volume * 30) - 30
+}
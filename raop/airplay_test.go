@@ -1,9 +1,18 @@
 package raop
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/grandcat/zeroconf"
 	"github.com/nstehr/bobcaygeon/sdp"
 
 	"github.com/nstehr/bobcaygeon/player"
@@ -11,40 +20,56 @@ import (
 )
 
 type FakePlayer struct {
+	volume float64
 	muted  bool
-	album  string
-	artist string
-	title  string
+	track  player.Track
+	// artwork
+	artwork     []byte
+	artworkType string
+	// progress
+	position time.Duration
+	duration time.Duration
+	playing  bool
 }
 
-func (*FakePlayer) Play(session *rtsp.Session) {}
-func (*FakePlayer) SetVolume(volume float64)   {}
-func (fp *FakePlayer) SetMute(isMuted bool)    { fp.muted = isMuted }
-func (fp *FakePlayer) GetIsMuted() bool        { return fp.muted }
-func (fp *FakePlayer) SetTrack(album string, artist string, title string) {
-	fp.album = album
-	fp.artist = artist
-	fp.title = title
+func (*FakePlayer) Play(session *rtsp.Session)     {}
+func (*FakePlayer) SetVolume(volume float64)       {}
+func (fp *FakePlayer) GetVolume() float64          { return fp.volume }
+func (fp *FakePlayer) SetMute(isMuted bool)        { fp.muted = isMuted }
+func (fp *FakePlayer) GetIsMuted() bool            { return fp.muted }
+func (fp *FakePlayer) SetTrack(track player.Track) { fp.track = track }
+func (fp *FakePlayer) SetAlbumArt(artwork []byte, mimeType string) {
+	fp.artwork = artwork
+	fp.artworkType = mimeType
 }
-func (*FakePlayer) SetAlbumArt(artwork []byte) {}
-func (*FakePlayer) GetTrack() player.Track     { return player.Track{} }
+func (fp *FakePlayer) SetProgress(position time.Duration, duration time.Duration) {
+	fp.position = position
+	fp.duration = duration
+}
+func (fp *FakePlayer) GetTrack() player.Track {
+	track := fp.track
+	track.Position, track.Duration = fp.position, fp.duration
+	return track
+}
+func (fp *FakePlayer) SetPlaying(playing bool) { fp.playing = playing }
 
 func TestHandleOptions(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
 	req := rtsp.NewRequest()
-	req.Headers["Apple-Challenge"] = "gY3cmhtK9LnECNUlXFb0qg=="
+	req.Headers.Set("Apple-Challenge", "gY3cmhtK9LnECNUlXFb0qg==")
 	resp := rtsp.NewResponse()
 	localAddress := "192.168.0.15"
 	remoteAddress := "10.0.0.0"
-	handleOptions(req, resp, localAddress, remoteAddress)
+	a.handleOptions(req, resp, rtsp.NewContext(1, localAddress, remoteAddress))
 	if resp.Status != rtsp.Ok {
 		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", rtsp.Ok.String(), resp.Status.String()))
 	}
-	_, ok := resp.Headers["Public"]
+	ok := resp.Headers.Has("Public")
 	if !ok {
 		t.Error(fmt.Sprintf("Expected to have Public header"))
 	}
 	// we don't actually care about the generated value (that is tested in another test)
-	_, ok = resp.Headers["Apple-Response"]
+	ok = resp.Headers.Has("Apple-Response")
 	if !ok {
 		t.Error(fmt.Sprintf("Expected to have Apple-Response header"))
 	}
@@ -54,17 +79,18 @@ func TestHandleSetup(t *testing.T) {
 	a := NewAirplayServer(444, "Test", &FakePlayer{})
 	s := rtsp.NewSession(sdp.NewSessionDescription(), nil)
 	req := rtsp.NewRequest()
-	req.Headers["Transport"] = "RTP/AVP/UDP;unicast;interleaved=0-1;mode=record;control_port=8888;timing_port=8889"
+	req.Headers.Set("Transport", "RTP/AVP/UDP;unicast;interleaved=0-1;mode=record;control_port=8888;timing_port=8889")
 	resp := rtsp.NewResponse()
 	localAddress := "192.168.0.15"
 	remoteAddress := "10.0.0.0"
 	as := newAirplaySession(s, nil)
-	a.sessions.addSession(remoteAddress, as)
-	a.handleSetup(req, resp, localAddress, remoteAddress)
+	as.clientKey = clientKey(req, remoteAddress)
+	a.sessions.addSession(as)
+	a.handleSetup(req, resp, rtsp.NewContext(1, localAddress, remoteAddress))
 	if resp.Status != rtsp.Ok {
 		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", rtsp.Ok.String(), resp.Status.String()))
 	}
-	retrievedSession := a.sessions.getSession(remoteAddress).session
+	retrievedSession := a.sessions.getSession(as.id).session
 	if retrievedSession.RemotePorts.Address != remoteAddress {
 		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", remoteAddress, retrievedSession.RemotePorts.Address))
 	}
@@ -74,18 +100,23 @@ func TestHandleSetup(t *testing.T) {
 	if retrievedSession.RemotePorts.Timing != 8889 {
 		t.Error(fmt.Sprintf("Expected: %d\r\n Got: %d", 8889, retrievedSession.RemotePorts.Timing))
 	}
-	_, ok := resp.Headers["Transport"]
+	ok := resp.Headers.Has("Transport")
 	if !ok {
 		t.Error(fmt.Sprintf("Expected to have Transport header"))
 	}
-	val, ok := resp.Headers["Session"]
+	ok = resp.Headers.Has("Session")
+	val := resp.Headers.Get("Session")
 	if !ok {
 		t.Error(fmt.Sprintf("Expected to have Session header"))
 	}
-	if val != "1" {
-		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", "1", val))
+	if val != as.id {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", as.id, val))
+	}
+	if as.getState() != SessionSetUp {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", SessionSetUp, as.getState()))
 	}
-	val, ok = resp.Headers["Audio-Jack-Status"]
+	ok = resp.Headers.Has("Audio-Jack-Status")
+	val = resp.Headers.Get("Audio-Jack-Status")
 	if !ok {
 		t.Error(fmt.Sprintf("Expected to have Transport header"))
 	}
@@ -94,6 +125,124 @@ func TestHandleSetup(t *testing.T) {
 	}
 }
 
+type LatencyPlayer struct {
+	FakePlayer
+	latency player.Latency
+}
+
+func (lp *LatencyPlayer) GetLatency() player.Latency { return lp.latency }
+
+func sendRecord(t *testing.T, a *AirplayServer, req *rtsp.Request) *rtsp.Response {
+	s := rtsp.NewSession(sdp.NewSessionDescription(), nil)
+	if err := s.InitReceive(); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	remoteAddress := "10.0.0.0"
+	as := newAirplaySession(s, nil)
+	as.clientKey = clientKey(req, remoteAddress)
+	as.setState(SessionSetUp)
+	a.sessions.addSession(as)
+	defer a.closeSession(as.id, ReasonTeardown)
+	resp := rtsp.NewResponse()
+	a.handleRecord(req, resp, rtsp.NewContext(1, "192.168.0.15", remoteAddress))
+	if resp.Status != rtsp.Ok {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", rtsp.Ok.String(), resp.Status.String()))
+	}
+	return resp
+}
+
+func TestHandleRecordDefaultLatency(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	resp := sendRecord(t, a, rtsp.NewRequest())
+	if resp.Headers.Get("Audio-Latency") != "2205" {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", "2205", resp.Headers.Get("Audio-Latency")))
+	}
+}
+
+func TestHandleRecordPlayerLatency(t *testing.T) {
+	lp := &LatencyPlayer{latency: player.Latency{Buffer: 100 * time.Millisecond, Sink: 50 * time.Millisecond, Forwarding: 50 * time.Millisecond}}
+	a := NewAirplayServer(444, "Test", lp)
+	resp := sendRecord(t, a, rtsp.NewRequest())
+	// 200ms at 44.1kHz
+	if resp.Headers.Get("Audio-Latency") != "8820" {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", "8820", resp.Headers.Get("Audio-Latency")))
+	}
+}
+
+func TestHandleRecordRequestedLatency(t *testing.T) {
+	lp := &LatencyPlayer{latency: player.Latency{Buffer: 100 * time.Millisecond}}
+	a := NewAirplayServer(444, "Test", lp)
+	req := rtsp.NewRequest()
+	req.Headers.Set("Audio-Latency", "11025")
+	resp := sendRecord(t, a, req)
+	if resp.Headers.Get("Audio-Latency") != "11025" {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", "11025", resp.Headers.Get("Audio-Latency")))
+	}
+}
+
+func TestHandleGetParameterVolume(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{volume: 0.5})
+	req := rtsp.NewRequest()
+	req.Headers.Set("Content-Type", "text/parameters")
+	req.Body = []byte("volume\r\n")
+	resp := rtsp.NewResponse()
+	a.handleGetParameter(req, resp, rtsp.NewContext(1, "192.168.0.15", "10.0.0.0"))
+	if resp.Status != rtsp.Ok {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", rtsp.Ok.String(), resp.Status.String()))
+	}
+	volume := rtsp.ParseParameters(resp.Body)["volume"]
+	if volume != "-15.000000" {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", "-15.000000", volume))
+	}
+}
+
+func TestHandleGetParameterMuted(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{volume: 0.5, muted: true})
+	req := rtsp.NewRequest()
+	req.Headers.Set("Content-Type", "text/parameters")
+	req.Body = []byte("volume\r\n")
+	resp := rtsp.NewResponse()
+	a.handleGetParameter(req, resp, rtsp.NewContext(1, "192.168.0.15", "10.0.0.0"))
+	volume := rtsp.ParseParameters(resp.Body)["volume"]
+	if volume != "-144.000000" {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", "-144.000000", volume))
+	}
+}
+
+func TestHandleGetParameterProgress(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{position: 10 * time.Second, duration: time.Minute})
+	req := rtsp.NewRequest()
+	req.Headers.Set("Content-Type", "text/parameters")
+	req.Body = []byte("progress\r\n")
+	resp := rtsp.NewResponse()
+	a.handleGetParameter(req, resp, rtsp.NewContext(1, "192.168.0.15", "10.0.0.0"))
+	progress := rtsp.ParseParameters(resp.Body)["progress"]
+	if progress != "0/441000/2646000" {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", "0/441000/2646000", progress))
+	}
+}
+
+func TestHandleGetParameterKeepAlive(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	resp := rtsp.NewResponse()
+	a.handleGetParameter(rtsp.NewRequest(), resp, rtsp.NewContext(1, "192.168.0.15", "10.0.0.0"))
+	if resp.Status != rtsp.Ok {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", rtsp.Ok.String(), resp.Status.String()))
+	}
+	if len(resp.Body) != 0 {
+		t.Error(fmt.Sprintf("Expected empty body\r\n Got: %s", resp.Body))
+	}
+}
+
+func TestVolumeRoundTrip(t *testing.T) {
+	for _, vol := range []float64{0, 0.25, 0.5, 1} {
+		normalized := normalizeVolume(denormalizeVolume(vol))
+		if normalized != vol {
+			t.Error(fmt.Sprintf("Expected: %f\r\n Got: %f", vol, normalized))
+		}
+	}
+}
+
 func TestChangeName(t *testing.T) {
 	a := NewAirplayServer(444, "Test", &FakePlayer{})
 	err := a.ChangeName("Foo")
@@ -145,13 +294,13 @@ func TestNotMuteNoHeader(t *testing.T) {
 	fp := &FakePlayer{muted: false}
 	a := NewAirplayServer(444, "Test", fp)
 	req := rtsp.NewRequest()
-	req.Headers["Content-Type"] = "text/parameters"
+	req.Headers.Set("Content-Type", "text/parameters")
 	req.Body = []byte("volume:111")
 	resp := rtsp.NewResponse()
 
 	localAddress := "192.168.0.15"
 	remoteAddress := "10.0.0.0"
-	a.handlSetParameter(req, resp, localAddress, remoteAddress)
+	a.handlSetParameter(req, resp, rtsp.NewContext(1, localAddress, remoteAddress))
 	if resp.Status != rtsp.Ok {
 		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", rtsp.Ok.String(), resp.Status.String()))
 	}
@@ -165,14 +314,14 @@ func TestMuteWithHeader(t *testing.T) {
 	fp := &FakePlayer{muted: false}
 	a := NewAirplayServer(444, "Test", fp)
 	req := rtsp.NewRequest()
-	req.Headers["Content-Type"] = "text/parameters"
-	req.Headers["X-BCG-Muted"] = "muted"
+	req.Headers.Set("Content-Type", "text/parameters")
+	req.Headers.Set("X-BCG-Muted", "muted")
 	req.Body = []byte("volume:111")
 	resp := rtsp.NewResponse()
 
 	localAddress := "192.168.0.15"
 	remoteAddress := "10.0.0.0"
-	a.handlSetParameter(req, resp, localAddress, remoteAddress)
+	a.handlSetParameter(req, resp, rtsp.NewContext(1, localAddress, remoteAddress))
 	if resp.Status != rtsp.Ok {
 		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", rtsp.Ok.String(), resp.Status.String()))
 	}
@@ -186,14 +335,14 @@ func TestUnMuteWithHeader(t *testing.T) {
 	fp := &FakePlayer{muted: false}
 	a := NewAirplayServer(444, "Test", fp)
 	req := rtsp.NewRequest()
-	req.Headers["Content-Type"] = "text/parameters"
-	req.Headers["X-BCG-Muted"] = "unmuted"
+	req.Headers.Set("Content-Type", "text/parameters")
+	req.Headers.Set("X-BCG-Muted", "unmuted")
 	req.Body = []byte("volume:111")
 	resp := rtsp.NewResponse()
 
 	localAddress := "192.168.0.15"
 	remoteAddress := "10.0.0.0"
-	a.handlSetParameter(req, resp, localAddress, remoteAddress)
+	a.handlSetParameter(req, resp, rtsp.NewContext(1, localAddress, remoteAddress))
 	if resp.Status != rtsp.Ok {
 		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", rtsp.Ok.String(), resp.Status.String()))
 	}
@@ -207,13 +356,13 @@ func TestChangeVolumeDoesntUnmute(t *testing.T) {
 	fp := &FakePlayer{muted: true}
 	a := NewAirplayServer(444, "Test", fp)
 	req := rtsp.NewRequest()
-	req.Headers["Content-Type"] = "text/parameters"
+	req.Headers.Set("Content-Type", "text/parameters")
 	req.Body = []byte("volume:111")
 	resp := rtsp.NewResponse()
 
 	localAddress := "192.168.0.15"
 	remoteAddress := "10.0.0.0"
-	a.handlSetParameter(req, resp, localAddress, remoteAddress)
+	a.handlSetParameter(req, resp, rtsp.NewContext(1, localAddress, remoteAddress))
 	if resp.Status != rtsp.Ok {
 		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", rtsp.Ok.String(), resp.Status.String()))
 	}
@@ -227,24 +376,213 @@ func TestSetMetadata(t *testing.T) {
 	fp := &FakePlayer{muted: true}
 	a := NewAirplayServer(444, "Test", fp)
 	req := rtsp.NewRequest()
-	req.Headers["Content-Type"] = "application/x-dmap-tagged"
+	req.Headers.Set("Content-Type", "application/x-dmap-tagged")
 	req.Body = []byte{109, 108, 105, 116, 0, 0, 6, 17, 109, 105, 107, 100, 0, 0, 0, 1, 2, 97, 115, 97, 108, 0, 0, 0, 13, 80, 104, 97, 110, 116, 111, 109, 32, 80, 111, 119, 101, 114, 97, 115, 97, 114, 0, 0, 0, 18, 84, 104, 101, 32, 84, 114, 97, 103, 105, 99, 97, 108, 108, 121, 32, 72, 105, 112, 97, 115, 98, 114, 0, 0, 0, 2, 1, 0, 97, 115, 99, 109, 0, 0, 0, 0, 97, 115, 99, 111, 0, 0, 0, 1, 0, 97, 115, 99, 112, 0, 0, 0, 85, 84, 104, 101, 32, 84, 114, 97, 103, 105, 99, 97, 108, 108, 121, 32, 72, 105, 112, 44, 32, 71, 111, 114, 100, 32, 68, 111, 119, 110, 105, 101, 44, 32, 82, 111, 98, 32, 66, 97, 107, 101, 114, 44, 32, 74, 111, 104, 110, 110, 121, 32, 70, 97, 121, 44, 32, 80, 97, 117, 108, 32, 76, 97, 110, 103, 108, 111, 105, 115, 32, 38, 32, 71, 111, 114, 100, 32, 83, 105, 110, 99, 108, 97, 105, 114, 109, 101, 105, 97, 0, 0, 0, 4, 90, 156, 21, 211, 97, 115, 100, 97, 0, 0, 0, 4, 90, 156, 21, 211, 109, 101, 105, 112, 0, 0, 0, 4, 131, 218, 135, 192, 97, 115, 112, 108, 0, 0, 0, 4, 131, 218, 135, 192, 97, 115, 100, 109, 0, 0, 0, 4, 90, 156, 97, 42, 97, 115, 100, 99, 0, 0, 0, 2, 0, 1, 97, 115, 100, 110, 0, 0, 0, 2, 0, 1, 97, 115, 101, 113, 0, 0, 0, 0, 97, 115, 103, 110, 0, 0, 0, 3, 80, 111, 112, 97, 115, 100, 116, 0, 0, 0, 24, 80, 117, 114, 99, 104, 97, 115, 101, 100, 32, 65, 65, 67, 32, 97, 117, 100, 105, 111, 32, 102, 105, 108, 101, 97, 115, 114, 118, 0, 0, 0, 1, 0, 97, 115, 115, 114, 0, 0, 0, 4, 0, 0, 172, 68, 97, 115, 115, 122, 0, 0, 0, 4, 0, 168, 248, 12, 97, 115, 115, 116, 0, 0, 0, 4, 0, 0, 0, 0, 97, 115, 115, 112, 0, 0, 0, 4, 0, 0, 0, 0, 97, 115, 116, 109, 0, 0, 0, 4, 0, 4, 129, 205, 97, 115, 116, 99, 0, 0, 0, 2, 0, 12, 97, 115, 116, 110, 0, 0, 0, 2, 0, 4, 97, 115, 117, 114, 0, 0, 0, 1, 0, 97, 115, 121, 114, 0, 0, 0, 2, 7, 206, 97, 115, 102, 109, 0, 0, 0, 3, 109, 52, 97, 109, 105, 105, 100, 0, 0, 0, 4, 0, 0, 193, 161, 109, 105, 110, 109, 0, 0, 0, 10, 66, 111, 98, 99, 97, 121, 103, 101, 111, 110, 109, 112, 101, 114, 0, 0, 0, 8, 54, 178, 28, 207, 201, 245, 87, 79, 97, 115, 100, 98, 0, 0, 0, 1, 0, 97, 101, 78, 86, 0, 0, 0, 4, 0, 0, 10, 60, 97, 115, 100, 107, 0, 0, 0, 1, 0, 97, 115, 98, 116, 0, 0, 0, 2, 0, 0, 97, 103, 114, 112, 0, 0, 0, 0, 97, 101, 83, 73, 0, 0, 0, 8, 0, 0, 0, 0, 58, 50, 211, 210, 97, 101, 65, 73, 0, 0, 0, 4, 0, 2, 113, 152, 97, 101, 80, 73, 0, 0, 0, 4, 58, 50, 211, 206, 97, 101, 67, 73, 0, 0, 0, 4, 1, 181, 202, 54, 97, 101, 71, 73, 0, 0, 0, 4, 0, 0, 0, 14, 97, 115, 99, 100, 0, 0, 0, 4, 109, 112, 52, 97, 97, 115, 99, 115, 0, 0, 0, 4, 0, 0, 0, 2, 97, 101, 83, 70, 0, 0, 0, 4, 0, 2, 48, 95, 97, 101, 80, 67, 0, 0, 0, 1, 0, 97, 115, 99, 116, 0, 0, 0, 0, 97, 115, 99, 110, 0, 0, 0, 0, 97, 115, 99, 114, 0, 0, 0, 1, 0, 97, 101, 72, 86, 0, 0, 0, 1, 0, 97, 101, 77, 75, 0, 0, 0, 1, 1, 97, 101, 83, 78, 0, 0, 0, 0, 97, 101, 69, 78, 0, 0, 0, 0, 97, 101, 69, 83, 0, 0, 0, 4, 0, 0, 0, 0, 97, 101, 83, 85, 0, 0, 0, 4, 0, 0, 0, 0, 97, 101, 71, 72, 0, 0, 0, 4, 0, 0, 0, 1, 97, 101, 71, 68, 0, 0, 0, 4, 0, 0, 1, 20, 97, 101, 71, 85, 0, 0, 0, 8, 0, 0, 0, 0, 0, 198, 194, 172, 97, 101, 71, 82, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0, 0, 97, 101, 71, 69, 0, 0, 0, 4, 0, 0, 8, 64, 97, 115, 97, 97, 0, 0, 0, 18, 84, 104, 101, 32, 84, 114, 97, 103, 105, 99, 97, 108, 108, 121, 32, 72, 105, 112, 97, 115, 103, 112, 0, 0, 0, 1, 0, 109, 101, 120, 116, 0, 0, 0, 2, 0, 1, 97, 115, 101, 100, 0, 0, 0, 2, 0, 1, 97, 115, 100, 114, 0, 0, 0, 4, 53, 171, 1, 240, 97, 115, 100, 112, 0, 0, 0, 4, 90, 156, 92, 35, 97, 115, 104, 112, 0, 0, 0, 1, 1, 97, 115, 115, 110, 0, 0, 0, 10, 66, 111, 98, 99, 97, 121, 103, 101, 111, 110, 97, 115, 115, 97, 0, 0, 0, 14, 84, 114, 97, 103, 105, 99, 97, 108, 108, 121, 32, 72, 105, 112, 97, 115, 115, 108, 0, 0, 0, 14, 84, 114, 97, 103, 105, 99, 97, 108, 108, 121, 32, 72, 105, 112, 97, 115, 115, 117, 0, 0, 0, 13, 80, 104, 97, 110, 116, 111, 109, 32, 80, 111, 119, 101, 114, 97, 115, 115, 99, 0, 0, 0, 81, 84, 114, 97, 103, 105, 99, 97, 108, 108, 121, 32, 72, 105, 112, 44, 32, 71, 111, 114, 100, 32, 68, 111, 119, 110, 105, 101, 44, 32, 82, 111, 98, 32, 66, 97, 107, 101, 114, 44, 32, 74, 111, 104, 110, 110, 121, 32, 70, 97, 121, 44, 32, 80, 97, 117, 108, 32, 76, 97, 110, 103, 108, 111, 105, 115, 32, 38, 32, 71, 111, 114, 100, 32, 83, 105, 110, 99, 108, 97, 105, 114, 97, 115, 115, 115, 0, 0, 0, 0, 97, 115, 98, 107, 0, 0, 0, 1, 0, 97, 115, 112, 117, 0, 0, 0, 0, 97, 101, 67, 82, 0, 0, 0, 0, 97, 115, 97, 105, 0, 0, 0, 8, 208, 203, 58, 24, 226, 64, 152, 237, 97, 115, 108, 115, 0, 0, 0, 8, 0, 0, 0, 0, 0, 168, 248, 12, 97, 101, 83, 69, 0, 0, 0, 8, 0, 0, 0, 0, 1, 182, 58, 229, 97, 101, 68, 86, 0, 0, 0, 4, 0, 0, 0, 0, 97, 101, 68, 80, 0, 0, 0, 4, 0, 0, 0, 0, 97, 101, 68, 82, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0, 0, 97, 101, 78, 68, 0, 0, 0, 8, 0, 0, 0, 0, 10, 81, 194, 42, 97, 101, 75, 49, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0, 0, 97, 101, 75, 50, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0, 0, 97, 101, 68, 76, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0, 0, 97, 101, 70, 65, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0, 0, 97, 101, 88, 68, 0, 0, 0, 27, 85, 110, 105, 118, 101, 114, 115, 97, 108, 58, 105, 115, 114, 99, 58, 67, 65, 77, 49, 57, 57, 55, 48, 48, 48, 55, 55, 97, 101, 77, 107, 0, 0, 0, 4, 0, 0, 0, 1, 97, 101, 77, 88, 0, 0, 0, 0, 97, 115, 112, 99, 0, 0, 0, 4, 0, 0, 0, 0, 97, 115, 114, 105, 0, 0, 0, 8, 172, 234, 51, 131, 12, 228, 253, 219, 97, 101, 67, 83, 0, 0, 0, 4, 0, 2, 195, 138, 97, 115, 107, 112, 0, 0, 0, 4, 0, 0, 0, 0, 97, 115, 97, 99, 0, 0, 0, 2, 0, 1, 97, 115, 107, 100, 0, 0, 0, 4, 131, 218, 135, 192, 109, 100, 115, 116, 0, 0, 0, 1, 1, 97, 115, 101, 115, 0, 0, 0, 1, 0, 97, 101, 67, 100, 0, 0, 0, 8, 0, 0, 191, 7, 202, 214, 154, 229, 97, 101, 67, 85, 0, 0, 0, 8, 0, 0, 0, 0, 10, 81, 194, 42, 97, 115, 114, 115, 0, 0, 0, 1, 0, 97, 115, 108, 114, 0, 0, 0, 1, 0, 97, 115, 97, 115, 0, 0, 0, 1, 32, 97, 101, 67, 70, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0, 2, 97, 101, 67, 75, 0, 0, 0, 1, 2, 97, 101, 71, 115, 0, 0, 0, 1, 1, 97, 101, 108, 115, 0, 0, 0, 1, 0, 97, 106, 97, 108, 0, 0, 0, 1, 0, 97, 106, 99, 65, 0, 0, 0, 1, 0, 97, 119, 114, 107, 0, 0, 0, 0, 97, 109, 118, 109, 0, 0, 0, 0, 97, 109, 118, 99, 0, 0, 0, 2, 0, 0, 97, 109, 118, 110, 0, 0, 0, 2, 0, 0, 97, 106, 117, 119, 0, 0, 0, 1, 0}
 	resp := rtsp.NewResponse()
 
 	localAddress := "192.168.0.15"
 	remoteAddress := "10.0.0.0"
-	a.handlSetParameter(req, resp, localAddress, remoteAddress)
+	a.handlSetParameter(req, resp, rtsp.NewContext(1, localAddress, remoteAddress))
 	if resp.Status != rtsp.Ok {
 		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", rtsp.Ok.String(), resp.Status.String()))
 	}
-	if fp.artist != "The Tragically Hip" {
-		t.Error(fmt.Sprintf("Expected: The Tragically Hip\r\n Got: %s", fp.artist))
+	if fp.track.Artist != "The Tragically Hip" {
+		t.Error(fmt.Sprintf("Expected: The Tragically Hip\r\n Got: %s", fp.track.Artist))
+	}
+	if fp.track.Album != "Phantom Power" {
+		t.Error(fmt.Sprintf("Expected: Phantom Power\r\n Got: %s", fp.track.Album))
 	}
-	if fp.album != "Phantom Power" {
-		t.Error(fmt.Sprintf("Expected: Phantom Power\r\n Got: %s", fp.album))
+	if fp.track.Title != "Bobcaygeon" {
+		t.Error(fmt.Sprintf("Expected: Bobcaygeon\r\n Got: %s", fp.track.Title))
 	}
-	if fp.title != "Bobcaygeon" {
-		t.Error(fmt.Sprintf("Expected: Bobcaygeon\r\n Got: %s", fp.title))
+	if fp.track.Genre != "Pop" {
+		t.Error(fmt.Sprintf("Expected: Pop\r\n Got: %s", fp.track.Genre))
 	}
 
 }
+
+func TestPasswordTextRecord(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	records := strings.Join(a.textRecords(), " ")
+	if !strings.Contains(records, "pw=false") {
+		t.Error(fmt.Sprintf("Expected: pw=false\r\n Got: %s", records))
+	}
+	a.SetPassword("hip")
+	records = strings.Join(a.textRecords(), " ")
+	if !strings.Contains(records, "pw=true") {
+		t.Error(fmt.Sprintf("Expected: pw=true\r\n Got: %s", records))
+	}
+	// we aren't advertising, so the rest of the cluster doesn't need the password
+	req := rtsp.NewRequest()
+	req.Method = rtsp.Announce
+	if pw := a.authPassword(req, rtsp.NewContext(1, "192.168.0.15", "10.0.0.0")); pw != "" {
+		t.Error(fmt.Sprintf("Expected no password\r\n Got: %s", pw))
+	}
+}
+
+func TestPasswordControlRequests(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	a.SetPassword("hip")
+	// pretend we are advertising
+	a.zerconfServer = &zeroconf.Server{}
+	req := rtsp.NewRequest()
+	req.Method = rtsp.Set_Parameter
+	// without a cluster, everyone needs the password
+	if pw := a.authPassword(req, rtsp.NewContext(1, "192.168.0.15", "10.0.0.1")); pw != "hip" {
+		t.Error(fmt.Sprintf("Expected: hip\r\n Got: %s", pw))
+	}
+	a.SetClusterPeers(func(address string) bool { return address == "10.0.0.1" })
+	if pw := a.authPassword(req, rtsp.NewContext(1, "192.168.0.15", "10.0.0.1")); pw != "" {
+		t.Error(fmt.Sprintf("Expected no password\r\n Got: %s", pw))
+	}
+	if pw := a.authPassword(req, rtsp.NewContext(1, "192.168.0.15", "10.0.0.2")); pw != "hip" {
+		t.Error(fmt.Sprintf("Expected: hip\r\n Got: %s", pw))
+	}
+	// requests in a session always need it
+	req.Headers.Set("Session", "1111")
+	if pw := a.authPassword(req, rtsp.NewContext(1, "192.168.0.15", "10.0.0.1")); pw != "hip" {
+		t.Error(fmt.Sprintf("Expected: hip\r\n Got: %s", pw))
+	}
+}
+
+func TestStartStop(t *testing.T) {
+	a := NewAirplayServer(0, "Test", &FakePlayer{})
+	// the server should be able to start again once stopped
+	for i := 0; i < 2; i++ {
+		started := make(chan error)
+		go func() { started <- a.Start(context.Background(), false, false) }()
+		// give the server a chance to start listening
+		time.Sleep(50 * time.Millisecond)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		if err := a.Stop(ctx); err != nil {
+			t.Error("Unexpected error", err)
+		}
+		cancel()
+		if err := <-started; err != nil {
+			t.Error("Unexpected error", err)
+		}
+	}
+}
+
+func TestStartPortInUse(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	a := NewAirplayServer(l.Addr().(*net.TCPAddr).Port, "Test", &FakePlayer{})
+	if err := a.Start(context.Background(), false, true); err == nil {
+		t.Error("Expected an error starting on a port in use")
+	}
+	if a.IsAdvertising() {
+		t.Error("Expected not to be advertising when we couldn't listen")
+	}
+}
+
+// PacketPlayer counts the packets it is sent
+type PacketPlayer struct {
+	FakePlayer
+	lock    sync.Mutex
+	packets int
+}
+
+func (pp *PacketPlayer) Play(session *rtsp.Session) {
+	go func() {
+		for range session.DataChan {
+			pp.lock.Lock()
+			pp.packets++
+			pp.lock.Unlock()
+		}
+	}()
+}
+
+func (pp *PacketPlayer) waitForPackets(t *testing.T, expected int) {
+	deadline := time.Now().Add(time.Second)
+	packets := 0
+	for time.Now().Before(deadline) {
+		pp.lock.Lock()
+		packets = pp.packets
+		pp.lock.Unlock()
+		if packets == expected {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error(fmt.Sprintf("Expected: %d packets\r\n Got: %d", expected, packets))
+}
+
+// serveTestAirplay serves the airplay protocol on a local port
+func serveTestAirplay(t *testing.T, a *AirplayServer) int {
+	// there is no sender to find
+	a.discoverDacp = func(ctx context.Context, dacpID string) (string, int, error) {
+		return "", 0, errors.New("No sender")
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	go a.newRTSPServer(false).Serve(context.Background(), l)
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestCaptureReplay(t *testing.T) {
+	captured := &PacketPlayer{}
+	a := NewAirplayServer(0, "Captured", captured)
+	var capture bytes.Buffer
+	recorder, err := rtsp.NewRecorder(&capture)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	a.SetRecorder(recorder)
+	port := serveTestAirplay(t, a)
+	defer a.Stop(context.Background())
+
+	// stream to the server like another node would
+	session, err := EstablishSession("127.0.0.1", port)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if err := session.StartSending(); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	for i := 0; i < 10; i++ {
+		session.DataChan <- []byte{0x80, 0x60, 0, byte(i)}
+	}
+	captured.waitForPackets(t, 10)
+	close(session.DataChan)
+
+	records, err := rtsp.ReadCapture(&capture)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	replayed := &PacketPlayer{}
+	b := NewAirplayServer(0, "Replayed", replayed)
+	replayPort := serveTestAirplay(t, b)
+	defer b.Stop(context.Background())
+	if err := rtsp.Replay(context.Background(), records, "127.0.0.1", replayPort, false); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	replayed.waitForPackets(t, 10)
+}
+
+// TestReplayCapturedForwarding replays traffic captured from a zone leader forwarding to
+// one of its followers, which any change to how we answer it should keep working
+func TestReplayCapturedForwarding(t *testing.T) {
+	f, err := os.Open("testdata/capture/forwarding.cap")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer f.Close()
+	records, err := rtsp.ReadCapture(f)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	replayed := &PacketPlayer{}
+	a := NewAirplayServer(0, "Replayed", replayed)
+	port := serveTestAirplay(t, a)
+	defer a.Stop(context.Background())
+	if err := rtsp.Replay(context.Background(), records, "127.0.0.1", port, false); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	replayed.waitForPackets(t, 10)
+}
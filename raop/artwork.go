@@ -0,0 +1,27 @@
+package raop
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// the artwork types we can make thumbnails of
+var artworkTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+// parseArtwork parses the artwork senders send with SET_PARAMETER, returning the artwork and its
+// type.  Senders don't always label it correctly, so the type is sniffed from the artwork itself.
+// image/none, or no artwork at all, clears the artwork
+func parseArtwork(contentType string, body []byte) ([]byte, string, error) {
+	if contentType == "image/none" || len(body) == 0 {
+		return nil, "", nil
+	}
+	mimeType := http.DetectContentType(body)
+	if !artworkTypes[mimeType] {
+		return nil, "", fmt.Errorf("Unsupported artwork: %s (sent as %s)", mimeType, contentType)
+	}
+	return body, mimeType, nil
+}
@@ -0,0 +1,93 @@
+package raop
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/nstehr/bobcaygeon/rtsp"
+)
+
+func encodedImage(t *testing.T, format string) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	var buf bytes.Buffer
+	var err error
+	if format == "png" {
+		err = png.Encode(&buf, img)
+	} else {
+		err = jpeg.Encode(&buf, img, nil)
+	}
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	return buf.Bytes()
+}
+
+func TestParseArtwork(t *testing.T) {
+	pngArtwork := encodedImage(t, "png")
+	artwork, mimeType, err := parseArtwork("image/png", pngArtwork)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if mimeType != "image/png" || !bytes.Equal(artwork, pngArtwork) {
+		t.Error(fmt.Sprintf("Expected: image/png\r\n Got: %s", mimeType))
+	}
+	// a png sent as a jpeg is still a png
+	_, mimeType, err = parseArtwork("image/jpeg", pngArtwork)
+	if err != nil || mimeType != "image/png" {
+		t.Error(fmt.Sprintf("Expected: image/png\r\n Got: %s (%v)", mimeType, err))
+	}
+	_, mimeType, err = parseArtwork("image/jpeg", encodedImage(t, "jpeg"))
+	if err != nil || mimeType != "image/jpeg" {
+		t.Error(fmt.Sprintf("Expected: image/jpeg\r\n Got: %s (%v)", mimeType, err))
+	}
+}
+
+func TestParseArtworkClears(t *testing.T) {
+	for _, body := range [][]byte{nil, []byte("ignored")} {
+		artwork, mimeType, err := parseArtwork("image/none", body)
+		if err != nil || artwork != nil || mimeType != "" {
+			t.Error(fmt.Sprintf("Expected no artwork\r\n Got: %s %d bytes (%v)", mimeType, len(artwork), err))
+		}
+	}
+	if artwork, _, err := parseArtwork("image/jpeg", nil); err != nil || artwork != nil {
+		t.Error(fmt.Sprintf("Expected no artwork\r\n Got: %d bytes (%v)", len(artwork), err))
+	}
+}
+
+func TestParseArtworkUnsupported(t *testing.T) {
+	if _, _, err := parseArtwork("image/jpeg", []byte("not an image at all")); err == nil {
+		t.Error("Expected error parsing artwork that isn't an image")
+	}
+}
+
+func TestSetArtworkParameter(t *testing.T) {
+	fp := &FakePlayer{}
+	a := NewAirplayServer(444, "Test", fp)
+	req := rtsp.NewRequest()
+	req.Headers.Set("Content-Type", "image/png")
+	req.Body = encodedImage(t, "png")
+	resp := rtsp.NewResponse()
+	a.handlSetParameter(req, resp, rtsp.NewContext(1, "192.168.0.15", "10.0.0.0"))
+	if resp.Status != rtsp.Ok {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", rtsp.Ok.String(), resp.Status.String()))
+	}
+	if fp.artworkType != "image/png" || len(fp.artwork) == 0 {
+		t.Error(fmt.Sprintf("Expected: image/png\r\n Got: %s", fp.artworkType))
+	}
+
+	// the next track has no artwork
+	req = rtsp.NewRequest()
+	req.Headers.Set("Content-Type", "image/none")
+	resp = rtsp.NewResponse()
+	a.handlSetParameter(req, resp, rtsp.NewContext(1, "192.168.0.15", "10.0.0.0"))
+	if resp.Status != rtsp.Ok {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", rtsp.Ok.String(), resp.Status.String()))
+	}
+	if fp.artwork != nil || fp.artworkType != "" {
+		t.Error(fmt.Sprintf("Expected artwork to be cleared\r\n Got: %s", fp.artworkType))
+	}
+}
@@ -40,6 +40,8 @@ func EstablishSession(ip string, port int) (*rtsp.Session, error) {
 	if err != nil {
 		return nil, err
 	}
+	// the session doesn't depend on the connection, control requests go through their own
+	defer client.Close()
 	sessionDescription := sdp.NewSessionDescription()
 	session := rtsp.NewSession(sessionDescription, nil)
 	session.RemotePorts.Address = client.RemoteAddress()
@@ -58,6 +60,40 @@ func EstablishSession(ip string, port int) (*rtsp.Session, error) {
 	return session, nil
 }
 
+// GetVolume asks the airplay server at the given address for its volume,
+// between 0 (mute) and 1 (full volume), using the pool's connection to it
+func GetVolume(clients *rtsp.ClientPool, ip string, port int) (float64, error) {
+	client, err := clients.Get(ip, port)
+	if err != nil {
+		return 0, err
+	}
+	volume, err := client.GetVolume()
+	if err != nil {
+		return 0, err
+	}
+	return normalizeVolume(volume), nil
+}
+
+// GetProgress asks the airplay server at the given address how far into the track it is,
+// and how long the track is, using the pool's connection to it
+func GetProgress(clients *rtsp.ClientPool, ip string, port int) (time.Duration, time.Duration, error) {
+	client, err := clients.Get(ip, port)
+	if err != nil {
+		return 0, 0, err
+	}
+	progress, err := client.GetProgress()
+	if err != nil {
+		return 0, 0, err
+	}
+	return parseProgress(progress)
+}
+
+// AirplayVolume maps a volume between 0 (mute) and 1 (full volume) to an airplay volume,
+// the way senders send it
+func AirplayVolume(volume float64) float64 {
+	return denormalizeVolume(volume)
+}
+
 // our state functions below, emulating the airplay protocol, leaving
 // out things like the encrypting and apple-challenge
 
@@ -82,7 +118,7 @@ func announce(client *rtsp.Client, session *rtsp.Session) (stateFn, error) {
 	sessionID := strconv.FormatInt(time.Now().Unix(), 10)
 	localAddress := client.LocalAddress()
 	req.RequestURI = fmt.Sprintf("rtsp://%s/%s", localAddress, sessionID)
-	req.Headers["Content-Type"] = "application/sdp"
+	req.Headers.Set("Content-Type", "application/sdp")
 	// build the SDP payload
 	sessionDescription := session.Description
 	origin := sdp.Origin{}
@@ -135,7 +171,7 @@ func setup(client *rtsp.Client, session *rtsp.Session) (stateFn, error) {
 	localAddress := client.LocalAddress()
 	req.RequestURI = fmt.Sprintf("rtsp://%s/%s", localAddress, session.Description.Origin.SessionID)
 	// hardcoded for now
-	req.Headers["Transport"] = "RTP/AVP/UDP;unicast;interleaved=0-1;mode=record;control_port=8888;timing_port=8889"
+	req.Headers.Set("Transport", "RTP/AVP/UDP;unicast;interleaved=0-1;mode=record;control_port=8888;timing_port=8889")
 	resp, err := client.Send(req)
 	if err != nil {
 		return nil, err
@@ -143,7 +179,7 @@ func setup(client *rtsp.Client, session *rtsp.Session) (stateFn, error) {
 	if resp.Status != rtsp.Ok {
 		return nil, fmt.Errorf("Non-ok status returned: %s", resp.Status.String())
 	}
-	transport := resp.Headers["Transport"]
+	transport := resp.Headers.Get("Transport")
 	transportParts := strings.Split(transport, ";")
 	var controlPort int
 	var timingPort int
@@ -163,6 +199,7 @@ func setup(client *rtsp.Client, session *rtsp.Session) (stateFn, error) {
 	session.RemotePorts.Control = controlPort
 	session.RemotePorts.Timing = timingPort
 	session.RemotePorts.Data = serverPort
+	session.ID = resp.Headers.Get("Session")
 
 	return record, nil
 }
@@ -172,6 +209,9 @@ func record(client *rtsp.Client, session *rtsp.Session) (stateFn, error) {
 	req.Method = rtsp.Record
 	localAddress := client.LocalAddress()
 	req.RequestURI = fmt.Sprintf("rtsp://%s/%s", localAddress, session.Description.Origin.SessionID)
+	if session.ID != "" {
+		req.Headers.Set("Session", session.ID)
+	}
 
 	resp, err := client.Send(req)
 	if err != nil {
@@ -3,121 +3,547 @@ package raop
 import (
 	"encoding/binary"
 	"fmt"
-	"log"
+	"math"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/nstehr/bobcaygeon/player"
+)
+
+// the types of data a DMAP tag can hold, and the go types they are parsed to
+const (
+	dmapByte        = "byte"        // uint8
+	dmapSignedByte  = "signedbyte"  // int8
+	dmapShort       = "short"       // uint16
+	dmapSignedShort = "signedshort" // int16
+	dmapInt         = "int"         // uint32
+	dmapSignedInt   = "signedint"   // int32
+	dmapLong        = "long"        // uint64
+	dmapSignedLong  = "signedlong"  // int64
+	dmapString      = "string"      // string
+	dmapDate        = "date"        // time.Time
+	dmapVersion     = "version"     // string, e.g: 3.0.2
+	dmapContainer   = "container"   // map[string]interface{}
 )
 
+// the width of the fixed size DMAP types
+var dmapWidths = map[string]int{
+	dmapByte:        1,
+	dmapSignedByte:  1,
+	dmapShort:       2,
+	dmapSignedShort: 2,
+	dmapInt:         4,
+	dmapSignedInt:   4,
+	dmapLong:        8,
+	dmapSignedLong:  8,
+	dmapDate:        4,
+	dmapVersion:     4,
+}
+
 type contentType struct {
 	code  string
 	name  string
 	cType string
 }
 
-// based on: https://github.com/kylewelsby/daap/blob/master/index.js
-func parseDaap(daap []byte) map[string]interface{} {
-	i := 8
+// the DMAP content codes, as iTunes, the Music app and Remote send them
+// based on: https://github.com/kylewelsby/daap/blob/master/index.js and forked-daapd's dmap_fields
+var contentTypes = []contentType{
+	{"mbcl", "dmap.bag", dmapContainer},
+	{"mccr", "dmap.contentcodesresponse", dmapContainer},
+	{"mcna", "dmap.contentcodesname", dmapString},
+	{"mcnm", "dmap.contentcodesnumber", dmapInt},
+	{"mcon", "dmap.container", dmapContainer},
+	{"mctc", "dmap.containercount", dmapInt},
+	{"mcti", "dmap.containeritemid", dmapInt},
+	{"mcty", "dmap.contentcodestype", dmapShort},
+	{"mdcl", "dmap.dictionary", dmapContainer},
+	{"mdst", "dmap.downloadstatus", dmapByte},
+	{"meds", "dmap.editcommandssupported", dmapInt},
+	{"meia", "dmap.itemdateadded", dmapDate},
+	{"meip", "dmap.itemdateplayed", dmapDate},
+	{"mext", "dmap.objectextradata", dmapShort},
+	{"miid", "dmap.itemid", dmapInt},
+	{"mikd", "dmap.itemkind", dmapByte},
+	{"mimc", "dmap.itemcount", dmapInt},
+	{"minm", "dmap.itemname", dmapString},
+	{"mlcl", "dmap.listing", dmapContainer},
+	{"mlid", "dmap.sessionid", dmapInt},
+	{"mlit", "dmap.listingitem", dmapContainer},
+	{"mlog", "dmap.loginresponse", dmapContainer},
+	{"mpco", "dmap.parentcontainerid", dmapInt},
+	{"mper", "dmap.persistentid", dmapLong},
+	{"mpro", "dmap.protocolversion", dmapVersion},
+	{"mrco", "dmap.returnedcount", dmapInt},
+	{"msal", "dmap.supportsautologout", dmapByte},
+	{"msas", "dmap.authenticationschemes", dmapInt},
+	{"msau", "dmap.authenticationmethod", dmapByte},
+	{"msbr", "dmap.supportsbrowse", dmapByte},
+	{"msdc", "dmap.databasescount", dmapInt},
+	{"msex", "dmap.supportsextensions", dmapByte},
+	{"msix", "dmap.supportsindex", dmapByte},
+	{"mslr", "dmap.loginrequired", dmapByte},
+	{"mspi", "dmap.supportspersistentids", dmapByte},
+	{"msqy", "dmap.supportsquery", dmapByte},
+	{"msrs", "dmap.supportsresolve", dmapByte},
+	{"msrv", "dmap.serverinforesponse", dmapContainer},
+	{"mstc", "dmap.utctime", dmapDate},
+	{"mstm", "dmap.timeoutinterval", dmapInt},
+	{"msto", "dmap.utcoffset", dmapSignedInt},
+	{"msts", "dmap.statusstring", dmapString},
+	{"mstt", "dmap.status", dmapInt},
+	{"msup", "dmap.supportsupdate", dmapByte},
+	{"mtco", "dmap.specifiedtotalcount", dmapInt},
+	{"mudl", "dmap.deletedidlisting", dmapContainer},
+	{"mupd", "dmap.updateresponse", dmapContainer},
+	{"musr", "dmap.serverrevision", dmapInt},
+	{"muty", "dmap.updatetype", dmapByte},
+
+	{"abal", "daap.browsealbumlisting", dmapContainer},
+	{"abar", "daap.browseartistlisting", dmapContainer},
+	{"abcp", "daap.browsecomposerlisting", dmapContainer},
+	{"abgn", "daap.browsegenrelisting", dmapContainer},
+	{"abro", "daap.databasebrowse", dmapContainer},
+	{"adbs", "daap.databasesongs", dmapContainer},
+	{"agrp", "daap.songgrouping", dmapString},
+	{"aply", "daap.databaseplaylists", dmapContainer},
+	{"apro", "daap.protocolversion", dmapVersion},
+	{"apso", "daap.playlistsongs", dmapContainer},
+	{"arif", "daap.resolveinfo", dmapContainer},
+	{"arsv", "daap.resolve", dmapContainer},
+	{"asaa", "daap.songalbumartist", dmapString},
+	{"asac", "daap.songartworkcount", dmapShort},
+	{"asai", "daap.songalbumid", dmapLong},
+	{"asal", "daap.songalbum", dmapString},
+	{"asar", "daap.songartist", dmapString},
+	{"asbk", "daap.bookmarkable", dmapByte},
+	{"asbr", "daap.songbitrate", dmapShort},
+	{"asbt", "daap.songbeatsperminute", dmapShort},
+	{"ascd", "daap.songcodectype", dmapInt},
+	{"ascm", "daap.songcomment", dmapString},
+	{"ascn", "daap.songcontentdescription", dmapString},
+	{"asco", "daap.songcompilation", dmapByte},
+	{"ascp", "daap.songcomposer", dmapString},
+	{"ascr", "daap.songcontentrating", dmapByte},
+	{"ascs", "daap.songcodecsubtype", dmapInt},
+	{"asct", "daap.songcategory", dmapString},
+	{"asda", "daap.songdateadded", dmapDate},
+	{"asdb", "daap.songdisabled", dmapByte},
+	{"asdc", "daap.songdisccount", dmapShort},
+	{"asdk", "daap.songdatakind", dmapByte},
+	{"asdm", "daap.songdatemodified", dmapDate},
+	{"asdn", "daap.songdiscnumber", dmapShort},
+	{"asdp", "daap.songdatepurchased", dmapDate},
+	{"asdr", "daap.songdatereleased", dmapDate},
+	{"asdt", "daap.songdescription", dmapString},
+	{"ased", "daap.songextradata", dmapShort},
+	{"aseq", "daap.songeqpreset", dmapString},
+	{"asfm", "daap.songformat", dmapString},
+	{"asgn", "daap.songgenre", dmapString},
+	{"asgp", "daap.songgapless", dmapByte},
+	{"ashp", "daap.songhasbeenplayed", dmapByte},
+	{"asky", "daap.songkeywords", dmapString},
+	{"aslc", "daap.songlongcontentdescription", dmapString},
+	{"asls", "daap.songlongsize", dmapLong},
+	{"aspl", "daap.songdateplayed", dmapDate},
+	{"aspu", "daap.songpodcasturl", dmapString},
+	{"asri", "daap.songartistid", dmapLong},
+	{"asrv", "daap.songrelativevolume", dmapSignedByte},
+	{"assa", "daap.sortartist", dmapString},
+	{"assc", "daap.sortcomposer", dmapString},
+	{"assl", "daap.sortalbumartist", dmapString},
+	{"assn", "daap.sortname", dmapString},
+	{"assp", "daap.songstoptime", dmapInt},
+	{"assr", "daap.songsamplerate", dmapInt},
+	{"asss", "daap.sortseriesname", dmapString},
+	{"asst", "daap.songstarttime", dmapInt},
+	{"assu", "daap.sortalbum", dmapString},
+	{"assz", "daap.songsize", dmapInt},
+	{"astc", "daap.songtrackcount", dmapShort},
+	{"astm", "daap.songtime", dmapInt},
+	{"astn", "daap.songtracknumber", dmapShort},
+	{"asul", "daap.songdataurl", dmapString},
+	{"asur", "daap.songuserrating", dmapByte},
+	{"asyr", "daap.songyear", dmapShort},
+	{"avdb", "daap.serverdatabases", dmapContainer},
+
+	{"aeCR", "com.apple.itunes.content-rating", dmapString},
+	{"aeCS", "com.apple.itunes.artworkchecksum", dmapInt},
+	{"aeEN", "com.apple.itunes.episode-num-str", dmapString},
+	{"aeES", "com.apple.itunes.episode-sort", dmapInt},
+	{"aeGD", "com.apple.itunes.gapless-enc-dr", dmapInt},
+	{"aeGE", "com.apple.itunes.gapless-enc-del", dmapInt},
+	{"aeGH", "com.apple.itunes.gapless-heur", dmapInt},
+	{"aeGR", "com.apple.itunes.gapless-resy", dmapLong},
+	{"aeGU", "com.apple.itunes.gapless-dur", dmapLong},
+	{"aeHV", "com.apple.itunes.has-video", dmapByte},
+	{"aeMK", "com.apple.itunes.mediakind", dmapByte},
+	{"aeMk", "com.apple.itunes.extended-media-kind", dmapInt},
+	{"aeNV", "com.apple.itunes.norm-volume", dmapInt},
+	{"aePC", "com.apple.itunes.is-podcast", dmapByte},
+	{"aePP", "com.apple.itunes.is-podcast-playlist", dmapByte},
+	{"aeSF", "com.apple.itunes.itms-storefrontid", dmapInt},
+	{"aeSI", "com.apple.itunes.itms-songid", dmapLong},
+	{"aeSN", "com.apple.itunes.series-name", dmapString},
+	{"aeSP", "com.apple.itunes.smart-playlist", dmapByte},
+	{"aeSU", "com.apple.itunes.season-num", dmapInt},
+	{"aeXD", "com.apple.itunes.xid", dmapString},
+
+	{"caar", "dacp.availablerepeatstates", dmapInt},
+	{"caas", "dacp.availableshufflestates", dmapInt},
+	{"cafs", "dacp.fullscreen", dmapByte},
+	{"cana", "dacp.nowplayingartist", dmapString},
+	{"cang", "dacp.nowplayinggenre", dmapString},
+	{"canl", "dacp.nowplayingalbum", dmapString},
+	{"cann", "dacp.nowplayingname", dmapString},
+	{"cant", "dacp.remainingtime", dmapInt},
+	{"caps", "dacp.playerstate", dmapByte},
+	{"carp", "dacp.repeatstate", dmapByte},
+	{"cash", "dacp.shufflestate", dmapByte},
+	{"cast", "dacp.tracklength", dmapInt},
+	{"cavc", "dacp.volumecontrollable", dmapByte},
+	{"cavs", "dacp.visualizer", dmapByte},
+	{"cmmk", "dmcp.mediakind", dmapInt},
+	{"cmsr", "dmcp.serverrevision", dmapInt},
+	{"cmst", "dmcp.playstatus", dmapContainer},
+	{"cmvo", "dmcp.volume", dmapInt},
+}
+
+var (
+	contentTypesByCode = make(map[string]contentType)
+	contentTypesByName = make(map[string]contentType)
+)
+
+func init() {
+	for _, ct := range contentTypes {
+		contentTypesByCode[ct.code] = ct
+		contentTypesByName[ct.name] = ct
+	}
+}
+
+// how deep containers can be nested, real bodies only go a few deep
+const maxDaapDepth = 16
+
+// parseDaap parses a DMAP tagged body into a map of tag name to value.  Containers are parsed
+// into nested maps, and tags that appear more than once in a container are collected into a
+// []interface{}.  Tags we don't know the type of are skipped
+func parseDaap(daap []byte) (map[string]interface{}, error) {
+	return parseDaapContainer(daap, 0)
+}
+
+// parseDaapContainer parses the tags of a container, depth containers down
+func parseDaapContainer(daap []byte, depth int) (map[string]interface{}, error) {
+	if depth > maxDaapDepth {
+		return nil, fmt.Errorf("DMAP containers nested more than %d deep", maxDaapDepth)
+	}
+	tags, err := splitDaap(daap)
+	if err != nil {
+		return nil, err
+	}
 	parsedData := make(map[string]interface{})
+	for _, tag := range tags {
+		ct, ok := getContentType(tag.code)
+		if !ok {
+			continue
+		}
+		val, err := parseDaapValue(ct, tag.data, depth)
+		if err != nil {
+			return nil, err
+		}
+		if val == nil {
+			continue
+		}
+		switch existing := parsedData[ct.name].(type) {
+		case nil:
+			parsedData[ct.name] = val
+		case []interface{}:
+			parsedData[ct.name] = append(existing, val)
+		default:
+			parsedData[ct.name] = []interface{}{existing, val}
+		}
+	}
+	return parsedData, nil
+}
+
+// daapTag is a tag as it was sent, before its value is parsed
+type daapTag struct {
+	code string
+	data []byte
+}
+
+// splitDaap splits DMAP data into its tags, without looking inside them
+func splitDaap(daap []byte) ([]daapTag, error) {
+	var tags []daapTag
+	i := 0
 	for i < len(daap) {
-		itemType := string(daap[i : i+4])
+		if len(daap)-i < 8 {
+			return nil, fmt.Errorf("Truncated DMAP tag at: %d", i)
+		}
+		code := string(daap[i : i+4])
 		itemLength := int(binary.BigEndian.Uint32(daap[i+4 : i+8]))
-		if itemLength != 0 {
-			data := daap[i+8 : i+8+itemLength]
-			contentType := getContentType(itemType)
-			switch contentType.cType {
-			case "byte":
-				parsedData[contentType.name] = data[0]
-			case "string":
-				parsedData[contentType.name] = string(data)
-			}
+		i = i + 8
+		if itemLength > len(daap)-i {
+			return nil, fmt.Errorf("Truncated DMAP tag: %s", code)
 		}
-		i = i + itemLength + 8
+		tags = append(tags, daapTag{code: code, data: daap[i : i+itemLength]})
+		i = i + itemLength
+	}
+	return tags, nil
+}
+
+// trackTags returns the tags describing a track, the tags in the listing item or, for
+// older versions of bobcaygeon, the bare tags
+func trackTags(daap []byte) ([]daapTag, error) {
+	tags, err := splitDaap(daap)
+	if err != nil {
+		return nil, err
+	}
+	if len(tags) == 1 && tags[0].code == "mlit" {
+		return splitDaap(tags[0].data)
+	}
+	return tags, nil
+}
+
+// parseDaapValue parses the data of a single tag.  Senders don't always agree on how wide a
+// tag is, so a fixed size tag that's the wrong size is skipped (nil) rather than failing the body
+func parseDaapValue(ct contentType, data []byte, depth int) (interface{}, error) {
+	if width, ok := dmapWidths[ct.cType]; ok && len(data) != width {
+		return nil, nil
+	}
+	switch ct.cType {
+	case dmapByte:
+		return data[0], nil
+	case dmapSignedByte:
+		return int8(data[0]), nil
+	case dmapShort:
+		return binary.BigEndian.Uint16(data), nil
+	case dmapSignedShort:
+		return int16(binary.BigEndian.Uint16(data)), nil
+	case dmapInt:
+		return binary.BigEndian.Uint32(data), nil
+	case dmapSignedInt:
+		return int32(binary.BigEndian.Uint32(data)), nil
+	case dmapLong:
+		return binary.BigEndian.Uint64(data), nil
+	case dmapSignedLong:
+		return int64(binary.BigEndian.Uint64(data)), nil
+	case dmapString:
+		return string(data), nil
+	case dmapDate:
+		return time.Unix(int64(binary.BigEndian.Uint32(data)), 0).UTC(), nil
+	case dmapVersion:
+		return fmt.Sprintf("%d.%d.%d", binary.BigEndian.Uint16(data), data[2], data[3]), nil
+	case dmapContainer:
+		return parseDaapContainer(data, depth+1)
 	}
-	log.Println(parsedData)
-	return parsedData
+	return nil, nil
 }
 
-// EncodeDaap will take a map and encode it in daap format
+// EncodeDaap will take a map and encode it in daap format, as a listing item (mlit)
+// the way senders send track information
 func EncodeDaap(dataToEncode map[string]interface{}) ([]byte, error) {
+	items, err := encodeDaapItems(dataToEncode)
+	if err != nil {
+		return nil, err
+	}
+	return encodeDaapTag("mlit", items), nil
+}
+
+// encodeDaapItems encodes each of the tags in the map, in order of their names
+func encodeDaapItems(dataToEncode map[string]interface{}) ([]byte, error) {
+	names := make([]string, 0, len(dataToEncode))
+	for name := range dataToEncode {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
 	var buf []byte
-	// can't find why, but I found needed to add a padding before the daap data
-	padding := make([]byte, 8)
-	binary.BigEndian.PutUint64(padding, uint64(0))
-	// we first add a padding, from the sample I captured from apple it started
-	// with these bytes: 109, 108, 105, 116, 0, 0, 6, 17 but for now I'll just add 0s
-	buf = append(buf, padding...)
-	for k, v := range dataToEncode {
-		ct := getContentTypeForName(k)
-		itemType := ct.code
-		field := []byte(itemType)
-		// format is dataType, dataLength, data
-		buf = append(buf, field...)
-		var length []byte
-		var data []byte
-		if ct.cType == "byte" {
-			data = make([]byte, 1)
-			data[0] = v.(uint8)
-			length = make([]byte, 4)
-			// length of type byte is... one byte :)
-			binary.BigEndian.PutUint32(length, 1)
+	for _, name := range names {
+		ct, ok := getContentTypeForName(name)
+		if !ok {
+			return nil, fmt.Errorf("Unknown DMAP tag: %s", name)
 		}
-		if ct.cType == "string" {
-			data = []byte(fmt.Sprintf("%s", v))
-			length = make([]byte, 4)
-			// add in the length of the data we want to encode
-			binary.BigEndian.PutUint32(length, uint32(len(data)))
+		// a tag can be repeated
+		values, ok := dataToEncode[name].([]interface{})
+		if !ok {
+			values = []interface{}{dataToEncode[name]}
+		}
+		for _, v := range values {
+			data, err := encodeDaapValue(ct, v)
+			if err != nil {
+				return nil, err
+			}
+			buf = append(buf, encodeDaapTag(ct.code, data)...)
 		}
-		buf = append(buf, length...)
-		buf = append(buf, data...)
 	}
-
 	return buf, nil
 }
 
-func getContentType(code string) contentType {
-	ct := contentType{}
-	// there is a whole TON of types that can come back
-	// only parse out the ones we are interested in for now
-	switch code {
-	case "mikd":
-		ct.cType = "byte"
-		ct.code = "mikd"
-		ct.name = "dmap.itemkind"
-	case "asal":
-		ct.cType = "string"
-		ct.code = "asal"
-		ct.name = "daap.songalbum"
-	case "asar":
-		ct.cType = "string"
-		ct.code = "asar"
-		ct.name = "daap.songartist"
-	case "minm":
-		ct.cType = "string"
-		ct.code = "minm"
-		ct.name = "dmap.itemname"
-	}
-	return ct
-}
-
-func getContentTypeForName(name string) contentType {
-	ct := contentType{}
-	// there is a whole TON of types that can come back
-	// only parse out the ones we are interested in for now
-	switch name {
-	case "dmap.itemkind":
-		ct.cType = "byte"
-		ct.code = "mikd"
-		ct.name = "dmap.itemkind"
-	case "daap.songalbum":
-		ct.cType = "string"
-		ct.code = "asal"
-		ct.name = "daap.songalbum"
-	case "daap.songartist":
-		ct.cType = "string"
-		ct.code = "asar"
-		ct.name = "daap.songartist"
-	case "dmap.itemname":
-		ct.cType = "string"
-		ct.code = "minm"
-		ct.name = "dmap.itemname"
-	}
-	return ct
+// encodeDaapTag encodes a tag, the format is code, data length, data
+func encodeDaapTag(code string, data []byte) []byte {
+	buf := make([]byte, 8, 8+len(data))
+	copy(buf, code)
+	binary.BigEndian.PutUint32(buf[4:8], uint32(len(data)))
+	return append(buf, data...)
+}
+
+func encodeDaapValue(ct contentType, v interface{}) ([]byte, error) {
+	switch ct.cType {
+	case dmapString:
+		return []byte(fmt.Sprintf("%s", v)), nil
+	case dmapDate:
+		date, ok := v.(time.Time)
+		if !ok {
+			return nil, fmt.Errorf("Invalid date for DMAP tag: %s", ct.name)
+		}
+		data := make([]byte, 4)
+		binary.BigEndian.PutUint32(data, uint32(date.Unix()))
+		return data, nil
+	case dmapVersion:
+		var major uint16
+		var minor, patch uint8
+		if _, err := fmt.Sscanf(fmt.Sprintf("%s", v), "%d.%d.%d", &major, &minor, &patch); err != nil {
+			return nil, fmt.Errorf("Invalid version for DMAP tag: %s", ct.name)
+		}
+		data := make([]byte, 4)
+		binary.BigEndian.PutUint16(data, major)
+		data[2] = minor
+		data[3] = patch
+		return data, nil
+	case dmapContainer:
+		items, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Invalid container for DMAP tag: %s", ct.name)
+		}
+		return encodeDaapItems(items)
+	}
+	return encodeDaapInteger(ct, v)
+}
+
+// encodeDaapInteger encodes any go integer as the width the tag calls for, as long as it fits
+func encodeDaapInteger(ct contentType, v interface{}) ([]byte, error) {
+	width := dmapWidths[ct.cType]
+	signed := ct.cType == dmapSignedByte || ct.cType == dmapSignedShort || ct.cType == dmapSignedInt || ct.cType == dmapSignedLong
+	bits := uint(width * 8)
+
+	var value uint64
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i := rv.Int()
+		if signed && bits < 64 && (i < -(1<<(bits-1)) || i > (1<<(bits-1))-1) ||
+			!signed && (i < 0 || bits < 64 && i > (1<<bits)-1) {
+			return nil, fmt.Errorf("Value out of range for DMAP tag: %s", ct.name)
+		}
+		value = uint64(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := rv.Uint()
+		if signed && (bits < 64 && u > (1<<(bits-1))-1 || bits == 64 && u > math.MaxInt64) ||
+			!signed && bits < 64 && u > (1<<bits)-1 {
+			return nil, fmt.Errorf("Value out of range for DMAP tag: %s", ct.name)
+		}
+		value = u
+	default:
+		return nil, fmt.Errorf("Invalid value for DMAP tag: %s", ct.name)
+	}
+
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, value)
+	return data[8-width:], nil
+}
+
+func getContentType(code string) (contentType, bool) {
+	ct, ok := contentTypesByCode[code]
+	return ct, ok
+}
+
+func getContentTypeForName(name string) (contentType, bool) {
+	ct, ok := contentTypesByName[name]
+	return ct, ok
+}
+
+// parseTrack parses the track information senders send with SET_PARAMETER
+func parseTrack(daap []byte) (player.Track, error) {
+	track := player.Track{}
+	parsed, err := parseDaap(daap)
+	if err != nil {
+		return track, err
+	}
+	// the track is sent as a listing item, but older versions of bobcaygeon sent the tags bare
+	item, ok := parsed["dmap.listingitem"].(map[string]interface{})
+	if !ok {
+		item = parsed
+	}
+	track.Title, _ = item["dmap.itemname"].(string)
+	track.Album, _ = item["daap.songalbum"].(string)
+	track.Artist, _ = item["daap.songartist"].(string)
+	track.AlbumArtist, _ = item["daap.songalbumartist"].(string)
+	track.Genre, _ = item["daap.songgenre"].(string)
+	track.Composer, _ = item["daap.songcomposer"].(string)
+	if n, ok := item["daap.songtracknumber"].(uint16); ok {
+		track.TrackNumber = int(n)
+	}
+	if n, ok := item["daap.songtrackcount"].(uint16); ok {
+		track.TrackCount = int(n)
+	}
+	if n, ok := item["daap.songdiscnumber"].(uint16); ok {
+		track.DiscNumber = int(n)
+	}
+	if n, ok := item["daap.songdisccount"].(uint16); ok {
+		track.DiscCount = int(n)
+	}
+	if year, ok := item["daap.songyear"].(uint16); ok {
+		track.Year = int(year)
+	}
+	if ms, ok := item["daap.songtime"].(uint32); ok {
+		track.Duration = time.Duration(ms) * time.Millisecond
+	}
+	track.PersistentID, _ = item["dmap.persistentid"].(uint64)
+	track.AlbumID, _ = item["daap.songalbumid"].(uint64)
+	return track, nil
+}
+
+// EncodeTrack encodes the track information, as senders send it with SET_PARAMETER
+func EncodeTrack(track player.Track) ([]byte, error) {
+	input := make(map[string]interface{})
+	// it's music
+	input["dmap.itemkind"] = uint8(2)
+	input["dmap.itemname"] = track.Title
+	input["daap.songalbum"] = track.Album
+	input["daap.songartist"] = track.Artist
+	if track.AlbumArtist != "" {
+		input["daap.songalbumartist"] = track.AlbumArtist
+	}
+	if track.Genre != "" {
+		input["daap.songgenre"] = track.Genre
+	}
+	if track.Composer != "" {
+		input["daap.songcomposer"] = track.Composer
+	}
+	if track.TrackNumber != 0 {
+		input["daap.songtracknumber"] = track.TrackNumber
+	}
+	if track.TrackCount != 0 {
+		input["daap.songtrackcount"] = track.TrackCount
+	}
+	if track.DiscNumber != 0 {
+		input["daap.songdiscnumber"] = track.DiscNumber
+	}
+	if track.DiscCount != 0 {
+		input["daap.songdisccount"] = track.DiscCount
+	}
+	if track.Year != 0 {
+		input["daap.songyear"] = track.Year
+	}
+	if track.Duration != 0 {
+		input["daap.songtime"] = int64(track.Duration / time.Millisecond)
+	}
+	if track.PersistentID != 0 {
+		input["dmap.persistentid"] = track.PersistentID
+	}
+	if track.AlbumID != 0 {
+		input["daap.songalbumid"] = track.AlbumID
+	}
+	return EncodeDaap(input)
 }
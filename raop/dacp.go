@@ -5,11 +5,44 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/grandcat/zeroconf"
 )
 
+// how long we wait on a sender to answer a DACP request
+const dacpTimeout = 5 * time.Second
+
+// how long we wait on a sender's DACP server to show up once it starts streaming
+const dacpLookupTimeout = 2 * time.Minute
+
+// RepeatMode is how the sender repeats what it is playing
+type RepeatMode int
+
+// the repeat modes, as DACP numbers them
+const (
+	RepeatOff RepeatMode = iota
+	RepeatOne
+	RepeatAll
+)
+
+// ParseRepeatMode parses a repeat mode name (off, one or all)
+func ParseRepeatMode(mode string) (RepeatMode, error) {
+	switch strings.ToLower(strings.TrimSpace(mode)) {
+	case "off":
+		return RepeatOff, nil
+	case "one":
+		return RepeatOne, nil
+	case "all":
+		return RepeatAll, nil
+	}
+	return RepeatOff, fmt.Errorf("Unknown repeat mode: %s", mode)
+}
+
 // DacpClient used to perform DACP operations
 type DacpClient struct {
 	dacpID       string
@@ -20,7 +53,7 @@ type DacpClient struct {
 }
 
 func newDacpClient(ipAddress string, port int, dacpID string, activeRemote string) *DacpClient {
-	return &DacpClient{ipAddress: ipAddress, port: port, dacpID: dacpID, activeRemote: activeRemote, httpClient: &http.Client{}}
+	return &DacpClient{ipAddress: ipAddress, port: port, dacpID: dacpID, activeRemote: activeRemote, httpClient: &http.Client{Timeout: dacpTimeout}}
 }
 
 func (d *DacpClient) Play() error {
@@ -43,60 +76,226 @@ func (d *DacpClient) Next() error {
 	return d.executeMethod("nextitem")
 }
 
+// Previous goes back to the previous track
+func (d *DacpClient) Previous() error {
+	return d.executeMethod("previtem")
+}
+
+// VolumeUp turns the sender's volume up a step
+func (d *DacpClient) VolumeUp() error {
+	return d.executeMethod("volumeup")
+}
+
+// VolumeDown turns the sender's volume down a step
+func (d *DacpClient) VolumeDown() error {
+	return d.executeMethod("volumedown")
+}
+
+// SetVolume sets the sender's volume, from 0 to 100
+func (d *DacpClient) SetVolume(volume float64) error {
+	if volume < 0 || volume > 100 {
+		return fmt.Errorf("Volume must be between 0 and 100, got: %g", volume)
+	}
+	return d.setProperty("dmcp.volume", strconv.FormatFloat(volume, 'f', -1, 64))
+}
+
+// SetShuffle turns shuffle on or off
+func (d *DacpClient) SetShuffle(shuffle bool) error {
+	state := "0"
+	if shuffle {
+		state = "1"
+	}
+	return d.setProperty("dacp.shufflestate", state)
+}
+
+// SetRepeat sets how the sender repeats what it is playing
+func (d *DacpClient) SetRepeat(mode RepeatMode) error {
+	if mode < RepeatOff || mode > RepeatAll {
+		return fmt.Errorf("Unknown repeat mode: %d", mode)
+	}
+	return d.setProperty("dacp.repeatstate", strconv.Itoa(int(mode)))
+}
+
+// Seek moves playback to the position in the current track
+func (d *DacpClient) Seek(position time.Duration) error {
+	if position < 0 {
+		return fmt.Errorf("Position must not be negative, got: %s", position)
+	}
+	return d.setProperty("dacp.playingtime", strconv.FormatInt(int64(position/time.Millisecond), 10))
+}
+
+func (d *DacpClient) setProperty(name string, value string) error {
+	return d.executeMethod(fmt.Sprintf("setproperty?%s=%s", name, url.QueryEscape(value)))
+}
+
 func (d *DacpClient) executeMethod(method string) error {
 	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:%d/ctrl-int/1/%s", d.ipAddress, d.port, method), nil)
+	if err != nil {
+		return err
+	}
 	req.Header.Add("Active-Remote", d.activeRemote)
-	_, err = d.httpClient.Do(req)
-	return err
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("DACP request: %s failed: %s", method, resp.Status)
+	}
+	return nil
+}
+
+// Close releases the connections held to the sender
+func (d *DacpClient) Close() {
+	d.httpClient.CloseIdleConnections()
+}
+
+// the DACP servers senders advertise, so they can be controlled
+const (
+	dacpServiceType    = "_dacp._tcp"
+	dacpInstancePrefix = "iTunes_Ctrl_"
+	// how often we start browsing over, to pick up senders that moved or came back
+	dacpBrowseInterval = 10 * time.Minute
+	// how long we wait before browsing again after browsing failed
+	dacpRetryInterval = 30 * time.Second
+)
+
+type dacpServer struct {
+	ipAddress string
+	port      int
 }
 
-// DiscoverDacpClient will try to find the matching DACP client for stream operations
-func DiscoverDacpClient(dacpID string, activeRemote string) *DacpClient {
-	serviceType := "_dacp._tcp"
+// DacpBrowser keeps track of the DACP servers senders advertise, so that a sender's
+// DACP server can be found as soon as it starts streaming
+type DacpBrowser struct {
+	lock    sync.Mutex
+	servers map[string]dacpServer
+	// lookups waiting on a DACP server to show up, by DACP id
+	waiters map[string][]chan dacpServer
+	browse  func(ctx context.Context, entries chan<- *zeroconf.ServiceEntry) error
+}
+
+// NewDacpBrowser instantiates a new DacpBrowser
+func NewDacpBrowser() *DacpBrowser {
+	return &DacpBrowser{servers: make(map[string]dacpServer), waiters: make(map[string][]chan dacpServer), browse: browseDacp}
+}
+
+func browseDacp(ctx context.Context, entries chan<- *zeroconf.ServiceEntry) error {
 	resolver, err := zeroconf.NewResolver(nil)
 	if err != nil {
-		log.Fatalln("Failed to initialize resolver:", err.Error())
+		return fmt.Errorf("Failed to initialize resolver: %s", err)
 	}
+	if err := resolver.Browse(ctx, dacpServiceType, "local", entries); err != nil {
+		return fmt.Errorf("Failed to browse: %s", err)
+	}
+	return nil
+}
 
+// Start starts browsing for DACP servers, returning an error if browsing couldn't be started.
+// Browsing carries on in the background until ctx is done
+func (b *DacpBrowser) Start(ctx context.Context) error {
+	roundCtx, cancel := context.WithTimeout(ctx, dacpBrowseInterval)
 	entries := make(chan *zeroconf.ServiceEntry)
-
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(5))
-	defer cancel()
-	err = resolver.Browse(ctx, serviceType, "local", entries)
-	if err != nil {
-		log.Fatalln("Failed to browse:", err.Error())
-	}
-	log.Println("searching for daacp airplay client")
-	instanceName := fmt.Sprintf("iTunes_Ctrl_%s", dacpID)
-	var entry *zeroconf.ServiceEntry
-	foundEntry := make(chan *zeroconf.ServiceEntry)
-	// what we do is spin of a goroutine that will process the entries registered in
-	// mDNS for our service.  As soon as we detect there is one with an IP4 address
-	// we send it off and cancel to stop the searching.
-	// there is an issue, https://github.com/grandcat/zeroconf/issues/27 where we
-	// could get an entry back without an IP4 addr, it will come in later as an update
-	// so we wait until we find the addr, or timeout
-	go func(results <-chan *zeroconf.ServiceEntry, foundEntry chan *zeroconf.ServiceEntry) {
-		for e := range results {
-			if (len(e.AddrIPv4)) > 0 && e.Instance == instanceName {
-				foundEntry <- e
+	if err := b.browse(roundCtx, entries); err != nil {
+		cancel()
+		return err
+	}
+	go func() {
+		for {
+			// zeroconf only tells us about a server once, so every so often we start over
+			// to pick up the ones that have changed address
+			b.receive(entries)
+			cancel()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				default:
+				}
+				roundCtx, cancel = context.WithTimeout(ctx, dacpBrowseInterval)
+				entries = make(chan *zeroconf.ServiceEntry)
+				err := b.browse(roundCtx, entries)
+				if err == nil {
+					break
+				}
 				cancel()
+				log.Println("Error browsing for DACP servers: ", err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(dacpRetryInterval):
+				}
 			}
 		}
-	}(entries, foundEntry)
+	}()
+	return nil
+}
+
+// receive adds the servers found until browsing stops, then forgets the servers that weren't
+// seen.  zeroconf doesn't pass on goodbyes, so a sender that has gone away is only dropped
+// once a round goes by without it
+func (b *DacpBrowser) receive(entries <-chan *zeroconf.ServiceEntry) {
+	seen := make(map[string]dacpServer)
+	for e := range entries {
+		// there is an issue, https://github.com/grandcat/zeroconf/issues/27 where we
+		// could get an entry back without an IP4 addr
+		if !strings.HasPrefix(e.Instance, dacpInstancePrefix) || len(e.AddrIPv4) == 0 {
+			continue
+		}
+		dacpID := strings.TrimPrefix(e.Instance, dacpInstancePrefix)
+		server := dacpServer{ipAddress: e.AddrIPv4[0].String(), port: e.Port}
+		seen[dacpID] = server
+		b.add(dacpID, server)
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.servers = seen
+}
+
+func (b *DacpBrowser) add(dacpID string, server dacpServer) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.servers[dacpID] = server
+	for _, waiter := range b.waiters[dacpID] {
+		waiter <- server
+	}
+	delete(b.waiters, dacpID)
+}
+
+// Lookup finds the DACP server for the DACP id, waiting for it to show up until ctx is done
+func (b *DacpBrowser) Lookup(ctx context.Context, dacpID string) (string, int, error) {
+	b.lock.Lock()
+	if server, ok := b.servers[dacpID]; ok {
+		b.lock.Unlock()
+		return server.ipAddress, server.port, nil
+	}
+	// buffered, so the browser never waits on us
+	waiter := make(chan dacpServer, 1)
+	b.waiters[dacpID] = append(b.waiters[dacpID], waiter)
+	b.lock.Unlock()
 
 	select {
-	// this should be ok, since we only expect one service of the _bobcaygeon_ type to be found
-	case entry = <-foundEntry:
-		log.Println("Found daacp airplay client")
+	case server := <-waiter:
+		return server.ipAddress, server.port, nil
 	case <-ctx.Done():
-		log.Println("dacp airplay client not found")
+		b.removeWaiter(dacpID, waiter)
+		return "", 0, fmt.Errorf("DACP server for: %s not found: %s", dacpID, ctx.Err())
 	}
+}
 
-	if entry == nil {
-		log.Println("no dacp client found, will not be able to control")
-		return nil
+func (b *DacpBrowser) removeWaiter(dacpID string, waiter chan dacpServer) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	waiters := b.waiters[dacpID]
+	for i, w := range waiters {
+		if w == waiter {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(b.waiters, dacpID)
+	} else {
+		b.waiters[dacpID] = waiters
 	}
-	client := newDacpClient(entry.AddrIPv4[0].String(), entry.Port, dacpID, activeRemote)
-	return client
 }
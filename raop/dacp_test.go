@@ -2,10 +2,16 @@ package raop
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"testing"
+	"time"
+
+	"github.com/grandcat/zeroconf"
 )
 
 // based on: http://hassansin.github.io/Unit-Testing-http-client-in-Go
@@ -159,3 +165,216 @@ func TestNext(t *testing.T) {
 		t.Error(fmt.Sprintf("Expected: %s\r\n Received: %s\r\n", expectedRemote, header))
 	}
 }
+
+// recordingClient returns a DACP client that records the URLs it requests, answering with the status
+func recordingClient(status int, urls *[]string) *DacpClient {
+	dc := newDacpClient("1.1.1.1", 333, "testID", "testActiveRemote")
+	dc.httpClient = NewTestClient(func(req *http.Request) *http.Response {
+		*urls = append(*urls, req.URL.String())
+		return &http.Response{
+			StatusCode: status,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(``)),
+			Header:     make(http.Header),
+		}
+	})
+	return dc
+}
+
+func TestControls(t *testing.T) {
+	var urls []string
+	dc := recordingClient(204, &urls)
+	controls := map[string]func() error{
+		"previtem":                            dc.Previous,
+		"volumeup":                            dc.VolumeUp,
+		"volumedown":                          dc.VolumeDown,
+		"setproperty?dmcp.volume=42.5":        func() error { return dc.SetVolume(42.5) },
+		"setproperty?dacp.shufflestate=1":     func() error { return dc.SetShuffle(true) },
+		"setproperty?dacp.shufflestate=0":     func() error { return dc.SetShuffle(false) },
+		"setproperty?dacp.repeatstate=2":      func() error { return dc.SetRepeat(RepeatAll) },
+		"setproperty?dacp.playingtime=905500": func() error { return dc.Seek(15*time.Minute + 5500*time.Millisecond) },
+	}
+	for method, control := range controls {
+		urls = nil
+		if err := control(); err != nil {
+			t.Error("Unexpected error", err)
+		}
+		expectedURL := "http://1.1.1.1:333/ctrl-int/1/" + method
+		if len(urls) != 1 || urls[0] != expectedURL {
+			t.Error(fmt.Sprintf("Expected: %s\r\n Received: %v\r\n", expectedURL, urls))
+		}
+	}
+}
+
+func TestControlsInvalid(t *testing.T) {
+	var urls []string
+	dc := recordingClient(204, &urls)
+	invalid := []func() error{
+		func() error { return dc.SetVolume(-1) },
+		func() error { return dc.SetVolume(101) },
+		func() error { return dc.SetRepeat(RepeatMode(3)) },
+		func() error { return dc.Seek(-time.Second) },
+	}
+	for i, control := range invalid {
+		if err := control(); err == nil {
+			t.Error(fmt.Sprintf("Expected error from control: %d", i))
+		}
+	}
+	if len(urls) != 0 {
+		t.Error(fmt.Sprintf("Expected no requests\r\n Received: %v\r\n", urls))
+	}
+}
+
+func TestControlRefused(t *testing.T) {
+	var urls []string
+	dc := recordingClient(403, &urls)
+	if err := dc.Next(); err == nil {
+		t.Error("Expected error when the sender refuses the request")
+	}
+}
+
+func TestParseRepeatMode(t *testing.T) {
+	modes := map[string]RepeatMode{"off": RepeatOff, "One": RepeatOne, " all ": RepeatAll}
+	for name, expected := range modes {
+		mode, err := ParseRepeatMode(name)
+		if err != nil {
+			t.Error("Unexpected error", err)
+		}
+		if mode != expected {
+			t.Error(fmt.Sprintf("Expected: %d\r\n Got: %d", expected, mode))
+		}
+	}
+	if _, err := ParseRepeatMode("shuffle"); err == nil {
+		t.Error("Expected error parsing an unknown repeat mode")
+	}
+}
+
+func dacpEntry(dacpID string, ip string, port int) *zeroconf.ServiceEntry {
+	entry := zeroconf.NewServiceEntry("iTunes_Ctrl_"+dacpID, "_dacp._tcp", "local")
+	if ip != "" {
+		entry.AddrIPv4 = []net.IP{net.ParseIP(ip)}
+	}
+	entry.Port = port
+	return entry
+}
+
+// fakeBrowser hands each round of browsing the entries sent to it
+func fakeBrowser(rounds chan chan<- *zeroconf.ServiceEntry) *DacpBrowser {
+	b := NewDacpBrowser()
+	b.browse = func(ctx context.Context, entries chan<- *zeroconf.ServiceEntry) error {
+		rounds <- entries
+		return nil
+	}
+	return b
+}
+
+func TestDacpBrowserLookup(t *testing.T) {
+	rounds := make(chan chan<- *zeroconf.ServiceEntry, 1)
+	b := fakeBrowser(rounds)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := b.Start(ctx); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	entries := <-rounds
+	// not a sender, or no address to reach it at
+	entries <- zeroconf.NewServiceEntry("Something_Else", "_dacp._tcp", "local")
+	entries <- dacpEntry("NOADDRESS", "", 3689)
+	entries <- dacpEntry("ABCD", "10.0.0.2", 3689)
+
+	lookupCtx, lookupCancel := context.WithTimeout(context.Background(), time.Second)
+	defer lookupCancel()
+	ip, port, err := b.Lookup(lookupCtx, "ABCD")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if ip != "10.0.0.2" || port != 3689 {
+		t.Error(fmt.Sprintf("Expected: 10.0.0.2:3689\r\n Got: %s:%d", ip, port))
+	}
+
+	// a lookup waits for the server to show up
+	found := make(chan string)
+	go func() {
+		ip, _, err := b.Lookup(lookupCtx, "EFGH")
+		if err != nil {
+			found <- err.Error()
+			return
+		}
+		found <- ip
+	}()
+	entries <- dacpEntry("EFGH", "10.0.0.3", 3689)
+	if ip := <-found; ip != "10.0.0.3" {
+		t.Error(fmt.Sprintf("Expected: 10.0.0.3\r\n Got: %s", ip))
+	}
+
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer shortCancel()
+	if _, _, err := b.Lookup(shortCtx, "NOADDRESS"); err == nil {
+		t.Error("Expected error looking up a server that never shows up")
+	}
+	b.lock.Lock()
+	waiting := len(b.waiters)
+	b.lock.Unlock()
+	if waiting != 0 {
+		t.Error(fmt.Sprintf("Expected: 0 waiting lookups\r\n Got: %d", waiting))
+	}
+}
+
+func TestDacpBrowserBrowsesAgain(t *testing.T) {
+	rounds := make(chan chan<- *zeroconf.ServiceEntry, 1)
+	b := fakeBrowser(rounds)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := b.Start(ctx); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	entries := <-rounds
+	entries <- dacpEntry("ABCD", "10.0.0.2", 3689)
+	// the round ends, and the sender has moved by the next one
+	close(entries)
+	entries = <-rounds
+	entries <- dacpEntry("ABCD", "10.0.0.4", 3689)
+	close(entries)
+	// wait on the next round, so the move has been seen
+	<-rounds
+	ip, _, err := b.Lookup(context.Background(), "ABCD")
+	if err != nil || ip != "10.0.0.4" {
+		t.Error(fmt.Sprintf("Expected: 10.0.0.4\r\n Got: %s (%v)", ip, err))
+	}
+}
+
+func TestDacpBrowserForgetsGone(t *testing.T) {
+	rounds := make(chan chan<- *zeroconf.ServiceEntry, 1)
+	b := fakeBrowser(rounds)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := b.Start(ctx); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	entries := <-rounds
+	entries <- dacpEntry("ABCD", "10.0.0.2", 3689)
+	entries <- dacpEntry("EFGH", "10.0.0.3", 3689)
+	close(entries)
+	// EFGH has gone away by the next round
+	entries = <-rounds
+	entries <- dacpEntry("ABCD", "10.0.0.2", 3689)
+	close(entries)
+	<-rounds
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer shortCancel()
+	if ip, _, err := b.Lookup(shortCtx, "EFGH"); err == nil {
+		t.Error(fmt.Sprintf("Expected error looking up a server that has gone\r\n Got: %s", ip))
+	}
+	if ip, _, err := b.Lookup(shortCtx, "ABCD"); err != nil || ip != "10.0.0.2" {
+		t.Error(fmt.Sprintf("Expected: 10.0.0.2\r\n Got: %s (%v)", ip, err))
+	}
+}
+
+func TestDacpBrowserStartError(t *testing.T) {
+	b := NewDacpBrowser()
+	b.browse = func(ctx context.Context, entries chan<- *zeroconf.ServiceEntry) error {
+		return errors.New("No network")
+	}
+	if err := b.Start(context.Background()); err == nil {
+		t.Error("Expected error when browsing can't be started")
+	}
+}
@@ -0,0 +1,74 @@
+package raop
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"net"
+)
+
+// ParseDeviceID parses a device id, which is written like a MAC address e.g: 02:42:AC:11:00:02
+func ParseDeviceID(id string) (net.HardwareAddr, error) {
+	addr, err := net.ParseMAC(id)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid device id: %s", id)
+	}
+	if len(addr) != 6 {
+		return nil, fmt.Errorf("Device id must be 6 bytes: %s", id)
+	}
+	return addr, nil
+}
+
+// GenerateDeviceID generates a random device id.  It is marked as a locally administered
+// address, so it won't clash with a real MAC address on the network
+func GenerateDeviceID() (net.HardwareAddr, error) {
+	id := make(net.HardwareAddr, 6)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	// set the locally administered bit, and clear the multicast bit
+	id[0] = (id[0] | 0x02) &^ 0x01
+	return id, nil
+}
+
+// interfaceMacAddr gets the MAC address of the interface that has the given IP address, so
+// a host with more than one interface (e.g. docker bridges) identifies with the one the sender
+// reached us on.  Falls back to getMacAddr if no interface has the address
+func interfaceMacAddr(ip string) net.HardwareAddr {
+	target := net.ParseIP(ip)
+	interfaces, err := net.Interfaces()
+	if target == nil || err != nil {
+		return getMacAddr()
+	}
+	for _, i := range interfaces {
+		if len(i.HardwareAddr) == 0 {
+			continue
+		}
+		addrs, err := i.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(target) {
+				return i.HardwareAddr
+			}
+		}
+	}
+	return getMacAddr()
+}
+
+// getMacAddr gets the MAC hardware
+// address of the host machine: https://gist.github.com/rucuriousyet/ab2ab3dc1a339de612e162512be39283
+func getMacAddr() (addr net.HardwareAddr) {
+	interfaces, err := net.Interfaces()
+	if err == nil {
+		for _, i := range interfaces {
+			if i.Flags&net.FlagUp != 0 && bytes.Compare(i.HardwareAddr, nil) != 0 {
+				// Don't use random as we have a real address
+				addr = i.HardwareAddr
+				break
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,82 @@
+package raop
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/nstehr/bobcaygeon/rtsp"
+)
+
+func TestParseDeviceID(t *testing.T) {
+	id, err := ParseDeviceID("02:42:AC:11:00:02")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if id.String() != "02:42:ac:11:00:02" {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", "02:42:ac:11:00:02", id.String()))
+	}
+	for _, invalid := range []string{"", "bobcaygeon", "00:00:00:00:fe:80:00:00:00:00:00:00:02:00:5e:10:00:00:00:01"} {
+		if _, err := ParseDeviceID(invalid); err == nil {
+			t.Error(fmt.Sprintf("Expected error parsing: %s", invalid))
+		}
+	}
+}
+
+func TestGenerateDeviceID(t *testing.T) {
+	first, err := GenerateDeviceID()
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	second, err := GenerateDeviceID()
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if bytes.Equal(first, second) {
+		t.Error("Expected generated ids to differ")
+	}
+	if first[0]&0x02 == 0 || first[0]&0x01 != 0 {
+		t.Error(fmt.Sprintf("Expected a locally administered unicast address\r\n Got: %s", first))
+	}
+}
+
+func TestChallengeUsesDeviceID(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	id, _ := ParseDeviceID("02:42:ac:11:00:02")
+	if err := a.SetDeviceID(id); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	req := rtsp.NewRequest()
+	req.Headers.Set("Apple-Challenge", "gY3cmhtK9LnECNUlXFb0qg==")
+	resp := rtsp.NewResponse()
+	a.handleOptions(req, resp, rtsp.NewContext(1, "192.168.0.15", "10.0.0.0"))
+	expected, _ := generateChallengeResponse("gY3cmhtK9LnECNUlXFb0qg==", id, "192.168.0.15")
+	if resp.Headers.Get("Apple-Response") != expected {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", expected, resp.Headers.Get("Apple-Response")))
+	}
+}
+
+func TestInterfaceMacAddr(t *testing.T) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	for _, i := range interfaces {
+		addrs, _ := i.Addrs()
+		if len(i.HardwareAddr) == 0 || len(addrs) == 0 {
+			continue
+		}
+		ipNet, ok := addrs[0].(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if mac := interfaceMacAddr(ipNet.IP.String()); !bytes.Equal(mac, i.HardwareAddr) {
+			t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", i.HardwareAddr, mac))
+		}
+	}
+	// an address we don't have falls back to the first interface
+	if mac := interfaceMacAddr("203.0.113.1"); !bytes.Equal(mac, getMacAddr()) {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", getMacAddr(), mac))
+	}
+}
@@ -0,0 +1,74 @@
+package raop
+
+import (
+	"log"
+	"sync"
+)
+
+// how many events a subscriber can fall behind by before we start dropping them
+const subscriberBuffer = 16
+
+// reasons a session was closed, reported in SessionEvent
+const (
+	// ReasonTeardown the sender tore down the session
+	ReasonTeardown = "teardown"
+	// ReasonReplaced the sender announced a new session
+	ReasonReplaced = "replaced"
+	// ReasonTakeover another sender took over
+	ReasonTakeover = "takeover"
+	// ReasonInactive nothing was heard from the sender within the inactivity timeout
+	ReasonInactive = "inactive"
+	// ReasonStopped the server was stopped
+	ReasonStopped = "stopped"
+	// ReasonError the session could not be started
+	ReasonError = "error"
+)
+
+// SessionEvent is sent to subscribers when an airplay session changes state
+type SessionEvent struct {
+	SessionID string
+	State     SessionState
+	// why the session was closed, only set when State is SessionClosed
+	Reason string
+}
+
+type subscribers struct {
+	sync.Mutex
+	subs map[<-chan SessionEvent]chan SessionEvent
+}
+
+func newSubscribers() *subscribers {
+	return &subscribers{subs: make(map[<-chan SessionEvent]chan SessionEvent)}
+}
+
+// Subscribe returns a channel that receives an event every time a session changes state.
+// A subscriber that falls behind misses events rather than holding up the server
+func (a *AirplayServer) Subscribe() <-chan SessionEvent {
+	a.subscribers.Lock()
+	defer a.subscribers.Unlock()
+	ch := make(chan SessionEvent, subscriberBuffer)
+	a.subscribers.subs[ch] = ch
+	return ch
+}
+
+// Unsubscribe stops sending events to a channel returned by Subscribe, and closes it
+func (a *AirplayServer) Unsubscribe(events <-chan SessionEvent) {
+	a.subscribers.Lock()
+	defer a.subscribers.Unlock()
+	if ch, ok := a.subscribers.subs[events]; ok {
+		delete(a.subscribers.subs, events)
+		close(ch)
+	}
+}
+
+func (a *AirplayServer) publish(event SessionEvent) {
+	a.subscribers.Lock()
+	defer a.subscribers.Unlock()
+	for _, ch := range a.subscribers.subs {
+		select {
+		case ch <- event:
+		default:
+			log.Printf("Subscriber not keeping up, dropping event for session %s\n", event.SessionID)
+		}
+	}
+}
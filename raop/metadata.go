@@ -0,0 +1,119 @@
+package raop
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nstehr/bobcaygeon/rtsp"
+)
+
+// metadata item types, named the way shairport-sync names them
+const (
+	// MetadataCore items are DMAP tags as the sender sent them, e.g: minm for the track name
+	MetadataCore = "core"
+	// MetadataShairport items are about the stream itself, e.g: pvol for the volume
+	MetadataShairport = "ssnc"
+)
+
+// MetadataItem is a piece of metadata about what is playing, in the form shairport-sync's
+// metadata pipe uses.  The codes we send are:
+//
+//	core: every DMAP tag describing the track, between ssnc mdst and mden
+//	ssnc pcst, PICT, pcen: the artwork, PICT is empty when the artwork is cleared
+//	ssnc pvol: the volume, as "airplay volume,volume,lowest,highest"
+//	ssnc prgr: the progress, as "start/current/end" in RTP timestamps
+//	ssnc pbeg, pfls, pend: the stream started, was flushed (e.g. paused) or ended
+//	ssnc snam, snua, clip, svip, daid, acre: who the sender is, when it announces a stream
+type MetadataItem struct {
+	Type string
+	Code string
+	Data []byte
+}
+
+// IsArtwork reports whether the item is part of the artwork
+func (m MetadataItem) IsArtwork() bool {
+	return m.Type == MetadataShairport && (m.Code == "pcst" || m.Code == "PICT" || m.Code == "pcen")
+}
+
+// MetadataSink receives metadata as the sender sends it.  It is called from the request
+// handlers, so it shouldn't block
+type MetadataSink interface {
+	WriteMetadata(item MetadataItem)
+}
+
+// AddMetadataSink adds a sink to send metadata to.  It must be added before the server is started
+func (a *AirplayServer) AddMetadataSink(sink MetadataSink) {
+	a.metadataSinks = append(a.metadataSinks, sink)
+}
+
+func (a *AirplayServer) emitMetadata(itemType string, code string, data []byte) {
+	item := MetadataItem{Type: itemType, Code: code, Data: data}
+	for _, sink := range a.metadataSinks {
+		sink.WriteMetadata(item)
+	}
+}
+
+// emitSender sends who the sender announcing a stream is
+func (a *AirplayServer) emitSender(req *rtsp.Request, ctx *rtsp.Context) {
+	headers := []struct {
+		code   string
+		header string
+	}{
+		{"snam", "X-Apple-Client-Name"},
+		{"snua", "User-Agent"},
+		{"daid", "DACP-ID"},
+		{"acre", "Active-Remote"},
+	}
+	for _, h := range headers {
+		if value := req.Headers.Get(h.header); value != "" {
+			a.emitMetadata(MetadataShairport, h.code, []byte(value))
+		}
+	}
+	// the context has the addresses without their ports
+	if ctx.RemoteAddr != "" {
+		a.emitMetadata(MetadataShairport, "clip", []byte(ctx.RemoteAddr))
+	}
+	if ctx.LocalAddr != "" {
+		a.emitMetadata(MetadataShairport, "svip", []byte(ctx.LocalAddr))
+	}
+}
+
+// emitTrack sends the tags describing the track, marked with the RTP time they apply from
+func (a *AirplayServer) emitTrack(req *rtsp.Request) error {
+	tags, err := trackTags(req.Body)
+	if err != nil {
+		return err
+	}
+	rtpTime := rtpTimeFromHeader(req.Headers.Get("RTP-Info"))
+	a.emitMetadata(MetadataShairport, "mdst", rtpTime)
+	for _, tag := range tags {
+		a.emitMetadata(MetadataCore, tag.code, tag.data)
+	}
+	a.emitMetadata(MetadataShairport, "mden", rtpTime)
+	return nil
+}
+
+// emitArtwork sends the artwork, or no artwork when it has been cleared
+func (a *AirplayServer) emitArtwork(artwork []byte, req *rtsp.Request) {
+	rtpTime := rtpTimeFromHeader(req.Headers.Get("RTP-Info"))
+	a.emitMetadata(MetadataShairport, "pcst", rtpTime)
+	a.emitMetadata(MetadataShairport, "PICT", artwork)
+	a.emitMetadata(MetadataShairport, "pcen", rtpTime)
+}
+
+// emitVolume sends the volume the way shairport-sync does, as the airplay volume then the volume
+// and its range.  We don't attenuate in dB, so the volume is the airplay volume over its range
+func (a *AirplayServer) emitVolume(volume float64) {
+	a.emitMetadata(MetadataShairport, "pvol", []byte(fmt.Sprintf("%.2f,%.2f,%.2f,%.2f", volume, volume, -30.0, 0.0)))
+}
+
+// rtpTimeFromHeader pulls the rtptime out of an RTP-Info header, nil if there isn't one
+func rtpTimeFromHeader(rtpInfo string) []byte {
+	for _, part := range strings.Split(rtpInfo, ";") {
+		part = strings.TrimSpace(part)
+		if strings.HasPrefix(part, "rtptime=") {
+			return []byte(strings.TrimPrefix(part, "rtptime="))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package raop
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/nstehr/bobcaygeon/rtsp"
+)
+
+type fakeSink struct {
+	items []MetadataItem
+}
+
+func (fs *fakeSink) WriteMetadata(item MetadataItem) { fs.items = append(fs.items, item) }
+
+func (fs *fakeSink) find(itemType string, code string) (MetadataItem, bool) {
+	for _, item := range fs.items {
+		if item.Type == itemType && item.Code == code {
+			return item, true
+		}
+	}
+	return MetadataItem{}, false
+}
+
+func setParameterWithSink(req *rtsp.Request) (*fakeSink, *rtsp.Response) {
+	sink := &fakeSink{}
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	a.AddMetadataSink(sink)
+	resp := rtsp.NewResponse()
+	a.handlSetParameter(req, resp, rtsp.NewContext(1, "192.168.0.15", "10.0.0.2"))
+	return sink, resp
+}
+
+func TestSenderMetadata(t *testing.T) {
+	sink := &fakeSink{}
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	a.AddMetadataSink(sink)
+	defer a.closeAllSessions(ReasonStopped)
+	req := rtsp.NewRequest()
+	req.Method = rtsp.Announce
+	req.Headers.Set("Content-Type", "application/sdp")
+	req.Headers.Set("X-Apple-Client-Name", "iPhone")
+	req.Body = []byte("v=0\r\no=AirTunes 1547303657935225515 0 IN IP4 10.0.0.2\r\ns=AirTunes\r\nc=IN IP4 10.0.0.2\r\n" +
+		"t=0 0\r\nm=audio 0 RTP/AVP 96\r\na=rtpmap:96 AppleLossless\r\na=fmtp:96 352 0 16 40 10 14 2 255 0 0 44100\r\n")
+	resp := rtsp.NewResponse()
+	a.handleAnnounce(req, resp, rtsp.NewContext(1, "192.168.0.15", "10.0.0.2"))
+	if resp.Status != rtsp.Ok {
+		t.Fatal(fmt.Sprintf("Expected: %s\r\n Got: %s", rtsp.Ok.String(), resp.Status.String()))
+	}
+	expected := map[string]string{"snam": "iPhone", "clip": "10.0.0.2", "svip": "192.168.0.15"}
+	for code, value := range expected {
+		item, ok := sink.find(MetadataShairport, code)
+		if !ok || string(item.Data) != value {
+			t.Error(fmt.Sprintf("Expected: %s %s\r\n Got: %s", code, value, item.Data))
+		}
+	}
+}
+
+func TestTrackMetadata(t *testing.T) {
+	req := rtsp.NewRequest()
+	req.Headers.Set("Content-Type", "application/x-dmap-tagged")
+	req.Headers.Set("RTP-Info", "rtptime=1234")
+	req.Body = daapSample
+	sink, resp := setParameterWithSink(req)
+	if resp.Status != rtsp.Ok {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", rtsp.Ok.String(), resp.Status.String()))
+	}
+	if len(sink.items) < 3 {
+		t.Fatal(fmt.Sprintf("Expected: at least 3 items\r\n Got: %d", len(sink.items)))
+	}
+	first, last := sink.items[0], sink.items[len(sink.items)-1]
+	if first.Code != "mdst" || last.Code != "mden" {
+		t.Error(fmt.Sprintf("Expected: mdst ... mden\r\n Got: %s ... %s", first.Code, last.Code))
+	}
+	if string(first.Data) != "1234" {
+		t.Error(fmt.Sprintf("Expected: 1234\r\n Got: %s", first.Data))
+	}
+	title, ok := sink.find(MetadataCore, "minm")
+	if !ok || string(title.Data) != "Bobcaygeon" {
+		t.Error(fmt.Sprintf("Expected: Bobcaygeon\r\n Got: %s", title.Data))
+	}
+	// the listing item itself isn't sent, just what is in it
+	if _, ok := sink.find(MetadataCore, "mlit"); ok {
+		t.Error("Expected the listing item to be unwrapped")
+	}
+}
+
+func TestArtworkMetadata(t *testing.T) {
+	req := rtsp.NewRequest()
+	req.Headers.Set("Content-Type", "image/none")
+	sink, _ := setParameterWithSink(req)
+	var codes []string
+	for _, item := range sink.items {
+		if !item.IsArtwork() {
+			t.Error(fmt.Sprintf("Expected: artwork item\r\n Got: %s", item.Code))
+		}
+		codes = append(codes, item.Code)
+	}
+	if fmt.Sprint(codes) != "[pcst PICT pcen]" {
+		t.Error(fmt.Sprintf("Expected: [pcst PICT pcen]\r\n Got: %s", codes))
+	}
+	if pict, _ := sink.find(MetadataShairport, "PICT"); len(pict.Data) != 0 {
+		t.Error(fmt.Sprintf("Expected: no artwork\r\n Got: %d bytes", len(pict.Data)))
+	}
+}
+
+func TestVolumeAndProgressMetadata(t *testing.T) {
+	req := rtsp.NewRequest()
+	req.Headers.Set("Content-Type", "text/parameters")
+	req.Body = []byte("volume: -15.000000\r\nprogress: 1000/45100/442000\r\n")
+	sink, _ := setParameterWithSink(req)
+	volume, _ := sink.find(MetadataShairport, "pvol")
+	if string(volume.Data) != "-15.00,-15.00,-30.00,0.00" {
+		t.Error(fmt.Sprintf("Expected: -15.00,-15.00,-30.00,0.00\r\n Got: %s", volume.Data))
+	}
+	progress, _ := sink.find(MetadataShairport, "prgr")
+	if string(progress.Data) != "1000/45100/442000" {
+		t.Error(fmt.Sprintf("Expected: 1000/45100/442000\r\n Got: %s", progress.Data))
+	}
+}
+
+func TestMutedVolumeMetadata(t *testing.T) {
+	req := rtsp.NewRequest()
+	req.Headers.Set("Content-Type", "text/parameters")
+	req.Headers.Set("X-BCG-Muted", "muted")
+	req.Body = []byte("volume: -15.000000\r\n")
+	sink, _ := setParameterWithSink(req)
+	volume, _ := sink.find(MetadataShairport, "pvol")
+	if string(volume.Data) != "-144.00,-144.00,-30.00,0.00" {
+		t.Error(fmt.Sprintf("Expected: -144.00,-144.00,-30.00,0.00\r\n Got: %s", volume.Data))
+	}
+}
+
+func TestRtpTimeFromHeader(t *testing.T) {
+	values := map[string]string{
+		"rtptime=1234":                 "1234",
+		"seq=4; rtptime=5678":          "5678",
+		"":                             "",
+		"url=rtsp://10.0.0.2/1; seq=4": "",
+	}
+	for header, expected := range values {
+		if got := string(rtpTimeFromHeader(header)); got != expected {
+			t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", expected, got))
+		}
+	}
+}
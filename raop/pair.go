@@ -0,0 +1,106 @@
+package raop
+
+import (
+	"encoding/hex"
+	"log"
+	"net"
+
+	"github.com/nstehr/bobcaygeon/raop/pairing"
+	"github.com/nstehr/bobcaygeon/rtsp"
+)
+
+// the keys the pairing exchanges on a connection are kept under, in the connection's context
+const (
+	pairSetupKey  = "pair-setup"
+	pairVerifyKey = "pair-verify"
+)
+
+// SetPairing lets senders pair with us, HomeKit style, as the given accessory.  Nil turns
+// pairing off
+func (a *AirplayServer) SetPairing(accessory *pairing.Accessory) {
+	a.serverLock.Lock()
+	a.pairing = accessory
+	a.serverLock.Unlock()
+	// senders find their pairing with us by our public key
+	a.updateTextRecords()
+}
+
+func (a *AirplayServer) getPairing() *pairing.Accessory {
+	a.serverLock.Lock()
+	defer a.serverLock.Unlock()
+	return a.pairing
+}
+
+// pairingRecords adds the TXT records pairing needs to the overrides, the caller must hold the serverLock
+func (a *AirplayServer) pairingRecords(overrides map[string]string) map[string]string {
+	if a.pairing == nil {
+		return overrides
+	}
+	records := map[string]string{"pk": hex.EncodeToString(a.pairing.Store().PublicKey())}
+	for key, value := range overrides {
+		records[key] = value
+	}
+	return records
+}
+
+// handlePost handles the pair-setup and pair-verify requests senders make to pair with us
+func (a *AirplayServer) handlePost(req *rtsp.Request, resp *rtsp.Response, ctx *rtsp.Context) {
+	accessory := a.getPairing()
+	if accessory == nil {
+		resp.Status = rtsp.NotFound
+		return
+	}
+	switch req.RequestURI {
+	case "/pair-setup":
+		setup, _ := ctx.Value(pairSetupKey).(*pairing.PairSetup)
+		if setup == nil {
+			setup = accessory.NewPairSetup()
+			ctx.SetValue(pairSetupKey, setup)
+		}
+		reply, err := setup.Handle(req.Body)
+		pairingReply(resp, reply)
+		if err != nil {
+			log.Println("Pair-setup failed: ", err)
+			return
+		}
+		// a transient pairing goes straight to encrypting the connection
+		if setup.Done() && setup.Transient() {
+			log.Printf("Transient pairing with: %s\n", ctx.RemoteAddr)
+			secureConnection(ctx, setup.SharedSecret())
+		} else if setup.Done() {
+			log.Printf("Paired with: %s\n", ctx.RemoteAddr)
+		}
+	case "/pair-verify":
+		verify, _ := ctx.Value(pairVerifyKey).(*pairing.PairVerify)
+		if verify == nil {
+			verify = accessory.NewPairVerify()
+			ctx.SetValue(pairVerifyKey, verify)
+		}
+		reply, err := verify.Handle(req.Body)
+		pairingReply(resp, reply)
+		if err != nil {
+			log.Println("Pair-verify failed: ", err)
+			return
+		}
+		if verify.Done() {
+			log.Printf("Verified pairing with: %s\n", ctx.RemoteAddr)
+			secureConnection(ctx, verify.SharedSecret())
+		}
+	default:
+		resp.Status = rtsp.NotFound
+	}
+}
+
+// pairingReply sends a reply in a pairing exchange, failures are reported in the reply itself
+func pairingReply(resp *rtsp.Response, reply []byte) {
+	resp.Status = rtsp.Ok
+	resp.Headers.Set("Content-Type", "application/octet-stream")
+	resp.Body = reply
+}
+
+// secureConnection encrypts the rest of the connection with the secret from pairing
+func secureConnection(ctx *rtsp.Context, secret []byte) {
+	ctx.Upgrade(func(conn net.Conn) (net.Conn, error) {
+		return pairing.NewSecureConn(conn, secret)
+	})
+}
@@ -0,0 +1,77 @@
+package raop
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/nstehr/bobcaygeon/raop/pairing"
+	"github.com/nstehr/bobcaygeon/rtsp"
+)
+
+func newTestAccessory(t *testing.T) *pairing.Accessory {
+	store, err := pairing.OpenStore("")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	return pairing.NewAccessory("AA:BB:CC:DD:EE:FF", "", store)
+}
+
+func postRequest(uri string, body []byte) *rtsp.Request {
+	req := rtsp.NewRequest()
+	req.Method = rtsp.Post
+	req.RequestURI = uri
+	req.Body = body
+	return req
+}
+
+func TestHandlePairSetup(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	a.SetPairing(newTestAccessory(t))
+	ctx := rtsp.NewContext(1, "192.168.0.15", "10.0.0.0")
+	resp := rtsp.NewResponse()
+	// M1: state 1, method 0
+	a.handlePost(postRequest("/pair-setup", []byte{0x06, 0x01, 0x01, 0x00, 0x01, 0x00}), resp, ctx)
+	if resp.Status != rtsp.Ok {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", rtsp.Ok.String(), resp.Status.String()))
+	}
+	if resp.Headers.Get("Content-Type") != "application/octet-stream" {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", "application/octet-stream", resp.Headers.Get("Content-Type")))
+	}
+	// M2 starts with the state, then the salt
+	if len(resp.Body) < 5 || resp.Body[2] != 2 || resp.Body[3] != 0x02 {
+		t.Error(fmt.Sprintf("Unexpected M2: %x", resp.Body))
+	}
+	if _, ok := ctx.Value(pairSetupKey).(*pairing.PairSetup); !ok {
+		t.Error("Expected the pair-setup to be kept with the connection")
+	}
+}
+
+func TestHandlePostNotFound(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	resp := rtsp.NewResponse()
+	// without pairing there's nothing to post to
+	a.handlePost(postRequest("/pair-setup", nil), resp, rtsp.NewContext(1, "192.168.0.15", "10.0.0.0"))
+	if resp.Status != rtsp.NotFound {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", rtsp.NotFound.String(), resp.Status.String()))
+	}
+
+	a.SetPairing(newTestAccessory(t))
+	resp = rtsp.NewResponse()
+	a.handlePost(postRequest("/fp-setup", nil), resp, rtsp.NewContext(1, "192.168.0.15", "10.0.0.0"))
+	if resp.Status != rtsp.NotFound {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", rtsp.NotFound.String(), resp.Status.String()))
+	}
+}
+
+func TestPairingTextRecords(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	accessory := newTestAccessory(t)
+	a.SetPairing(accessory)
+	expected := "pk=" + hex.EncodeToString(accessory.Store().PublicKey())
+	joined := strings.Join(a.textRecords(), " ")
+	if !strings.Contains(joined, expected) {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", expected, joined))
+	}
+}
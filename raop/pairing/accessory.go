@@ -0,0 +1,62 @@
+package pairing
+
+import (
+	"sync"
+)
+
+// DefaultPin is the pin senders use for transient pairings, and what we use when one isn't set
+const DefaultPin = "3939"
+
+// after this many failed attempts at pair-setup we stop accepting them, so the pin can't be guessed
+const maxSetupFailures = 100
+
+// Accessory is us, as far as pairing is concerned: what senders pair with and verify.  It
+// handles the HomeKit pair-setup and pair-verify exchanges, each of which takes place over a
+// single connection
+type Accessory struct {
+	// our pairing identifier
+	id    string
+	pin   string
+	store *Store
+	lock  sync.Mutex
+	// failed pair-setup attempts
+	failures int
+}
+
+// NewAccessory instantiates a new Accessory, identified by id (e.g. our device id), which
+// controllers pair with using the pin.  Pairings are kept in the store
+func NewAccessory(id string, pin string, store *Store) *Accessory {
+	if pin == "" {
+		pin = DefaultPin
+	}
+	return &Accessory{id: id, pin: pin, store: store}
+}
+
+// ID returns our pairing identifier
+func (a *Accessory) ID() string {
+	return a.id
+}
+
+// Store returns the store our pairings are kept in
+func (a *Accessory) Store() *Store {
+	return a.store
+}
+
+// setupFailed records a failed pair-setup
+func (a *Accessory) setupFailed() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.failures++
+}
+
+// acceptingSetup returns whether we are still taking pair-setup attempts
+func (a *Accessory) acceptingSetup() bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.failures < maxSetupFailures
+}
+
+// errorReply builds the reply telling the controller why it failed
+func errorReply(state byte, code byte) []byte {
+	return newTLV8().setByte(tlvState, state).setByte(tlvError, code).encode()
+}
@@ -0,0 +1,237 @@
+package pairing
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"fmt"
+	"io"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// testController does the controller's side of pairing, as a sender would
+type testController struct {
+	id      string
+	public  ed25519.PublicKey
+	private ed25519.PrivateKey
+}
+
+func newTestController(t *testing.T, id string) *testController {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	return &testController{id: id, public: public, private: private}
+}
+
+func handle(t *testing.T, handler func([]byte) ([]byte, error), message *tlv8) (*tlv8, error) {
+	reply, err := handler(message.encode())
+	decoded, decodeErr := decodeTLV8(reply)
+	if decodeErr != nil {
+		t.Fatal("Unexpected error decoding reply", decodeErr)
+	}
+	return decoded, err
+}
+
+// srpExchange does M1 to M4 of pair-setup, returning the SRP session key
+func (c *testController) srpExchange(t *testing.T, ps *PairSetup, pin string, flags []byte) ([]byte, error) {
+	m1 := newTLV8().setByte(tlvState, 1).setByte(tlvMethod, 0)
+	if flags != nil {
+		m1.set(tlvFlags, flags)
+	}
+	m2, err := handle(t, ps.Handle, m1)
+	if err != nil {
+		return nil, err
+	}
+	client := newSRPClient(srp3072, sha512.New, bytes.Repeat([]byte{7}, 32))
+	proof := client.proof([]byte("Pair-Setup"), []byte(pin), m2.get(tlvSalt), m2.get(tlvPublicKey))
+	m4, err := handle(t, ps.Handle, newTLV8().setByte(tlvState, 3).set(tlvPublicKey, client.A).set(tlvProof, proof))
+	if err != nil {
+		if code, _ := m4.getByte(tlvError); code != errorAuthentication {
+			t.Error(fmt.Sprintf("Expected error: %d\r\n Got: %d", errorAuthentication, code))
+		}
+		return nil, err
+	}
+	if !bytes.Equal(m4.get(tlvProof), client.hash(client.A, proof, client.key)) {
+		t.Error("Unexpected server proof")
+	}
+	return client.key, nil
+}
+
+// pairSetup pairs with the accessory, returning the accessory's long term key
+func (c *testController) pairSetup(t *testing.T, accessory *Accessory, pin string) (ed25519.PublicKey, error) {
+	ps := accessory.NewPairSetup()
+	sessionKey, err := c.srpExchange(t, ps, pin, nil)
+	if err != nil {
+		return nil, err
+	}
+	key := deriveKey(sessionKey, "Pair-Setup-Encrypt-Salt", "Pair-Setup-Encrypt-Info")
+	controllerX := deriveKey(sessionKey, "Pair-Setup-Controller-Sign-Salt", "Pair-Setup-Controller-Sign-Info")
+	signature := ed25519.Sign(c.private, bytes.Join([][]byte{controllerX, []byte(c.id), c.public}, nil))
+	encrypted, err := sealMessage(key, "PS-Msg05", newTLV8().set(tlvIdentifier, []byte(c.id)).set(tlvPublicKey, c.public).set(tlvSignature, signature))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	m6, err := handle(t, ps.Handle, newTLV8().setByte(tlvState, 5).set(tlvEncryptedData, encrypted))
+	if err != nil {
+		return nil, err
+	}
+	sub, err := openMessage(key, "PS-Msg06", m6.get(tlvEncryptedData))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	accessoryKey := ed25519.PublicKey(sub.get(tlvPublicKey))
+	accessoryX := deriveKey(sessionKey, "Pair-Setup-Accessory-Sign-Salt", "Pair-Setup-Accessory-Sign-Info")
+	if !ed25519.Verify(accessoryKey, bytes.Join([][]byte{accessoryX, sub.get(tlvIdentifier), accessoryKey}, nil), sub.get(tlvSignature)) {
+		t.Error("Invalid accessory signature")
+	}
+	if !ps.Done() {
+		t.Error("Expected pair-setup to be done")
+	}
+	return accessoryKey, nil
+}
+
+// pairVerify verifies with the accessory, returning the shared secret
+func (c *testController) pairVerify(t *testing.T, accessory *Accessory, accessoryKey ed25519.PublicKey) ([]byte, *PairVerify, error) {
+	pv := accessory.NewPairVerify()
+	public, private, err := newCurve25519Key()
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	m2, err := handle(t, pv.Handle, newTLV8().setByte(tlvState, 1).set(tlvPublicKey, public[:]))
+	if err != nil {
+		return nil, pv, err
+	}
+	accessoryPublic := m2.get(tlvPublicKey)
+	secret := sharedSecret(private, accessoryPublic)
+	key := deriveKey(secret[:], "Pair-Verify-Encrypt-Salt", "Pair-Verify-Encrypt-Info")
+	sub, err := openMessage(key, "PV-Msg02", m2.get(tlvEncryptedData))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if !ed25519.Verify(accessoryKey, bytes.Join([][]byte{accessoryPublic, sub.get(tlvIdentifier), public[:]}, nil), sub.get(tlvSignature)) {
+		t.Error("Invalid accessory signature")
+	}
+	signature := ed25519.Sign(c.private, bytes.Join([][]byte{public[:], []byte(c.id), accessoryPublic}, nil))
+	encrypted, err := sealMessage(key, "PV-Msg03", newTLV8().set(tlvIdentifier, []byte(c.id)).set(tlvSignature, signature))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if _, err := handle(t, pv.Handle, newTLV8().setByte(tlvState, 3).set(tlvEncryptedData, encrypted)); err != nil {
+		return nil, pv, err
+	}
+	return secret[:], pv, nil
+}
+
+func newTestAccessory(t *testing.T) *Accessory {
+	store, err := OpenStore("")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	return NewAccessory("AA:BB:CC:DD:EE:FF", "1234", store)
+}
+
+func TestPairSetupAndVerify(t *testing.T) {
+	accessory := newTestAccessory(t)
+	controller := newTestController(t, "controller")
+	accessoryKey, err := controller.pairSetup(t, accessory, "1234")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if !bytes.Equal(accessoryKey, accessory.Store().PublicKey()) {
+		t.Error(fmt.Sprintf("Expected: %x\r\n Got: %x", accessory.Store().PublicKey(), accessoryKey))
+	}
+	if _, ok := accessory.Store().Pairing("controller"); !ok {
+		t.Error("Expected controller to be paired")
+	}
+
+	secret, pv, err := controller.pairVerify(t, accessory, accessoryKey)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if !pv.Done() || !bytes.Equal(pv.SharedSecret(), secret) {
+		t.Error(fmt.Sprintf("Expected: %x\r\n Got: %x", secret, pv.SharedSecret()))
+	}
+
+	// both sides can now talk over an encrypted connection
+	controllerConn, accessoryConn := secureConnPair(t, secret)
+	defer controllerConn.Close()
+	defer accessoryConn.Close()
+	go controllerConn.Write([]byte("hello"))
+	received := make([]byte, 5)
+	if _, err := io.ReadFull(accessoryConn, received); err != nil || string(received) != "hello" {
+		t.Error(fmt.Sprintf("Expected: hello\r\n Got: %s (%v)", received, err))
+	}
+}
+
+func TestPairSetupWrongPin(t *testing.T) {
+	accessory := newTestAccessory(t)
+	controller := newTestController(t, "controller")
+	if _, err := controller.pairSetup(t, accessory, "4321"); err == nil {
+		t.Error("Expected pair-setup with the wrong pin to fail")
+	}
+	if len(accessory.Store().Pairings()) != 0 {
+		t.Error("Expected no pairings")
+	}
+}
+
+func TestPairSetupMaxTries(t *testing.T) {
+	accessory := newTestAccessory(t)
+	accessory.failures = maxSetupFailures
+	m2, err := handle(t, accessory.NewPairSetup().Handle, newTLV8().setByte(tlvState, 1).setByte(tlvMethod, 0))
+	if err == nil {
+		t.Error("Expected pair-setup to be refused")
+	}
+	if code, _ := m2.getByte(tlvError); code != errorMaxTries {
+		t.Error(fmt.Sprintf("Expected error: %d\r\n Got: %d", errorMaxTries, code))
+	}
+}
+
+func TestTransientPairSetup(t *testing.T) {
+	store, err := OpenStore("")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	accessory := NewAccessory("AA:BB:CC:DD:EE:FF", "", store)
+	controller := newTestController(t, "controller")
+	ps := accessory.NewPairSetup()
+	sessionKey, err := controller.srpExchange(t, ps, DefaultPin, []byte{flagTransient})
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if !ps.Done() || !ps.Transient() {
+		t.Fatal("Expected transient pair-setup to be done after M4")
+	}
+	if !bytes.Equal(ps.SharedSecret(), sessionKey) {
+		t.Error(fmt.Sprintf("Expected: %x\r\n Got: %x", sessionKey, ps.SharedSecret()))
+	}
+	if len(store.Pairings()) != 0 {
+		t.Error("Expected transient pairing not to be saved")
+	}
+	// there's nothing more to exchange
+	if _, err := ps.Handle(newTLV8().setByte(tlvState, 5).encode()); err == nil {
+		t.Error("Expected M5 to be refused for a transient pairing")
+	}
+}
+
+func TestPairVerifyUnknownController(t *testing.T) {
+	accessory := newTestAccessory(t)
+	controller := newTestController(t, "stranger")
+	_, pv, err := controller.pairVerify(t, accessory, accessory.Store().PublicKey())
+	if err == nil || pv.Done() {
+		t.Error("Expected pair-verify from an unpaired controller to fail")
+	}
+}
+
+func TestPairVerifyOutOfOrder(t *testing.T) {
+	accessory := newTestAccessory(t)
+	reply, err := handle(t, accessory.NewPairVerify().Handle, newTLV8().setByte(tlvState, 3))
+	if err == nil {
+		t.Error("Expected M3 before M1 to be refused")
+	}
+	if state, _ := reply.getByte(tlvState); state != 4 {
+		t.Error(fmt.Sprintf("Expected: %d\r\n Got: %d", 4, state))
+	}
+}
@@ -0,0 +1,110 @@
+package pairing
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// the most plaintext sent in one encrypted block
+const maxBlockSize = 1024
+
+// secureConn encrypts a connection the way HomeKit does once a controller is verified.  Data is
+// sent in blocks of up to 1024 bytes, each sent as its length (2 bytes, little endian) followed by
+// the block encrypted with ChaCha20-Poly1305, authenticating the length along with it.  The nonce
+// is a count of the blocks sent in that direction
+type secureConn struct {
+	net.Conn
+	readLock  sync.Mutex
+	reader    cipher.AEAD
+	readCount uint64
+	// decrypted data that hasn't been read yet
+	pending    []byte
+	writeLock  sync.Mutex
+	writer     cipher.AEAD
+	writeCount uint64
+}
+
+// NewSecureConn encrypts the rest of the connection with keys derived from the shared secret of a
+// pair-verify (or transient pair-setup) with the controller at the other end
+func NewSecureConn(conn net.Conn, secret []byte) (net.Conn, error) {
+	// we read what the controller writes, and vice versa
+	return newSecureConn(conn, deriveKey(secret, "Control-Salt", "Control-Write-Encryption-Key"),
+		deriveKey(secret, "Control-Salt", "Control-Read-Encryption-Key"))
+}
+
+func newSecureConn(conn net.Conn, readKey, writeKey []byte) (*secureConn, error) {
+	reader, err := chacha20poly1305.New(readKey)
+	if err != nil {
+		return nil, err
+	}
+	writer, err := chacha20poly1305.New(writeKey)
+	if err != nil {
+		return nil, err
+	}
+	return &secureConn{Conn: conn, reader: reader, writer: writer}, nil
+}
+
+func counterNonce(count uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], count)
+	return nonce
+}
+
+func (c *secureConn) Read(p []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	if len(c.pending) == 0 {
+		length := make([]byte, 2)
+		if _, err := io.ReadFull(c.Conn, length); err != nil {
+			return 0, err
+		}
+		size := int(binary.LittleEndian.Uint16(length))
+		if size > maxBlockSize {
+			return 0, fmt.Errorf("Encrypted block too long: %d", size)
+		}
+		block := make([]byte, size+c.reader.Overhead())
+		if _, err := io.ReadFull(c.Conn, block); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		decrypted, err := c.reader.Open(block[:0], counterNonce(c.readCount), block, length)
+		if err != nil {
+			return 0, err
+		}
+		c.readCount++
+		c.pending = decrypted
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *secureConn) Write(p []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	written := 0
+	for len(p) > 0 {
+		size := len(p)
+		if size > maxBlockSize {
+			size = maxBlockSize
+		}
+		block := make([]byte, 2, 2+size+c.writer.Overhead())
+		binary.LittleEndian.PutUint16(block, uint16(size))
+		block = c.writer.Seal(block, counterNonce(c.writeCount), p[:size], block[:2])
+		if _, err := c.Conn.Write(block); err != nil {
+			return written, err
+		}
+		c.writeCount++
+		written += size
+		p = p[size:]
+	}
+	return written, nil
+}
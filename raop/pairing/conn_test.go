@@ -0,0 +1,69 @@
+package pairing
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+)
+
+// secureConnPair connects a controller and an accessory over encrypted connections
+func secureConnPair(t *testing.T, secret []byte) (controller net.Conn, accessory net.Conn) {
+	controllerEnd, accessoryEnd := net.Pipe()
+	accessory, err := NewSecureConn(accessoryEnd, secret)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	// the controller writes with the key we read with
+	controller, err = newSecureConn(controllerEnd, deriveKey(secret, "Control-Salt", "Control-Read-Encryption-Key"),
+		deriveKey(secret, "Control-Salt", "Control-Write-Encryption-Key"))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	return controller, accessory
+}
+
+func TestSecureConn(t *testing.T) {
+	controller, accessory := secureConnPair(t, []byte("secret"))
+	defer controller.Close()
+	defer accessory.Close()
+	// long enough to be split into blocks
+	message := bytes.Repeat([]byte("OPTIONS * RTSP/1.0\r\n"), 100)
+	go controller.Write(message)
+	received := make([]byte, len(message))
+	if _, err := io.ReadFull(accessory, received); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if !bytes.Equal(received, message) {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", message, received))
+	}
+
+	reply := []byte("RTSP/1.0 200 OK\r\n\r\n")
+	go accessory.Write(reply)
+	received = make([]byte, len(reply))
+	if _, err := io.ReadFull(controller, received); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if !bytes.Equal(received, reply) {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", reply, received))
+	}
+}
+
+func TestSecureConnWrongKey(t *testing.T) {
+	controllerEnd, accessoryEnd := net.Pipe()
+	defer controllerEnd.Close()
+	accessory, err := NewSecureConn(accessoryEnd, []byte("secret"))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer accessory.Close()
+	controller, err := NewSecureConn(controllerEnd, []byte("other secret"))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	go controller.Write([]byte("OPTIONS * RTSP/1.0\r\n"))
+	if _, err := accessory.Read(make([]byte, 64)); err == nil {
+		t.Error("Expected error reading a block encrypted with the wrong key")
+	}
+}
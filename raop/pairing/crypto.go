@@ -0,0 +1,71 @@
+package pairing
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// deriveKey derives a 32 byte key from a shared secret with HKDF-SHA-512
+func deriveKey(secret []byte, salt string, info string) []byte {
+	key := make([]byte, 32)
+	io.ReadFull(hkdf.New(sha512.New, secret, []byte(salt), []byte(info)), key)
+	return key
+}
+
+// messageNonce makes the nonce for the encrypted data in a pairing message from the message's
+// name (e.g. PS-Msg05), which is padded out to the front with zeros
+func messageNonce(name string) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	copy(nonce[chacha20poly1305.NonceSize-len(name):], name)
+	return nonce
+}
+
+// sealMessage encrypts the TLV items of a pairing message with ChaCha20-Poly1305
+func sealMessage(key []byte, name string, items *tlv8) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, messageNonce(name), items.encode(), nil), nil
+}
+
+// openMessage decrypts the TLV items of a pairing message
+func openMessage(key []byte, name string, encrypted []byte) (*tlv8, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	decrypted, err := aead.Open(nil, messageNonce(name), encrypted, nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeTLV8(decrypted)
+}
+
+// newCurve25519Key generates a key pair for an X25519 key exchange
+func newCurve25519Key() (public, private [32]byte, err error) {
+	if _, err = rand.Read(private[:]); err != nil {
+		return
+	}
+	curve25519.ScalarBaseMult(&public, &private)
+	return
+}
+
+// sharedSecret works out the X25519 shared secret from our private key and their public key
+func sharedSecret(private [32]byte, theirPublic []byte) [32]byte {
+	var public, secret [32]byte
+	copy(public[:], theirPublic)
+	curve25519.ScalarMult(&secret, &private, &public)
+	return secret
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	return b, err
+}
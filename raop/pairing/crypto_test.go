@@ -0,0 +1,55 @@
+package pairing
+
+import (
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+// test vector from RFC 7748, section 6.1
+func TestSharedSecret(t *testing.T) {
+	var alicePrivate, bobPrivate [32]byte
+	a, _ := hex.DecodeString("77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a")
+	b, _ := hex.DecodeString("5dab087e624a8a4b79e17f8b83800ee66f3bb1292618b6fd1c2f8b27ff88e0eb")
+	copy(alicePrivate[:], a)
+	copy(bobPrivate[:], b)
+	bobPublic, _ := hex.DecodeString("de9edb7d7b7dc1b4d35b61c2ece435373f8343c85b78674dadfc7e146f882b4f")
+	alicePublic, _ := hex.DecodeString("8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a")
+
+	expected := "4a5d9d5ba4ce2de1728e3bf480350f25e07e21c947d19e3376f09b3c1e161742"
+	aliceSecret := sharedSecret(alicePrivate, bobPublic)
+	if hex.EncodeToString(aliceSecret[:]) != expected {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %x", expected, aliceSecret))
+	}
+	bobSecret := sharedSecret(bobPrivate, alicePublic)
+	if hex.EncodeToString(bobSecret[:]) != expected {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %x", expected, bobSecret))
+	}
+}
+
+func TestMessageNonce(t *testing.T) {
+	// padded out to the front with zeros
+	expected := "00000000" + hex.EncodeToString([]byte("PS-Msg05"))
+	if nonce := messageNonce("PS-Msg05"); hex.EncodeToString(nonce) != expected {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %x", expected, nonce))
+	}
+}
+
+func TestSealOpenMessage(t *testing.T) {
+	key := deriveKey([]byte("secret"), "Pair-Setup-Encrypt-Salt", "Pair-Setup-Encrypt-Info")
+	sealed, err := sealMessage(key, "PS-Msg06", newTLV8().set(tlvIdentifier, []byte("bcg")))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	opened, err := openMessage(key, "PS-Msg06", sealed)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if string(opened.get(tlvIdentifier)) != "bcg" {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", "bcg", opened.get(tlvIdentifier)))
+	}
+	// a message sealed for one step can't be passed off as another
+	if _, err := openMessage(key, "PS-Msg05", sealed); err == nil {
+		t.Error("Expected error opening message with the wrong nonce")
+	}
+}
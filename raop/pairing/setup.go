@@ -0,0 +1,142 @@
+package pairing
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// PairSetup is a pair-setup exchange with a controller, in which the controller proves it
+// knows our pin with SRP and then we swap long term keys.  A transient pair-setup stops once
+// the pin is checked, and leaves nothing behind but a secret to encrypt the connection with
+type PairSetup struct {
+	accessory *Accessory
+	// the state of our last reply
+	state     byte
+	srp       *srpServer
+	transient bool
+	done      bool
+}
+
+// NewPairSetup starts a pair-setup exchange with a controller
+func (a *Accessory) NewPairSetup() *PairSetup {
+	return &PairSetup{accessory: a}
+}
+
+// Handle handles a pair-setup message from the controller, returning our reply.  If the
+// exchange fails the reply tells the controller, and the error tells us why
+func (ps *PairSetup) Handle(body []byte) ([]byte, error) {
+	message, err := decodeTLV8(body)
+	if err != nil {
+		return errorReply(ps.state+1, errorUnknown), err
+	}
+	state, _ := message.getByte(tlvState)
+	switch {
+	case state == 1:
+		return ps.start(message)
+	case state == 3 && ps.state == 2:
+		return ps.verifyProof(message)
+	case state == 5 && ps.state == 4 && !ps.transient:
+		return ps.exchangeKeys(message)
+	}
+	return errorReply(state+1, errorUnknown), fmt.Errorf("Unexpected pair-setup state: %d", state)
+}
+
+// Done returns whether the controller has finished pairing
+func (ps *PairSetup) Done() bool {
+	return ps.done
+}
+
+// Transient returns whether the controller asked for a transient pairing
+func (ps *PairSetup) Transient() bool {
+	return ps.transient
+}
+
+// SharedSecret returns the secret a finished transient pairing encrypts the connection with
+func (ps *PairSetup) SharedSecret() []byte {
+	if !ps.done || !ps.transient {
+		return nil
+	}
+	return ps.srp.sessionKey()
+}
+
+// start handles M1, answering with our salt and SRP public key
+func (ps *PairSetup) start(message *tlv8) ([]byte, error) {
+	// starting over forgets any exchange that was in progress
+	ps.state, ps.srp, ps.transient, ps.done = 0, nil, false, false
+	if !ps.accessory.acceptingSetup() {
+		return errorReply(2, errorMaxTries), fmt.Errorf("Too many failed pair-setup attempts")
+	}
+	flags := message.get(tlvFlags)
+	if len(flags) > 0 {
+		padded := make([]byte, 4)
+		copy(padded, flags)
+		ps.transient = binary.LittleEndian.Uint32(padded)&flagTransient != 0
+	}
+	salt, err := randomBytes(16)
+	if err != nil {
+		return errorReply(2, errorUnknown), err
+	}
+	private, err := randomBytes(32)
+	if err != nil {
+		return errorReply(2, errorUnknown), err
+	}
+	ps.srp = newHomeKitSRPServer(ps.accessory.pin, salt, private)
+	ps.state = 2
+	return newTLV8().setByte(tlvState, 2).set(tlvSalt, salt).set(tlvPublicKey, ps.srp.publicKey()).encode(), nil
+}
+
+// verifyProof handles M3, checking the controller's SRP proof and answering with ours
+func (ps *PairSetup) verifyProof(message *tlv8) ([]byte, error) {
+	if err := ps.srp.setClientPublicKey(message.get(tlvPublicKey)); err != nil {
+		ps.accessory.setupFailed()
+		return errorReply(4, errorAuthentication), err
+	}
+	proof, ok := ps.srp.verifyClientProof(message.get(tlvProof))
+	if !ok {
+		ps.accessory.setupFailed()
+		return errorReply(4, errorAuthentication), fmt.Errorf("Incorrect pin")
+	}
+	ps.state = 4
+	ps.done = ps.transient
+	return newTLV8().setByte(tlvState, 4).set(tlvProof, proof).encode(), nil
+}
+
+// exchangeKeys handles M5, saving the controller's long term key and answering with ours
+func (ps *PairSetup) exchangeKeys(message *tlv8) ([]byte, error) {
+	sessionKey := ps.srp.sessionKey()
+	key := deriveKey(sessionKey, "Pair-Setup-Encrypt-Salt", "Pair-Setup-Encrypt-Info")
+	sub, err := openMessage(key, "PS-Msg05", message.get(tlvEncryptedData))
+	if err != nil {
+		return errorReply(6, errorAuthentication), err
+	}
+	id := sub.get(tlvIdentifier)
+	publicKey := sub.get(tlvPublicKey)
+	if len(publicKey) != ed25519.PublicKeySize {
+		return errorReply(6, errorAuthentication), fmt.Errorf("Invalid controller key")
+	}
+	controllerX := deriveKey(sessionKey, "Pair-Setup-Controller-Sign-Salt", "Pair-Setup-Controller-Sign-Info")
+	signed := bytes.Join([][]byte{controllerX, id, publicKey}, nil)
+	if !ed25519.Verify(publicKey, signed, sub.get(tlvSignature)) {
+		return errorReply(6, errorAuthentication), fmt.Errorf("Invalid controller signature")
+	}
+	store := ps.accessory.store
+	if err := store.AddPairing(Pairing{ID: string(id), PublicKey: publicKey, Admin: true}); err != nil {
+		return errorReply(6, errorUnknown), err
+	}
+
+	accessoryX := deriveKey(sessionKey, "Pair-Setup-Accessory-Sign-Salt", "Pair-Setup-Accessory-Sign-Info")
+	accessoryID := []byte(ps.accessory.id)
+	accessoryKey := store.PublicKey()
+	signature := store.sign(bytes.Join([][]byte{accessoryX, accessoryID, accessoryKey}, nil))
+	reply := newTLV8().set(tlvIdentifier, accessoryID).set(tlvPublicKey, accessoryKey).set(tlvSignature, signature)
+	encrypted, err := sealMessage(key, "PS-Msg06", reply)
+	if err != nil {
+		return errorReply(6, errorUnknown), err
+	}
+	ps.state = 6
+	ps.done = true
+	return newTLV8().setByte(tlvState, 6).set(tlvEncryptedData, encrypted).encode(), nil
+}
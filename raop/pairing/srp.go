@@ -0,0 +1,152 @@
+package pairing
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"math/big"
+	"strings"
+)
+
+// srpGroup is the group SRP is done in, a safe prime and a generator
+type srpGroup struct {
+	N *big.Int
+	g *big.Int
+}
+
+// the 3072 bit group from RFC 5054, which HomeKit uses
+var srp3072 = newSRPGroup(`
+	FFFFFFFF FFFFFFFF C90FDAA2 2168C234 C4C6628B 80DC1CD1 29024E08
+	8A67CC74 020BBEA6 3B139B22 514A0879 8E3404DD EF9519B3 CD3A431B
+	302B0A6D F25F1437 4FE1356D 6D51C245 E485B576 625E7EC6 F44C42E9
+	A637ED6B 0BFF5CB6 F406B7ED EE386BFB 5A899FA5 AE9F2411 7C4B1FE6
+	49286651 ECE45B3D C2007CB8 A163BF05 98DA4836 1C55D39A 69163FA8
+	FD24CF5F 83655D23 DCA3AD96 1C62F356 208552BB 9ED52907 7096966D
+	670C354E 4ABC9804 F1746C08 CA18217C 32905E46 2E36CE3B E39E772C
+	180E8603 9B2783A2 EC07A28F B5C55DF0 6F4C52C9 DE2BCBF6 95581718
+	3995497C EA956AE5 15D22618 98FA0510 15728E5A 8AAAC42D AD33170D
+	04507A33 A85521AB DF1CBA64 ECFB8504 58DBEF0A 8AEA7157 5D060C7D
+	B3970F85 A6E1E4C7 ABF5AE8C DB0933D7 1E8C94E0 4A25619D CEE3D226
+	1AD2EE6B F12FFA06 D98A0864 D8760273 3EC86A64 521F2B18 177B200C
+	BBE11757 7A615D6C 770988C0 BAD946E2 08E24FA0 74E5AB31 43DB5BFC
+	E0FD108E 4B82D120 A93AD2CA FFFFFFFF FFFFFFFF`, 5)
+
+func newSRPGroup(hexN string, g int64) srpGroup {
+	N, ok := new(big.Int).SetString(strings.Join(strings.Fields(hexN), ""), 16)
+	if !ok {
+		panic("Invalid SRP group")
+	}
+	return srpGroup{N: N, g: big.NewInt(g)}
+}
+
+// srpServer is our side of an SRP-6a exchange (RFC 5054), with the hash and group HomeKit
+// settles on: SHA-512 and the 3072 bit group
+type srpServer struct {
+	group    srpGroup
+	newHash  func() hash.Hash
+	username []byte
+	salt     []byte
+	// the verifier, worked out from the password
+	v *big.Int
+	b *big.Int
+	B *big.Int
+	// the premaster secret, and the session key derived from it
+	S   *big.Int
+	key []byte
+	// the client's public key, once we have it
+	A []byte
+}
+
+// newSRPServer starts an exchange with the client, for the username and password, using the salt
+// and our private key (which should both be random)
+func newSRPServer(group srpGroup, newHash func() hash.Hash, username, password, salt, private []byte) *srpServer {
+	s := &srpServer{group: group, newHash: newHash, username: username, salt: salt}
+	// x = H(s | H(I | ":" | P))
+	x := new(big.Int).SetBytes(s.hash(salt, s.hash(username, []byte(":"), password)))
+	s.v = new(big.Int).Exp(group.g, x, group.N)
+	// B = k*v + g^b
+	s.b = new(big.Int).SetBytes(private)
+	s.B = new(big.Int).Mul(s.multiplier(), s.v)
+	s.B.Add(s.B, new(big.Int).Exp(group.g, s.b, group.N))
+	s.B.Mod(s.B, group.N)
+	return s
+}
+
+// newHomeKitSRPServer starts an exchange the way HomeKit pair-setup does it
+func newHomeKitSRPServer(pin string, salt, private []byte) *srpServer {
+	return newSRPServer(srp3072, sha512.New, []byte("Pair-Setup"), []byte(pin), salt, private)
+}
+
+func (s *srpServer) hash(values ...[]byte) []byte {
+	h := s.newHash()
+	for _, v := range values {
+		h.Write(v)
+	}
+	return h.Sum(nil)
+}
+
+// pad left pads a value to the length of N
+func (s *srpServer) pad(x *big.Int) []byte {
+	b := x.Bytes()
+	length := len(s.group.N.Bytes())
+	if len(b) >= length {
+		return b
+	}
+	return append(make([]byte, length-len(b)), b...)
+}
+
+// multiplier is k = H(N | PAD(g))
+func (s *srpServer) multiplier() *big.Int {
+	return new(big.Int).SetBytes(s.hash(s.group.N.Bytes(), s.pad(s.group.g)))
+}
+
+// publicKey returns B, to send to the client along with the salt
+func (s *srpServer) publicKey() []byte {
+	return s.B.Bytes()
+}
+
+// setClientPublicKey works out the session key from the client's public key, A
+func (s *srpServer) setClientPublicKey(A []byte) error {
+	a := new(big.Int).SetBytes(A)
+	if new(big.Int).Mod(a, s.group.N).Sign() == 0 {
+		return fmt.Errorf("Invalid SRP public key")
+	}
+	// u = H(PAD(A) | PAD(B))
+	u := new(big.Int).SetBytes(s.hash(s.pad(a), s.pad(s.B)))
+	if u.Sign() == 0 {
+		return fmt.Errorf("Invalid SRP public key")
+	}
+	// S = (A * v^u) ^ b
+	s.S = new(big.Int).Exp(s.v, u, s.group.N)
+	s.S.Mul(s.S, a)
+	s.S.Exp(s.S, s.b, s.group.N)
+	s.key = s.hash(s.S.Bytes())
+	s.A = A
+	return nil
+}
+
+// verifyClientProof checks the client's proof, M1, that it has the same session key as us.
+// If it does, our proof (M2) is returned for the client to check
+func (s *srpServer) verifyClientProof(M1 []byte) ([]byte, bool) {
+	if s.key == nil {
+		return nil, false
+	}
+	// M1 = H(H(N) xor H(g) | H(I) | s | A | B | K)
+	hN := s.hash(s.group.N.Bytes())
+	hg := s.hash(s.group.g.Bytes())
+	for i := range hN {
+		hN[i] ^= hg[i]
+	}
+	expected := s.hash(hN, s.hash(s.username), s.salt, s.A, s.B.Bytes(), s.key)
+	if !hmac.Equal(expected, M1) {
+		return nil, false
+	}
+	// M2 = H(A | M1 | K)
+	return s.hash(s.A, M1, s.key), true
+}
+
+// sessionKey returns K, the key both sides end up with
+func (s *srpServer) sessionKey() []byte {
+	return s.key
+}
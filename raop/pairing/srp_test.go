@@ -0,0 +1,165 @@
+package pairing
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+// the 1024 bit group from RFC 5054, which the test vectors use
+var srp1024 = newSRPGroup(`
+	EEAF0AB9 ADB38DD6 9C33F80A FA8FC5E8 60726187 75FF3C0B 9EA2314C
+	9C256576 D674DF74 96EA81D3 383B4813 D692C6E0 E0D5D8E2 50B98BE4
+	8E495C1D 6089DAD1 5DC7D7B4 6154D6B6 CE8EF4AD 69B15D49 82559B29
+	7BCF1885 C529F566 660E57EC 68EDBC3C 05726CC0 2FD4CBF4 976EAA9A
+	FD5138FE 8376435B 9FC61D2F C0EB06E3`, 2)
+
+func fromHex(s string) []byte {
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// srpClient is the client side of an SRP-6a exchange, so we can test the server against it
+type srpClient struct {
+	*srpServer
+	a *big.Int
+}
+
+func newSRPClient(group srpGroup, newHash func() hash.Hash, private []byte) *srpClient {
+	return &srpClient{srpServer: &srpServer{group: group, newHash: newHash}, a: new(big.Int).SetBytes(private)}
+}
+
+func (c *srpClient) publicKey() []byte {
+	return new(big.Int).Exp(c.group.g, c.a, c.group.N).Bytes()
+}
+
+// proof works out the session key from the server's salt and public key, returning the proof for
+// the server, M1
+func (c *srpClient) proof(username, password, salt, B []byte) []byte {
+	c.username = username
+	c.salt = salt
+	c.A = c.publicKey()
+	c.B = new(big.Int).SetBytes(B)
+	x := new(big.Int).SetBytes(c.hash(salt, c.hash(username, []byte(":"), password)))
+	u := new(big.Int).SetBytes(c.hash(c.pad(new(big.Int).SetBytes(c.A)), c.pad(c.B)))
+	// S = (B - k*g^x) ^ (a + u*x)
+	base := new(big.Int).Exp(c.group.g, x, c.group.N)
+	base.Mul(base, c.multiplier())
+	base.Sub(c.B, base)
+	base.Mod(base, c.group.N)
+	exp := new(big.Int).Mul(u, x)
+	exp.Add(exp, c.a)
+	c.S = new(big.Int).Exp(base, exp, c.group.N)
+	c.key = c.hash(c.S.Bytes())
+
+	hN := c.hash(c.group.N.Bytes())
+	hg := c.hash(c.group.g.Bytes())
+	for i := range hN {
+		hN[i] ^= hg[i]
+	}
+	return c.hash(hN, c.hash(username), salt, c.A, c.B.Bytes(), c.key)
+}
+
+func TestSRPGroupsAreSafePrimes(t *testing.T) {
+	for _, group := range []srpGroup{srp1024, srp3072} {
+		q := new(big.Int).Rsh(group.N, 1)
+		if !group.N.ProbablyPrime(20) || !q.ProbablyPrime(20) {
+			t.Error(fmt.Sprintf("Expected a safe prime, got: %x", group.N))
+		}
+	}
+}
+
+// test vectors from RFC 5054, appendix B
+func TestSRPVectors(t *testing.T) {
+	salt := fromHex("BEB25379 D1A8581E B5A72767 3A2441EE")
+	b := fromHex(`E487CB59 D31AC550 471E81F0 0F6928E0 1DDA08E9 74A004F4 9E61F5D1
+		05284D20`)
+	a := fromHex(`60975527 035CF2AD 1989806F 0407210B C81EDC04 E2762A56 AFD529DD
+		DA2D4393`)
+	A := fromHex(`61D5E490 F6F1B795 47B0704C 436F523D D0E560F0 C64115BB 72557EC4
+		4352E890 3211C046 92272D8B 2D1A5358 A2CF1B6E 0BFCF99F 921530EC
+		8E393561 79EAE45E 42BA92AE ACED8251 71E1E8B9 AF6D9C03 E1327F44
+		BE087EF0 6530E69F 66615261 EEF54073 CA11CF58 58F0EDFD FE15EFEA
+		B349EF5D 76988A36 72FAC47B 0769447B`)
+	expectedK := fromHex("7556AA04 5AEF2CDD 07ABAF0F 665C3E81 8913186F")
+	expectedV := fromHex(`7E273DE8 696FFC4F 4E337D05 B4B375BE B0DDE156 9E8FA00A 9886D812
+		9BADA1F1 822223CA 1A605B53 0E379BA4 729FDC59 F105B478 7E5186F5
+		C671085A 1447B52A 48CF1970 B4FB6F84 00BBF4CE BFBB1681 52E08AB5
+		EA53D15C 1AFF87B2 B9DA6E04 E058AD51 CC72BFC9 033B564E 26480D78
+		E955A5E2 9E7AB245 DB2BE315 E2099AFB`)
+	expectedB := fromHex(`BD0C6151 2C692C0C B6D041FA 01BB152D 4916A1E7 7AF46AE1 05393011
+		BAF38964 DC46A067 0DD125B9 5A981652 236F99D9 B681CBF8 7837EC99
+		6C6DA044 53728610 D0C6DDB5 8B318885 D7D82C7F 8DEB75CE 7BD4FBAA
+		37089E6F 9C6059F3 88838E7A 00030B33 1EB76840 910440B1 B27AAEAE
+		EB4012B7 D7665238 A8E3FB00 4B117B58`)
+	expectedS := fromHex(`B0DC82BA BCF30674 AE450C02 87745E79 90A3381F 63B387AA F271A10D
+		233861E3 59B48220 F7C4693C 9AE12B0A 6F67809F 0876E2D0 13800D6C
+		41BB59B6 D5979B5C 00A172B4 A2A5903A 0BDCAF8A 709585EB 2AFAFA8F
+		3499B200 210DCC1F 10EB3394 3CD67FC8 8A2F39A4 BE5BEC4E C0A3212D
+		C346D7E4 74B29EDE 8A469FFE CA686E5A`)
+
+	server := newSRPServer(srp1024, sha1.New, []byte("alice"), []byte("password123"), salt, b)
+	if !bytes.Equal(server.multiplier().Bytes(), expectedK) {
+		t.Error(fmt.Sprintf("Expected k: %x\r\n Got: %x", expectedK, server.multiplier().Bytes()))
+	}
+	if !bytes.Equal(server.v.Bytes(), expectedV) {
+		t.Error(fmt.Sprintf("Expected v: %x\r\n Got: %x", expectedV, server.v.Bytes()))
+	}
+	if !bytes.Equal(server.publicKey(), expectedB) {
+		t.Error(fmt.Sprintf("Expected B: %x\r\n Got: %x", expectedB, server.publicKey()))
+	}
+
+	client := newSRPClient(srp1024, sha1.New, a)
+	if !bytes.Equal(client.publicKey(), A) {
+		t.Error(fmt.Sprintf("Expected A: %x\r\n Got: %x", A, client.publicKey()))
+	}
+	if err := server.setClientPublicKey(A); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(server.S.Bytes(), expectedS) {
+		t.Error(fmt.Sprintf("Expected premaster secret: %x\r\n Got: %x", expectedS, server.S.Bytes()))
+	}
+
+	// the client should end up in the same place, and the proofs should check out
+	M1 := client.proof([]byte("alice"), []byte("password123"), salt, server.publicKey())
+	if !bytes.Equal(client.S.Bytes(), expectedS) {
+		t.Error(fmt.Sprintf("Expected client premaster secret: %x\r\n Got: %x", expectedS, client.S.Bytes()))
+	}
+	M2, ok := server.verifyClientProof(M1)
+	if !ok {
+		t.Fatal("Expected client proof to be accepted")
+	}
+	if !bytes.Equal(M2, client.hash(client.A, M1, client.key)) {
+		t.Error(fmt.Sprintf("Unexpected server proof: %x", M2))
+	}
+}
+
+func TestSRPWrongPassword(t *testing.T) {
+	server := newHomeKitSRPServer("3939", bytes.Repeat([]byte{1}, 16), bytes.Repeat([]byte{2}, 32))
+	client := newSRPClient(srp3072, server.newHash, bytes.Repeat([]byte{3}, 32))
+	if err := server.setClientPublicKey(client.publicKey()); err != nil {
+		t.Fatal(err)
+	}
+	M1 := client.proof([]byte("Pair-Setup"), []byte("1234"), server.salt, server.publicKey())
+	if _, ok := server.verifyClientProof(M1); ok {
+		t.Error("Expected proof for the wrong pin to be refused")
+	}
+}
+
+func TestSRPInvalidPublicKey(t *testing.T) {
+	server := newHomeKitSRPServer("3939", bytes.Repeat([]byte{1}, 16), bytes.Repeat([]byte{2}, 32))
+	// A = 0 or N would let the client force the secret
+	for _, A := range [][]byte{{0}, srp3072.N.Bytes()} {
+		if err := server.setClientPublicKey(A); err == nil {
+			t.Error(fmt.Sprintf("Expected public key to be refused: %x", A))
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package pairing
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// Pairing is a controller (i.e. a sender) that has paired with us
+type Pairing struct {
+	// the controller's pairing identifier
+	ID string `json:"id"`
+	// the controller's long term public key
+	PublicKey []byte `json:"publicKey"`
+	Admin     bool   `json:"admin"`
+}
+
+// Store keeps our long term key, and the controllers we have paired with, so pairings last
+// between restarts.  Each receiver needs a store of its own
+type Store struct {
+	lock     sync.Mutex
+	path     string
+	key      ed25519.PrivateKey
+	pairings map[string]Pairing
+}
+
+// what the store is saved as
+type storeFile struct {
+	// the seed of our long term key
+	Key      []byte    `json:"key"`
+	Pairings []Pairing `json:"pairings"`
+}
+
+// OpenStore loads the store saved at path, creating it (and our long term key) if there isn't
+// one yet.  An empty path keeps the store in memory, so nothing lasts between restarts
+func OpenStore(path string) (*Store, error) {
+	s := &Store{path: path, pairings: make(map[string]Pairing)}
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err == nil {
+			var saved storeFile
+			if err := json.Unmarshal(data, &saved); err != nil {
+				return nil, fmt.Errorf("Could not read pairing store %s: %s", path, err)
+			}
+			if len(saved.Key) != ed25519.SeedSize {
+				return nil, fmt.Errorf("Invalid key in pairing store: %s", path)
+			}
+			s.key = ed25519.NewKeyFromSeed(saved.Key)
+			for _, pairing := range saved.Pairings {
+				s.pairings[pairing.ID] = pairing
+			}
+			return s, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	s.key = key
+	return s, s.save()
+}
+
+// PublicKey returns our long term public key
+func (s *Store) PublicKey() ed25519.PublicKey {
+	return s.key.Public().(ed25519.PublicKey)
+}
+
+// sign signs the message with our long term key
+func (s *Store) sign(message []byte) []byte {
+	return ed25519.Sign(s.key, message)
+}
+
+// Pairing returns the pairing for the controller with the given id
+func (s *Store) Pairing(id string) (Pairing, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	pairing, ok := s.pairings[id]
+	return pairing, ok
+}
+
+// Pairings returns every pairing, ordered by id
+func (s *Store) Pairings() []Pairing {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.sortedPairings()
+}
+
+// sortedPairings returns every pairing ordered by id, the caller must hold the lock
+func (s *Store) sortedPairings() []Pairing {
+	var pairings []Pairing
+	for _, pairing := range s.pairings {
+		pairings = append(pairings, pairing)
+	}
+	sort.Slice(pairings, func(i, j int) bool { return pairings[i].ID < pairings[j].ID })
+	return pairings
+}
+
+// AddPairing adds (or replaces) the pairing for a controller, saving the store
+func (s *Store) AddPairing(pairing Pairing) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pairings[pairing.ID] = pairing
+	return s.save()
+}
+
+// RemovePairing removes the pairing for a controller, saving the store
+func (s *Store) RemovePairing(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.pairings, id)
+	return s.save()
+}
+
+// save writes the store out, replacing what was there so a crash can't leave it half written.
+// The caller must hold the lock
+func (s *Store) save() error {
+	if s.path == "" {
+		return nil
+	}
+	saved := storeFile{Key: s.key.Seed(), Pairings: s.sortedPairings()}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,91 @@
+package pairing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tempStorePath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "pairing")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	return filepath.Join(dir, "pairings.json"), func() { os.RemoveAll(dir) }
+}
+
+func TestStorePersists(t *testing.T) {
+	path, cleanup := tempStorePath(t)
+	defer cleanup()
+	store, err := OpenStore(path)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	pairing := Pairing{ID: "controller", PublicKey: bytes.Repeat([]byte{1}, 32), Admin: true}
+	if err := store.AddPairing(pairing); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	reopened, err := OpenStore(path)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if !bytes.Equal(reopened.PublicKey(), store.PublicKey()) {
+		t.Error("Expected the long term key to be kept")
+	}
+	saved, ok := reopened.Pairing("controller")
+	if !ok || !bytes.Equal(saved.PublicKey, pairing.PublicKey) || !saved.Admin {
+		t.Error(fmt.Sprintf("Expected: %v\r\n Got: %v", pairing, saved))
+	}
+
+	if err := reopened.RemovePairing("controller"); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	reopened, err = OpenStore(path)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if len(reopened.Pairings()) != 0 {
+		t.Error(fmt.Sprintf("Expected no pairings, got: %v", reopened.Pairings()))
+	}
+}
+
+// test vector 1 from RFC 8032, section 7.1
+func TestStoreKey(t *testing.T) {
+	path, cleanup := tempStorePath(t)
+	defer cleanup()
+	seed, _ := hex.DecodeString("9d61b19deffd5a60ba844af492ec2cc44449c5697b326919703bac031cae7f60")
+	data, _ := json.Marshal(storeFile{Key: seed})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	store, err := OpenStore(path)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	expectedKey := "d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a"
+	if hex.EncodeToString(store.PublicKey()) != expectedKey {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %x", expectedKey, store.PublicKey()))
+	}
+	expectedSignature := "e5564300c360ac729086e2cc806e828a84877f1eb8e5d974d873e06522490155" +
+		"5fb8821590a33bacc61e39701cf9b46bd25bf5f0595bbe24655141438e7a100b"
+	if signature := store.sign(nil); hex.EncodeToString(signature) != expectedSignature {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %x", expectedSignature, signature))
+	}
+}
+
+func TestStoreInvalid(t *testing.T) {
+	path, cleanup := tempStorePath(t)
+	defer cleanup()
+	if err := ioutil.WriteFile(path, []byte(`{"key": "c2hvcnQ="}`), 0600); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if _, err := OpenStore(path); err == nil {
+		t.Error("Expected error opening a store with an invalid key")
+	}
+}
@@ -0,0 +1,118 @@
+package pairing
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// the TLV types used by pair-setup and pair-verify
+const (
+	tlvMethod        = 0x00
+	tlvIdentifier    = 0x01
+	tlvSalt          = 0x02
+	tlvPublicKey     = 0x03
+	tlvProof         = 0x04
+	tlvEncryptedData = 0x05
+	tlvState         = 0x06
+	tlvError         = 0x07
+	tlvSignature     = 0x0a
+	tlvFlags         = 0x13
+)
+
+// the error codes we send back in the tlvError item
+const (
+	errorUnknown        = 0x01
+	errorAuthentication = 0x02
+	errorMaxTries       = 0x05
+)
+
+// flagTransient asks for a pairing that isn't saved, which only lasts for the connection
+const flagTransient = 0x10
+
+// tlv8 is a set of items encoded as TLV8, as used by HomeKit
+type tlv8 struct {
+	// the order the items were added in, which is the order they are encoded in
+	types  []byte
+	values map[byte][]byte
+}
+
+func newTLV8() *tlv8 {
+	return &tlv8{values: make(map[byte][]byte)}
+}
+
+// set sets the value of an item
+func (t *tlv8) set(typ byte, value []byte) *tlv8 {
+	if _, ok := t.values[typ]; !ok {
+		t.types = append(t.types, typ)
+	}
+	t.values[typ] = value
+	return t
+}
+
+// setByte sets the value of an item holding a single byte
+func (t *tlv8) setByte(typ byte, value byte) *tlv8 {
+	return t.set(typ, []byte{value})
+}
+
+// get returns the value of an item, nil if there isn't one
+func (t *tlv8) get(typ byte) []byte {
+	return t.values[typ]
+}
+
+// getByte returns the value of an item holding a single byte
+func (t *tlv8) getByte(typ byte) (byte, bool) {
+	value, ok := t.values[typ]
+	if !ok || len(value) != 1 {
+		return 0, false
+	}
+	return value[0], true
+}
+
+// encode encodes the items, splitting values longer than 255 bytes across consecutive items
+func (t *tlv8) encode() []byte {
+	var b bytes.Buffer
+	for _, typ := range t.types {
+		value := t.values[typ]
+		if len(value) == 0 {
+			b.WriteByte(typ)
+			b.WriteByte(0)
+			continue
+		}
+		for len(value) > 0 {
+			n := len(value)
+			if n > 255 {
+				n = 255
+			}
+			b.WriteByte(typ)
+			b.WriteByte(byte(n))
+			b.Write(value[:n])
+			value = value[n:]
+		}
+	}
+	return b.Bytes()
+}
+
+// decodeTLV8 decodes TLV8 encoded items, joining items split across consecutive fragments
+func decodeTLV8(data []byte) (*tlv8, error) {
+	t := newTLV8()
+	var last = -1
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil, fmt.Errorf("Truncated TLV item")
+		}
+		typ, length := data[0], int(data[1])
+		if len(data) < 2+length {
+			return nil, fmt.Errorf("Truncated TLV item: %d", typ)
+		}
+		value := data[2 : 2+length]
+		if int(typ) == last {
+			// a continuation of the item before
+			t.values[typ] = append(t.values[typ], value...)
+		} else {
+			t.set(typ, append([]byte{}, value...))
+		}
+		last = int(typ)
+		data = data[2+length:]
+	}
+	return t, nil
+}
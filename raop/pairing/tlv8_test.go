@@ -0,0 +1,45 @@
+package pairing
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestTLV8Encode(t *testing.T) {
+	encoded := newTLV8().setByte(tlvState, 3).set(tlvIdentifier, []byte("hello")).encode()
+	expected := []byte{0x06, 0x01, 0x03, 0x01, 0x05, 'h', 'e', 'l', 'l', 'o'}
+	if !bytes.Equal(encoded, expected) {
+		t.Error(fmt.Sprintf("Expected: %x\r\n Got: %x", expected, encoded))
+	}
+}
+
+func TestTLV8Fragments(t *testing.T) {
+	// values over 255 bytes are split across items of the same type
+	long := bytes.Repeat([]byte{0xab}, 300)
+	encoded := newTLV8().set(tlvPublicKey, long).setByte(tlvState, 2).encode()
+	if len(encoded) != 2+255+2+45+3 {
+		t.Fatal(fmt.Sprintf("Expected: %d bytes\r\n Got: %d", 2+255+2+45+3, len(encoded)))
+	}
+	if encoded[0] != tlvPublicKey || encoded[1] != 255 || encoded[257] != tlvPublicKey || encoded[258] != 45 {
+		t.Error(fmt.Sprintf("Unexpected fragments: %x", encoded[:4]))
+	}
+	decoded, err := decodeTLV8(encoded)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if !bytes.Equal(decoded.get(tlvPublicKey), long) {
+		t.Error(fmt.Sprintf("Expected: %d bytes\r\n Got: %d", len(long), len(decoded.get(tlvPublicKey))))
+	}
+	if state, _ := decoded.getByte(tlvState); state != 2 {
+		t.Error(fmt.Sprintf("Expected: %d\r\n Got: %d", 2, state))
+	}
+}
+
+func TestTLV8Truncated(t *testing.T) {
+	for _, data := range [][]byte{{0x06}, {0x06, 0x02, 0x01}} {
+		if _, err := decodeTLV8(data); err == nil {
+			t.Error(fmt.Sprintf("Expected error decoding: %x", data))
+		}
+	}
+}
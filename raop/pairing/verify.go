@@ -0,0 +1,103 @@
+package pairing
+
+import (
+	"bytes"
+	"fmt"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// PairVerify is a pair-verify exchange, in which a controller we have paired with and us each
+// prove we hold our long term keys, agreeing on a secret to encrypt the connection with
+type PairVerify struct {
+	accessory *Accessory
+	// the state of our last reply
+	state            byte
+	public           [32]byte
+	controllerPublic []byte
+	secret           [32]byte
+	verified         bool
+}
+
+// NewPairVerify starts a pair-verify exchange with a controller
+func (a *Accessory) NewPairVerify() *PairVerify {
+	return &PairVerify{accessory: a}
+}
+
+// Handle handles a pair-verify message from the controller, returning our reply.  If the
+// exchange fails the reply tells the controller, and the error tells us why
+func (pv *PairVerify) Handle(body []byte) ([]byte, error) {
+	message, err := decodeTLV8(body)
+	if err != nil {
+		return errorReply(pv.state+1, errorUnknown), err
+	}
+	state, _ := message.getByte(tlvState)
+	switch {
+	case state == 1:
+		return pv.start(message)
+	case state == 3 && pv.state == 2:
+		return pv.finish(message)
+	}
+	return errorReply(state+1, errorUnknown), fmt.Errorf("Unexpected pair-verify state: %d", state)
+}
+
+// Done returns whether the controller has been verified
+func (pv *PairVerify) Done() bool {
+	return pv.verified
+}
+
+// SharedSecret returns the secret to encrypt the connection with, once the controller is verified
+func (pv *PairVerify) SharedSecret() []byte {
+	if !pv.verified {
+		return nil
+	}
+	return pv.secret[:]
+}
+
+func (pv *PairVerify) encryptionKey() []byte {
+	return deriveKey(pv.secret[:], "Pair-Verify-Encrypt-Salt", "Pair-Verify-Encrypt-Info")
+}
+
+// start handles M1, swapping X25519 public keys and signing ours along with theirs
+func (pv *PairVerify) start(message *tlv8) ([]byte, error) {
+	pv.state, pv.verified = 0, false
+	pv.controllerPublic = message.get(tlvPublicKey)
+	if len(pv.controllerPublic) != 32 {
+		return errorReply(2, errorUnknown), fmt.Errorf("Invalid controller public key")
+	}
+	public, private, err := newCurve25519Key()
+	if err != nil {
+		return errorReply(2, errorUnknown), err
+	}
+	pv.public = public
+	pv.secret = sharedSecret(private, pv.controllerPublic)
+
+	accessoryID := []byte(pv.accessory.id)
+	signature := pv.accessory.store.sign(bytes.Join([][]byte{pv.public[:], accessoryID, pv.controllerPublic}, nil))
+	encrypted, err := sealMessage(pv.encryptionKey(), "PV-Msg02", newTLV8().set(tlvIdentifier, accessoryID).set(tlvSignature, signature))
+	if err != nil {
+		return errorReply(2, errorUnknown), err
+	}
+	pv.state = 2
+	return newTLV8().setByte(tlvState, 2).set(tlvPublicKey, pv.public[:]).set(tlvEncryptedData, encrypted).encode(), nil
+}
+
+// finish handles M3, checking the controller is one we have paired with
+func (pv *PairVerify) finish(message *tlv8) ([]byte, error) {
+	sub, err := openMessage(pv.encryptionKey(), "PV-Msg03", message.get(tlvEncryptedData))
+	if err != nil {
+		return errorReply(4, errorAuthentication), err
+	}
+	id := sub.get(tlvIdentifier)
+	pairing, ok := pv.accessory.store.Pairing(string(id))
+	if !ok || len(pairing.PublicKey) != ed25519.PublicKeySize {
+		return errorReply(4, errorAuthentication), fmt.Errorf("Unknown controller: %s", id)
+	}
+	signed := bytes.Join([][]byte{pv.controllerPublic, id, pv.public[:]}, nil)
+	if !ed25519.Verify(pairing.PublicKey, signed, sub.get(tlvSignature)) {
+		return errorReply(4, errorAuthentication), fmt.Errorf("Invalid signature from controller: %s", id)
+	}
+	pv.state = 4
+	pv.verified = true
+	return newTLV8().setByte(tlvState, 4).encode(), nil
+}
@@ -0,0 +1,48 @@
+package raop
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nstehr/bobcaygeon/player"
+)
+
+// parseProgress parses the progress parameter senders send with SET_PARAMETER, which is the RTP
+// timestamps of the start of the track, what is playing now and the end of the track
+// e.g: progress: 1146221540/1146549156/1195701740
+// returning how far into the track we are, and how long it is
+func parseProgress(progress string) (time.Duration, time.Duration, error) {
+	parts := strings.Split(strings.TrimSpace(progress), "/")
+	if len(parts) != 3 {
+		return 0, 0, fmt.Errorf("Invalid progress: %s", progress)
+	}
+	var timestamps [3]uint32
+	for i, part := range parts {
+		timestamp, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return 0, 0, fmt.Errorf("Invalid progress: %s", progress)
+		}
+		timestamps[i] = uint32(timestamp)
+	}
+	start, current, end := timestamps[0], timestamps[1], timestamps[2]
+	// the timestamps can wrap around, and current can be a little before the start
+	// when the sender is counting in its latency
+	position := int32(current - start)
+	if position < 0 {
+		position = 0
+	}
+	duration := player.FramesToDuration(end - start)
+	elapsed := player.FramesToDuration(uint32(position))
+	if elapsed > duration {
+		elapsed = duration
+	}
+	return elapsed, duration, nil
+}
+
+// FormatProgress formats how far into the track we are, and how long it is, as the progress
+// parameter to send with SET_PARAMETER
+func FormatProgress(position time.Duration, duration time.Duration) string {
+	return fmt.Sprintf("0/%d/%d", player.DurationToFrames(position), player.DurationToFrames(duration))
+}
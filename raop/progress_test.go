@@ -0,0 +1,90 @@
+package raop
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nstehr/bobcaygeon/rtsp"
+)
+
+func TestParseProgress(t *testing.T) {
+	// 7.43 seconds into a track 1 minute 57 seconds long
+	position, duration, err := parseProgress("1146221540/1146549156/1151381240")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if position.Round(10*time.Millisecond) != 7430*time.Millisecond {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", 7430*time.Millisecond, position))
+	}
+	if duration.Round(10*time.Millisecond) != 117*time.Second {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", 117*time.Second, duration))
+	}
+}
+
+func TestParseProgressWraps(t *testing.T) {
+	// the timestamps wrap around part way through the track
+	position, duration, err := parseProgress("4294923196/44100/4410000")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if position != 2*time.Second {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", 2*time.Second, position))
+	}
+	if duration != 101*time.Second {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", 101*time.Second, duration))
+	}
+}
+
+func TestParseProgressBeforeStart(t *testing.T) {
+	// senders count in their latency, so can be playing from before the start
+	position, _, err := parseProgress("100000/99000/4510000")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if position != 0 {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", time.Duration(0), position))
+	}
+}
+
+func TestParseProgressInvalid(t *testing.T) {
+	for _, progress := range []string{"", "1/2", "1/two/3", "1/2/3/4"} {
+		if _, _, err := parseProgress(progress); err == nil {
+			t.Error(fmt.Sprintf("Expected error parsing: %s", progress))
+		}
+	}
+}
+
+func TestFormatProgress(t *testing.T) {
+	progress := FormatProgress(2*time.Second, 101*time.Second)
+	if progress != "0/88200/4454100" {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", "0/88200/4454100", progress))
+	}
+	position, duration, err := parseProgress(progress)
+	if err != nil || position != 2*time.Second || duration != 101*time.Second {
+		t.Error(fmt.Sprintf("Expected to parse what we format, got: %s %s %v", position, duration, err))
+	}
+}
+
+func TestSetProgressParameter(t *testing.T) {
+	fp := &FakePlayer{}
+	a := NewAirplayServer(444, "Test", fp)
+	req := rtsp.NewRequest()
+	req.Headers.Set("Content-Type", "text/parameters")
+	req.Body = []byte("progress: 0/88200/4454100\r\n")
+	resp := rtsp.NewResponse()
+	a.handlSetParameter(req, resp, rtsp.NewContext(1, "192.168.0.15", "10.0.0.0"))
+	if resp.Status != rtsp.Ok {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", rtsp.Ok.String(), resp.Status.String()))
+	}
+	if fp.position != 2*time.Second || fp.duration != 101*time.Second {
+		t.Error(fmt.Sprintf("Expected: %s/%s\r\n Got: %s/%s", 2*time.Second, 101*time.Second, fp.position, fp.duration))
+	}
+
+	req.Body = []byte("progress: nonsense\r\n")
+	resp = rtsp.NewResponse()
+	a.handlSetParameter(req, resp, rtsp.NewContext(1, "192.168.0.15", "10.0.0.0"))
+	if resp.Status != rtsp.BadRequest {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", rtsp.BadRequest.String(), resp.Status.String()))
+	}
+}
@@ -0,0 +1,227 @@
+package raop
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nstehr/bobcaygeon/rtsp"
+)
+
+// SessionState is where an airplay session is in its lifecycle
+type SessionState int
+
+const (
+	// ANNOUNCE received, waiting on SETUP
+	SessionAnnounced SessionState = iota
+	// SETUP received, waiting on RECORD
+	SessionSetUp
+	// RECORD received, audio is being played
+	SessionRecording
+	// RECORD received while another sender was playing, waiting its turn
+	SessionQueued
+	// the session has ended, by the sender or because it went quiet
+	SessionClosed
+)
+
+func (s SessionState) String() string {
+	switch s {
+	case SessionAnnounced:
+		return "announced"
+	case SessionSetUp:
+		return "setup"
+	case SessionRecording:
+		return "recording"
+	case SessionQueued:
+		return "queued"
+	case SessionClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// SenderPolicy decides what happens when a second sender connects while
+// another one is already streaming
+type SenderPolicy int
+
+const (
+	// SenderTakeover closes the current sender's session in favour of the new one
+	SenderTakeover SenderPolicy = iota
+	// SenderQueue holds the new sender until the current one tears down
+	SenderQueue
+	// SenderRefuse rejects the new sender with 453 Not Enough Bandwidth
+	SenderRefuse
+)
+
+// ParseSenderPolicy parses a policy name (takeover, queue or refuse)
+func ParseSenderPolicy(policy string) (SenderPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(policy)) {
+	case "", "takeover":
+		return SenderTakeover, nil
+	case "queue":
+		return SenderQueue, nil
+	case "refuse":
+		return SenderRefuse, nil
+	}
+	return SenderTakeover, fmt.Errorf("Unknown sender policy: %s", policy)
+}
+
+type airplaySession struct {
+	id string
+	// identifies the sender, used to replace a session when the same sender announces again
+	clientKey string
+	created   time.Time
+	session   *rtsp.Session
+	stateLock sync.RWMutex
+	state     SessionState
+	// controls playback on the sender, attached once the sender's DACP server is found
+	client *DacpClient
+	// whether the client has been taken to close the session
+	clientTaken bool
+	// whether the session was announced by another node in the cluster, i.e: a zone leader forwarding to us
+	peer bool
+}
+
+func newAirplaySession(session *rtsp.Session, dacpClient *DacpClient) *airplaySession {
+	if session.ID == "" {
+		session.ID = newSessionID()
+	}
+	return &airplaySession{id: session.ID, session: session, client: dacpClient, created: time.Now(), state: SessionAnnounced}
+}
+
+func (as *airplaySession) getState() SessionState {
+	as.stateLock.RLock()
+	defer as.stateLock.RUnlock()
+	return as.state
+}
+
+func (as *airplaySession) setState(state SessionState) {
+	as.stateLock.Lock()
+	defer as.stateLock.Unlock()
+	as.state = state
+}
+
+func (as *airplaySession) getClient() *DacpClient {
+	as.stateLock.RLock()
+	defer as.stateLock.RUnlock()
+	return as.client
+}
+
+// setClient attaches the client, unless the session has been closed in the meantime
+func (as *airplaySession) setClient(client *DacpClient) bool {
+	as.stateLock.Lock()
+	defer as.stateLock.Unlock()
+	if as.clientTaken {
+		return false
+	}
+	as.client = client
+	return true
+}
+
+// takeClient takes the client to close it, no client is attached after
+func (as *airplaySession) takeClient() *DacpClient {
+	as.stateLock.Lock()
+	defer as.stateLock.Unlock()
+	as.clientTaken = true
+	client := as.client
+	as.client = nil
+	return client
+}
+
+// newSessionID generates a random id to hand back to the sender in the Session header
+func newSessionID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		// very unlikely, but fallback to something that is still unique to us
+		return fmt.Sprintf("%X", time.Now().UnixNano())
+	}
+	return strings.ToUpper(hex.EncodeToString(b))
+}
+
+// clientKey identifies a sender.  The DACP-ID is unique per app on a device, so it
+// lets us tell apart multiple apps on the same device, or devices behind the same NAT
+func clientKey(req *rtsp.Request, remoteAddress string) string {
+	return remoteAddress + "/" + req.Headers.Get("DACP-ID")
+}
+
+// sessionIDFromHeader pulls the id out of a Session header, which can also carry a timeout
+// e.g: Session: 12345678;timeout=60
+func sessionIDFromHeader(header string) string {
+	return strings.TrimSpace(strings.Split(header, ";")[0])
+}
+
+type sessionMap struct {
+	sync.RWMutex
+	sessions map[string]*airplaySession
+}
+
+func newSessionMap() *sessionMap {
+	return &sessionMap{sessions: make(map[string]*airplaySession)}
+}
+
+func (sm *sessionMap) addSession(session *airplaySession) {
+	sm.Lock()
+	defer sm.Unlock()
+	sm.sessions[session.id] = session
+}
+
+// removeSession removes the session, returning it if it was there.  Only one caller gets
+// the session back, so it is only closed once
+func (sm *sessionMap) removeSession(id string) *airplaySession {
+	sm.Lock()
+	defer sm.Unlock()
+	s, ok := sm.sessions[id]
+	if !ok {
+		return nil
+	}
+	delete(sm.sessions, id)
+	return s
+}
+
+func (sm *sessionMap) getSession(id string) *airplaySession {
+	sm.RLock()
+	defer sm.RUnlock()
+	s, ok := sm.sessions[id]
+	if !ok {
+		return nil
+	}
+	return s
+}
+
+// getSessionForClient returns the most recent session for the given sender
+func (sm *sessionMap) getSessionForClient(key string) *airplaySession {
+	var found *airplaySession
+	for _, s := range sm.getSessions() {
+		if s.clientKey == key {
+			found = s
+		}
+	}
+	return found
+}
+
+// getSessions returns all the sessions, oldest first
+func (sm *sessionMap) getSessions() []*airplaySession {
+	sm.RLock()
+	defer sm.RUnlock()
+	sessions := make([]*airplaySession, 0, len(sm.sessions))
+
+	for _, value := range sm.sessions {
+		sessions = append(sessions, value)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].created.Before(sessions[j].created) })
+	return sessions
+}
+
+// getSessionInState returns the oldest session in the given state
+func (sm *sessionMap) getSessionInState(state SessionState) *airplaySession {
+	for _, s := range sm.getSessions() {
+		if s.getState() == state {
+			return s
+		}
+	}
+	return nil
+}
@@ -0,0 +1,445 @@
+package raop
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nstehr/bobcaygeon/rtsp"
+	"github.com/nstehr/bobcaygeon/sdp"
+)
+
+const testRemoteAddress = "10.0.0.0"
+
+func addTestSession(t *testing.T, a *AirplayServer, dacpID string, state SessionState) *airplaySession {
+	s := rtsp.NewSession(sdp.NewSessionDescription(), nil)
+	if err := s.InitReceive(); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	req := rtsp.NewRequest()
+	req.Headers.Set("DACP-ID", dacpID)
+	as := newAirplaySession(s, nil)
+	as.clientKey = clientKey(req, testRemoteAddress)
+	as.setState(state)
+	a.sessions.addSession(as)
+	return as
+}
+
+func sessionRequest(as *airplaySession) *rtsp.Request {
+	req := rtsp.NewRequest()
+	req.Headers.Set("Session", as.id)
+	return req
+}
+
+func TestParseSenderPolicy(t *testing.T) {
+	policies := map[string]SenderPolicy{"": SenderTakeover, "takeover": SenderTakeover, "Queue": SenderQueue, "refuse": SenderRefuse}
+	for name, expected := range policies {
+		policy, err := ParseSenderPolicy(name)
+		if err != nil {
+			t.Error("Unexpected error", err)
+		}
+		if policy != expected {
+			t.Error(fmt.Sprintf("Expected: %d\r\n Got: %d", expected, policy))
+		}
+	}
+	if _, err := ParseSenderPolicy("share"); err == nil {
+		t.Error("Expected error for unknown policy")
+	}
+}
+
+func TestSessionIDFromHeader(t *testing.T) {
+	id := sessionIDFromHeader("DEADBEEF;timeout=60")
+	if id != "DEADBEEF" {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", "DEADBEEF", id))
+	}
+}
+
+func TestSetupBySessionID(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	first := addTestSession(t, a, "1111", SessionAnnounced)
+	second := addTestSession(t, a, "2222", SessionAnnounced)
+	defer a.closeAllSessions(ReasonStopped)
+	// both senders share an address, the session header tells them apart
+	req := sessionRequest(second)
+	resp := rtsp.NewResponse()
+	a.handleSetup(req, resp, rtsp.NewContext(1, "192.168.0.15", testRemoteAddress))
+	if resp.Status != rtsp.Ok {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", rtsp.Ok.String(), resp.Status.String()))
+	}
+	if second.getState() != SessionSetUp {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", SessionSetUp, second.getState()))
+	}
+	if first.getState() != SessionAnnounced {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", SessionAnnounced, first.getState()))
+	}
+	if first.id == second.id {
+		t.Error("Expected sessions to have different ids")
+	}
+}
+
+func TestSetupByClient(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	addTestSession(t, a, "1111", SessionAnnounced)
+	as := addTestSession(t, a, "2222", SessionAnnounced)
+	defer a.closeAllSessions(ReasonStopped)
+	req := rtsp.NewRequest()
+	req.Headers.Set("DACP-ID", "2222")
+	resp := rtsp.NewResponse()
+	a.handleSetup(req, resp, rtsp.NewContext(1, "192.168.0.15", testRemoteAddress))
+	if resp.Headers.Get("Session") != as.id {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", as.id, resp.Headers.Get("Session")))
+	}
+}
+
+func TestSetupUnknownSession(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	req := rtsp.NewRequest()
+	req.Headers.Set("Session", "DEADBEEF")
+	resp := rtsp.NewResponse()
+	a.handleSetup(req, resp, rtsp.NewContext(1, "192.168.0.15", testRemoteAddress))
+	if resp.Status != rtsp.SessionNotFound {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", rtsp.SessionNotFound.String(), resp.Status.String()))
+	}
+}
+
+func TestRecordBeforeSetup(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	as := addTestSession(t, a, "1111", SessionAnnounced)
+	defer a.closeAllSessions(ReasonStopped)
+	resp := rtsp.NewResponse()
+	a.handleRecord(sessionRequest(as), resp, rtsp.NewContext(1, "192.168.0.15", testRemoteAddress))
+	if resp.Status != rtsp.MethodNotValidInThisState {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", rtsp.MethodNotValidInThisState.String(), resp.Status.String()))
+	}
+}
+
+func TestRefuseSecondSender(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	a.SetSenderPolicy(SenderRefuse)
+	addTestSession(t, a, "1111", SessionRecording)
+	defer a.closeAllSessions(ReasonStopped)
+	if a.admitSender(testRemoteAddress + "/2222") {
+		t.Error("Expected second sender to be refused")
+	}
+	// the same sender announcing again is always let in
+	if !a.admitSender(testRemoteAddress + "/1111") {
+		t.Error("Expected sender to be admitted")
+	}
+	if len(a.sessions.getSessions()) != 0 {
+		t.Error(fmt.Sprintf("Expected: %d sessions\r\n Got: %d", 0, len(a.sessions.getSessions())))
+	}
+}
+
+func TestTakeoverSecondSender(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	addTestSession(t, a, "1111", SessionRecording)
+	if !a.admitSender(testRemoteAddress + "/2222") {
+		t.Error("Expected second sender to be admitted")
+	}
+	if len(a.sessions.getSessions()) != 0 {
+		t.Error(fmt.Sprintf("Expected: %d sessions\r\n Got: %d", 0, len(a.sessions.getSessions())))
+	}
+}
+
+func TestQueueSecondSender(t *testing.T) {
+	fp := &FakePlayer{}
+	a := NewAirplayServer(444, "Test", fp)
+	a.SetSenderPolicy(SenderQueue)
+	first := addTestSession(t, a, "1111", SessionSetUp)
+	if !a.admitSender(testRemoteAddress + "/2222") {
+		t.Error("Expected second sender to be admitted")
+	}
+	second := addTestSession(t, a, "2222", SessionSetUp)
+	defer a.closeAllSessions(ReasonStopped)
+
+	resp := rtsp.NewResponse()
+	a.handleRecord(sessionRequest(first), resp, rtsp.NewContext(1, "192.168.0.15", testRemoteAddress))
+	if first.getState() != SessionRecording {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", SessionRecording, first.getState()))
+	}
+	resp = rtsp.NewResponse()
+	a.handleRecord(sessionRequest(second), resp, rtsp.NewContext(1, "192.168.0.15", testRemoteAddress))
+	if resp.Status != rtsp.Ok {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", rtsp.Ok.String(), resp.Status.String()))
+	}
+	if second.getState() != SessionQueued {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", SessionQueued, second.getState()))
+	}
+
+	// the queued sender can't control the player
+	req := sessionRequest(second)
+	req.Headers.Set("Content-Type", "text/parameters")
+	req.Headers.Set("X-BCG-Muted", "muted")
+	req.Body = []byte("volume: -144")
+	resp = rtsp.NewResponse()
+	a.handlSetParameter(req, resp, rtsp.NewContext(1, "192.168.0.15", testRemoteAddress))
+	if fp.muted {
+		t.Error("Expected player to not be muted, but was muted")
+	}
+
+	resp = rtsp.NewResponse()
+	a.handleTeardown(sessionRequest(first), resp, rtsp.NewContext(1, "192.168.0.15", testRemoteAddress))
+	if resp.Status != rtsp.Ok {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", rtsp.Ok.String(), resp.Status.String()))
+	}
+	if a.sessions.getSession(first.id) != nil {
+		t.Error("Expected first session to be removed")
+	}
+	if second.getState() != SessionRecording {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", SessionRecording, second.getState()))
+	}
+}
+
+func TestIsPlaying(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	as := addTestSession(t, a, "1111", SessionSetUp)
+	defer a.closeAllSessions(ReasonStopped)
+	if a.IsPlaying() {
+		t.Error("Expected nothing to be playing before RECORD")
+	}
+	resp := rtsp.NewResponse()
+	a.handleRecord(sessionRequest(as), resp, rtsp.NewContext(1, "192.168.0.15", testRemoteAddress))
+	if !a.IsPlaying() {
+		t.Error("Expected to be playing after RECORD")
+	}
+	resp = rtsp.NewResponse()
+	a.handleTeardown(sessionRequest(as), resp, rtsp.NewContext(1, "192.168.0.15", testRemoteAddress))
+	if a.IsPlaying() {
+		t.Error("Expected nothing to be playing after TEARDOWN")
+	}
+}
+
+func TestPlayerToldWhenPlaying(t *testing.T) {
+	fp := &FakePlayer{}
+	a := NewAirplayServer(444, "Test", fp)
+	as := addTestSession(t, a, "1111", SessionSetUp)
+	defer a.closeAllSessions(ReasonStopped)
+	ctx := rtsp.NewContext(1, "192.168.0.15", testRemoteAddress)
+	a.handleRecord(sessionRequest(as), rtsp.NewResponse(), ctx)
+	if !fp.playing {
+		t.Error("Expected the player to be playing after RECORD")
+	}
+	a.handlFlush(sessionRequest(as), rtsp.NewResponse(), ctx)
+	if fp.playing {
+		t.Error("Expected the player to be paused after FLUSH")
+	}
+	req := sessionRequest(as)
+	req.Headers.Set("Content-Type", "text/parameters")
+	req.Body = []byte("progress: 1000/45100/442000\r\n")
+	a.handlSetParameter(req, rtsp.NewResponse(), ctx)
+	if !fp.playing {
+		t.Error("Expected the player to be playing after the progress")
+	}
+	a.handleTeardown(sessionRequest(as), rtsp.NewResponse(), ctx)
+	if fp.playing {
+		t.Error("Expected the player to be stopped after TEARDOWN")
+	}
+}
+
+func TestCloseSessionTwice(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	as := addTestSession(t, a, "1111", SessionSetUp)
+	a.handleRecord(sessionRequest(as), rtsp.NewResponse(), rtsp.NewContext(1, "192.168.0.15", testRemoteAddress))
+	// e.g: the server stopping while the sender tears down
+	done := make(chan struct{})
+	go func() {
+		a.closeAllSessions(ReasonStopped)
+		done <- struct{}{}
+	}()
+	go func() {
+		a.closeSession(as.id, ReasonTeardown)
+		done <- struct{}{}
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Expected the session to close")
+		}
+	}
+	if as.getState() != SessionClosed {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", SessionClosed, as.getState()))
+	}
+}
+
+func TestSetParameterUnknownSession(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	req := rtsp.NewRequest()
+	req.Headers.Set("Session", "DEADBEEF")
+	req.Headers.Set("Content-Type", "text/parameters")
+	req.Body = []byte("volume: -15")
+	resp := rtsp.NewResponse()
+	a.handlSetParameter(req, resp, rtsp.NewContext(1, "192.168.0.15", testRemoteAddress))
+	if resp.Status != rtsp.SessionNotFound {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", rtsp.SessionNotFound.String(), resp.Status.String()))
+	}
+}
+
+// nextEvent waits on the next session event
+func nextEvent(t *testing.T, events <-chan SessionEvent) SessionEvent {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("Expected a session event")
+	}
+	return SessionEvent{}
+}
+
+func TestInactiveSessionClosed(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	a.SetInactivityTimeout(50 * time.Millisecond)
+	events := a.Subscribe()
+	defer a.Unsubscribe(events)
+	as := addTestSession(t, a, "1111", SessionSetUp)
+	defer a.closeAllSessions(ReasonStopped)
+	resp := rtsp.NewResponse()
+	a.handleRecord(sessionRequest(as), resp, rtsp.NewContext(1, "192.168.0.15", testRemoteAddress))
+
+	event := nextEvent(t, events)
+	if event.SessionID != as.id || event.State != SessionRecording {
+		t.Error(fmt.Sprintf("Expected: %s %s\r\n Got: %s %s", as.id, SessionRecording, event.SessionID, event.State))
+	}
+	// the sender never sends anything, so the session is torn down
+	event = nextEvent(t, events)
+	if event.State != SessionClosed || event.Reason != ReasonInactive {
+		t.Error(fmt.Sprintf("Expected: %s %s\r\n Got: %s %s", SessionClosed, ReasonInactive, event.State, event.Reason))
+	}
+	if a.sessions.getSession(as.id) != nil {
+		t.Error("Expected inactive session to be removed")
+	}
+}
+
+func TestPeerSessionNotTimedOut(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	a.SetInactivityTimeout(50 * time.Millisecond)
+	a.SetClusterPeers(func(address string) bool { return address == "10.0.0.2" })
+	events := a.Subscribe()
+	defer a.Unsubscribe(events)
+	defer a.closeAllSessions(ReasonStopped)
+	// the zone leader sets up forwarding to us
+	req := rtsp.NewRequest()
+	req.Method = rtsp.Announce
+	req.Headers.Set("Content-Type", "application/sdp")
+	req.Body = []byte("v=0\r\no=AirTunes 1547303657935225515 0 IN IP4 10.0.0.2\r\ns=AirTunes\r\nc=IN IP4 10.0.0.2\r\n" +
+		"t=0 0\r\nm=audio 0 RTP/AVP 96\r\na=rtpmap:96 AppleLossless\r\na=fmtp:96 352 0 16 40 10 14 2 255 0 0 44100\r\n")
+	resp := rtsp.NewResponse()
+	a.handleAnnounce(req, resp, rtsp.NewContext(1, "192.168.0.15", "10.0.0.2"))
+	if resp.Status != rtsp.Ok {
+		t.Fatal(fmt.Sprintf("Expected: %s\r\n Got: %s", rtsp.Ok.String(), resp.Status.String()))
+	}
+	sessions := a.sessions.getSessions()
+	if len(sessions) != 1 {
+		t.Fatal(fmt.Sprintf("Expected: %d\r\n Got: %d", 1, len(sessions)))
+	}
+	as := sessions[0]
+	as.setState(SessionSetUp)
+	a.handleRecord(sessionRequest(as), rtsp.NewResponse(), rtsp.NewContext(1, "192.168.0.15", "10.0.0.2"))
+	event := nextEvent(t, events)
+	if event.State != SessionRecording {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", SessionRecording, event.State))
+	}
+	// nothing is playing, so the leader sends nothing, but the session stays up
+	select {
+	case event = <-events:
+		t.Error(fmt.Sprintf("Expected no event\r\n Got: %s %s", event.State, event.Reason))
+	case <-time.After(200 * time.Millisecond):
+	}
+	if as.getState() != SessionRecording {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", SessionRecording, as.getState()))
+	}
+}
+
+func TestTeardownPublishesEvent(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	as := addTestSession(t, a, "1111", SessionAnnounced)
+	events := a.Subscribe()
+	resp := rtsp.NewResponse()
+	a.handleTeardown(sessionRequest(as), resp, rtsp.NewContext(1, "192.168.0.15", testRemoteAddress))
+	event := nextEvent(t, events)
+	if event.State != SessionClosed || event.Reason != ReasonTeardown {
+		t.Error(fmt.Sprintf("Expected: %s %s\r\n Got: %s %s", SessionClosed, ReasonTeardown, event.State, event.Reason))
+	}
+	a.Unsubscribe(events)
+	if _, ok := <-events; ok {
+		t.Error("Expected channel to be closed once unsubscribed")
+	}
+}
+
+func TestRemote(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	if _, err := a.Remote(); err == nil {
+		t.Error("Expected error when nothing is playing")
+	}
+	as := addTestSession(t, a, "1", SessionRecording)
+	if _, err := a.Remote(); err == nil {
+		t.Error("Expected error when the sender has no remote")
+	}
+	remote := newDacpClient("1.1.1.1", 333, "1", "remote")
+	as.client = remote
+	// a queued sender isn't the one we control
+	addTestSession(t, a, "2", SessionQueued).client = newDacpClient("1.1.1.2", 333, "2", "other")
+	found, err := a.Remote()
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if found != remote {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", remote.ipAddress, found.ipAddress))
+	}
+}
+
+func TestAttachRemote(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	a.discoverDacp = func(ctx context.Context, dacpID string) (string, int, error) {
+		return "10.0.0.2", 3689, nil
+	}
+	as := addTestSession(t, a, "ABCD", SessionRecording)
+	a.attachRemote(as, "ABCD", "remote")
+	remote, err := a.Remote()
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if remote.ipAddress != "10.0.0.2" || remote.activeRemote != "remote" {
+		t.Error(fmt.Sprintf("Expected: 10.0.0.2 remote\r\n Got: %s %s", remote.ipAddress, remote.activeRemote))
+	}
+
+	// the session closes before its DACP server is found
+	closed := addTestSession(t, a, "EFGH", SessionRecording)
+	a.closeSession(closed.id, ReasonTeardown)
+	a.attachRemote(closed, "EFGH", "remote")
+	if closed.getClient() != nil {
+		t.Error("Expected no client to be attached to a closed session")
+	}
+}
+
+func TestAttachRemoteSessionCloses(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	// the DACP server never shows up
+	a.discoverDacp = func(ctx context.Context, dacpID string) (string, int, error) {
+		<-ctx.Done()
+		return "", 0, ctx.Err()
+	}
+	as := addTestSession(t, a, "ABCD", SessionRecording)
+	done := make(chan struct{})
+	go func() {
+		a.attachRemote(as, "ABCD", "remote")
+		close(done)
+	}()
+	a.closeSession(as.id, ReasonTeardown)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Expected to stop looking for the DACP server once the session closed")
+	}
+}
+
+func TestAttachRemoteNotFound(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	// without a browser there is nothing to find the DACP server with
+	as := addTestSession(t, a, "ABCD", SessionRecording)
+	a.attachRemote(as, "ABCD", "remote")
+	if as.getClient() != nil {
+		t.Error("Expected no client to be attached")
+	}
+}
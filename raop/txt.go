@@ -0,0 +1,138 @@
+package raop
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// codecs, for the cn TXT record
+const (
+	CodecPCM    = 0
+	CodecALAC   = 1
+	CodecAAC    = 2
+	CodecAACELD = 3
+)
+
+// encryption types, for the et TXT record
+const (
+	EncryptionNone     = 0
+	EncryptionRSA      = 1
+	EncryptionFairPlay = 3
+)
+
+// metadata types, for the md TXT record
+const (
+	MetadataText     = 0
+	MetadataArtwork  = 1
+	MetadataProgress = 2
+)
+
+// Capabilities are what we support, which senders find out about from our TXT records
+// https://nto.github.io/AirPlay.html#audio
+type Capabilities struct {
+	// cn
+	Codecs []int
+	// et
+	EncryptionTypes []int
+	// md, metadata the sender can send us with SET_PARAMETER
+	MetadataTypes []int
+	// sr
+	SampleRate int
+	// ss
+	SampleSize int
+	// ch
+	Channels int
+	// am, left out if empty
+	Model string
+	// vn
+	ProtocolVersion int
+}
+
+// DefaultCapabilities returns what we support out of the box
+func DefaultCapabilities() Capabilities {
+	return Capabilities{
+		// anything that isn't ALAC is passed through as PCM
+		Codecs:          []int{CodecPCM, CodecALAC},
+		EncryptionTypes: []int{EncryptionNone, EncryptionRSA},
+		MetadataTypes:   []int{MetadataText, MetadataArtwork, MetadataProgress},
+		SampleRate:      44100,
+		SampleSize:      16,
+		Channels:        2,
+		Model:           "Bobcaygeon",
+		ProtocolVersion: 3,
+	}
+}
+
+// textRecords builds the TXT records advertising the capabilities.  Overrides replace (or add)
+// records by key, an empty override leaves the record out
+func (c Capabilities) textRecords(password bool, overrides map[string]string) []string {
+	// txtvers has to be first
+	records := [][2]string{
+		{"txtvers", "1"},
+		{"ch", strconv.Itoa(c.Channels)},
+		{"cn", joinInts(c.Codecs)},
+		{"et", joinInts(c.EncryptionTypes)},
+		// we can only be sent an encryption key if we can decrypt it
+		{"ek", boolRecord(containsInt(c.EncryptionTypes, EncryptionRSA))},
+		{"md", joinInts(c.MetadataTypes)},
+		{"pw", strconv.FormatBool(password)},
+		{"sm", "false"},
+		{"sr", strconv.Itoa(c.SampleRate)},
+		{"ss", strconv.Itoa(c.SampleSize)},
+		{"sv", "false"},
+		{"tp", "UDP"},
+		{"vn", strconv.Itoa(c.ProtocolVersion)},
+	}
+	if c.Model != "" {
+		records = append(records, [2]string{"am", c.Model})
+	}
+
+	var txt []string
+	seen := make(map[string]bool)
+	for _, record := range records {
+		key, value := record[0], record[1]
+		seen[key] = true
+		if override, ok := overrides[key]; ok {
+			value = override
+		}
+		if value == "" {
+			continue
+		}
+		txt = append(txt, fmt.Sprintf("%s=%s", key, value))
+	}
+	// anything we don't know about goes on the end, sorted so the records don't keep changing
+	var extra []string
+	for key, value := range overrides {
+		if !seen[key] && value != "" {
+			extra = append(extra, fmt.Sprintf("%s=%s", key, value))
+		}
+	}
+	sort.Strings(extra)
+	return append(txt, extra...)
+}
+
+func joinInts(values []int) string {
+	s := make([]string, len(values))
+	for i, v := range values {
+		s[i] = strconv.Itoa(v)
+	}
+	return strings.Join(s, ",")
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func boolRecord(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
@@ -0,0 +1,66 @@
+package raop
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDefaultTextRecords(t *testing.T) {
+	records := DefaultCapabilities().textRecords(false, nil)
+	if records[0] != "txtvers=1" {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", "txtvers=1", records[0]))
+	}
+	joined := strings.Join(records, " ")
+	for _, expected := range []string{"cn=0,1", "et=0,1", "ek=1", "md=0,1,2", "sr=44100", "ss=16", "ch=2", "pw=false", "am=Bobcaygeon", "vn=3"} {
+		if !strings.Contains(joined, expected) {
+			t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", expected, joined))
+		}
+	}
+}
+
+func TestTextRecordsFromCapabilities(t *testing.T) {
+	capabilities := DefaultCapabilities()
+	capabilities.EncryptionTypes = []int{EncryptionNone}
+	capabilities.MetadataTypes = []int{MetadataText, MetadataArtwork, MetadataProgress}
+	capabilities.SampleRate = 48000
+	capabilities.Model = ""
+	joined := strings.Join(capabilities.textRecords(true, nil), " ")
+	for _, expected := range []string{"et=0", "ek=0", "md=0,1,2", "sr=48000", "pw=true"} {
+		if !strings.Contains(joined, expected) {
+			t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", expected, joined))
+		}
+	}
+	if strings.Contains(joined, "am=") {
+		t.Error(fmt.Sprintf("Expected no model\r\n Got: %s", joined))
+	}
+}
+
+func TestTextRecordOverrides(t *testing.T) {
+	overrides := map[string]string{"am": "AirPort10,115", "sv": "", "vs": "130.14", "da": "true"}
+	records := DefaultCapabilities().textRecords(false, overrides)
+	joined := strings.Join(records, " ")
+	if !strings.Contains(joined, "am=AirPort10,115") {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", "am=AirPort10,115", joined))
+	}
+	if strings.Contains(joined, "sv=") {
+		t.Error(fmt.Sprintf("Expected sv to be left out\r\n Got: %s", joined))
+	}
+	// records we don't know about are added to the end, in order
+	last := strings.Join(records[len(records)-2:], " ")
+	if last != "da=true vs=130.14" {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", "da=true vs=130.14", last))
+	}
+}
+
+func TestSetCapabilities(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	capabilities := DefaultCapabilities()
+	capabilities.Channels = 1
+	a.SetCapabilities(capabilities)
+	a.SetTextOverrides(map[string]string{"am": "Kitchen"})
+	joined := strings.Join(a.textRecords(), " ")
+	if !strings.Contains(joined, "ch=1") || !strings.Contains(joined, "am=Kitchen") {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", "ch=1 am=Kitchen", joined))
+	}
+}
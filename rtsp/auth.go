@@ -0,0 +1,100 @@
+package rtsp
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// key the nonce handed to a connection is kept under in its Context
+const digestNonceKey = "rtsp.digest-nonce"
+
+// PasswordFunc returns the password a request must be authenticated with, or an empty
+// string if the request doesn't need to be authenticated
+type PasswordFunc func(req *Request, ctx *Context) string
+
+// DigestAuth returns middleware that enforces RTSP Digest authentication (RFC 2069, which
+// is what airplay senders use).  OPTIONS is never authenticated, senders use it to find out
+// what we support before being asked for a password
+func DigestAuth(realm string, password PasswordFunc) Middleware {
+	return func(next RequestHandler) RequestHandler {
+		return func(req *Request, resp *Response, ctx *Context) {
+			if req.Method == Options {
+				next(req, resp, ctx)
+				return
+			}
+			pw := password(req, ctx)
+			if pw == "" {
+				next(req, resp, ctx)
+				return
+			}
+			nonce, _ := ctx.Value(digestNonceKey).(string)
+			if nonce != "" && checkDigest(req, realm, nonce, pw) {
+				next(req, resp, ctx)
+				return
+			}
+			if req.Headers.Has("Authorization") {
+				log.Printf("Failed authentication from: %s\n", ctx.RemoteAddr)
+			}
+			if nonce == "" {
+				nonce = newNonce()
+				ctx.SetValue(digestNonceKey, nonce)
+			}
+			resp.Headers.Set("WWW-Authenticate", fmt.Sprintf(`Digest realm="%s", nonce="%s"`, realm, nonce))
+			resp.Status = Unauthorized
+		}
+	}
+}
+
+// checkDigest checks the Authorization header of the request against the password
+func checkDigest(req *Request, realm string, nonce string, password string) bool {
+	auth := req.Headers.Get("Authorization")
+	if !strings.HasPrefix(auth, "Digest ") {
+		return false
+	}
+	params := parseAuthParams(strings.TrimPrefix(auth, "Digest "))
+	if params["realm"] != realm || params["nonce"] != nonce {
+		return false
+	}
+	// the digest only covers the uri it names, so it has to be the one being asked for
+	if params["uri"] != req.RequestURI {
+		return false
+	}
+	expected := DigestResponse(params["username"], realm, password, nonce, strings.ToUpper(req.Method.String()), params["uri"])
+	// some senders send the hash in upper case
+	return strings.EqualFold(params["response"], expected)
+}
+
+// DigestResponse computes the response to a digest challenge
+func DigestResponse(username string, realm string, password string, nonce string, method string, uri string) string {
+	ha1 := md5Hex(username + ":" + realm + ":" + password)
+	ha2 := md5Hex(method + ":" + uri)
+	return md5Hex(ha1 + ":" + nonce + ":" + ha2)
+}
+
+// parseAuthParams parses the comma separated key="value" pairs of an Authorization header
+func parseAuthParams(params string) map[string]string {
+	parsed := make(map[string]string)
+	for _, param := range strings.Split(params, ",") {
+		parts := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		parsed[strings.ToLower(parts[0])] = strings.Trim(parts[1], `"`)
+	}
+	return parsed
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func newNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
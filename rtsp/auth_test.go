@@ -0,0 +1,118 @@
+package rtsp
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func newAuthTestServer(t *testing.T, password string) (*Client, func()) {
+	server := NewServer(0)
+	server.Use(DigestAuth("raop", func(req *Request, ctx *Context) string { return password }))
+	ok := func(req *Request, resp *Response, ctx *Context) { resp.Status = Ok }
+	server.AddHandler(Options, ok)
+	server.AddHandler(Announce, ok)
+	l := serveTestClients(t, server)
+	client := newTestClient(t, l)
+	return client, func() {
+		client.Close()
+		l.Close()
+	}
+}
+
+func sendAnnounce(t *testing.T, client *Client, authorization string) *Response {
+	req := NewRequest()
+	req.Method = Announce
+	req.RequestURI = "rtsp://127.0.0.1/1"
+	if authorization != "" {
+		req.Headers.Set("Authorization", authorization)
+	}
+	resp, err := client.Send(req)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	return resp
+}
+
+func challengeNonce(t *testing.T, resp *Response) string {
+	params := parseAuthParams(strings.TrimPrefix(resp.Headers.Get("WWW-Authenticate"), "Digest "))
+	if params["realm"] != "raop" || params["nonce"] == "" {
+		t.Fatal(fmt.Sprintf("Expected a digest challenge\r\n Got: %s", resp.Headers.Get("WWW-Authenticate")))
+	}
+	return params["nonce"]
+}
+
+func authorization(nonce string, password string, response func(string) string) string {
+	digest := response(DigestResponse("iTunes", "raop", password, nonce, "ANNOUNCE", "rtsp://127.0.0.1/1"))
+	return fmt.Sprintf(`Digest username="iTunes", realm="raop", nonce="%s", uri="rtsp://127.0.0.1/1", response="%s"`, nonce, digest)
+}
+
+func TestDigestAuthChallenge(t *testing.T) {
+	client, done := newAuthTestServer(t, "hip")
+	defer done()
+	resp := sendAnnounce(t, client, "")
+	if resp.Status != Unauthorized {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", Unauthorized.String(), resp.Status.String()))
+	}
+	nonce := challengeNonce(t, resp)
+
+	resp = sendAnnounce(t, client, authorization(nonce, "hip", strings.ToLower))
+	if resp.Status != Ok {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", Ok.String(), resp.Status.String()))
+	}
+	// senders don't agree on the case of the hash
+	resp = sendAnnounce(t, client, authorization(nonce, "hip", strings.ToUpper))
+	if resp.Status != Ok {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", Ok.String(), resp.Status.String()))
+	}
+}
+
+func TestDigestAuthWrongPassword(t *testing.T) {
+	client, done := newAuthTestServer(t, "hip")
+	defer done()
+	nonce := challengeNonce(t, sendAnnounce(t, client, ""))
+	resp := sendAnnounce(t, client, authorization(nonce, "tragically", strings.ToLower))
+	if resp.Status != Unauthorized {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", Unauthorized.String(), resp.Status.String()))
+	}
+	// a nonce we didn't hand out isn't accepted either
+	resp = sendAnnounce(t, client, authorization("abc", "hip", strings.ToLower))
+	if resp.Status != Unauthorized {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", Unauthorized.String(), resp.Status.String()))
+	}
+}
+
+func TestDigestAuthWrongURI(t *testing.T) {
+	client, done := newAuthTestServer(t, "hip")
+	defer done()
+	nonce := challengeNonce(t, sendAnnounce(t, client, ""))
+	// a digest for another uri can't be replayed against this one
+	digest := DigestResponse("iTunes", "raop", "hip", nonce, "ANNOUNCE", "rtsp://127.0.0.1/2")
+	auth := fmt.Sprintf(`Digest username="iTunes", realm="raop", nonce="%s", uri="rtsp://127.0.0.1/2", response="%s"`, nonce, digest)
+	resp := sendAnnounce(t, client, auth)
+	if resp.Status != Unauthorized {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", Unauthorized.String(), resp.Status.String()))
+	}
+}
+
+func TestDigestAuthOptionsAndNoPassword(t *testing.T) {
+	client, done := newAuthTestServer(t, "hip")
+	defer done()
+	req := NewRequest()
+	req.Method = Options
+	req.RequestURI = "*"
+	resp, err := client.Send(req)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if resp.Status != Ok {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", Ok.String(), resp.Status.String()))
+	}
+
+	open, openDone := newAuthTestServer(t, "")
+	defer openDone()
+	resp = sendAnnounce(t, open, "")
+	if resp.Status != Ok {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", Ok.String(), resp.Status.String()))
+	}
+}
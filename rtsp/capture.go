@@ -0,0 +1,229 @@
+package rtsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// every capture file starts with this, the last byte is the version of the format
+var captureMagic = []byte{'B', 'C', 'G', 'C', 'A', 'P', 0, 1}
+
+// CaptureKind is what a captured record holds
+type CaptureKind uint8
+
+const (
+	// CaptureRequest an RTSP request from the sender
+	CaptureRequest CaptureKind = iota + 1
+	// CaptureResponse our response to an RTSP request
+	CaptureResponse
+	// CaptureData an RTP audio packet, as received (i.e. still encrypted)
+	CaptureData
+	// CaptureControl a packet received on the control port
+	CaptureControl
+	// there is no kind for timing packets, we don't listen on the timing port so none are captured,
+	// and capturing them is out of scope until we do
+)
+
+func (k CaptureKind) String() string {
+	switch k {
+	case CaptureRequest:
+		return "request"
+	case CaptureResponse:
+		return "response"
+	case CaptureData:
+		return "data"
+	case CaptureControl:
+		return "control"
+	}
+	return "unknown"
+}
+
+// CaptureRecord is a single request, response or packet in a capture
+type CaptureRecord struct {
+	Kind CaptureKind
+	// the RTSP connection a request or response was on
+	ConnID uint64
+	// the RTSP session a packet was received for
+	Session string
+	// how long after the capture started this was recorded
+	Offset time.Duration
+	Data   []byte
+}
+
+// Request parses the request held by a CaptureRequest record
+func (cr *CaptureRecord) Request() (*Request, error) {
+	return readRequest(bytes.NewReader(cr.Data))
+}
+
+// Response parses the response held by a CaptureResponse record
+func (cr *CaptureRecord) Response() (*Response, error) {
+	return readResponse(bytes.NewReader(cr.Data))
+}
+
+// Recorder writes RTSP exchanges and the packets of RTSP sessions to a capture,
+// which can be read back with a CaptureReader and replayed with Replay
+type Recorder struct {
+	lock  sync.Mutex
+	w     io.Writer
+	start time.Time
+	// set if we fail to write, after which nothing more is recorded
+	err error
+}
+
+// NewRecorder instantiates a new Recorder, writing the capture to w
+func NewRecorder(w io.Writer) (*Recorder, error) {
+	if _, err := w.Write(captureMagic); err != nil {
+		return nil, err
+	}
+	return &Recorder{w: w, start: time.Now()}, nil
+}
+
+// RecordRequest records a request received on the given connection
+func (r *Recorder) RecordRequest(connID uint64, req *Request) {
+	var b bytes.Buffer
+	writeRequest(&b, req)
+	r.record(&CaptureRecord{Kind: CaptureRequest, ConnID: connID, Data: b.Bytes()})
+}
+
+// RecordResponse records a response sent on the given connection
+func (r *Recorder) RecordResponse(connID uint64, resp *Response) {
+	var b bytes.Buffer
+	writeResponse(&b, resp)
+	r.record(&CaptureRecord{Kind: CaptureResponse, ConnID: connID, Data: b.Bytes()})
+}
+
+// RecordPacket records a packet received for the given session
+func (r *Recorder) RecordPacket(kind CaptureKind, session string, packet []byte) {
+	r.record(&CaptureRecord{Kind: kind, Session: session, Data: packet})
+}
+
+// Err returns the error that stopped the recording, if there was one
+func (r *Recorder) Err() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.err
+}
+
+// record writes the record out as:
+// kind (1 byte), connection id (8 bytes), offset in nanoseconds (8 bytes),
+// session length (2 bytes), session, data length (4 bytes), data
+func (r *Recorder) record(record *CaptureRecord) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.err != nil {
+		return
+	}
+	record.Offset = time.Since(r.start)
+	var b bytes.Buffer
+	b.WriteByte(byte(record.Kind))
+	binary.Write(&b, binary.BigEndian, record.ConnID)
+	binary.Write(&b, binary.BigEndian, int64(record.Offset))
+	binary.Write(&b, binary.BigEndian, uint16(len(record.Session)))
+	b.WriteString(record.Session)
+	binary.Write(&b, binary.BigEndian, uint32(len(record.Data)))
+	b.Write(record.Data)
+	if _, err := r.w.Write(b.Bytes()); err != nil {
+		log.Println("Error writing capture, stopping capture: ", err)
+		r.err = err
+	}
+}
+
+// CaptureMiddleware returns middleware that records every request, and the response to it
+func CaptureMiddleware(recorder *Recorder) Middleware {
+	return func(next RequestHandler) RequestHandler {
+		return func(req *Request, resp *Response, ctx *Context) {
+			recorder.RecordRequest(ctx.ConnID, req)
+			next(req, resp, ctx)
+			recorder.RecordResponse(ctx.ConnID, resp)
+		}
+	}
+}
+
+// CaptureReader reads the records of a capture written by a Recorder
+type CaptureReader struct {
+	r *bufio.Reader
+}
+
+// NewCaptureReader instantiates a new CaptureReader, returning an error if r doesn't hold a capture
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	buf := bufio.NewReader(r)
+	magic := make([]byte, len(captureMagic))
+	if _, err := io.ReadFull(buf, magic); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(magic, captureMagic) {
+		return nil, fmt.Errorf("Not a capture, or unsupported capture version")
+	}
+	return &CaptureReader{r: buf}, nil
+}
+
+// Next returns the next record in the capture, or io.EOF once there are no more
+func (cr *CaptureReader) Next() (*CaptureRecord, error) {
+	kind, err := cr.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	record := &CaptureRecord{Kind: CaptureKind(kind)}
+	var offset int64
+	var sessionLength uint16
+	var dataLength uint32
+	if err := binary.Read(cr.r, binary.BigEndian, &record.ConnID); err != nil {
+		return nil, truncated(err)
+	}
+	if err := binary.Read(cr.r, binary.BigEndian, &offset); err != nil {
+		return nil, truncated(err)
+	}
+	record.Offset = time.Duration(offset)
+	if err := binary.Read(cr.r, binary.BigEndian, &sessionLength); err != nil {
+		return nil, truncated(err)
+	}
+	session := make([]byte, sessionLength)
+	if _, err := io.ReadFull(cr.r, session); err != nil {
+		return nil, truncated(err)
+	}
+	record.Session = string(session)
+	if err := binary.Read(cr.r, binary.BigEndian, &dataLength); err != nil {
+		return nil, truncated(err)
+	}
+	if dataLength > maxBodySize {
+		return nil, fmt.Errorf("Unsupported record length: %d", dataLength)
+	}
+	record.Data = make([]byte, dataLength)
+	if _, err := io.ReadFull(cr.r, record.Data); err != nil {
+		return nil, truncated(err)
+	}
+	return record, nil
+}
+
+// truncated makes sure running out of data part way through a record isn't mistaken for the end
+func truncated(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// ReadCapture reads all the records in a capture
+func ReadCapture(r io.Reader) ([]*CaptureRecord, error) {
+	cr, err := NewCaptureReader(r)
+	if err != nil {
+		return nil, err
+	}
+	var records []*CaptureRecord
+	for {
+		record, err := cr.Next()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+}
@@ -0,0 +1,111 @@
+package rtsp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestCaptureRoundTrip(t *testing.T) {
+	var capture bytes.Buffer
+	recorder, err := NewRecorder(&capture)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	req := optionsRequest()
+	req.Headers.Set("CSeq", "1")
+	resp := NewResponse()
+	resp.protocol = "RTSP/1.0"
+	resp.Status = Ok
+	resp.Headers.Set("Session", "DEADBEEF")
+	recorder.RecordRequest(3, req)
+	recorder.RecordResponse(3, resp)
+	recorder.RecordPacket(CaptureData, "DEADBEEF", []byte{0x80, 0x60, 0, 1})
+
+	records, err := ReadCapture(&capture)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if len(records) != 3 {
+		t.Fatal(fmt.Sprintf("Expected: %d records\r\n Got: %d", 3, len(records)))
+	}
+	captured, err := records[0].Request()
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if records[0].ConnID != 3 || captured.Method != Options || captured.Headers.Get("CSeq") != "1" {
+		t.Error(fmt.Sprintf("Expected: OPTIONS on conn 3\r\n Got: %s on conn %d", captured.Method, records[0].ConnID))
+	}
+	capturedResp, err := records[1].Response()
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if capturedResp.Status != Ok || capturedResp.Headers.Get("Session") != "DEADBEEF" {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", resp.String(), capturedResp.String()))
+	}
+	if records[2].Kind != CaptureData || records[2].Session != "DEADBEEF" || !bytes.Equal(records[2].Data, []byte{0x80, 0x60, 0, 1}) {
+		t.Error(fmt.Sprintf("Expected: data packet for DEADBEEF\r\n Got: %s packet for %s", records[2].Kind, records[2].Session))
+	}
+	if records[2].Offset < records[0].Offset {
+		t.Error("Expected records to be in the order they were captured")
+	}
+}
+
+func TestCaptureTruncated(t *testing.T) {
+	var capture bytes.Buffer
+	recorder, err := NewRecorder(&capture)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	recorder.RecordPacket(CaptureControl, "DEADBEEF", make([]byte, syncPacketSize))
+	truncated := capture.Bytes()[:capture.Len()-1]
+	if _, err := ReadCapture(bytes.NewReader(truncated)); err != io.ErrUnexpectedEOF {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %v", io.ErrUnexpectedEOF, err))
+	}
+	if _, err := ReadCapture(bytes.NewReader([]byte("OPTIONS * RTSP/1.0\r\n"))); err == nil {
+		t.Error("Expected error reading something that isn't a capture")
+	}
+}
+
+func TestReplayPasswordProtected(t *testing.T) {
+	server := NewServer(0)
+	server.Use(DigestAuth("raop", func(req *Request, ctx *Context) string { return "hip" }))
+	server.AddHandler(Announce, func(req *Request, resp *Response, ctx *Context) { resp.Status = Ok })
+	l := serveTestClients(t, server)
+	defer l.Close()
+
+	// an ANNOUNCE answered with the digest for the nonce handed out when it was captured
+	var capture bytes.Buffer
+	recorder, err := NewRecorder(&capture)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	req := NewRequest()
+	req.Method = Announce
+	req.RequestURI = "rtsp://127.0.0.1/1"
+	req.Headers.Set("Authorization", authorization("0123456789abcdef", "hip", strings.ToLower))
+	resp := NewResponse()
+	resp.protocol = "RTSP/1.0"
+	resp.Status = Ok
+	recorder.RecordRequest(1, req)
+	recorder.RecordResponse(1, resp)
+	records, err := ReadCapture(&capture)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	err = Replay(context.Background(), records, "127.0.0.1", l.Addr().(*net.TCPAddr).Port, false)
+	if err == nil || !strings.Contains(err.Error(), "password protected") {
+		t.Error(fmt.Sprintf("Expected: an error about the password\r\n Got: %v", err))
+	}
+}
+
+func TestTransportPorts(t *testing.T) {
+	ports := transportPorts("RTP/AVP/UDP;unicast;mode=record;server_port=6000;control_port=6001;timing_port=6002")
+	if ports.Data != 6000 || ports.Control != 6001 {
+		t.Error(fmt.Sprintf("Expected: %d %d\r\n Got: %d %d", 6000, 6001, ports.Data, ports.Control))
+	}
+}
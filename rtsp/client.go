@@ -1,37 +1,175 @@
 package rtsp
 
 import (
+	"bufio"
+	"context"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
-	"sync/atomic"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultTimeout is how long a client waits on the server, to connect or for a response
+	DefaultTimeout = 10 * time.Second
+	// how long to look for the server having closed an idle connection before sending on it,
+	// a deadline that has already passed would give up without looking
+	staleCheckTimeout = time.Millisecond
 )
 
 // Client Rtsp client
 type Client struct {
+	address string
+	port    int
+	timeout time.Duration
+	// serializes requests, we only have one connection
+	lock sync.Mutex
 	conn net.Conn
-	seq  int64
+	// kept for the connection, so nothing read past a response is lost
+	reader *bufio.Reader
+	// set when the connection can't be used anymore, the next request will reconnect
+	broken bool
+	closed bool
+	seq    int64
 }
 
 // NewClient instantiates a new client connecting to the address specified
 func NewClient(address string, port int) (*Client, error) {
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", address, port))
-	if err != nil {
+	return NewClientContext(context.Background(), address, port)
+}
+
+// NewClientContext instantiates a new client connecting to the address specified, giving
+// up connecting once ctx is done
+func NewClientContext(ctx context.Context, address string, port int) (*Client, error) {
+	c := &Client{address: address, port: port, timeout: DefaultTimeout, seq: 1}
+	if err := c.connect(ctx); err != nil {
 		return nil, err
 	}
-	return &Client{conn: conn, seq: 1}, nil
+	return c, nil
+}
+
+// SetTimeout sets how long the client waits on the server, to connect or for a response
+func (c *Client) SetTimeout(timeout time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.timeout = timeout
+}
+
+func (c *Client) connect(ctx context.Context) error {
+	dialer := net.Dialer{Timeout: c.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(c.address, strconv.Itoa(c.port)))
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	c.reader = bufio.NewReader(conn)
+	c.broken = false
+	return nil
 }
 
 // Send will send a request to the server
 func (c *Client) Send(request *Request) (*Response, error) {
-	request.Headers["CSeq"] = strconv.FormatInt(c.seq, 10)
-	request.Headers["User-Agent"] = "Bobcaygeon/1.0"
-	atomic.AddInt64(&c.seq, 1)
+	return c.SendContext(context.Background(), request)
+}
+
+// SendContext will send a request to the server, giving up once ctx is done or the
+// client's timeout passes.  If the connection was closed since the last request, the
+// client reconnects before sending.  Requests that can safely be sent twice are tried
+// again on a new connection if the server drops the connection without answering
+func (c *Client) SendContext(ctx context.Context, request *Request) (*Response, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return nil, fmt.Errorf("Client is closed")
+	}
+	if !c.broken && c.stale() {
+		c.conn.Close()
+		c.broken = true
+	}
+	if c.broken {
+		if err := c.connect(ctx); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := c.roundTrip(ctx, request)
+	if err != nil && c.shouldRetry(ctx, request, err) {
+		c.conn.Close()
+		if err := c.connect(ctx); err != nil {
+			return nil, err
+		}
+		resp, err = c.roundTrip(ctx, request)
+	}
+	if err != nil {
+		// we can't tell where the connection is at anymore, so start fresh next time
+		c.conn.Close()
+		c.broken = true
+		return nil, err
+	}
+	return resp, nil
+}
+
+// stale checks if the server closed the connection while it sat idle (e.g. it was restarted),
+// so the request can go on a new connection before anything is sent
+func (c *Client) stale() bool {
+	if c.reader.Buffered() > 0 {
+		return true
+	}
+	c.conn.SetReadDeadline(time.Now().Add(staleCheckTimeout))
+	defer c.conn.SetReadDeadline(time.Time{})
+	// nothing should be waiting to be read between requests, so anything but
+	// timing out means the connection is gone
+	_, err := c.reader.Peek(1)
+	ne, ok := err.(net.Error)
+	return !ok || !ne.Timeout()
+}
+
+// shouldRetry decides if a failed request should be tried again on a new connection.  The
+// server may have acted on the request before dropping the connection, so only requests
+// that don't change anything are retried, and only when the connection was dropped, not
+// when the server didn't answer in time, sent something we couldn't read, or the caller has given up
+func (c *Client) shouldRetry(ctx context.Context, request *Request, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if request.Method != Options && request.Method != Get_Parameter {
+		return false
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	ne, ok := err.(net.Error)
+	return ok && !ne.Timeout()
+}
+
+func (c *Client) roundTrip(ctx context.Context, request *Request) (*Response, error) {
+	deadline := time.Now().Add(c.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	c.conn.SetDeadline(deadline)
+	defer c.conn.SetDeadline(time.Time{})
+	// unblock the request if the caller gives up
+	done := make(chan struct{})
+	defer close(done)
+	go func(conn net.Conn) {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}(c.conn)
+
+	request.Headers.Set("CSeq", strconv.FormatInt(c.seq, 10))
+	request.Headers.Set("User-Agent", "Bobcaygeon/1.0")
+	c.seq++
 	_, err := writeRequest(c.conn, request)
 	if err != nil {
 		return nil, err
 	}
-	resp, err := readResponse(c.conn)
+	resp, err := readResponse(c.reader)
 	if err != nil {
 		return nil, err
 	}
@@ -40,10 +178,68 @@ func (c *Client) Send(request *Request) (*Response, error) {
 
 // LocalAddress returns the local (our) address
 func (c *Client) LocalAddress() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	return c.conn.LocalAddr().(*net.TCPAddr).IP.String()
 }
 
 // RemoteAddress returns the remote address
 func (c *Client) RemoteAddress() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	return c.conn.RemoteAddr().(*net.TCPAddr).IP.String()
 }
+
+// GetParameters asks the server for the values of the given parameters
+func (c *Client) GetParameters(names ...string) (map[string]string, error) {
+	req := NewRequest()
+	req.Method = Get_Parameter
+	sessionID := strconv.FormatInt(time.Now().Unix(), 10)
+	req.RequestURI = fmt.Sprintf("rtsp://%s/%s", c.LocalAddress(), sessionID)
+	req.Headers.Set("Content-Type", "text/parameters")
+	req.Body = []byte(strings.Join(names, "\r\n") + "\r\n")
+	resp, err := c.Send(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status != Ok {
+		return nil, fmt.Errorf("Non-ok status returned: %s", resp.Status.String())
+	}
+	return ParseParameters(resp.Body), nil
+}
+
+// GetVolume asks the server for its volume, as an airplay volume
+// between -30 and 0, or -144 for muted
+func (c *Client) GetVolume() (float64, error) {
+	params, err := c.GetParameters("volume")
+	if err != nil {
+		return 0, err
+	}
+	volume, ok := params["volume"]
+	if !ok {
+		return 0, fmt.Errorf("Volume not returned by server")
+	}
+	return strconv.ParseFloat(volume, 64)
+}
+
+// GetProgress asks the server how far into the track it is, as the RTP timestamps
+// of the start of the track, what is playing now and the end of the track
+func (c *Client) GetProgress() (string, error) {
+	params, err := c.GetParameters("progress")
+	if err != nil {
+		return "", err
+	}
+	progress, ok := params["progress"]
+	if !ok {
+		return "", fmt.Errorf("Progress not returned by server")
+	}
+	return progress, nil
+}
+
+// Close closes the connection to the server
+func (c *Client) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closed = true
+	return c.conn.Close()
+}
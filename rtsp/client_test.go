@@ -0,0 +1,273 @@
+package rtsp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func optionsRequest() *Request {
+	req := NewRequest()
+	req.Method = Options
+	req.RequestURI = "*"
+	return req
+}
+
+// silentListener accepts connections but never answers
+func silentListener(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	return l
+}
+
+func TestClientTimeout(t *testing.T) {
+	l := silentListener(t)
+	defer l.Close()
+	client := newTestClient(t, l)
+	defer client.Close()
+	client.SetTimeout(50 * time.Millisecond)
+	start := time.Now()
+	if _, err := client.Send(optionsRequest()); err == nil {
+		t.Error("Expected timeout error")
+	}
+	if time.Since(start) > time.Second {
+		t.Error(fmt.Sprintf("Expected request to time out quickly\r\n Got: %s", time.Since(start)))
+	}
+}
+
+func TestClientContext(t *testing.T) {
+	l := silentListener(t)
+	defer l.Close()
+	client := newTestClient(t, l)
+	defer client.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	if _, err := client.SendContext(ctx, optionsRequest()); err == nil {
+		t.Error("Expected error once the context is cancelled")
+	}
+	if time.Since(start) > time.Second {
+		t.Error(fmt.Sprintf("Expected request to be cancelled quickly\r\n Got: %s", time.Since(start)))
+	}
+}
+
+func TestClientReconnects(t *testing.T) {
+	newServer := func(l net.Listener) *Server {
+		server := NewServer(0)
+		server.AddHandler(Options, func(req *Request, resp *Response, ctx *Context) { resp.Status = Ok })
+		go server.Serve(context.Background(), l)
+		return server
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	server := newServer(l)
+	client := newTestClient(t, l)
+	defer client.Close()
+	if _, err := client.Send(optionsRequest()); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	// restarting the server drops our connection
+	server.Stop(context.Background())
+	l, err = net.Listen("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	server = newServer(l)
+	defer server.Stop(context.Background())
+	resp, err := client.Send(optionsRequest())
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if resp.Status != Ok {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", Ok.String(), resp.Status.String()))
+	}
+}
+
+// droppingListener reads each request and then drops the connection without answering
+func droppingListener(t *testing.T) (net.Listener, chan Method) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	requests := make(chan Method, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				req, err := readRequest(conn)
+				if err == nil {
+					requests <- req.Method
+				}
+			}(conn)
+		}
+	}()
+	return l, requests
+}
+
+func TestClientRetriesOnlySafeRequests(t *testing.T) {
+	l, requests := droppingListener(t)
+	defer l.Close()
+	client := newTestClient(t, l)
+	defer client.Close()
+	// the server may have acted on it, so it isn't sent again
+	req := NewRequest()
+	req.Method = Record
+	req.RequestURI = "*"
+	if _, err := client.Send(req); err == nil {
+		t.Error("Expected error when the connection is dropped")
+	}
+	if sent := len(requests); sent != 1 {
+		t.Error(fmt.Sprintf("Expected: %d\r\n Got: %d", 1, sent))
+	}
+	<-requests
+	// but asking again is harmless
+	if _, err := client.Send(optionsRequest()); err == nil {
+		t.Error("Expected error when the connection is dropped")
+	}
+	if sent := len(requests); sent != 2 {
+		t.Error(fmt.Sprintf("Expected: %d\r\n Got: %d", 2, sent))
+	}
+}
+
+func TestClientReconnectsBeforeSending(t *testing.T) {
+	records := make(chan struct{}, 10)
+	newServer := func(l net.Listener) *Server {
+		server := NewServer(0)
+		server.AddHandler(Options, func(req *Request, resp *Response, ctx *Context) { resp.Status = Ok })
+		server.AddHandler(Record, func(req *Request, resp *Response, ctx *Context) {
+			records <- struct{}{}
+			resp.Status = Ok
+		})
+		go server.Serve(context.Background(), l)
+		return server
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	server := newServer(l)
+	client := newTestClient(t, l)
+	defer client.Close()
+	if _, err := client.Send(optionsRequest()); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	// the server restarts while the connection is idle
+	server.Stop(context.Background())
+	l, err = net.Listen("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	server = newServer(l)
+	defer server.Stop(context.Background())
+	time.Sleep(10 * time.Millisecond)
+	req := NewRequest()
+	req.Method = Record
+	req.RequestURI = "*"
+	resp, err := client.Send(req)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if resp.Status != Ok {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", Ok.String(), resp.Status.String()))
+	}
+	if len(records) != 1 {
+		t.Error(fmt.Sprintf("Expected: %d\r\n Got: %d", 1, len(records)))
+	}
+}
+
+func TestClientPool(t *testing.T) {
+	l := serveTestClients(t, NewServer(0))
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+	pool := NewClientPool()
+	defer pool.Close()
+	first, err := pool.Get("127.0.0.1", port)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	second, err := pool.Get("127.0.0.1", port)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if first != second {
+		t.Error("Expected the client to be reused")
+	}
+	pool.Remove("127.0.0.1", port)
+	if _, err := first.Send(optionsRequest()); err == nil {
+		t.Error("Expected removed client to be closed")
+	}
+	third, err := pool.Get("127.0.0.1", port)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if third == first {
+		t.Error("Expected a new client")
+	}
+}
+
+func TestClientPoolSlowConnect(t *testing.T) {
+	l := serveTestClients(t, NewServer(0))
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+	pool := NewClientPool()
+	defer pool.Close()
+	// the first server takes its time to answer
+	release := make(chan struct{})
+	pool.dial = func(address string, p int) (*Client, error) {
+		if p == 1 {
+			<-release
+			return nil, fmt.Errorf("Unreachable")
+		}
+		return NewClient(address, p)
+	}
+	slow := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := pool.Get("127.0.0.1", 1)
+			slow <- err
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	got := make(chan error)
+	go func() {
+		_, err := pool.Get("127.0.0.1", port)
+		got <- err
+	}()
+	select {
+	case err := <-got:
+		if err != nil {
+			t.Error("Unexpected error", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the client to connect while another server is slow")
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-slow; err == nil {
+			t.Error("Expected an error from the unreachable server")
+		}
+	}
+}
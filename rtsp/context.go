@@ -0,0 +1,71 @@
+package rtsp
+
+import (
+	"net"
+	"sync"
+)
+
+// Context carries information about the connection a request was received on.  The
+// same Context is handed to every request on a connection, so handlers and middleware
+// can use it to keep state for the life of the connection
+type Context struct {
+	// ConnID uniquely identifies the connection for the life of the server
+	ConnID     uint64
+	LocalAddr  string
+	RemoteAddr string
+	lock       sync.RWMutex
+	values     map[string]interface{}
+	// wraps the connection once the response to the current request has been written
+	upgrade func(net.Conn) (net.Conn, error)
+}
+
+// NewContext instantiates a new context for a connection
+func NewContext(connID uint64, localAddr string, remoteAddr string) *Context {
+	return &Context{ConnID: connID, LocalAddr: localAddr, RemoteAddr: remoteAddr, values: make(map[string]interface{})}
+}
+
+func newConnContext(connID uint64, conn net.Conn) *Context {
+	return NewContext(connID, addrIP(conn.LocalAddr()), addrIP(conn.RemoteAddr()))
+}
+
+func addrIP(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// Value returns the connection scoped value stored under key, or nil if there isn't one
+func (c *Context) Value(key string) interface{} {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.values[key]
+}
+
+// Upgrade has the connection wrapped by fn once the response to the current request has been
+// written, e.g. to encrypt the rest of the connection.  The connection is closed if fn fails
+func (c *Context) Upgrade(fn func(net.Conn) (net.Conn, error)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.upgrade = fn
+}
+
+// takeUpgrade returns the upgrade asked for while handling the current request, if there was one
+func (c *Context) takeUpgrade() func(net.Conn) (net.Conn, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	upgrade := c.upgrade
+	c.upgrade = nil
+	return upgrade
+}
+
+// SetValue stores a value for the rest of the connection
+func (c *Context) SetValue(key string, value interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.values[key] = value
+}
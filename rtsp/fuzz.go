@@ -0,0 +1,11 @@
+//go:build gofuzz
+// +build gofuzz
+
+package rtsp
+
+// Fuzz is the entry point for go-fuzz (https://github.com/dvyukov/go-fuzz), run with:
+// go-fuzz-build github.com/nstehr/bobcaygeon/rtsp && go-fuzz -bin=rtsp-fuzz.zip -workdir=testdata/fuzz
+// The corpus is also run by the tests, through roundTrip
+func Fuzz(data []byte) int {
+	return roundTrip(data)
+}
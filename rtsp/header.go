@@ -0,0 +1,66 @@
+package rtsp
+
+import (
+	"net/textproto"
+	"strings"
+)
+
+// Header holds the headers of an RTSP request or response.  Like
+// textproto.MIMEHeader, keys are canonicalized and a header can have
+// multiple values
+type Header map[string][]string
+
+// headers used by airplay that don't follow the usual canonical form.  RTSP
+// headers are case-insensitive, but not every client out there treats them that way
+var commonHeaders = map[string]string{
+	"cseq":              "CSeq",
+	"dacp-id":           "DACP-ID",
+	"rtp-info":          "RTP-Info",
+	"www-authenticate":  "WWW-Authenticate",
+	"x-apple-device-id": "X-Apple-Device-ID",
+	"x-bcg-muted":       "X-BCG-Muted",
+}
+
+// CanonicalHeaderKey returns the canonical format of the header key
+func CanonicalHeaderKey(key string) string {
+	if canonical, ok := commonHeaders[strings.ToLower(key)]; ok {
+		return canonical
+	}
+	return textproto.CanonicalMIMEHeaderKey(key)
+}
+
+// Add adds the value to key, appending to any existing values
+func (h Header) Add(key string, value string) {
+	key = CanonicalHeaderKey(key)
+	h[key] = append(h[key], value)
+}
+
+// Set sets key to the single value, replacing any existing values
+func (h Header) Set(key string, value string) {
+	h[CanonicalHeaderKey(key)] = []string{value}
+}
+
+// Get returns the first value for key, or "" if there isn't one
+func (h Header) Get(key string) string {
+	values := h[CanonicalHeaderKey(key)]
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// Values returns all the values for key
+func (h Header) Values(key string) []string {
+	return h[CanonicalHeaderKey(key)]
+}
+
+// Has returns whether or not key is present
+func (h Header) Has(key string) bool {
+	_, ok := h[CanonicalHeaderKey(key)]
+	return ok
+}
+
+// Del removes key
+func (h Header) Del(key string) {
+	delete(h, CanonicalHeaderKey(key))
+}
@@ -0,0 +1,65 @@
+package rtsp
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCanonicalHeaderKey(t *testing.T) {
+	tests := map[string]string{
+		"content-type":      "Content-Type",
+		"CONTENT-LENGTH":    "Content-Length",
+		"cseq":              "CSeq",
+		"Dacp-Id":           "DACP-ID",
+		"x-apple-device-id": "X-Apple-Device-ID",
+		"active-remote":     "Active-Remote",
+	}
+	for key, expected := range tests {
+		canonical := CanonicalHeaderKey(key)
+		if canonical != expected {
+			t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", expected, canonical))
+		}
+	}
+}
+
+func TestHeaderCaseInsensitive(t *testing.T) {
+	h := make(Header)
+	h.Set("content-type", "text/parameters")
+	if h.Get("Content-Type") != "text/parameters" {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", "text/parameters", h.Get("Content-Type")))
+	}
+	if !h.Has("CONTENT-TYPE") {
+		t.Error("Expected header to be present")
+	}
+	h.Del("CoNtEnT-TyPe")
+	if h.Has("Content-Type") {
+		t.Error("Expected header to be removed")
+	}
+}
+
+func TestHeaderMultipleValues(t *testing.T) {
+	h := make(Header)
+	h.Add("Public", "ANNOUNCE")
+	h.Add("public", "SETUP")
+	values := h.Values("Public")
+	if len(values) != 2 || values[0] != "ANNOUNCE" || values[1] != "SETUP" {
+		t.Error(fmt.Sprintf("Expected: %v\r\n Got: %v", []string{"ANNOUNCE", "SETUP"}, values))
+	}
+	if h.Get("Public") != "ANNOUNCE" {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", "ANNOUNCE", h.Get("Public")))
+	}
+	h.Set("Public", "RECORD")
+	if len(h.Values("Public")) != 1 {
+		t.Error(fmt.Sprintf("Expected: %d values\r\n Got: %d", 1, len(h.Values("Public"))))
+	}
+}
+
+func TestHeaderGetMissing(t *testing.T) {
+	h := make(Header)
+	if h.Get("Transport") != "" {
+		t.Error(fmt.Sprintf("Expected empty value\r\n Got: %s", h.Get("Transport")))
+	}
+	if h.Has("Transport") {
+		t.Error("Expected header to not be present")
+	}
+}
@@ -16,4 +16,7 @@ const (
 	Set_Parameter
 	Teardown
 	Flush
+	Post
+	// a method we don't know, requests with it are answered with 501 Not Implemented
+	Unknown
 )
@@ -0,0 +1,37 @@
+package rtsp
+
+import (
+	"log"
+)
+
+// Middleware wraps a RequestHandler, so it can act on a request before and/or after the handler does
+type Middleware func(next RequestHandler) RequestHandler
+
+// chain wraps the handler in the given middleware, the first middleware being the outermost
+func chain(handler RequestHandler, middleware []Middleware) RequestHandler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// notImplemented responds to methods we don't have a handler for
+func notImplemented(req *Request, resp *Response, ctx *Context) {
+	if req.Method == Unknown {
+		log.Printf("Method: %s is not known\n", req.methodName)
+	} else {
+		log.Printf("Method: %s does not have a handler\n", req.Method)
+	}
+	resp.Status = NotImplemented
+}
+
+// LoggingMiddleware logs every request and response
+func LoggingMiddleware(next RequestHandler) RequestHandler {
+	return func(req *Request, resp *Response, ctx *Context) {
+		log.Printf("Received Request (conn: %d, from: %s)\n", ctx.ConnID, ctx.RemoteAddr)
+		log.Println(req.String())
+		next(req, resp, ctx)
+		log.Printf("Outbound Response (conn: %d, to: %s)\n", ctx.ConnID, ctx.RemoteAddr)
+		log.Println(resp.String())
+	}
+}
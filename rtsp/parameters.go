@@ -0,0 +1,43 @@
+package rtsp
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ParseParameters parses a text/parameters body.  Each line is either a
+// "name: value" pair, or just a name, as sent in a GET_PARAMETER request
+func ParseParameters(body []byte) map[string]string {
+	params := make(map[string]string)
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		name := strings.TrimSpace(parts[0])
+		value := ""
+		if len(parts) == 2 {
+			value = strings.TrimSpace(parts[1])
+		}
+		params[name] = value
+	}
+	return params
+}
+
+// WriteParameters builds a text/parameters body out of the given parameters
+func WriteParameters(params map[string]string) []byte {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	// keep the output stable
+	sort.Strings(names)
+	var buffer bytes.Buffer
+	for _, name := range names {
+		buffer.WriteString(fmt.Sprintf("%s: %s\r\n", name, params[name]))
+	}
+	return buffer.Bytes()
+}
@@ -0,0 +1,66 @@
+package rtsp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestParseParameters(t *testing.T) {
+	params := ParseParameters([]byte("volume: -15.000000\r\nprogress: 1/2/3\r\n\r\n"))
+	if params["volume"] != "-15.000000" {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", "-15.000000", params["volume"]))
+	}
+	if params["progress"] != "1/2/3" {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", "1/2/3", params["progress"]))
+	}
+}
+
+func TestParseParameterNames(t *testing.T) {
+	params := ParseParameters([]byte("volume\r\n"))
+	val, ok := params["volume"]
+	if !ok {
+		t.Error("Expected volume to be parsed")
+	}
+	if val != "" {
+		t.Error(fmt.Sprintf("Expected empty value\r\n Got: %s", val))
+	}
+}
+
+func TestWriteParameters(t *testing.T) {
+	body := string(WriteParameters(map[string]string{"volume": "0.000000", "progress": "1/2/3"}))
+	expected := "progress: 1/2/3\r\nvolume: 0.000000\r\n"
+	if body != expected {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", expected, body))
+	}
+}
+
+func TestClientGetVolume(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer l.Close()
+	server := NewServer(0)
+	server.AddHandler(Get_Parameter, func(req *Request, resp *Response, ctx *Context) {
+		if _, ok := ParseParameters(req.Body)["volume"]; ok {
+			resp.Body = WriteParameters(map[string]string{"volume": "-15.000000"})
+		}
+		resp.Status = Ok
+	})
+	go server.Serve(context.Background(), l)
+
+	client, err := NewClient("127.0.0.1", l.Addr().(*net.TCPAddr).Port)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer client.Close()
+	volume, err := client.GetVolume()
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if volume != -15 {
+		t.Error(fmt.Sprintf("Expected: %f\r\n Got: %f", -15.0, volume))
+	}
+}
@@ -5,16 +5,29 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"sort"
 	"strconv"
 	"strings"
 )
 
+// the largest body we will read, bodies are mostly small but can hold album art
+const maxBodySize = 16 * 1024 * 1024
+
+// reader returns r as a buffered reader.  Connections should keep one buffered reader for
+// their life, anything it has read past the current message (e.g. a pipelined request) would
+// be lost with a new one
+func reader(r io.Reader) *bufio.Reader {
+	if buf, ok := r.(*bufio.Reader); ok {
+		return buf
+	}
+	return bufio.NewReader(r)
+}
+
 // https://tools.ietf.org/html/rfc2326#page-19
 func readRequest(r io.Reader) (*Request, error) {
 
 	req := new(Request)
-	buf := bufio.NewReader(r)
-	headers := make(map[string]string)
+	buf := reader(r)
 
 	// first line of the request will be the request line
 	requestLine, err := buf.ReadString('\n')
@@ -28,98 +41,129 @@ func readRequest(r io.Reader) (*Request, error) {
 		return nil, fmt.Errorf("Improperly formatted request line: %s", requestLine)
 	}
 
+	// senders may use methods we don't know about, they get a 501 rather than a closed connection
 	method, err := getMethod(requestLineParts[0])
-
 	if err != nil {
-		return nil, fmt.Errorf("Method does exist in RTSP protocol: %s", requestLineParts[0])
+		method = Unknown
 	}
 
 	req.Method = method
+	req.methodName = requestLineParts[0]
 	req.RequestURI = requestLineParts[1]
 	req.protocol = requestLineParts[2]
 
-	// now we can read the headers.
-	// we read a line until we hit the empty line
-	// which indicates all the headers have been processed
+	req.Headers, err = readHeaders(buf)
+	if err != nil {
+		return nil, err
+	}
+	req.Body, err = readBody(buf, req.Headers)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// readHeaders reads header lines until we hit the empty line
+// which indicates all the headers have been processed
+func readHeaders(buf *bufio.Reader) (Header, error) {
+	headers := make(Header)
 	for {
 		headerField, err := buf.ReadString('\n')
 		if err != nil {
 			return nil, err
 		}
 		headerField = strings.Trim(headerField, "\r\n")
-		if strings.Trim(headerField, "\r\n") == "" {
+		if headerField == "" {
 			break
 		}
-		headerParts := strings.Split(headerField, ":")
+		// only split on the first colon, values can have colons of their own
+		headerParts := strings.SplitN(headerField, ":", 2)
 		if len(headerParts) < 2 {
 			return nil, fmt.Errorf("Inproper header: %s", headerField)
 		}
-		headers[strings.TrimSpace(headerParts[0])] = strings.TrimSpace(headerParts[1])
+		name := strings.TrimSpace(headerParts[0])
+		if name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("Inproper header name: %s", headerField)
+		}
+		headers.Add(name, strings.TrimSpace(headerParts[1]))
 	}
+	return headers, nil
+}
 
-	req.Headers = headers
-
-	contentLength, hasBody := req.Headers["Content-Length"]
-	if !hasBody {
-		return req, nil
+// readBody reads the body described by the Content-Length header, if there is one
+func readBody(buf *bufio.Reader, headers Header) ([]byte, error) {
+	if !headers.Has("Content-Length") {
+		return nil, nil
+	}
+	length, err := strconv.Atoi(headers.Get("Content-Length"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid Content-Length: %s", headers.Get("Content-Length"))
+	}
+	if length < 0 || length > maxBodySize {
+		return nil, fmt.Errorf("Unsupported Content-Length: %d", length)
 	}
-
-	// now read the body
-	length, _ := strconv.Atoi(contentLength)
 	bodyBuf := make([]byte, length)
 	// makes sure we read the full length of the content
-	io.ReadFull(buf, bodyBuf)
-	req.Body = bodyBuf
-
-	return req, nil
+	_, err = io.ReadFull(buf, bodyBuf)
+	if err != nil {
+		return nil, err
+	}
+	return bodyBuf, nil
 }
 
-// TODO: writeResponse and writeRequest look very similar....
-func writeResponse(w io.Writer, resp *Response) (n int, err error) {
-	var buffer bytes.Buffer
-	buffer.WriteString(fmt.Sprintf("%s %d %s\r\n", resp.protocol, resp.Status, resp.Status.String()))
-	for header, value := range resp.Headers {
-		buffer.WriteString(fmt.Sprintf("%s: %s\r\n", header, value))
+// writeHeaders writes out the headers, sorted so the output is stable.  Content-Length
+// is always worked out from the body
+func writeHeaders(buffer *bytes.Buffer, headers Header, body []byte) {
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if CanonicalHeaderKey(key) == "Content-Length" {
+			continue
+		}
+		for _, value := range headers[key] {
+			buffer.WriteString(fmt.Sprintf("%s: %s\r\n", key, value))
+		}
 	}
-	if len(resp.Body) > 0 {
-		buffer.WriteString(fmt.Sprintf("%s: %d\r\n", "Content-Length", len(resp.Body)))
-
+	if len(body) > 0 {
+		buffer.WriteString(fmt.Sprintf("%s: %d\r\n", "Content-Length", len(body)))
 	}
 	buffer.WriteString("\r\n")
-
-	if len(resp.Body) > 0 {
-		buffer.Write(resp.Body)
+	if len(body) > 0 {
+		buffer.Write(body)
 	}
+}
+
+func writeResponse(w io.Writer, resp *Response) (n int, err error) {
+	var buffer bytes.Buffer
+	buffer.WriteString(fmt.Sprintf("%s %d %s\r\n", resp.protocol, resp.Status, resp.Status.String()))
+	writeHeaders(&buffer, resp.Headers, resp.Body)
 	return w.Write(buffer.Bytes())
 }
 
 func writeRequest(w io.Writer, request *Request) (n int, err error) {
 	var buffer bytes.Buffer
-	buffer.WriteString(fmt.Sprintf("%s %s %s\r\n", strings.ToUpper(request.Method.String()), request.RequestURI, request.protocol))
-	for header, value := range request.Headers {
-		buffer.WriteString(fmt.Sprintf("%s: %s\r\n", header, value))
-	}
-	if len(request.Body) > 0 {
-		buffer.WriteString(fmt.Sprintf("%s: %s\r\n", "Content-Length", strconv.Itoa(len(request.Body))))
+	method := strings.ToUpper(request.Method.String())
+	if request.Method == Unknown && request.methodName != "" {
+		method = request.methodName
 	}
-	buffer.WriteString("\r\n")
-	if len(request.Body) > 0 {
-		buffer.Write(request.Body)
-	}
-
+	buffer.WriteString(fmt.Sprintf("%s %s %s\r\n", method, request.RequestURI, request.protocol))
+	writeHeaders(&buffer, request.Headers, request.Body)
 	return w.Write(buffer.Bytes())
 }
 
 func readResponse(r io.Reader) (*Response, error) {
 	resp := new(Response)
-	buf := bufio.NewReader(r)
-	headers := make(map[string]string)
+	buf := reader(r)
 	statusLine, err := buf.ReadString('\n')
 	if err != nil {
 		return nil, err
 	}
 	statusLine = strings.Trim(statusLine, "\r\n")
-	statusLineParts := strings.Split(statusLine, " ")
+	// the reason phrase can have spaces in it
+	statusLineParts := strings.SplitN(statusLine, " ", 3)
 	if len(statusLineParts) != 3 {
 		return nil, fmt.Errorf("Improperly formatted status line: %s", statusLine)
 	}
@@ -136,37 +180,13 @@ func readResponse(r io.Reader) (*Response, error) {
 	}
 	resp.Status = status
 
-	// now we can read the headers.
-	// we read a line until we hit the empty line
-	// which indicates all the headers have been processed
-	for {
-		headerField, err := buf.ReadString('\n')
-		if err != nil {
-			return nil, err
-		}
-		headerField = strings.Trim(headerField, "\r\n")
-		if strings.Trim(headerField, "\r\n") == "" {
-			break
-		}
-		headerParts := strings.Split(headerField, ":")
-		if len(headerParts) < 2 {
-			return nil, fmt.Errorf("Inproper header: %s", headerField)
-		}
-		headers[strings.TrimSpace(headerParts[0])] = strings.TrimSpace(headerParts[1])
+	resp.Headers, err = readHeaders(buf)
+	if err != nil {
+		return nil, err
 	}
-	resp.Headers = headers
-
-	contentLength, hasBody := resp.Headers["Content-Length"]
-	if !hasBody {
-		return resp, nil
+	resp.Body, err = readBody(buf, resp.Headers)
+	if err != nil {
+		return nil, err
 	}
-
-	// now read the body
-	length, _ := strconv.Atoi(contentLength)
-	bodyBuf := make([]byte, length)
-	// makes sure we read the full length of the content
-	io.ReadFull(buf, bodyBuf)
-	resp.Body = bodyBuf
-
 	return resp, nil
 }
@@ -2,6 +2,9 @@ package rtsp
 
 import (
 	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -32,11 +35,11 @@ func TestOptionsParse(t *testing.T) {
 		t.Error("Unexpected amount of headers: ", len(msg.Headers))
 	}
 	// test a couple of the headers
-	if msg.Headers["CSeq"] != "1" {
-		t.Error("Unexpected CSeq", msg.Headers["CSeq"])
+	if msg.Headers.Get("CSeq") != "1" {
+		t.Error("Unexpected CSeq", msg.Headers.Get("CSeq"))
 	}
-	if msg.Headers["Client-Instance"] != "67F67C1CAA66A2F4" {
-		t.Error("Unexpected Client-Instance", msg.Headers["Client-Instance"])
+	if msg.Headers.Get("Client-Instance") != "67F67C1CAA66A2F4" {
+		t.Error("Unexpected Client-Instance", msg.Headers.Get("Client-Instance"))
 	}
 
 }
@@ -121,8 +124,8 @@ func TestBuildResponse(t *testing.T) {
 			"Client-Instance: 67F67C1CAA66A2F4\r\n" +
 			"\r\n"
 	resp := Response{}
-	headers := make(map[string]string)
-	headers["Client-Instance"] = "67F67C1CAA66A2F4"
+	headers := make(Header)
+	headers.Set("Client-Instance", "67F67C1CAA66A2F4")
 	resp.protocol = "RTSP/1.0"
 	resp.Headers = headers
 	resp.Status = Ok
@@ -149,8 +152,8 @@ func TestWriteRequest(t *testing.T) {
 	request.Method = Options
 	request.protocol = "RTSP/1.0"
 	request.RequestURI = "*"
-	headers := make(map[string]string)
-	headers["Client-Instance"] = "67F67C1CAA66A2F4"
+	headers := make(Header)
+	headers.Set("Client-Instance", "67F67C1CAA66A2F4")
 	request.Headers = headers
 	var b bytes.Buffer
 	n, err := writeRequest(&b, &request)
@@ -212,3 +215,123 @@ func TestParseResponse(t *testing.T) {
 		t.Error("Non matching protocol generated. Expected:"+"RTSP/1.0"+"got:", resp.protocol)
 	}
 }
+
+func TestParseHeaderValuesWithColons(t *testing.T) {
+	request := "SET_PARAMETER rtsp://[fe80::1]/1 RTSP/1.0\r\n" +
+		"cseq: 7\r\n" +
+		"Content-Location: rtsp://[fe80::1]:5000/stream\r\n" +
+		"X-Forwarded-For: fe80::1\r\n" +
+		"\r\n"
+	msg, err := readRequest(strings.NewReader(request))
+	if err != nil {
+		t.Fatal("Unexpected err value", err)
+	}
+	if msg.Headers.Get("CSeq") != "7" {
+		t.Error("Unexpected CSeq", msg.Headers.Get("CSeq"))
+	}
+	if msg.Headers.Get("Content-Location") != "rtsp://[fe80::1]:5000/stream" {
+		t.Error("Unexpected Content-Location", msg.Headers.Get("Content-Location"))
+	}
+	if msg.Headers.Get("x-forwarded-for") != "fe80::1" {
+		t.Error("Unexpected X-Forwarded-For", msg.Headers.Get("X-Forwarded-For"))
+	}
+}
+
+func TestParseRepeatedHeaders(t *testing.T) {
+	response := "RTSP/1.0 200 OK\r\n" +
+		"CSeq: 2\r\n" +
+		"Public: ANNOUNCE, SETUP\r\n" +
+		"Public: RECORD\r\n" +
+		"\r\n"
+	resp, err := readResponse(strings.NewReader(response))
+	if err != nil {
+		t.Fatal("Unexpected err value", err)
+	}
+	values := resp.Headers.Values("Public")
+	if len(values) != 2 || values[1] != "RECORD" {
+		t.Error("Unexpected Public values", values)
+	}
+}
+
+func TestWriteRepeatedHeaders(t *testing.T) {
+	requestStr :=
+		"OPTIONS * RTSP/1.0\r\n" +
+			"CSeq: 1\r\n" +
+			"Public: ANNOUNCE\r\n" +
+			"Public: SETUP\r\n" +
+			"\r\n"
+	request := NewRequest()
+	request.Method = Options
+	request.RequestURI = "*"
+	request.Headers.Add("public", "ANNOUNCE")
+	request.Headers.Add("Public", "SETUP")
+	request.Headers.Set("cseq", "1")
+	var b bytes.Buffer
+	writeRequest(&b, request)
+	if requestStr != b.String() {
+		t.Error("Non matching request generated. Expected:"+requestStr+"got:", b.String())
+	}
+}
+
+func TestParseInvalidContentLength(t *testing.T) {
+	for _, length := range []string{"abc", "-1", "99999999999"} {
+		request := "SET_PARAMETER * RTSP/1.0\r\n" +
+			"Content-Length: " + length + "\r\n" +
+			"\r\n"
+		_, err := readRequest(strings.NewReader(request))
+		if err == nil {
+			t.Error("Expected error for Content-Length: ", length)
+		}
+	}
+}
+
+func TestParseTruncatedBody(t *testing.T) {
+	request := "SET_PARAMETER * RTSP/1.0\r\n" +
+		"Content-Length: 10\r\n" +
+		"\r\n" +
+		"volume"
+	_, err := readRequest(strings.NewReader(request))
+	if err == nil {
+		t.Error("Expected error for truncated body")
+	}
+}
+
+func TestParseTruncatedMessages(t *testing.T) {
+	request := "ANNOUNCE rtsp://192.168.1.45/2699324803567405959 RTSP/1.0\r\n" +
+		"CSeq: 16\r\n" +
+		"Content-Type: application/sdp\r\n" +
+		"Content-Length: 4\r\n" +
+		"\r\n" +
+		"v=0\n"
+	// every prefix of a valid message should fail cleanly, not panic
+	for i := 0; i < len(request); i++ {
+		if _, err := readRequest(strings.NewReader(request[:i])); err == nil {
+			t.Error("Expected error for truncated request: ", request[:i])
+		}
+		readResponse(strings.NewReader(request[:i]))
+	}
+}
+
+// runs the fuzzing corpus, so what the fuzzer has found stays fixed
+func TestFuzzCorpus(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "fuzz", "corpus", "*"))
+	if err != nil || len(files) == 0 {
+		t.Fatal("Expected a fuzzing corpus", err)
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Error(fmt.Sprintf("%s: %v", file, r))
+				}
+			}()
+			if roundTrip(data) != 1 {
+				t.Error(fmt.Sprintf("Expected %s to parse", file))
+			}
+		}()
+	}
+}
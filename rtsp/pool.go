@@ -0,0 +1,98 @@
+package rtsp
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// ClientPool keeps a client per server, so control requests can reuse a connection
+// instead of connecting every time
+type ClientPool struct {
+	lock    sync.Mutex
+	clients map[string]*pooledClient
+	// connects to a server, swapped out in tests
+	dial func(address string, port int) (*Client, error)
+}
+
+// pooledClient is a client in the pool, ready is closed once it has connected, or failed to
+type pooledClient struct {
+	ready  chan struct{}
+	client *Client
+	err    error
+}
+
+// NewClientPool instantiates a new ClientPool
+func NewClientPool() *ClientPool {
+	return &ClientPool{clients: make(map[string]*pooledClient), dial: NewClient}
+}
+
+// Get returns the client for the given server, connecting if we don't have one yet.  Connecting
+// is done without holding up clients for the other servers, callers asking for the same server
+// while it connects wait on the one connection
+func (cp *ClientPool) Get(address string, port int) (*Client, error) {
+	key := net.JoinHostPort(address, strconv.Itoa(port))
+	cp.lock.Lock()
+	if pc, ok := cp.clients[key]; ok {
+		cp.lock.Unlock()
+		<-pc.ready
+		return pc.client, pc.err
+	}
+	pc := &pooledClient{ready: make(chan struct{})}
+	cp.clients[key] = pc
+	cp.lock.Unlock()
+
+	client, err := cp.dial(address, port)
+
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	defer close(pc.ready)
+	removed := cp.clients[key] != pc
+	if err != nil || removed {
+		if !removed {
+			// the next caller tries again
+			delete(cp.clients, key)
+		} else if client != nil {
+			client.Close()
+			err = fmt.Errorf("Client for %s was removed while connecting", key)
+		}
+		pc.err = err
+		return nil, err
+	}
+	pc.client = client
+	return client, nil
+}
+
+// Remove closes and forgets the client for the given server
+func (cp *ClientPool) Remove(address string, port int) {
+	key := net.JoinHostPort(address, strconv.Itoa(port))
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	if pc, ok := cp.clients[key]; ok {
+		pc.close()
+		delete(cp.clients, key)
+	}
+}
+
+// Close closes every client in the pool, the pool can still be used afterwards
+func (cp *ClientPool) Close() {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	for key, pc := range cp.clients {
+		pc.close()
+		delete(cp.clients, key)
+	}
+}
+
+// close closes the client if it has connected, a client still connecting is closed by
+// Get once it sees it has been removed
+func (pc *pooledClient) close() {
+	select {
+	case <-pc.ready:
+		if pc.client != nil {
+			pc.client.Close()
+		}
+	default:
+	}
+}
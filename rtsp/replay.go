@@ -0,0 +1,181 @@
+package rtsp
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// replayer keeps track of what the server has handed out during a replay, so the captured
+// traffic can be pointed at it
+type replayer struct {
+	address string
+	port    int
+	clients map[uint64]*Client
+	// the live response to the last request sent on each connection
+	pending map[uint64]*Response
+	// captured session id to the id the server gave us
+	sessions map[string]string
+	// captured session id to the ports the server gave us
+	ports map[string]PortSet
+	conns map[string]net.Conn
+}
+
+// Replay plays the records of a capture against the RTSP server at the given address.  Each
+// captured connection is replayed on a connection of its own, and captured packets are sent to
+// the ports the server hands out in its response to SETUP.  If realtime is set the records are
+// sent with the timing they were captured with, otherwise as fast as possible.  It returns an
+// error if the server answers a request with a different status than the one captured.  Captures
+// of password protected sessions can't be replayed, the captured digests won't match a new nonce
+func Replay(ctx context.Context, records []*CaptureRecord, address string, port int, realtime bool) error {
+	r := &replayer{address: address, port: port, clients: make(map[uint64]*Client), pending: make(map[uint64]*Response),
+		sessions: make(map[string]string), ports: make(map[string]PortSet), conns: make(map[string]net.Conn)}
+	defer r.close()
+	start := time.Now()
+	for _, record := range records {
+		if realtime {
+			select {
+			case <-time.After(time.Until(start.Add(record.Offset))):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var err error
+		switch record.Kind {
+		case CaptureRequest:
+			err = r.sendRequest(ctx, record)
+		case CaptureResponse:
+			err = r.checkResponse(record)
+		case CaptureData, CaptureControl:
+			err = r.sendPacket(record)
+		default:
+			log.Printf("Skipping unknown record kind: %d\n", record.Kind)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *replayer) sendRequest(ctx context.Context, record *CaptureRecord) error {
+	req, err := record.Request()
+	if err != nil {
+		return fmt.Errorf("Could not parse captured request: %s", err)
+	}
+	// the server will have handed out a different session id
+	if req.Headers.Has("Session") {
+		captured := strings.Split(req.Headers.Get("Session"), ";")[0]
+		if id, ok := r.sessions[captured]; ok {
+			req.Headers.Set("Session", id)
+		}
+	}
+	client, ok := r.clients[record.ConnID]
+	if !ok {
+		client, err = NewClientContext(ctx, r.address, r.port)
+		if err != nil {
+			return err
+		}
+		r.clients[record.ConnID] = client
+	}
+	resp, err := client.SendContext(ctx, req)
+	if err != nil {
+		return err
+	}
+	r.pending[record.ConnID] = resp
+	return nil
+}
+
+func (r *replayer) checkResponse(record *CaptureRecord) error {
+	captured, err := record.Response()
+	if err != nil {
+		return fmt.Errorf("Could not parse captured response: %s", err)
+	}
+	resp, ok := r.pending[record.ConnID]
+	if !ok {
+		// the request didn't make it into the capture
+		return nil
+	}
+	delete(r.pending, record.ConnID)
+	if resp.Status == Unauthorized && captured.Status != Unauthorized {
+		// the captured digest was for the nonce the server handed out then
+		return fmt.Errorf("Server returned %s, captured %s: captures of password protected sessions can't be replayed",
+			resp.Status.String(), captured.Status.String())
+	}
+	if resp.Status != captured.Status {
+		return fmt.Errorf("Server returned %s, captured %s", resp.Status.String(), captured.Status.String())
+	}
+	if captured.Headers.Has("Session") && resp.Headers.Has("Session") {
+		capturedID := strings.Split(captured.Headers.Get("Session"), ";")[0]
+		r.sessions[capturedID] = strings.Split(resp.Headers.Get("Session"), ";")[0]
+		if resp.Headers.Has("Transport") {
+			r.ports[capturedID] = transportPorts(resp.Headers.Get("Transport"))
+		}
+	}
+	return nil
+}
+
+func (r *replayer) sendPacket(record *CaptureRecord) error {
+	ports, ok := r.ports[record.Session]
+	if !ok {
+		// the session was never set up with the server
+		return nil
+	}
+	port := ports.Data
+	if record.Kind == CaptureControl {
+		port = ports.Control
+	}
+	if port == 0 {
+		return nil
+	}
+	key := fmt.Sprintf("%s/%d", record.Session, record.Kind)
+	conn, ok := r.conns[key]
+	if !ok {
+		var err error
+		conn, err = net.Dial("udp", net.JoinHostPort(r.address, strconv.Itoa(port)))
+		if err != nil {
+			return err
+		}
+		r.conns[key] = conn
+	}
+	// the server might not be listening anymore, which isn't worth stopping for
+	conn.Write(record.Data)
+	return nil
+}
+
+func (r *replayer) close() {
+	for _, client := range r.clients {
+		client.Close()
+	}
+	for _, conn := range r.conns {
+		conn.Close()
+	}
+}
+
+// transportPorts pulls the ports out of the Transport header of a response to SETUP
+// e.g: RTP/AVP/UDP;unicast;mode=record;server_port=6000;control_port=6001;timing_port=6002, the
+// timing port is left out as there are no timing packets to send to it
+func transportPorts(transport string) PortSet {
+	var ports PortSet
+	for _, part := range strings.Split(transport, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		port, _ := strconv.Atoi(kv[1])
+		switch strings.TrimSpace(kv[0]) {
+		case "server_port":
+			ports.Data = port
+		case "control_port":
+			ports.Control = port
+		}
+	}
+	return ports
+}
@@ -0,0 +1,46 @@
+package rtsp
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+)
+
+// roundTrip parses data as a request or response, anything that parses should write back out and
+// parse again to the same thing.  It panics if it doesn't, and returns 1 if data parsed
+func roundTrip(data []byte) int {
+	// responses first, a status line would otherwise parse as a request with an unknown method
+	if resp, err := readResponse(bytes.NewReader(data)); err == nil {
+		var b bytes.Buffer
+		writeResponse(&b, resp)
+		reparsed, err := readResponse(&b)
+		if err != nil {
+			panic(fmt.Sprintf("Could not reparse response: %s", err))
+		}
+		checkRoundTrip(resp.Headers, reparsed.Headers, resp.Body, reparsed.Body)
+		return 1
+	}
+	if req, err := readRequest(bytes.NewReader(data)); err == nil {
+		var b bytes.Buffer
+		writeRequest(&b, req)
+		reparsed, err := readRequest(&b)
+		if err != nil {
+			panic(fmt.Sprintf("Could not reparse request: %s", err))
+		}
+		checkRoundTrip(req.Headers, reparsed.Headers, req.Body, reparsed.Body)
+		return 1
+	}
+	return 0
+}
+
+func checkRoundTrip(headers Header, reparsedHeaders Header, body []byte, reparsedBody []byte) {
+	// Content-Length is always rewritten from the body
+	headers.Del("Content-Length")
+	reparsedHeaders.Del("Content-Length")
+	if !reflect.DeepEqual(headers, reparsedHeaders) {
+		panic(fmt.Sprintf("Headers changed: %v != %v", headers, reparsedHeaders))
+	}
+	if !bytes.Equal(body, reparsedBody) {
+		panic(fmt.Sprintf("Body changed: %q != %q", body, reparsedBody))
+	}
+}
@@ -8,35 +8,39 @@ import (
 
 // Request RTSP request
 type Request struct {
-	Method     Method
+	Method Method
+	// the method as it was sent, so we can tell unknown methods apart
+	methodName string
 	RequestURI string
 	protocol   string
-	Headers    map[string]string
+	Headers    Header
 	Body       []byte
 }
 
 // Response RTSP response
 type Response struct {
-	Headers  map[string]string
+	Headers  Header
 	Body     []byte
 	Status   Status
 	protocol string
 }
 
 func NewResponse() *Response {
-	return &Response{Headers: make(map[string]string)}
+	return &Response{Headers: make(Header)}
 }
 
 func NewRequest() *Request {
-	return &Request{Headers: make(map[string]string), protocol: "RTSP/1.0"}
+	return &Request{Headers: make(Header), protocol: "RTSP/1.0"}
 }
 
 func (r *Request) String() string {
 	var buffer bytes.Buffer
 	buffer.WriteString(fmt.Sprintf("Protocol: %s\r\nMethod: %s\r\nRequest URI: %s\r\n", r.protocol, r.Method.String(), r.RequestURI))
 	buffer.WriteString("Headers:\r\n")
-	for k, v := range r.Headers {
-		buffer.WriteString(fmt.Sprintf("%s: %s\r\n", k, v))
+	for k, values := range r.Headers {
+		for _, v := range values {
+			buffer.WriteString(fmt.Sprintf("%s: %s\r\n", k, v))
+		}
 	}
 	buffer.WriteString(fmt.Sprintf("Body:\r\n%s", r.Body))
 	return buffer.String()
@@ -46,8 +50,10 @@ func (r *Response) String() string {
 	var buffer bytes.Buffer
 	buffer.WriteString(fmt.Sprintf("Protocol: %s\r\nStatus: %s\r\n", r.protocol, r.Status.String()))
 	buffer.WriteString("Headers:\r\n")
-	for k, v := range r.Headers {
-		buffer.WriteString(fmt.Sprintf("%s: %s\r\n", k, v))
+	for k, values := range r.Headers {
+		for _, v := range values {
+			buffer.WriteString(fmt.Sprintf("%s: %s\r\n", k, v))
+		}
 	}
 	buffer.WriteString(fmt.Sprintf("Body:\r\n%s", r.Body))
 	return buffer.String()
@@ -65,6 +71,7 @@ var methods = map[string]Method{
 	strings.ToLower(Set_Parameter.String()): Set_Parameter,
 	strings.ToLower(Teardown.String()):      Teardown,
 	strings.ToLower(Flush.String()):         Flush,
+	strings.ToLower(Post.String()):          Post,
 }
 
 // getMethod converts string to Method enum value, returning error if it can't map
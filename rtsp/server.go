@@ -1,28 +1,40 @@
 package rtsp
 
 import (
+	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // RequestHandler callback function that gets invoked when a request is received
-type RequestHandler func(req *Request, resp *Response, localAddr string, remoteAddr string)
+type RequestHandler func(req *Request, resp *Response, ctx *Context)
 
 // Server Server for handling Rtsp control requests
 type Server struct {
-	port     int
-	handlers map[Method]RequestHandler
-	done     chan bool
+	port       int
+	handlers   map[Method]RequestHandler
+	middleware []Middleware
+	connID     uint64
+	lock       sync.Mutex
+	listener   net.Listener
+	conns      map[net.Conn]struct{}
+	stopped    bool
+	// tracks the goroutines serving connections
+	wg sync.WaitGroup
 }
 
 // NewServer instantiates a new RtspServer
 func NewServer(port int) *Server {
 	server := Server{}
 	server.port = port
-	server.done = make(chan bool)
 	server.handlers = make(map[Method]RequestHandler)
+	server.conns = make(map[net.Conn]struct{})
 	return &server
 }
 
@@ -31,74 +43,185 @@ func (r *Server) AddHandler(m Method, rh RequestHandler) {
 	r.handlers[m] = rh
 }
 
-// Stop stops the RTSP server
-func (r *Server) Stop() {
-	log.Println("Stopping RTSP server")
-	r.done <- true
+// Use adds middleware that wraps every handler, including the response to methods
+// without a handler.  Middleware is run in the order it is added
+func (r *Server) Use(middleware ...Middleware) {
+	r.middleware = append(r.middleware, middleware...)
 }
 
-// Start creates listening socket for the RTSP connection
-func (r *Server) Start(verbose bool) {
+// Start listens on the server's port and serves connections, see Serve
+func (r *Server) Start(ctx context.Context) error {
 	log.Printf("Starting RTSP server on port: %d\n", r.port)
-	tcpListen, err := net.Listen("tcp", fmt.Sprintf(":%d", r.port))
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", r.port))
 	if err != nil {
-		log.Fatal("Error listening:", err.Error())
+		return err
 	}
+	return r.Serve(ctx, l)
+}
 
-	defer tcpListen.Close()
+// Serve accepts connections on the listener, blocking until the server is stopped, ctx is
+// done or the listener fails.  Stopping the server, or ctx being done, returns nil once
+// every connection has been closed
+func (r *Server) Serve(ctx context.Context, l net.Listener) error {
+	r.lock.Lock()
+	if r.stopped {
+		r.lock.Unlock()
+		l.Close()
+		return nil
+	}
+	r.listener = l
+	r.lock.Unlock()
 
-	//handle TCP connections
+	// watch for the context being done, until we return
+	serving := make(chan struct{})
+	defer close(serving)
 	go func() {
-		for {
-			// Listen for an incoming connection.
-			conn, err := tcpListen.Accept()
-			if err != nil {
-				log.Fatal("Error accepting: ", err.Error())
+		select {
+		case <-ctx.Done():
+			r.shutdown()
+		case <-serving:
+		}
+	}()
+
+	var retryDelay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if r.isStopped() {
+				r.wg.Wait()
+				return nil
+			}
+			// back off and try again on errors that may go away, e.g running out of file descriptors
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if retryDelay == 0 {
+					retryDelay = 5 * time.Millisecond
+				} else if retryDelay *= 2; retryDelay > time.Second {
+					retryDelay = time.Second
+				}
+				log.Printf("Error accepting: %s, retrying in %s\n", err, retryDelay)
+				time.Sleep(retryDelay)
+				continue
 			}
-			go read(conn, r.handlers, verbose)
+			r.shutdown()
+			r.wg.Wait()
+			return err
 		}
+		retryDelay = 0
+		if !r.trackConn(conn) {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer r.wg.Done()
+			defer r.untrackConn(conn)
+			r.serve(conn)
+		}()
+	}
+}
+
+// Stop stops the RTSP server, closing the listener and every connection, and waits
+// for them to finish up, or until ctx is done
+func (r *Server) Stop(ctx context.Context) error {
+	log.Println("Stopping RTSP server")
+	r.shutdown()
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
 	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-	<-r.done
+func (r *Server) shutdown() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.stopped = true
+	if r.listener != nil {
+		r.listener.Close()
+	}
+	for conn := range r.conns {
+		conn.Close()
+	}
+}
+
+func (r *Server) isStopped() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.stopped
+}
+
+// trackConn keeps track of the connection so it can be closed when stopping, returns false
+// if the server has already been stopped
+func (r *Server) trackConn(conn net.Conn) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.stopped {
+		return false
+	}
+	r.conns[conn] = struct{}{}
+	r.wg.Add(1)
+	return true
+}
+
+func (r *Server) untrackConn(conn net.Conn) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.conns, conn)
+}
+
+// bufferedConn reads what has already been buffered off the connection before reading it directly
+type bufferedConn struct {
+	net.Conn
+	buf *bufio.Reader
 }
 
-func read(conn net.Conn, handlers map[Method]RequestHandler, verbose bool) {
+func (bc *bufferedConn) Read(b []byte) (int, error) {
+	return bc.buf.Read(b)
+}
+
+// serve reads requests off the connection, until it is closed, handing them to the handlers
+func (r *Server) serve(conn net.Conn) {
 	defer conn.Close()
+	ctx := newConnContext(atomic.AddUint64(&r.connID, 1), conn)
+	buf := bufio.NewReader(conn)
 	for {
-		request, err := readRequest(conn)
+		request, err := readRequest(buf)
 		if err != nil {
 			if err == io.EOF {
 				log.Println("Client closed connection")
-			} else {
+			} else if !r.isStopped() {
 				log.Println("Error reading data: ", err.Error())
 			}
 			return
 		}
 
-		if verbose {
-			log.Println("Received Request")
-			log.Println(request.String())
-		}
-
-		handler, exists := handlers[request.Method]
+		handler, exists := r.handlers[request.Method]
 		if !exists {
-			log.Printf("Method: %s does not have a handler. Skipping", request.Method)
-			continue
+			handler = notImplemented
 		}
 		resp := NewResponse()
 		// for now we just stick in the protocol (protocol/version) from the request
 		resp.protocol = request.protocol
 		// same with CSeq
-		resp.Headers["CSeq"] = request.Headers["CSeq"]
-		// invokes the client specified handler to build the response
-		localAddr := conn.LocalAddr().(*net.TCPAddr).IP
-		remoteAddr := conn.RemoteAddr().(*net.TCPAddr).IP
-		handler(request, resp, localAddr.String(), remoteAddr.String())
-		if verbose {
-			log.Println("Outbound Response")
-			log.Println(resp.String())
-		}
+		resp.Headers.Set("CSeq", request.Headers.Get("CSeq"))
+		// invokes the client specified handler, wrapped in any middleware, to build the response
+		chain(handler, r.middleware)(request, resp, ctx)
 		writeResponse(conn, resp)
+		if upgrade := ctx.takeUpgrade(); upgrade != nil {
+			// anything already buffered belongs to the upgraded connection
+			upgraded, err := upgrade(&bufferedConn{Conn: conn, buf: buf})
+			if err != nil {
+				log.Println("Error upgrading connection: ", err)
+				return
+			}
+			conn = upgraded
+			buf = bufio.NewReader(conn)
+		}
 
 	}
 }
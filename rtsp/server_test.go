@@ -0,0 +1,309 @@
+package rtsp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// serveTestClients serves every connection made to a local listener with the given server
+func serveTestClients(t *testing.T, server *Server) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	go server.Serve(context.Background(), l)
+	return l
+}
+
+func newTestClient(t *testing.T, l net.Listener) *Client {
+	client, err := NewClient("127.0.0.1", l.Addr().(*net.TCPAddr).Port)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	return client
+}
+
+func TestUnknownMethodNotImplemented(t *testing.T) {
+	l := serveTestClients(t, NewServer(0))
+	defer l.Close()
+	client := newTestClient(t, l)
+	defer client.Close()
+	req := NewRequest()
+	req.Method = Describe
+	req.RequestURI = "*"
+	resp, err := client.Send(req)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if resp.Status != NotImplemented {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", NotImplemented.String(), resp.Status.String()))
+	}
+	// the connection should still be usable afterwards
+	if _, err := client.Send(req); err != nil {
+		t.Error("Unexpected error", err)
+	}
+}
+
+func TestUnknownMethodKeepsConnection(t *testing.T) {
+	server := NewServer(0)
+	server.AddHandler(Options, func(req *Request, resp *Response, ctx *Context) { resp.Status = Ok })
+	l := serveTestClients(t, server)
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	buf := bufio.NewReader(conn)
+	conn.Write([]byte("GET_INFO rtsp://127.0.0.1/1 RTSP/1.0\r\nCSeq: 5\r\n\r\n"))
+	resp, err := readResponse(buf)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if resp.Status != NotImplemented || resp.Headers.Get("CSeq") != "5" {
+		t.Error(fmt.Sprintf("Expected: %s CSeq 5\r\n Got: %s CSeq %s", NotImplemented.String(), resp.Status.String(), resp.Headers.Get("CSeq")))
+	}
+	// the connection should still be usable afterwards
+	conn.Write([]byte("OPTIONS * RTSP/1.0\r\nCSeq: 6\r\n\r\n"))
+	resp, err = readResponse(buf)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if resp.Status != Ok || resp.Headers.Get("CSeq") != "6" {
+		t.Error(fmt.Sprintf("Expected: %s CSeq 6\r\n Got: %s CSeq %s", Ok.String(), resp.Status.String(), resp.Headers.Get("CSeq")))
+	}
+}
+
+func TestPipelinedRequests(t *testing.T) {
+	server := NewServer(0)
+	server.AddHandler(Options, func(req *Request, resp *Response, ctx *Context) { resp.Status = Ok })
+	l := serveTestClients(t, server)
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	// both requests in one write, so they are read together
+	conn.Write([]byte("OPTIONS * RTSP/1.0\r\nCSeq: 1\r\n\r\nOPTIONS * RTSP/1.0\r\nCSeq: 2\r\n\r\n"))
+	buf := bufio.NewReader(conn)
+	for _, cseq := range []string{"1", "2"} {
+		resp, err := readResponse(buf)
+		if err != nil {
+			t.Fatal("Unexpected error", err)
+		}
+		if resp.Headers.Get("CSeq") != cseq {
+			t.Error(fmt.Sprintf("Expected: CSeq %s\r\n Got: CSeq %s", cseq, resp.Headers.Get("CSeq")))
+		}
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	server := NewServer(0)
+	var calls []string
+	tag := func(name string) Middleware {
+		return func(next RequestHandler) RequestHandler {
+			return func(req *Request, resp *Response, ctx *Context) {
+				calls = append(calls, name+" before")
+				next(req, resp, ctx)
+				calls = append(calls, name+" after")
+			}
+		}
+	}
+	server.Use(tag("first"), tag("second"))
+	server.AddHandler(Options, func(req *Request, resp *Response, ctx *Context) {
+		calls = append(calls, "handler")
+		resp.Status = Ok
+	})
+	l := serveTestClients(t, server)
+	defer l.Close()
+	client := newTestClient(t, l)
+	defer client.Close()
+	req := NewRequest()
+	req.Method = Options
+	req.RequestURI = "*"
+	if _, err := client.Send(req); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	expected := "[first before second before handler second after first after]"
+	if fmt.Sprint(calls) != expected {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %v", expected, calls))
+	}
+}
+
+func TestContextPerConnection(t *testing.T) {
+	server := NewServer(0)
+	server.AddHandler(Options, func(req *Request, resp *Response, ctx *Context) {
+		count, _ := ctx.Value("count").(int)
+		count++
+		ctx.SetValue("count", count)
+		resp.Headers.Set("X-Count", fmt.Sprintf("%d", count))
+		resp.Headers.Set("X-Conn", fmt.Sprintf("%d", ctx.ConnID))
+		resp.Headers.Set("X-Remote", ctx.RemoteAddr)
+		resp.Status = Ok
+	})
+	l := serveTestClients(t, server)
+	defer l.Close()
+	send := func(client *Client) *Response {
+		req := NewRequest()
+		req.Method = Options
+		req.RequestURI = "*"
+		resp, err := client.Send(req)
+		if err != nil {
+			t.Fatal("Unexpected error", err)
+		}
+		return resp
+	}
+
+	first := newTestClient(t, l)
+	defer first.Close()
+	send(first)
+	resp := send(first)
+	if resp.Headers.Get("X-Count") != "2" {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", "2", resp.Headers.Get("X-Count")))
+	}
+	if resp.Headers.Get("X-Remote") != "127.0.0.1" {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", "127.0.0.1", resp.Headers.Get("X-Remote")))
+	}
+
+	second := newTestClient(t, l)
+	defer second.Close()
+	other := send(second)
+	if other.Headers.Get("X-Count") != "1" {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", "1", other.Headers.Get("X-Count")))
+	}
+	if other.Headers.Get("X-Conn") == resp.Headers.Get("X-Conn") {
+		t.Error("Expected connections to have different ids")
+	}
+}
+
+// xorConn scrambles everything sent over a connection, standing in for encryption
+type xorConn struct {
+	net.Conn
+}
+
+func (c xorConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	for i := 0; i < n; i++ {
+		p[i] ^= 0x5a
+	}
+	return n, err
+}
+
+func (c xorConn) Write(p []byte) (int, error) {
+	scrambled := make([]byte, len(p))
+	for i := range p {
+		scrambled[i] = p[i] ^ 0x5a
+	}
+	return c.Conn.Write(scrambled)
+}
+
+func TestUpgradeConnection(t *testing.T) {
+	server := NewServer(0)
+	server.AddHandler(Post, func(req *Request, resp *Response, ctx *Context) {
+		ctx.Upgrade(func(conn net.Conn) (net.Conn, error) {
+			return xorConn{conn}, nil
+		})
+		resp.Status = Ok
+	})
+	server.AddHandler(Options, func(req *Request, resp *Response, ctx *Context) {
+		resp.Status = Ok
+	})
+	l := serveTestClients(t, server)
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer conn.Close()
+	send := func(conn net.Conn, method Method) *Response {
+		req := NewRequest()
+		req.Method = method
+		req.RequestURI = "*"
+		req.Headers.Set("CSeq", "1")
+		if _, err := writeRequest(conn, req); err != nil {
+			t.Fatal("Unexpected error", err)
+		}
+		resp, err := readResponse(conn)
+		if err != nil {
+			t.Fatal("Unexpected error", err)
+		}
+		return resp
+	}
+
+	// the response to the request asking for the upgrade isn't scrambled, what comes after is
+	if resp := send(conn, Post); resp.Status != Ok {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", Ok.String(), resp.Status.String()))
+	}
+	if resp := send(xorConn{conn}, Options); resp.Status != Ok {
+		t.Error(fmt.Sprintf("Expected: %s\r\n Got: %s", Ok.String(), resp.Status.String()))
+	}
+}
+
+func TestStopClosesConnections(t *testing.T) {
+	server := NewServer(0)
+	server.AddHandler(Options, func(req *Request, resp *Response, ctx *Context) { resp.Status = Ok })
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	served := make(chan error)
+	go func() { served <- server.Serve(context.Background(), l) }()
+	client := newTestClient(t, l)
+	defer client.Close()
+	req := NewRequest()
+	req.Method = Options
+	req.RequestURI = "*"
+	if _, err := client.Send(req); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := server.Stop(ctx); err != nil {
+		t.Error("Unexpected error", err)
+	}
+	if err := <-served; err != nil {
+		t.Error("Unexpected error", err)
+	}
+	if _, err := client.Send(req); err == nil {
+		t.Error("Expected connection to be closed")
+	}
+}
+
+func TestServeContextDone(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() { served <- NewServer(0).Serve(ctx, l) }()
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Error("Unexpected error", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected server to stop")
+	}
+}
+
+func TestStartListenError(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer l.Close()
+	server := NewServer(l.Addr().(*net.TCPAddr).Port)
+	if err := server.Start(context.Background()); err == nil {
+		t.Error("Expected error listening on a port in use")
+	}
+}
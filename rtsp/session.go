@@ -1,17 +1,24 @@
 package rtsp
 
 import (
+	"encoding/binary"
 	"fmt"
 	"log"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/nstehr/bobcaygeon/sdp"
 )
 
 const (
 	readBuffer = 1024 * 16
+	// payload type of the sync packets sent on the control port
+	syncPayloadType = 0x54
+	syncPacketSize  = 20
 )
 
 // Decrypter decrypts a received packet
@@ -29,18 +36,35 @@ type PortSet struct {
 
 // Session a streaming session
 type Session struct {
+	// when we last heard from the sender, in unix nanoseconds.  Accessed atomically,
+	// so kept first to be 64 bit aligned
+	lastActivity int64
+	// ID is the RTSP session id, handed out in the response to SETUP
+	ID          string
 	Description *sdp.SessionDescription
 	decrypter   Decrypter
 	RemotePorts PortSet
 	LocalPorts  PortSet
 	dataConn    net.Conn
+	controlConn *net.UDPConn
 	DataChan    chan []byte
 	stopChan    chan (struct{})
+	receiving   bool
+	latencyLock sync.RWMutex
+	// latency (in frames) the sender has asked us to play with
+	requestedLatency uint32
+	// how long we go without hearing from the sender before the session is inactive
+	inactivityTimeout time.Duration
+	inactive          chan struct{}
+	done              chan struct{}
+	closeOnce         sync.Once
+	recorder          *Recorder
 }
 
 // NewSession instantiates a new Session
 func NewSession(description *sdp.SessionDescription, decrypter Decrypter) *Session {
-	return &Session{Description: description, decrypter: decrypter, DataChan: make(chan []byte, 1000)}
+	return &Session{Description: description, decrypter: decrypter, DataChan: make(chan []byte, 1000),
+		inactive: make(chan struct{}), done: make(chan struct{})}
 }
 
 // InitReceive initializes the session to for receiving
@@ -55,21 +79,104 @@ func (s *Session) InitReceive() error {
 	}
 	// keep track of the actual connection so we close it later
 	s.dataConn = conn
-	localAddr := strings.Split(conn.LocalAddr().String(), ":")
-	port := localAddr[len(localAddr)-1]
-	s.LocalPorts.Data, _ = strconv.Atoi(port)
+	s.LocalPorts.Data = localPort(conn)
+	// the control port is where the sender tells us about timing, via sync packets
+	controlConn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	s.controlConn = controlConn
+	s.LocalPorts.Control = localPort(controlConn)
 	return nil
 }
 
+func localPort(conn net.Conn) int {
+	localAddr := strings.Split(conn.LocalAddr().String(), ":")
+	port, _ := strconv.Atoi(localAddr[len(localAddr)-1])
+	return port
+}
+
+// SetRequestedLatency sets the latency, in frames, the sender wants the audio played with
+func (s *Session) SetRequestedLatency(frames uint32) {
+	s.latencyLock.Lock()
+	defer s.latencyLock.Unlock()
+	s.requestedLatency = frames
+}
+
+// RequestedLatency returns the latency, in frames, the sender wants the audio played with.
+// 0 means the sender hasn't told us
+func (s *Session) RequestedLatency() uint32 {
+	s.latencyLock.RLock()
+	defer s.latencyLock.RUnlock()
+	return s.requestedLatency
+}
+
+// SetInactivityTimeout sets how long the session can go without a packet from the sender,
+// on either the data or control port, before it is considered inactive.  0 (the default)
+// never considers the session inactive.  It must be set before StartReceiving
+func (s *Session) SetInactivityTimeout(timeout time.Duration) {
+	s.inactivityTimeout = timeout
+}
+
+// SetRecorder records the packets received for the session, it must be set before StartReceiving
+func (s *Session) SetRecorder(recorder *Recorder) {
+	s.recorder = recorder
+}
+
+// Touch records that we heard from the sender, e.g. when it makes a request for the session
+func (s *Session) Touch() {
+	atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
+}
+
+// Inactive returns a channel that is closed once the session has gone the inactivity
+// timeout without hearing from the sender
+func (s *Session) Inactive() <-chan struct{} {
+	return s.inactive
+}
+
+// Done returns a channel that is closed once the session is closed
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// watchActivity checks in on the session until it is closed, or until the sender
+// has been quiet for longer than the timeout
+func (s *Session) watchActivity(timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			last := time.Unix(0, atomic.LoadInt64(&s.lastActivity))
+			if time.Since(last) >= timeout {
+				log.Printf("Nothing heard from sender in %s\n", timeout)
+				close(s.inactive)
+				return
+			}
+		}
+	}
+}
+
 // Close closes a session
 func (s *Session) Close(closeDone chan struct{}) {
 	log.Println("closing session")
+	s.closeOnce.Do(func() { close(s.done) })
 	s.stopChan = closeDone
+	if s.controlConn != nil {
+		s.controlConn.Close()
+	}
 	if s.dataConn != nil {
 		s.dataConn.Close()
 	} else {
 		log.Println("Currently no data connection...")
-		s.stopChan <- struct{}{}
+	}
+	// if we are receiving, the receiving goroutine signals once it stops, otherwise
+	// there is nothing to wait on
+	if !s.receiving {
+		go func() { closeDone <- struct{}{} }()
 	}
 }
 
@@ -77,6 +184,14 @@ func (s *Session) Close(closeDone chan struct{}) {
 func (s *Session) StartReceiving() error {
 	// start listening for audio data
 	log.Println("Session started.  Listening for audio packets")
+	s.receiving = true
+	s.Touch()
+	if s.inactivityTimeout > 0 {
+		go s.watchActivity(s.inactivityTimeout)
+	}
+	if s.controlConn != nil {
+		go s.receiveControl(s.controlConn)
+	}
 	go func(conn *net.UDPConn) {
 		buf := make([]byte, readBuffer)
 		for {
@@ -87,7 +202,11 @@ func (s *Session) StartReceiving() error {
 				conn = nil
 				break
 			}
+			s.Touch()
 			packet := buf[:n]
+			if s.recorder != nil {
+				s.recorder.RecordPacket(CaptureData, s.ID, packet)
+			}
 			// send the data to the decoder
 			d := packet
 			if s.decrypter != nil {
@@ -110,10 +229,47 @@ func (s *Session) StartReceiving() error {
 	return nil
 }
 
+// receiveControl reads packets off the control port until it is closed, keeping
+// track of the latency the sender puts in its sync packets
+func (s *Session) receiveControl(conn *net.UDPConn) {
+	buf := make([]byte, readBuffer)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		s.Touch()
+		if s.recorder != nil {
+			s.recorder.RecordPacket(CaptureControl, s.ID, buf[:n])
+		}
+		latency, ok := parseSyncLatency(buf[:n])
+		if !ok {
+			continue
+		}
+		if latency != s.RequestedLatency() {
+			log.Printf("Sender requested latency: %d frames\n", latency)
+			s.SetRequestedLatency(latency)
+		}
+	}
+}
+
+// parseSyncLatency pulls the latency out of a sync packet.  A sync packet carries
+// the RTP timestamp that should be playing now, minus the latency, and the RTP timestamp
+// of the next packet to be sent, so the difference is the latency the sender wants
+// https://nto.github.io/AirPlay.html#audio-rtpcontrol
+func parseSyncLatency(packet []byte) (uint32, bool) {
+	if len(packet) < syncPacketSize || packet[1]&0x7f != syncPayloadType {
+		return 0, false
+	}
+	playing := binary.BigEndian.Uint32(packet[4:8])
+	next := binary.BigEndian.Uint32(packet[16:20])
+	return next - playing, true
+}
+
 // StartSending starts a session for sending data
 func (s *Session) StartSending() error {
 
-	conn, err := net.Dial("udp", fmt.Sprintf("%s:%d", s.RemotePorts.Address, s.RemotePorts.Data))
+	conn, err := net.Dial("udp", net.JoinHostPort(s.RemotePorts.Address, strconv.Itoa(s.RemotePorts.Data)))
 	if err != nil {
 		return err
 	}
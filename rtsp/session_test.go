@@ -0,0 +1,119 @@
+package rtsp
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nstehr/bobcaygeon/sdp"
+)
+
+func startTestSession(t *testing.T, timeout time.Duration) *Session {
+	s := NewSession(sdp.NewSessionDescription(), nil)
+	if err := s.InitReceive(); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	s.SetInactivityTimeout(timeout)
+	if err := s.StartReceiving(); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	return s
+}
+
+func closeTestSession(s *Session) {
+	done := make(chan struct{})
+	s.Close(done)
+	<-done
+}
+
+func TestParseSyncLatency(t *testing.T) {
+	// first sync packet of a stream (extension bit set), with 11025 frames of latency
+	packet := []byte{0x90, 0xd4, 0x00, 0x07,
+		0x00, 0x01, 0x2d, 0x96,
+		0x83, 0xc1, 0x17, 0xcc, 0xae, 0x41, 0x59, 0x74,
+		0x00, 0x01, 0x58, 0xa7}
+	latency, ok := parseSyncLatency(packet)
+	if !ok {
+		t.Fatal("Expected packet to be parsed as a sync packet")
+	}
+	if latency != 11025 {
+		t.Error(fmt.Sprintf("Expected: %d\r\n Got: %d", 11025, latency))
+	}
+}
+
+func TestParseSyncLatencyWraps(t *testing.T) {
+	packet := make([]byte, syncPacketSize)
+	packet[0] = 0x80
+	packet[1] = 0xd4
+	// playing timestamp is just before the wrap, next is just after
+	copy(packet[4:8], []byte{0xff, 0xff, 0xff, 0x00})
+	copy(packet[16:20], []byte{0x00, 0x00, 0x00, 0x10})
+	latency, _ := parseSyncLatency(packet)
+	if latency != 0x110 {
+		t.Error(fmt.Sprintf("Expected: %d\r\n Got: %d", 0x110, latency))
+	}
+}
+
+func TestParseSyncLatencyIgnoresOtherPackets(t *testing.T) {
+	// retransmit reply
+	packet := make([]byte, 32)
+	packet[0] = 0x80
+	packet[1] = 0xd6
+	if _, ok := parseSyncLatency(packet); ok {
+		t.Error("Expected non sync packet to be ignored")
+	}
+	if _, ok := parseSyncLatency([]byte{0x80, 0xd4}); ok {
+		t.Error("Expected short packet to be ignored")
+	}
+}
+
+func TestSessionInactive(t *testing.T) {
+	s := startTestSession(t, 50*time.Millisecond)
+	defer closeTestSession(s)
+	select {
+	case <-s.Inactive():
+	case <-time.After(time.Second):
+		t.Error("Expected session to become inactive")
+	}
+}
+
+func TestSessionControlPacketsKeepActive(t *testing.T) {
+	s := startTestSession(t, 100*time.Millisecond)
+	defer closeTestSession(s)
+	conn, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", s.LocalPorts.Control))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer conn.Close()
+	for i := 0; i < 15; i++ {
+		conn.Write(make([]byte, syncPacketSize))
+		time.Sleep(20 * time.Millisecond)
+	}
+	select {
+	case <-s.Inactive():
+		t.Error("Expected session to still be active")
+	default:
+	}
+	// once the sender stops, the session goes inactive
+	select {
+	case <-s.Inactive():
+	case <-time.After(time.Second):
+		t.Error("Expected session to become inactive")
+	}
+}
+
+func TestSessionNoTimeout(t *testing.T) {
+	s := startTestSession(t, 0)
+	closeTestSession(s)
+	select {
+	case <-s.Done():
+	default:
+		t.Error("Expected session to be done once closed")
+	}
+	select {
+	case <-s.Inactive():
+		t.Error("Expected session without a timeout to never be inactive")
+	default:
+	}
+}